@@ -0,0 +1,245 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/zeroshade/tmsapi/internal"
+	"github.com/zeroshade/tmsapi/paypal"
+	"github.com/zeroshade/tmsapi/types"
+)
+
+func passLink(host, merchantID, orderID string) string {
+	return fmt.Sprintf("https://%s/info/%s/passes/%s", host, merchantID, orderID)
+}
+
+func tripName(locale string, l *types.OrderLine) string {
+	if l.Departure == nil {
+		return l.Name
+	}
+	return l.Name + ", " + types.FormatDate(locale, l.Departure.In(timeloc), types.DateTime)
+}
+
+// transferredLines finds the order lines a transfer will move, as they are
+// before it. Paypal requests name a line by its checkout and old sku.
+func transferredLines(db *gorm.DB, data []types.TransferReq) []types.OrderLine {
+	ids := make([]string, 0, len(data)*2)
+	for _, d := range data {
+		ids = append(ids, d.LineItemID, paypal.LineID(d.LineItemID, d.OldSku))
+	}
+
+	var lines []types.OrderLine
+	db.Where("id IN (?)", ids).Order("order_id, id").Find(&lines)
+	return lines
+}
+
+// sendTransferUpdates emails each customer whose tickets were moved with
+// their new trip and an updated calendar invite
+func sendTransferUpdates(db *gorm.DB, conf *types.MerchantConfig, host string, before []types.OrderLine) {
+	for start := 0; start < len(before); {
+		end := start + 1
+		for end < len(before) && before[end].OrderID == before[start].OrderID {
+			end++
+		}
+		sendTransferUpdate(db, conf, host, before[start:end])
+		start = end
+	}
+}
+
+func sendTransferUpdate(db *gorm.DB, conf *types.MerchantConfig, host string, before []types.OrderLine) {
+	orderID := before[0].OrderID
+
+	var o types.Order
+	db.Preload("Customer").Where("id = ? AND merchant_id = ?", orderID, conf.ID).First(&o)
+	if o.Customer == nil || o.Customer.Email == "" {
+		return
+	}
+
+	locale := types.ResolveLocale(o.Locale, conf.Locale)
+	var oldTrips, newTrips []string
+	seen := make(map[string]bool)
+	for idx := range before {
+		var moved types.OrderLine
+		db.Find(&moved, "id = ?", before[idx].ID)
+		if moved.Sku == before[idx].Sku {
+			continue
+		}
+
+		from, to := tripName(locale, &before[idx]), tripName(locale, &moved)
+		if !seen[from+"\x00"+to] {
+			seen[from+"\x00"+to] = true
+			oldTrips = append(oldTrips, from)
+			newTrips = append(newTrips, to)
+		}
+	}
+	if len(newTrips) == 0 {
+		return
+	}
+
+	data := &types.EmailData{
+		Locale:   locale,
+		Name:     o.Customer.Name,
+		Email:    o.Customer.Email,
+		Phone:    o.Customer.Phone,
+		OrderID:  orderID,
+		OldTrip:  strings.Join(oldTrips, "; "),
+		NewTrip:  strings.Join(newTrips, "; "),
+		PassLink: passLink(host, conf.ID, orderID),
+	}
+	msg, err := types.RenderEmail(db, conf, types.EmailTransfer, data)
+	if err != nil {
+		log.Println("Transfer Email Error:", orderID, err)
+		return
+	}
+
+	m := internal.NewMerchantMessage(conf, msg.Subject, msg.Text, msg.HTML, fmt.Sprintf("%s <%s>", data.Name, data.Email))
+	if events := types.OrderEvents(db, conf, orderID, data.PassLink); len(events) > 0 {
+		types.BumpSequence(db, events)
+		m.Attach("trip.ics", types.BuildCalendar(conf, types.CalendarPublish, events))
+	}
+	if err := internal.SendEmail(db, conf, orderID, types.EmailTransfer, m); err != nil {
+		log.Println("Transfer Email Error:", orderID, err)
+	}
+}
+
+// sendRefundNotices emails each customer whose tickets were refunded in a
+// request, going by the refunds recorded since it started. Stripe and box
+// office refunds both name a line by its order and line id.
+func sendRefundNotices(db *gorm.DB, conf *types.MerchantConfig, since time.Time, data json.RawMessage) {
+	var info []struct {
+		OrderID string `json:"paymentId"`
+		LineID  string `json:"itemId"`
+	}
+	if err := json.Unmarshal(data, &info); err != nil {
+		return
+	}
+
+	var orders []string
+	lines := make(map[string][]string)
+	for _, i := range info {
+		if _, ok := lines[i.OrderID]; !ok {
+			orders = append(orders, i.OrderID)
+		}
+		lines[i.OrderID] = append(lines[i.OrderID], i.LineID)
+	}
+	for _, id := range orders {
+		sendRefundNotice(db, conf, id, lines[id], since)
+	}
+}
+
+func sendRefundNotice(db *gorm.DB, conf *types.MerchantConfig, orderID string, lineIDs []string, since time.Time) {
+	var refunds []types.OrderRefund
+	db.Where("order_id = ? AND line_id IN (?) AND created_at >= ?", orderID, lineIDs, since).Find(&refunds)
+	if len(refunds) == 0 {
+		return
+	}
+
+	var o types.Order
+	db.Preload("Customer").Where("id = ? AND merchant_id = ?", orderID, conf.ID).First(&o)
+	if o.Customer == nil || o.Customer.Email == "" {
+		return
+	}
+
+	total := 0.0
+	refunded := make([]string, 0, len(refunds))
+	for _, r := range refunds {
+		total += types.ParseMoney(r.Amount)
+		refunded = append(refunded, r.LineID)
+	}
+
+	data := &types.EmailData{
+		Locale:  o.Locale,
+		Name:    o.Customer.Name,
+		Email:   o.Customer.Email,
+		Phone:   o.Customer.Phone,
+		OrderID: o.ID,
+		Amount:  types.FormatMoney(total),
+	}
+	var lines []types.OrderLine
+	db.Where("order_id = ? AND id IN (?)", o.ID, refunded).Order("id").Find(&lines)
+	for _, l := range lines {
+		data.Items = append(data.Items, types.EmailItem{Name: l.Name, Quantity: int(l.Quantity), Amount: l.Amount})
+	}
+
+	msg, err := types.RenderEmail(db, conf, types.EmailRefund, data)
+	if err != nil {
+		log.Println("Refund Email Error:", o.ID, err)
+		return
+	}
+
+	m := internal.NewMerchantMessage(conf, msg.Subject, msg.Text, msg.HTML, fmt.Sprintf("%s <%s>", data.Name, data.Email))
+	if err := internal.SendEmail(db, conf, o.ID, types.EmailRefund, m); err != nil {
+		log.Println("Refund Email Error:", o.ID, err)
+	}
+}
+
+// sendTripCancelled lets everyone booked on a departure know it has been
+// cancelled, with an invite that takes it off their calendar
+func sendTripCancelled(db *gorm.DB, merchantID, host string, productID uint, departure time.Time) {
+	var conf types.MerchantConfig
+	db.Find(&conf, "id = ?", merchantID)
+
+	owned := db.Model(&types.Order{}).Select("id").Where("merchant_id = ?", conf.ID).SubQuery()
+	var lines []types.OrderLine
+	db.Where("order_id IN ? AND product_id = ? AND departure = ? AND COALESCE(status, '') <> ?",
+		owned, productID, departure, "refunded").Order("order_id, id").Find(&lines)
+
+	for start := 0; start < len(lines); {
+		end := start + 1
+		for end < len(lines) && lines[end].OrderID == lines[start].OrderID {
+			end++
+		}
+		sendOrderCancelled(db, &conf, host, lines[start:end])
+		start = end
+	}
+}
+
+func sendOrderCancelled(db *gorm.DB, conf *types.MerchantConfig, host string, lines []types.OrderLine) {
+	first := lines[0]
+
+	var o types.Order
+	db.Preload("Customer").Where("id = ?", first.OrderID).First(&o)
+	if o.Customer == nil || o.Customer.Email == "" {
+		return
+	}
+
+	locale := types.ResolveLocale(o.Locale, conf.Locale)
+	data := &types.EmailData{
+		Locale:        locale,
+		Name:          o.Customer.Name,
+		Email:         o.Customer.Email,
+		Phone:         o.Customer.Phone,
+		OrderID:       o.ID,
+		Departure:     types.FormatDate(locale, first.Departure.In(timeloc), types.DateTime),
+		WeatherNotice: conf.WeatherNotice,
+		PassLink:      passLink(host, conf.ID, o.ID),
+	}
+	for _, l := range lines {
+		data.Items = append(data.Items, types.EmailItem{Name: l.Name, Quantity: int(l.Quantity)})
+	}
+
+	msg, err := types.RenderEmail(db, conf, types.EmailCancelled, data)
+	if err != nil {
+		log.Println("Cancellation Email Error:", o.ID, err)
+		return
+	}
+
+	m := internal.NewMerchantMessage(conf, msg.Subject, msg.Text, msg.HTML, fmt.Sprintf("%s <%s>", data.Name, data.Email))
+	var cancelled []types.CalendarEvent
+	for _, ev := range types.OrderEvents(db, conf, o.ID, data.PassLink) {
+		if ev.ProductID == first.ProductID && ev.Start.Equal(*first.Departure) {
+			cancelled = append(cancelled, ev)
+		}
+	}
+	if len(cancelled) > 0 {
+		types.BumpSequence(db, cancelled)
+		m.Attach("trip.ics", types.BuildCalendar(conf, types.CalendarCancel, cancelled))
+	}
+	if err := internal.SendEmail(db, conf, o.ID, types.EmailCancelled, m); err != nil {
+		log.Println("Cancellation Email Error:", o.ID, err)
+	}
+}
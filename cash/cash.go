@@ -0,0 +1,233 @@
+package cash
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jinzhu/gorm"
+	"github.com/zeroshade/tmsapi/payments"
+	"github.com/zeroshade/tmsapi/types"
+)
+
+var timeloc *time.Location
+
+func init() {
+	timeloc, _ = time.LoadLocation("America/New_York")
+	payments.Register(types.ProviderCash, Handler{})
+}
+
+// Handler records tickets sold in person at the box office and paid for with
+// cash, a check or a card on an outside terminal. There's nothing to charge so everything lives in the
+// unified order tables.
+type Handler struct{}
+
+const skuTimestamp = `SUBSTRING(ol.sku FROM '\d+[A-Z]+(\d{10})\d*')`
+
+func (h Handler) OrdersTimestamp(config *types.MerchantConfig, db *gorm.DB, timestamp string) (interface{}, error) {
+	type Ret struct {
+		ID        string    `json:"id"`
+		PaymentID string    `json:"paymentId"`
+		Quantity  uint      `json:"qty"`
+		Prod      string    `json:"name"`
+		Name      string    `json:"payer"`
+		Email     string    `json:"email"`
+		Phone     string    `json:"phone"`
+		CreatedAt time.Time `json:"created"`
+		Sku       string    `json:"sku"`
+		Status    string    `json:"status"`
+		OrigSku   string    `json:"origSku"`
+		OrigProd  string    `json:"origName"`
+		Tender    string    `json:"tender"`
+		StaffID   string    `json:"staffId"`
+		Balance   string    `json:"balanceDue,omitempty"`
+	}
+
+	var ret []Ret
+	err := db.Table("order_lines AS ol").
+		Joins("JOIN orders AS o ON (o.id = ol.order_id)").
+		Joins("LEFT JOIN customers AS cu ON (cu.id = o.customer_id)").
+		Joins("LEFT JOIN order_payments AS op ON (op.order_id = o.id)").
+		Where("o.merchant_id = ? AND o.provider = ? AND "+skuTimestamp+" = ?", config.ID, types.ProviderCash, timestamp).
+		Select([]string{"ol.id", "o.id AS payment_id", "ol.quantity", "ol.name AS prod", "cu.name", "cu.email", "cu.phone",
+			"o.created_at", "ol.sku", "ol.status", "ol.orig_sku", "ol.orig_name AS orig_prod", "op.tender", "op.staff_id",
+			"CASE WHEN ol.status = 'reserved' THEN ol.amount END AS balance"}).
+		Scan(&ret).Error
+
+	return ret, err
+}
+
+func (h Handler) GetSoldTickets(config *types.MerchantConfig, db *gorm.DB, from, to string) (interface{}, error) {
+	type result struct {
+		Stamp time.Time `json:"stamp"`
+		Qty   uint      `json:"qty"`
+		Pid   uint      `json:"pid"`
+	}
+
+	var out []result
+	err := db.Table("order_lines AS ol").
+		Joins("JOIN orders AS o ON (o.id = ol.order_id)").
+		Select("ol.product_id AS pid, ol.departure AS stamp, SUM(ol.quantity) AS qty").
+		Where("o.merchant_id = ? AND o.provider = ? AND ol.status NOT IN ('refunded', 'released')", config.ID, types.ProviderCash).
+		Where("ol.departure BETWEEN TO_TIMESTAMP(?) AND TO_TIMESTAMP(?)", from, to).
+		Group("ol.product_id, ol.departure").
+		Scan(&out).Error
+
+	for idx, o := range out {
+		out[idx].Stamp = o.Stamp.In(timeloc)
+	}
+
+	return out, err
+}
+
+func (h Handler) GetPassItems(config *types.MerchantConfig, db *gorm.DB, id string) ([]types.PassItem, string, string) {
+	var o types.Order
+	db.Preload("Customer").Preload("Lines", "status NOT IN ('refunded', 'released')").
+		Find(&o, "id = ? AND merchant_id = ? AND provider = ?", id, config.ID, types.ProviderCash)
+
+	ret := make([]types.PassItem, len(o.Lines))
+	for idx := range o.Lines {
+		ret[idx] = &o.Lines[idx]
+	}
+
+	if o.Customer == nil {
+		return ret, "", ""
+	}
+	return ret, o.Customer.Name, o.Customer.Email
+}
+
+// RefundInfo uses the same fields the stripe refunds do so the dashboard can
+// send either
+type RefundInfo struct {
+	OrderID string `json:"paymentId"`
+	LineID  string `json:"itemId"`
+}
+
+// RefundTickets marks lines as refunded, the money itself is handed back at
+// the window so this just records who did it and how much
+func (h Handler) RefundTickets(config *types.MerchantConfig, db *gorm.DB, data json.RawMessage) (interface{}, error) {
+	info := make([]RefundInfo, 0)
+	if err := json.Unmarshal(data, &info); err != nil {
+		return nil, err
+	}
+	return refundLines(config, db, info)
+}
+
+// refundLines records the refunds in the same tender the sale was paid with,
+// against the staff member's open drawer if they have one
+func refundLines(config *types.MerchantConfig, db *gorm.DB, info []RefundInfo) (interface{}, error) {
+	staff := payments.Staff(db)
+	drawerID := ""
+	if d := openDrawer(db, config.ID, staff); d != nil {
+		drawerID = d.ID
+	}
+
+	for _, i := range info {
+		var line types.OrderLine
+		db.Table("order_lines AS ol").Select("ol.*").
+			Joins("JOIN orders AS o ON (o.id = ol.order_id)").
+			Where("ol.id = ? AND ol.order_id = ? AND o.merchant_id = ? AND o.provider = ?", i.LineID, i.OrderID, config.ID, types.ProviderCash).
+			Scan(&line)
+		if line.ID == "" {
+			return nil, fmt.Errorf("line %s not found", i.LineID)
+		}
+		if line.Status == "refunded" {
+			continue
+		}
+
+		var paid types.OrderPayment
+		db.Where("order_id = ?", line.OrderID).First(&paid)
+
+		err := types.RecordRefund(db, &types.OrderRefund{
+			ID:        uuid.New().String(),
+			OrderID:   line.OrderID,
+			LineID:    line.ID,
+			Provider:  types.ProviderCash,
+			Status:    "succeeded",
+			Amount:    types.FormatMoney(types.ParseMoney(line.Amount)),
+			Tender:    paid.Tender,
+			StaffID:   staff,
+			DrawerID:  drawerID,
+			CreatedAt: time.Now(),
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return nil, nil
+}
+
+func (h Handler) TransferTickets(config *types.MerchantConfig, db *gorm.DB, data []types.TransferReq) (interface{}, error) {
+	for idx := range data {
+		var line types.OrderLine
+		db.Table("order_lines AS ol").Select("ol.*").
+			Joins("JOIN orders AS o ON (o.id = ol.order_id)").
+			Where("ol.id = ? AND o.merchant_id = ? AND o.provider = ?", data[idx].LineItemID, config.ID, types.ProviderCash).
+			Scan(&line)
+		if line.ID == "" {
+			return nil, fmt.Errorf("line %s not found", data[idx].LineItemID)
+		}
+
+		data[idx].OldSku = line.Sku
+		if err := types.TransferOrderLine(db, line.ID, data[idx].NewSKU, data[idx].NewName); err != nil {
+			return nil, err
+		}
+
+		var moved types.OrderLine
+		db.Find(&moved, "id = ?", line.ID)
+		if line.Departure != nil {
+			db.Table("manual_overrides").Where("product_id = ? AND time = ?", line.ProductID, *line.Departure).
+				UpdateColumn("avail", gorm.Expr("avail + ?", line.Quantity))
+		}
+		if moved.Departure != nil {
+			db.Table("manual_overrides").Where("product_id = ? AND time = ?", moved.ProductID, *moved.Departure).
+				UpdateColumn("avail", gorm.Expr("avail - ?", line.Quantity))
+		}
+
+		db.Save(&data[idx])
+	}
+	return nil, nil
+}
+
+// ManualEntry records a box office sale. The tender defaults to the entry type
+// for older dashboards that only send that.
+func (h Handler) ManualEntry(config *types.MerchantConfig, db *gorm.DB, entry types.Manual) (interface{}, error) {
+	tender := entry.Tender
+	if tender == "" {
+		tender = entry.EntryType
+	}
+
+	unit := 0.0
+	if entry.Quantity > 0 {
+		unit = types.ParseMoney(entry.Amount) / float64(entry.Quantity)
+	}
+
+	staff := payments.Staff(db)
+	drawerID := ""
+	if d := openDrawer(db, config.ID, staff); d != nil {
+		drawerID = d.ID
+	} else if needsDrawer(tender) {
+		return nil, ErrNoDrawer
+	}
+
+	return recordSale(db, config.ID, staff, drawerID, &Sale{
+		Items: []SaleItem{{
+			ProductID:  entry.ProductID,
+			Timestamp:  entry.Timestamp,
+			TicketType: entry.TicketType,
+			Quantity:   entry.Quantity,
+			Desc:       entry.Desc,
+			UnitPrice:  types.FormatMoney(unit),
+		}},
+		Tender: tender,
+		Name:   entry.Name,
+		Email:  entry.Email,
+		Phone:  entry.Phone,
+	})
+}
+
+func (h Handler) RedeemTickets(*types.MerchantConfig, *gorm.DB, json.RawMessage) (interface{}, error) {
+	return nil, errors.New("gift cards can't be redeemed for box office sales")
+}
@@ -0,0 +1,455 @@
+package cash
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/jinzhu/gorm"
+	"github.com/zeroshade/tmsapi/internal"
+	"github.com/zeroshade/tmsapi/payments"
+	"github.com/zeroshade/tmsapi/types"
+)
+
+const (
+	DrawerOpen   = "open"
+	DrawerClosed = "closed"
+)
+
+var timestampRe = regexp.MustCompile(`^\d{10}$`)
+
+// ErrNoDrawer is returned for cash or checks taken without an open drawer
+var ErrNoDrawer = errors.New("open a drawer before taking cash or checks")
+
+// AddPOSRoutes sets up the box office endpoints staff use to sell tickets at
+// the dock and reconcile their cash drawer at the end of the day
+func AddPOSRoutes(router *gin.RouterGroup, authHandler, logHandler gin.HandlerFunc, db *gorm.DB) {
+	pos := router.Group("/pos", authHandler)
+	pos.GET("/drawer", CurrentDrawer(db))
+	pos.GET("/drawers", ListDrawers(db))
+	pos.POST("/drawers", logHandler, OpenDrawer(db))
+	pos.POST("/drawers/:drawerid/close", logHandler, CloseDrawer(db))
+	pos.POST("/sales", logHandler, CreateSale(db))
+	pos.GET("/sales/:orderid/passes", SalePasses(db))
+	pos.POST("/refund", logHandler, RefundSale(db))
+	pos.GET("/reservations", ListReservations(db))
+	pos.POST("/reservations", logHandler, CreateReservation(db))
+	pos.POST("/reservations/:orderid/settle", logHandler, SettleReservation(db))
+	pos.POST("/reservations/:orderid/release", logHandler, ReleaseReservation(db))
+}
+
+// DrawerSession is a staff member's till from when they open it with a float
+// until they count it at close. Expected totals are what the recorded sales
+// less refunds say should be there.
+type DrawerSession struct {
+	ID             string     `json:"id" gorm:"primary_key"`
+	MerchantID     string     `json:"-" gorm:"index"`
+	StaffID        string     `json:"staffId" gorm:"index"`
+	Status         string     `json:"status"`
+	OpeningFloat   string     `json:"openingFloat" gorm:"type:money"`
+	ExpectedCash   string     `json:"expectedCash" gorm:"type:money"`
+	CountedCash    string     `json:"countedCash" gorm:"type:money"`
+	ExpectedChecks string     `json:"expectedChecks" gorm:"type:money"`
+	CountedChecks  string     `json:"countedChecks" gorm:"type:money"`
+	CardTotal      string     `json:"cardTotal" gorm:"type:money"`
+	Notes          string     `json:"notes"`
+	OpenedAt       time.Time  `json:"opened"`
+	ClosedAt       *time.Time `json:"closed"`
+	ClosedBy       string     `json:"closedBy"`
+	CashOver       float64    `json:"cashOver" gorm:"-"`
+	ChecksOver     float64    `json:"checksOver" gorm:"-"`
+}
+
+// AfterFind works out how far over or short a closed drawer was
+func (d *DrawerSession) AfterFind() error {
+	if d.Status == DrawerClosed {
+		d.CashOver = types.ParseMoney(d.CountedCash) - types.ParseMoney(d.ExpectedCash)
+		d.ChecksOver = types.ParseMoney(d.CountedChecks) - types.ParseMoney(d.ExpectedChecks)
+	}
+	return nil
+}
+
+func openDrawer(db *gorm.DB, merchantID, staff string) *DrawerSession {
+	var d DrawerSession
+	db.Where("merchant_id = ? AND staff_id = ? AND status = ?", merchantID, staff, DrawerOpen).First(&d)
+	if d.ID == "" {
+		return nil
+	}
+	return &d
+}
+
+// drawerTotals adds up what each tender took in a drawer, net of refunds
+func drawerTotals(db *gorm.DB, drawerID string) (map[string]float64, error) {
+	type row struct {
+		Tender string
+		Total  float64
+	}
+
+	var paid, refunded []row
+	err := db.Table("order_payments").Select("tender, SUM(amount)::numeric AS total").
+		Where("drawer_id = ? AND status = 'succeeded'", drawerID).Group("tender").Scan(&paid).Error
+	if err != nil {
+		return nil, err
+	}
+	err = db.Table("order_refunds").Select("tender, SUM(amount)::numeric AS total").
+		Where("drawer_id = ? AND status = 'succeeded'", drawerID).Group("tender").Scan(&refunded).Error
+	if err != nil {
+		return nil, err
+	}
+
+	out := make(map[string]float64)
+	for _, r := range paid {
+		out[r.Tender] += r.Total
+	}
+	for _, r := range refunded {
+		out[r.Tender] -= r.Total
+	}
+	return out, nil
+}
+
+// fillExpected sets the expected totals of a drawer from its sales so far
+func (d *DrawerSession) fillExpected(db *gorm.DB) error {
+	totals, err := drawerTotals(db, d.ID)
+	if err != nil {
+		return err
+	}
+
+	d.ExpectedCash = types.FormatMoney(types.ParseMoney(d.OpeningFloat) + totals[types.TenderCash])
+	d.ExpectedChecks = types.FormatMoney(totals[types.TenderCheck])
+	d.CardTotal = types.FormatMoney(totals[types.TenderCard])
+	return nil
+}
+
+func CurrentDrawer(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		d := openDrawer(db, c.Param("merchantid"), c.GetString("user_id"))
+		if d == nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "no open drawer"})
+			return
+		}
+
+		if err := d.fillExpected(db); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, d)
+	}
+}
+
+func ListDrawers(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		scope := db.Where("merchant_id = ?", c.Param("merchantid"))
+		if from := c.Query("from"); from != "" {
+			scope = scope.Where("opened_at >= ?::date", from)
+		}
+		if to := c.Query("to"); to != "" {
+			scope = scope.Where("opened_at < ?::date + 1", to)
+		}
+		if staff := c.Query("staff"); staff != "" {
+			scope = scope.Where("staff_id = ?", staff)
+		}
+
+		var out []DrawerSession
+		if err := scope.Order("opened_at desc").Find(&out).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		for idx := range out {
+			if out[idx].Status == DrawerOpen {
+				out[idx].fillExpected(db)
+			}
+		}
+		c.JSON(http.StatusOK, out)
+	}
+}
+
+func OpenDrawer(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req struct {
+			OpeningFloat string `json:"openingFloat"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		staff := c.GetString("user_id")
+		if d := openDrawer(db, c.Param("merchantid"), staff); d != nil {
+			c.JSON(http.StatusConflict, gin.H{"error": "drawer already open", "drawer": d})
+			return
+		}
+
+		zero := types.FormatMoney(0)
+		d := &DrawerSession{
+			ID:             uuid.New().String(),
+			MerchantID:     c.Param("merchantid"),
+			StaffID:        staff,
+			Status:         DrawerOpen,
+			OpeningFloat:   types.FormatMoney(types.ParseMoney(req.OpeningFloat)),
+			ExpectedCash:   types.FormatMoney(types.ParseMoney(req.OpeningFloat)),
+			CountedCash:    zero,
+			ExpectedChecks: zero,
+			CountedChecks:  zero,
+			CardTotal:      zero,
+			OpenedAt:       time.Now(),
+		}
+		if err := db.Create(d).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusCreated, d)
+	}
+}
+
+// CloseDrawer records what was counted in a drawer against what its sales
+// say should be there. Any staff member can close a drawer left open.
+func CloseDrawer(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req struct {
+			CountedCash   string `json:"countedCash"`
+			CountedChecks string `json:"countedChecks"`
+			Notes         string `json:"notes"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		var d DrawerSession
+		db.Find(&d, "id = ? AND merchant_id = ?", c.Param("drawerid"), c.Param("merchantid"))
+		if d.ID == "" {
+			c.JSON(http.StatusNotFound, gin.H{"error": "drawer not found"})
+			return
+		}
+		if d.Status != DrawerOpen {
+			c.JSON(http.StatusConflict, gin.H{"error": "drawer already closed"})
+			return
+		}
+
+		if err := d.fillExpected(db); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		now := time.Now()
+		d.Status = DrawerClosed
+		d.CountedCash = types.FormatMoney(types.ParseMoney(req.CountedCash))
+		d.CountedChecks = types.FormatMoney(types.ParseMoney(req.CountedChecks))
+		d.Notes = req.Notes
+		d.ClosedAt = &now
+		d.ClosedBy = c.GetString("user_id")
+		if err := db.Save(&d).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		d.AfterFind()
+		c.JSON(http.StatusOK, d)
+	}
+}
+
+type SaleItem struct {
+	ProductID  int    `json:"productId"`
+	Timestamp  string `json:"timestamp"`
+	TicketType string `json:"ticket"`
+	Quantity   int    `json:"quantity"`
+	Desc       string `json:"desc"`
+	UnitPrice  string `json:"unitPrice"`
+}
+
+// Sale is a box office purchase. Reference is the check number or the
+// authorization from an external card terminal.
+type Sale struct {
+	Items     []SaleItem `json:"items"`
+	Tender    string     `json:"tender"`
+	Reference string     `json:"reference"`
+	Name      string     `json:"name"`
+	Email     string     `json:"email"`
+	Phone     string     `json:"phone"`
+	Locale    string     `json:"locale"`
+}
+
+func validTender(t string) bool {
+	return t == types.TenderCash || t == types.TenderCheck || t == types.TenderCard
+}
+
+// newOrder builds the unified order for box office items, the customer is
+// whoever is buying or holding them
+func newOrder(merchantID string, sale *Sale, status string) (*types.Order, error) {
+	if len(sale.Items) == 0 {
+		return nil, errors.New("cannot sell no items")
+	}
+
+	id := uuid.New().String()
+	o := &types.Order{
+		ID:          id,
+		MerchantID:  merchantID,
+		Provider:    types.ProviderCash,
+		ProviderRef: id,
+		Status:      status,
+		Locale:      types.ParseLocale(sale.Locale),
+		Customer: &types.Customer{
+			Name:  sale.Name,
+			Email: sale.Email,
+			Phone: sale.Phone,
+		},
+	}
+
+	var total float64
+	for _, item := range sale.Items {
+		if item.Quantity <= 0 {
+			return nil, errors.New("quantity must be positive")
+		}
+		if !timestampRe.MatchString(item.Timestamp) {
+			return nil, fmt.Errorf("invalid timestamp %q", item.Timestamp)
+		}
+
+		unit := types.ParseMoney(item.UnitPrice)
+		if unit < 0 {
+			return nil, errors.New("unit price can't be negative")
+		}
+		amount := unit * float64(item.Quantity)
+		total += amount
+		o.Lines = append(o.Lines, types.OrderLine{
+			ID:        uuid.New().String(),
+			Sku:       fmt.Sprintf("%d%s%s", item.ProductID, strings.ToUpper(item.TicketType), item.Timestamp),
+			Name:      item.Desc,
+			Quantity:  uint(item.Quantity),
+			UnitPrice: types.FormatMoney(unit),
+			Amount:    types.FormatMoney(amount),
+			Status:    status,
+		})
+	}
+
+	o.Total = types.FormatMoney(total)
+	return o, nil
+}
+
+// takeInventory takes sold or held tickets out of the trips' availability the
+// same way manual entries always have
+func takeInventory(db *gorm.DB, items []SaleItem) {
+	for _, item := range items {
+		db.Table("manual_overrides").Where("product_id = ? AND time = TO_TIMESTAMP(?::INTEGER)", item.ProductID, item.Timestamp).
+			UpdateColumn("avail", gorm.Expr("avail - ?", item.Quantity))
+	}
+}
+
+// recordSale saves a box office sale as a unified order
+func recordSale(db *gorm.DB, merchantID, staff, drawerID string, sale *Sale) (*types.Order, error) {
+	sale.Tender = strings.ToLower(sale.Tender)
+	if !validTender(sale.Tender) {
+		return nil, fmt.Errorf("invalid tender %q, must be cash, check or card", sale.Tender)
+	}
+
+	o, err := newOrder(merchantID, sale, "succeeded")
+	if err != nil {
+		return nil, err
+	}
+
+	o.Payments = []types.OrderPayment{{
+		ID:        uuid.New().String(),
+		Provider:  types.ProviderCash,
+		Status:    "succeeded",
+		Amount:    o.Total,
+		Tender:    sale.Tender,
+		Reference: sale.Reference,
+		StaffID:   staff,
+		DrawerID:  drawerID,
+	}}
+
+	if err := types.SaveOrder(db, o); err != nil {
+		return nil, err
+	}
+	takeInventory(db, sale.Items)
+	return o, nil
+}
+
+func needsDrawer(tender string) bool {
+	t := strings.ToLower(tender)
+	return t == types.TenderCash || t == types.TenderCheck
+}
+
+// staffDrawer finds the drawer a payment taken by the signed in staff member
+// goes in. Cash and checks need one to be open, so this responds with an
+// error when there isn't.
+func staffDrawer(c *gin.Context, db *gorm.DB, tender string) (string, bool) {
+	if d := openDrawer(db, c.Param("merchantid"), c.GetString("user_id")); d != nil {
+		return d.ID, true
+	}
+
+	if needsDrawer(tender) {
+		c.JSON(http.StatusConflict, gin.H{"error": ErrNoDrawer.Error()})
+		return "", false
+	}
+	return "", true
+}
+
+// CreateSale records tickets sold at the box office. Cash and checks go in
+// the staff member's open drawer so one has to be open to take them.
+func CreateSale(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var sale Sale
+		if err := c.ShouldBindJSON(&sale); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		drawerID, ok := staffDrawer(c, db, sale.Tender)
+		if !ok {
+			return
+		}
+
+		o, err := recordSale(db, c.Param("merchantid"), c.GetString("user_id"), drawerID, &sale)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusCreated, o)
+	}
+}
+
+// SalePasses prints the boarding passes for a box office sale
+func SalePasses(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var config types.MerchantConfig
+		db.Find(&config, "id = ?", c.Param("merchantid"))
+
+		items, name, email := Handler{}.GetPassItems(&config, db, c.Param("orderid"))
+		if len(items) == 0 {
+			c.JSON(http.StatusNotFound, gin.H{"error": "sale not found"})
+			return
+		}
+
+		c.Header("Content-Type", "application/pdf")
+		c.Status(http.StatusOK)
+		locale := types.ResolveLocale(c.Query("locale"), types.OrderLocale(db, &config, c.Param("orderid")))
+		internal.GeneratePdf(db, items, config.PassTitle, name, email, locale, c.Writer)
+	}
+}
+
+// RefundSale refunds box office sales for any merchant, whichever provider
+// they sell online with
+func RefundSale(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var data []RefundInfo
+		if err := c.ShouldBindJSON(&data); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		var config types.MerchantConfig
+		db.Find(&config, "id = ?", c.Param("merchantid"))
+
+		if _, err := refundLines(&config, payments.WithStaff(db, c.GetString("user_id")), data); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.Status(http.StatusOK)
+	}
+}
@@ -0,0 +1,51 @@
+package cash
+
+import (
+	"testing"
+
+	"github.com/zeroshade/tmsapi/internal/dbtest"
+	"github.com/zeroshade/tmsapi/types"
+)
+
+func TestNewOrderRejects(t *testing.T) {
+	tests := []SaleItem{
+		{ProductID: 1, Timestamp: "1720130400", Quantity: 0, UnitPrice: "10.00"},
+		{ProductID: 1, Timestamp: "1720130400", Quantity: -2, UnitPrice: "10.00"},
+		{ProductID: 1, Timestamp: "1720130400", Quantity: 2, UnitPrice: "-10.00"},
+		{ProductID: 1, Timestamp: "today", Quantity: 2, UnitPrice: "10.00"},
+	}
+	for _, item := range tests {
+		if _, err := newOrder("m1", &Sale{Items: []SaleItem{item}}, "succeeded"); err == nil {
+			t.Errorf("accepted %+v", item)
+		}
+	}
+
+	o, err := newOrder("m1", &Sale{Items: []SaleItem{{ProductID: 1, Timestamp: "1720130400", Quantity: 2, UnitPrice: "0"}}}, "succeeded")
+	if err != nil || o.Total != "0.00" {
+		t.Errorf("free tickets: %+v, %v", o, err)
+	}
+}
+
+func TestManualEntryNeedsDrawer(t *testing.T) {
+	entry := types.Manual{ProductID: 1, Timestamp: "1720130400", Quantity: 2, Amount: "40.00"}
+	for _, tender := range []string{types.TenderCash, types.TenderCheck} {
+		db, d := dbtest.Open(t)
+		entry.Tender = tender
+		if _, err := (Handler{}).ManualEntry(&types.MerchantConfig{ID: "m1"}, db, entry); err != ErrNoDrawer {
+			t.Errorf("%s without a drawer: %v", tender, err)
+		}
+		if n := len(d.Statements(`"orders"`)); n != 0 {
+			t.Errorf("%s without a drawer was recorded", tender)
+		}
+	}
+
+	db, d := dbtest.Open(t)
+	entry.Tender = types.TenderCard
+	if _, err := (Handler{}).ManualEntry(&types.MerchantConfig{ID: "m1"}, db, entry); err != nil {
+		t.Fatal(err)
+	}
+	// saving tries an update before inserting
+	if n := len(d.Statements(`UPDATE "orders"`)); n != 1 {
+		t.Errorf("card entry saved %d orders", n)
+	}
+}
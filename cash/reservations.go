@@ -0,0 +1,170 @@
+package cash
+
+import (
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/jinzhu/gorm"
+	"github.com/zeroshade/tmsapi/types"
+)
+
+type reservationRequest struct {
+	Sale
+	HoldUntil     *time.Time `json:"holdUntil"`
+	CutoffMinutes int        `json:"cutoffMinutes"`
+}
+
+// CreateReservation holds seats for a customer who will pay later, either at
+// the dock or through a payment link
+func CreateReservation(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req reservationRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if req.Name == "" || (req.Email == "" && req.Phone == "") {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "reservations need a name and an email or phone"})
+			return
+		}
+
+		o, err := newOrder(c.Param("merchantid"), &req.Sale, "reserved")
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		r := &types.Reservation{
+			OrderID:       o.ID,
+			MerchantID:    o.MerchantID,
+			Status:        types.ReservationHeld,
+			BalanceDue:    o.Total,
+			HoldUntil:     req.HoldUntil,
+			CutoffMinutes: req.CutoffMinutes,
+			CreatedBy:     c.GetString("user_id"),
+		}
+
+		if err := types.SaveOrder(db, o); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		// the lines know their departures once they've been saved
+		var first *time.Time
+		for _, l := range o.Lines {
+			if l.Departure != nil && (first == nil || l.Departure.Before(*first)) {
+				first = l.Departure
+			}
+		}
+		r.SetReleaseAt(first)
+
+		if err := db.Create(r).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		takeInventory(db, req.Items)
+
+		r.Order = o
+		c.JSON(http.StatusCreated, r)
+	}
+}
+
+func ListReservations(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		scope := db.Preload("Order").Preload("Order.Customer").Preload("Order.Lines").
+			Where("merchant_id = ?", c.Param("merchantid"))
+		if status := c.Query("status"); status != "" {
+			scope = scope.Where("status = ?", status)
+		}
+
+		var out []types.Reservation
+		if err := scope.Order("created_at desc").Find(&out).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, out)
+	}
+}
+
+// SettleReservation takes payment for a reservation at the dock
+func SettleReservation(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req struct {
+			Tender    string `json:"tender"`
+			Reference string `json:"reference"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		req.Tender = strings.ToLower(req.Tender)
+		if !validTender(req.Tender) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "tender must be cash, check or card"})
+			return
+		}
+
+		var r types.Reservation
+		db.Find(&r, "order_id = ? AND merchant_id = ?", c.Param("orderid"), c.Param("merchantid"))
+		if r.OrderID == "" {
+			c.JSON(http.StatusNotFound, gin.H{"error": "reservation not found"})
+			return
+		}
+
+		drawerID, ok := staffDrawer(c, db, req.Tender)
+		if !ok {
+			return
+		}
+
+		err := types.SettleReservation(db, r.OrderID, &types.OrderPayment{
+			ID:        uuid.New().String(),
+			Provider:  types.ProviderCash,
+			Status:    "succeeded",
+			Amount:    types.FormatMoney(types.ParseMoney(r.BalanceDue)),
+			Tender:    req.Tender,
+			Reference: req.Reference,
+			StaffID:   c.GetString("user_id"),
+			DrawerID:  drawerID,
+		})
+		if err != nil {
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		}
+		c.Status(http.StatusOK)
+	}
+}
+
+func ReleaseReservation(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var r types.Reservation
+		db.Find(&r, "order_id = ? AND merchant_id = ?", c.Param("orderid"), c.Param("merchantid"))
+		if r.OrderID == "" {
+			c.JSON(http.StatusNotFound, gin.H{"error": "reservation not found"})
+			return
+		}
+
+		if err := types.ReleaseReservation(db, &r); err != nil {
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, r)
+	}
+}
+
+// ReleaseExpiredReservations periodically gives back the seats of unpaid
+// reservations whose hold has run out
+func ReleaseExpiredReservations(db *gorm.DB, interval time.Duration) {
+	for {
+		var expired []types.Reservation
+		db.Where("status = ? AND release_at <= ?", types.ReservationHeld, time.Now()).Find(&expired)
+		for idx := range expired {
+			if err := types.ReleaseReservation(db, &expired[idx]); err != nil {
+				log.Println("Release Reservation Error:", expired[idx].OrderID, err)
+			}
+		}
+		time.Sleep(interval)
+	}
+}
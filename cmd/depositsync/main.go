@@ -0,0 +1,57 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	_ "github.com/jinzhu/gorm/dialects/postgres"
+	"github.com/zeroshade/tmsapi/stripe"
+	"github.com/zeroshade/tmsapi/types"
+)
+
+// depositsync pulls historical deposit charges from stripe into the
+// deposit_bookings table. Bookings are upserted by payment intent so it can
+// be rerun safely.
+//
+//	DATABASE_URL=... STRIPE_KEY=... go run ./cmd/depositsync -since 2022-01-01
+func main() {
+	since := flag.String("since", "2021-01-01", "only sync charges created on or after this date")
+	merchant := flag.String("merchant", "", "only sync this merchant id")
+	flag.Parse()
+
+	start, err := time.Parse("2006-01-02", *since)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	URI := os.Getenv("DATABASE_URL")
+	if URI == "" {
+		log.Fatal("must set $DATABASE_URL")
+	}
+
+	db, err := gorm.Open("postgres", URI+"?timezone=America/New_York")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+	db.AutoMigrate(&stripe.DepositBooking{})
+
+	scope := db.Where("payment_type = ?", "stripe")
+	if *merchant != "" {
+		scope = scope.Where("id = ?", *merchant)
+	}
+
+	var confs []types.MerchantConfig
+	scope.Find(&confs)
+
+	for idx := range confs {
+		n, err := stripe.SyncDeposits(db, &confs[idx], start)
+		if err != nil {
+			log.Println(confs[idx].ID, err)
+		}
+		log.Println(confs[idx].ID, "deposits synced:", n)
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"log"
+	"os"
+
+	"github.com/jinzhu/gorm"
+	_ "github.com/jinzhu/gorm/dialects/postgres"
+	"github.com/zeroshade/tmsapi/paypal"
+	"github.com/zeroshade/tmsapi/stripe"
+	"github.com/zeroshade/tmsapi/types"
+)
+
+// orderbackfill copies historical PayPal checkout orders and Stripe payment
+// intents into the unified orders schema. It is safe to run more than once,
+// orders are upserted by their provider id.
+func main() {
+	URI := os.Getenv("DATABASE_URL")
+	if URI == "" {
+		log.Fatal("must set $DATABASE_URL")
+	}
+
+	db, err := gorm.Open("postgres", URI+"?timezone=America/New_York")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+	db.AutoMigrate(&types.Customer{}, &types.Order{}, &types.OrderLine{}, &types.OrderPayment{}, &types.OrderRefund{})
+
+	var confs []types.MerchantConfig
+	db.Find(&confs)
+
+	for _, conf := range confs {
+		switch conf.PaymentType {
+		case "paypal":
+			backfillPaypal(db, &conf)
+		case "stripe":
+			backfillStripe(db, &conf)
+		}
+	}
+
+	backfillTransfers(db)
+}
+
+func backfillPaypal(db *gorm.DB, conf *types.MerchantConfig) {
+	si := types.SandboxInfo{ID: conf.ID}
+	db.Find(&si)
+
+	ids := append([]string{conf.ID}, si.SandboxIDs...)
+
+	var coids []string
+	db.Table("purchase_units").Where("payee_merchant_id IN (?)", ids).Pluck("DISTINCT checkout_id", &coids)
+
+	log.Println(conf.ID, "paypal orders:", len(coids))
+	for _, id := range coids {
+		var co types.CheckoutOrder
+		db.Preload("Payer").Find(&co, "id = ?", id)
+		db.Where("checkout_id = ?", id).Find(&co.PurchaseUnits)
+		for idx := range co.PurchaseUnits {
+			db.Where("checkout_id = ?", id).Find(&co.PurchaseUnits[idx].Items)
+			db.Where("checkout_id = ?", id).Find(&co.PurchaseUnits[idx].Payments.Captures)
+		}
+
+		o := paypal.ToOrder(conf.ID, &co)
+		if co.Intent == "" && len(o.Payments) == 0 {
+			// orders saved by ManualEntry never went through paypal
+			o.Provider = types.ProviderManual
+		}
+
+		if err := types.SaveOrder(db, o); err != nil {
+			log.Println(id, err)
+		}
+	}
+}
+
+func backfillStripe(db *gorm.DB, conf *types.MerchantConfig) {
+	var pids []string
+	db.Table("line_items").Where("acct = ? AND payment_id != '-'", conf.StripeKey).Pluck("DISTINCT payment_id", &pids)
+
+	log.Println(conf.ID, "stripe orders:", len(pids))
+	for _, id := range pids {
+		if err := stripe.RecordOrder(db, conf.ID, id); err != nil {
+			log.Println(id, err)
+		}
+	}
+
+	var manual []stripe.LineItem
+	db.Find(&manual, "acct = ? AND payment_id = '-'", conf.StripeKey)
+
+	log.Println(conf.ID, "manual orders:", len(manual))
+	for _, li := range manual {
+		var payer stripe.ManualPayerInfo
+		db.Find(&payer, "id = ?", li.ID)
+
+		if err := stripe.RecordManualOrder(db, conf.ID, li.ID, &payer, []stripe.LineItem{li}); err != nil {
+			log.Println(li.ID, err)
+		}
+	}
+}
+
+func backfillTransfers(db *gorm.DB) {
+	var transfers []types.TransferReq
+	db.Find(&transfers)
+
+	for _, t := range transfers {
+		lineID := t.LineItemID
+		if t.OldSku != "" {
+			lineID = paypal.LineID(t.LineItemID, t.OldSku)
+		}
+		types.TransferOrderLine(db, lineID, t.NewSKU, t.NewName)
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	_ "github.com/jinzhu/gorm/dialects/postgres"
+	"github.com/zeroshade/tmsapi/types"
+)
+
+// orderbench seeds a throwaway schema with generated paypal orders and times
+// loading them one order at a time, the way the listing endpoints used to,
+// against the batched loaders they use now.
+//
+//	DATABASE_URL=... go run ./cmd/orderbench -orders 5000 -items 3
+func main() {
+	numOrders := flag.Int("orders", 2000, "number of checkout orders to generate")
+	numItems := flag.Int("items", 3, "items per order")
+	schema := flag.String("schema", "orderbench", "schema to seed, dropped when done")
+	runs := flag.Int("runs", 3, "timed runs of each loader")
+	flag.Parse()
+
+	URI := os.Getenv("DATABASE_URL")
+	if URI == "" {
+		log.Fatal("must set $DATABASE_URL")
+	}
+
+	db, err := gorm.Open("postgres", URI+"?timezone=America/New_York")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+	// search_path is per connection, so keep everything on one
+	db.DB().SetMaxOpenConns(1)
+
+	db.Exec("DROP SCHEMA IF EXISTS " + *schema + " CASCADE")
+	db.Exec("CREATE SCHEMA " + *schema)
+	defer db.Exec("DROP SCHEMA IF EXISTS " + *schema + " CASCADE")
+	db.Exec("SET search_path TO " + *schema)
+
+	db.AutoMigrate(&types.CheckoutOrder{}, &types.PurchaseUnit{}, &types.PurchaseItem{},
+		&types.Capture{}, &types.Payer{}, &types.TicketUsage{})
+
+	start := time.Now()
+	ids := seed(db, *numOrders, *numItems)
+	log.Printf("seeded %d orders with %d items each in %s", *numOrders, *numItems, time.Since(start))
+
+	var items []types.PurchaseItem
+	db.Find(&items)
+	var units []types.PurchaseUnit
+	db.Find(&units)
+
+	bench("orders (per order)", *runs, func() { loadOrdersNaive(db, ids) })
+	bench("orders (batched)", *runs, func() { types.LoadCheckoutOrders(db, ids) })
+	bench("checkouts (per unit)", *runs, func() { loadUnitsNaive(db, units) })
+	bench("checkouts (batched)", *runs, func() { types.LoadCheckoutsForUnits(db, units) })
+	bench("usage (per order)", *runs, func() { loadUsageNaive(db, ids) })
+	bench("usage (batched)", *runs, func() { types.LoadTicketUsage(db, ids) })
+}
+
+func seed(db *gorm.DB, numOrders, numItems int) []string {
+	tx := db.Begin()
+	base := time.Now().Add(30 * 24 * time.Hour).Unix()
+
+	ids := make([]string, 0, numOrders)
+	for o := 0; o < numOrders; o++ {
+		id := fmt.Sprintf("BENCH%012d", o)
+		ids = append(ids, id)
+
+		payer := types.Payer{ID: fmt.Sprintf("PAYER%08d", o), Email: fmt.Sprintf("buyer%d@example.com", o)}
+		payer.Name.GivenName = "Bench"
+		payer.Name.Surname = fmt.Sprint(o)
+		tx.Create(&payer)
+
+		tx.Create(&types.CheckoutOrder{ID: id, PayerID: payer.ID, Intent: "CAPTURE", Status: "COMPLETED"})
+
+		pu := types.PurchaseUnit{CheckoutID: id}
+		pu.Payee.MerchantID = "BENCHMERCHANT"
+		pu.Amount.Value = fmt.Sprint(numItems * 25)
+		tx.Create(&pu)
+
+		cp := types.Capture{ID: "CAP" + id, CheckoutID: id, Status: "COMPLETED"}
+		cp.Amount.Value = pu.Amount.Value
+		tx.Create(&cp)
+
+		for i := 0; i < numItems; i++ {
+			sku := fmt.Sprintf("%dADULT%d", i+1, base+int64(o%50)*3600)
+			item := types.PurchaseItem{CheckoutID: id, Sku: sku, Name: "Bench Trip", Quantity: 2}
+			item.Amount.Value = "25"
+			tx.Create(&item)
+			tx.Create(&types.TicketUsage{TicketID: id + "-" + sku + "-0", Used: o%2 == 0})
+		}
+	}
+
+	tx.Commit()
+	return ids
+}
+
+func bench(name string, runs int, fn func()) {
+	var total time.Duration
+	for i := 0; i < runs; i++ {
+		start := time.Now()
+		fn()
+		total += time.Since(start)
+	}
+	log.Printf("%-22s %s avg over %d runs", name, total/time.Duration(runs), runs)
+}
+
+func loadOrdersNaive(db *gorm.DB, ids []string) []types.CheckoutOrder {
+	var co []types.CheckoutOrder
+	db.Preload("Payer").Where("id in (?)", ids).Find(&co)
+
+	for idx := range co {
+		db.Where("checkout_id = ?", co[idx].ID).Find(&co[idx].PurchaseUnits)
+		db.Where("checkout_id = ?", co[idx].ID).Find(&co[idx].PurchaseUnits[0].Payments.Captures)
+		db.Where("checkout_id = ?", co[idx].ID).Find(&co[idx].PurchaseUnits[0].Items)
+	}
+	return co
+}
+
+func loadUnitsNaive(db *gorm.DB, units []types.PurchaseUnit) []*types.CheckoutOrder {
+	var orders []*types.CheckoutOrder
+	for idx := range units {
+		db.Where("checkout_id = ?", units[idx].CheckoutID).Find(&units[idx].Payments.Captures)
+		db.Where("checkout_id = ?", units[idx].CheckoutID).Find(&units[idx].Items)
+
+		o := &types.CheckoutOrder{}
+		db.Preload("Payer").Find(o, "id = ?", units[idx].CheckoutID)
+		o.PurchaseUnits = []types.PurchaseUnit{units[idx]}
+		orders = append(orders, o)
+	}
+	return orders
+}
+
+func loadUsageNaive(db *gorm.DB, ids []string) map[string]bool {
+	usage := make(map[string]bool)
+	for _, id := range ids {
+		var used []types.TicketUsage
+		db.Where("ticket_id ^@ ?", id).Find(&used)
+		for _, tu := range used {
+			usage[tu.TicketID] = tu.Used
+		}
+	}
+	return usage
+}
@@ -4,33 +4,57 @@ import (
 	_ "image/jpeg"
 	_ "image/png"
 	"net/http"
+	"strings"
 
 	"github.com/gin-gonic/gin"
 	"github.com/jinzhu/gorm"
 	"github.com/zeroshade/tmsapi/internal"
-	"github.com/zeroshade/tmsapi/paypal"
-	"github.com/zeroshade/tmsapi/stripe"
+	"github.com/zeroshade/tmsapi/payments"
 	"github.com/zeroshade/tmsapi/types"
 )
 
+// passItems finds the passes for an order with the merchant's provider,
+// falling back to the box office
+func passItems(db *gorm.DB, config *types.MerchantConfig, handler payments.PaymentHandler, id string) ([]types.PassItem, string, string) {
+	items, name, email := handler.GetPassItems(config, db, id)
+	if len(items) == 0 && config.PaymentType != types.ProviderCash {
+		// could be a box office sale
+		if box, err := payments.Get(types.ProviderCash); err == nil {
+			items, name, email = box.GetPassItems(config, db, id)
+		}
+	}
+	return items, name, email
+}
+
 func GetBoardingPasses(db *gorm.DB) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		var config types.MerchantConfig
 		db.Find(&config, "id = ? OR sandbox_id = ?", c.Param("merchantid"), c.Param("merchantid"))
 
-		var handler PaymentHandler
+		// gin can't route a suffix on a param, so the calendar is served here
+		if id := c.Param("checkoutid"); strings.HasSuffix(id, ".ics") {
+			id = strings.TrimSuffix(id, ".ics")
+			link := "https://" + c.Request.Host + "/info/" + c.Param("merchantid") + "/passes/" + id
+			ics := types.OrderCalendar(db, &config, id, link)
+			if ics == nil {
+				c.JSON(http.StatusNotFound, gin.H{"error": "no trips found for order"})
+				return
+			}
+			c.Header("Content-Disposition", `attachment; filename="trip.ics"`)
+			c.Data(http.StatusOK, "text/calendar; charset=utf-8", ics)
+			return
+		}
 
-		switch config.PaymentType {
-		case "stripe":
-			handler = &stripe.Handler{}
-		case "paypal":
-			handler = &paypal.Handler{}
+		handler, ok := paymentHandler(c, &config)
+		if !ok {
+			return
 		}
 
-		items, name, email := handler.GetPassItems(&config, db, c.Param("checkoutid"))
+		items, name, email := passItems(db, &config, handler, c.Param("checkoutid"))
+		locale := types.ResolveLocale(c.Query("locale"), types.OrderLocale(db, &config, c.Param("checkoutid")))
 		c.Header("Content-Type", "application/pdf")
 		// c.Header("Content-Disposition", `attachment; filename="boardingpasses_`+c.Param("checkoutid")+`.pdf"`)
 		c.Status(http.StatusOK)
-		internal.GeneratePdf(db, items, config.PassTitle, name, email, c.Writer)
+		internal.GeneratePdf(db, items, config.PassTitle, name, email, locale, c.Writer)
 	}
 }
@@ -0,0 +1,389 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+	"github.com/lib/pq"
+	"github.com/zeroshade/tmsapi/internal"
+	"github.com/zeroshade/tmsapi/stripe"
+	"github.com/zeroshade/tmsapi/types"
+)
+
+const defaultDigestTime = "18:00"
+
+func addDigestRoutes(router *gin.RouterGroup, db *gorm.DB) {
+	router.GET("/digest", checkJWT(), ListDigestRuns(db))
+	router.GET("/digest/preview", checkJWT(), PreviewDigest(db))
+	router.POST("/digest/send", checkJWT(), logActionMiddle(db), SendDigestNow(db))
+	router.PUT("/digest/settings", checkJWT(), logActionMiddle(db), UpdateDigestSettings(db))
+}
+
+type digestDeparture struct {
+	ProductID uint
+	Product   string
+	Departure time.Time
+	Booked    int
+	Remaining int
+	Cancelled bool
+}
+
+type digestBooking struct {
+	OrderID  string
+	Provider string
+	Name     string
+	Tickets  int
+	Total    string
+}
+
+type digestRefund struct {
+	OrderID string
+	Name    string
+	Amount  string
+}
+
+type digestTransfer struct {
+	OrderID string
+	Name    string
+	OldSku  string
+	NewName string
+}
+
+// digest is everything a merchant's evening email covers
+type digest struct {
+	Merchant   string
+	Day        time.Time
+	Departures []digestDeparture
+	Bookings   []digestBooking
+	Refunds    []digestRefund
+	Transfers  []digestTransfer
+	Charters   []stripe.CharterBooking
+}
+
+// tomorrowsDepartures lists each departure the next day, whether or not
+// anything is booked on it. Remaining starts at the schedule's capacity less
+// what's booked, unless a manual override has it, since sales take from the
+// override's availability.
+func tomorrowsDepartures(db *gorm.DB, merchantID string, start, end time.Time) []digestDeparture {
+	var deps []digestDeparture
+	byKey := make(map[string]int)
+	key := func(pid uint, t time.Time) string { return fmt.Sprintf("%d/%d", pid, t.Unix()) }
+
+	var prods []types.Product
+	db.Preload("Schedules").Preload("Schedules.TimeArray").Where("merchant_id = ?", merchantID).Find(&prods)
+	for idx := range prods {
+		p := &prods[idx]
+		for _, sd := range p.Departures(start) {
+			byKey[key(p.ID, sd.Time)] = len(deps)
+			deps = append(deps, digestDeparture{ProductID: p.ID, Product: p.Name, Departure: sd.Time, Remaining: int(sd.Avail)})
+		}
+	}
+
+	var booked []digestDeparture
+	db.Table("order_lines AS ol").
+		Joins("JOIN orders AS o ON o.id = ol.order_id").
+		Joins("LEFT JOIN products AS p ON p.id = ol.product_id AND p.merchant_id = o.merchant_id").
+		Where("o.merchant_id = ? AND ol.departure >= ? AND ol.departure < ?", merchantID, start, end).
+		Where("ol.status NOT IN ('refunded', 'released') AND o.status <> 'refunded'").
+		Select("ol.product_id, p.name AS product, ol.departure, sum(ol.quantity) AS booked").
+		Group("ol.product_id, p.name, ol.departure").
+		Scan(&booked)
+	for _, b := range booked {
+		idx, ok := byKey[key(b.ProductID, b.Departure)]
+		if !ok {
+			// booked on a time no schedule has anymore
+			byKey[key(b.ProductID, b.Departure)] = len(deps)
+			deps = append(deps, b)
+			continue
+		}
+		deps[idx].Booked = b.Booked
+		deps[idx].Remaining -= b.Booked
+	}
+
+	type override struct {
+		ProductID uint
+		Product   string
+		Time      time.Time
+		Avail     int
+		Cancelled bool
+	}
+	var overrides []override
+	db.Table("manual_overrides AS mo").
+		Joins("JOIN products AS p ON p.id = mo.product_id").
+		Where("p.merchant_id = ? AND mo.time >= ? AND mo.time < ?", merchantID, start, end).
+		Select("mo.product_id, p.name AS product, mo.time, mo.avail, mo.cancelled").
+		Scan(&overrides)
+
+	for _, o := range overrides {
+		idx, ok := byKey[key(o.ProductID, o.Time)]
+		if !ok {
+			deps = append(deps, digestDeparture{ProductID: o.ProductID, Product: o.Product, Departure: o.Time})
+			idx = len(deps) - 1
+		}
+		deps[idx].Remaining, deps[idx].Cancelled = o.Avail, o.Cancelled
+	}
+
+	for idx := range deps {
+		deps[idx].Departure = deps[idx].Departure.In(timeloc)
+		if deps[idx].Remaining < 0 {
+			deps[idx].Remaining = 0
+		}
+	}
+	sort.SliceStable(deps, func(i, j int) bool {
+		if !deps[i].Departure.Equal(deps[j].Departure) {
+			return deps[i].Departure.Before(deps[j].Departure)
+		}
+		return deps[i].Product < deps[j].Product
+	})
+	return deps
+}
+
+// buildDigest gathers tomorrow's departures, the last day's bookings,
+// refunds and transfers, and charters with a balance coming due
+func buildDigest(db *gorm.DB, conf *types.MerchantConfig, now time.Time) *digest {
+	now = now.In(timeloc)
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, timeloc)
+	tomorrow := today.AddDate(0, 0, 1)
+	since := now.Add(-24 * time.Hour)
+
+	d := &digest{Merchant: conf.PassTitle, Day: tomorrow}
+	d.Departures = tomorrowsDepartures(db, conf.ID, tomorrow, tomorrow.AddDate(0, 0, 1))
+
+	db.Table("orders AS o").
+		Joins("LEFT JOIN customers AS cu ON cu.id = o.customer_id").
+		Where("o.merchant_id = ? AND o.created_at >= ?", conf.ID, since).
+		Select("o.id AS order_id, o.provider, cu.name, o.total, (SELECT coalesce(sum(quantity), 0) FROM order_lines WHERE order_id = o.id) AS tickets").
+		Order("o.created_at").
+		Scan(&d.Bookings)
+
+	db.Table("order_refunds AS r").
+		Joins("JOIN orders AS o ON o.id = r.order_id").
+		Joins("LEFT JOIN customers AS cu ON cu.id = o.customer_id").
+		Where("o.merchant_id = ? AND r.created_at >= ?", conf.ID, since).
+		Select("r.order_id, cu.name, r.amount").
+		Order("r.created_at").
+		Scan(&d.Refunds)
+
+	db.Table("transfer_reqs AS tr").
+		Joins("JOIN order_lines AS ol ON ol.id = tr.line_item_id OR ol.id = tr.line_item_id || ':' || tr.old_sku").
+		Joins("JOIN orders AS o ON o.id = ol.order_id").
+		Joins("LEFT JOIN customers AS cu ON cu.id = o.customer_id").
+		Where("o.merchant_id = ? AND tr.created_at >= ?", conf.ID, since).
+		Select("DISTINCT o.id AS order_id, cu.name, tr.old_sku, tr.new_name, tr.created_at").
+		Order("tr.created_at").
+		Scan(&d.Transfers)
+
+	days := conf.CharterBalanceDays
+	if days <= 0 {
+		days = 7
+	}
+	var charters []stripe.CharterBooking
+	db.Where("merchant_id = ? AND status = ? AND date BETWEEN ? AND ?", conf.ID, stripe.CharterBooked,
+		today.Format("2006-01-02"), today.AddDate(0, 0, days).Format("2006-01-02")).
+		Order("date, time").Find(&charters)
+	for _, b := range charters {
+		if types.ParseMoney(b.Owed) > 0 {
+			d.Charters = append(d.Charters, b)
+		}
+	}
+	return d
+}
+
+var digestTemplate = template.Must(template.New("digest").Parse(`
+<h2>{{ .Merchant }}: {{ .Day.Format "Monday, Jan 2" }}</h2>
+
+<h3>Tomorrow's Departures</h3>
+{{ if .Departures -}}
+<table>
+	<thead><tr><th>Time</th><th>Trip</th><th>Booked</th><th>Remaining</th></tr></thead>
+	<tbody>
+{{ range .Departures }}		<tr><td>{{ .Departure.Format "3:04 PM" }}</td><td>{{ .Product }}{{ if .Cancelled }} (cancelled){{ end }}</td><td>{{ .Booked }}</td><td>{{ .Remaining }}</td></tr>
+{{ end }}	</tbody>
+</table>
+{{- else }}<p>No departures scheduled.</p>{{ end }}
+
+<h3>New Bookings</h3>
+{{ if .Bookings -}}
+<ul>
+{{ range .Bookings }}<li>{{ .OrderID }}: {{ .Name }}, {{ .Tickets }} tickets, {{ .Total }} ({{ .Provider }})</li>
+{{ end }}</ul>
+{{- else }}<p>None in the last 24 hours.</p>{{ end }}
+
+<h3>Refunds</h3>
+{{ if .Refunds -}}
+<ul>
+{{ range .Refunds }}<li>{{ .OrderID }}: {{ .Name }}, {{ .Amount }}</li>
+{{ end }}</ul>
+{{- else }}<p>None in the last 24 hours.</p>{{ end }}
+
+<h3>Transfers</h3>
+{{ if .Transfers -}}
+<ul>
+{{ range .Transfers }}<li>{{ .OrderID }}: {{ .Name }}, moved from {{ .OldSku }} to {{ .NewName }}</li>
+{{ end }}</ul>
+{{- else }}<p>None in the last 24 hours.</p>{{ end }}
+
+<h3>Charter Balances Due</h3>
+{{ if .Charters -}}
+<ul>
+{{ range .Charters }}<li>{{ .Date }} {{ .Time }}: {{ .Name }}, {{ .Length }} hour {{ .TripType }}, ${{ .Owed }} owed{{ if .BalanceSentAt }} (link sent){{ end }}</li>
+{{ end }}</ul>
+{{- else }}<p>No charter balances due.</p>{{ end }}
+`))
+
+func renderDigest(d *digest) (string, error) {
+	var buf bytes.Buffer
+	if err := digestTemplate.Execute(&buf, d); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+func sendDigest(db *gorm.DB, conf *types.MerchantConfig, now time.Time) error {
+	d := buildDigest(db, conf, now)
+	html, err := renderDigest(d)
+	if err != nil {
+		return err
+	}
+
+	subject := conf.PassTitle + " Daily Digest for " + d.Day.Format("Mon, Jan 2")
+	m := internal.NewMerchantMessage(conf, subject, "", html, conf.DigestTo()...)
+	return internal.SendEmail(db, conf, "", "digest", m)
+}
+
+// digestDue reports whether it's past the merchant's digest time today
+func digestDue(conf *types.MerchantConfig, now time.Time) bool {
+	at, err := time.Parse("15:04", conf.DigestTime)
+	if err != nil {
+		at, _ = time.Parse("15:04", defaultDigestTime)
+	}
+	now = now.In(timeloc)
+	return now.Hour()*60+now.Minute() >= at.Hour()*60+at.Minute()
+}
+
+// SendDigests periodically emails each merchant that wants it their digest,
+// once a day after their digest time
+func SendDigests(db *gorm.DB, interval time.Duration) {
+	for {
+		now := time.Now().In(timeloc)
+
+		var confs []types.MerchantConfig
+		db.Where("digest_enabled").Find(&confs)
+		for idx := range confs {
+			conf := &confs[idx]
+			if !digestDue(conf, now) {
+				continue
+			}
+
+			runDigest(db, conf, now)
+		}
+		time.Sleep(interval)
+	}
+}
+
+// runDigest claims and sends the merchant's digest for the day
+func runDigest(db *gorm.DB, conf *types.MerchantConfig, now time.Time) {
+	run := &types.DigestRun{
+		MerchantID: conf.ID,
+		Date:       now.Format("2006-01-02"),
+		Recipients: strings.Join(conf.DigestTo(), ", "),
+	}
+	if ok, err := types.ClaimDigest(db, run); !ok {
+		if err != nil {
+			log.Println("Digest Claim Error:", conf.ID, err)
+		}
+		return
+	}
+
+	if err := sendDigest(db, conf, now); err != nil {
+		log.Println("Digest Error:", conf.ID, err)
+		// let the next pass try again
+		db.Delete(run)
+	}
+}
+
+func ListDigestRuns(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var out []types.DigestRun
+		if err := db.Where("merchant_id = ?", c.Param("merchantid")).Order("date desc").Limit(60).Find(&out).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, out)
+	}
+}
+
+// PreviewDigest renders the digest as it would be sent right now
+func PreviewDigest(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var conf types.MerchantConfig
+		db.Find(&conf, "id = ?", c.Param("merchantid"))
+
+		html, err := renderDigest(buildDigest(db, &conf, time.Now()))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(html))
+	}
+}
+
+// SendDigestNow sends the digest immediately, without counting as the
+// day's scheduled one
+func SendDigestNow(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var conf types.MerchantConfig
+		db.Find(&conf, "id = ?", c.Param("merchantid"))
+
+		if err := sendDigest(db, &conf, time.Now()); err != nil {
+			c.JSON(http.StatusFailedDependency, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"recipients": conf.DigestTo()})
+	}
+}
+
+// UpdateDigestSettings is separate from the merchant config so the digest
+// can be switched off, which a struct update would skip
+func UpdateDigestSettings(db *gorm.DB) gin.HandlerFunc {
+	type settings struct {
+		Enabled    bool     `json:"digestEnabled"`
+		Time       string   `json:"digestTime"`
+		Recipients []string `json:"digestRecipients"`
+	}
+
+	return func(c *gin.Context) {
+		var req settings
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if req.Time == "" {
+			req.Time = defaultDigestTime
+		}
+		if _, err := time.Parse("15:04", req.Time); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "digestTime must be HH:MM"})
+			return
+		}
+
+		err := db.Model(&types.MerchantConfig{}).Where("id = ?", c.Param("merchantid")).
+			Updates(map[string]interface{}{
+				"digest_enabled":    req.Enabled,
+				"digest_time":       req.Time,
+				"digest_recipients": pq.StringArray(req.Recipients),
+			}).Error
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, req)
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zeroshade/tmsapi/internal"
+	"github.com/zeroshade/tmsapi/internal/dbtest"
+	"github.com/zeroshade/tmsapi/types"
+)
+
+func TestTomorrowsDepartures(t *testing.T) {
+	start := time.Date(2024, 7, 5, 0, 0, 0, 0, timeloc)
+	morning := start.Add(8 * time.Hour)
+	evening := start.Add(18 * time.Hour)
+
+	db, d := dbtest.Open(t)
+	d.Returns(`FROM order_lines AS ol`, []string{"product_id", "product", "departure", "booked"},
+		[]interface{}{int64(1), "Fishing", evening.UTC(), int64(5)})
+	d.Returns(`FROM manual_overrides AS mo`, []string{"product_id", "product", "time", "avail", "cancelled"},
+		[]interface{}{int64(1), "Fishing", evening.UTC(), int64(3), false},
+		[]interface{}{int64(2), "Sunset", morning.UTC(), int64(20), true})
+
+	deps := tomorrowsDepartures(db, "m1", start, start.AddDate(0, 0, 1))
+	if len(deps) != 2 {
+		t.Fatalf("got %+v", deps)
+	}
+	want := []digestDeparture{
+		{ProductID: 2, Product: "Sunset", Departure: morning, Remaining: 20, Cancelled: true},
+		{ProductID: 1, Product: "Fishing", Departure: evening, Booked: 5, Remaining: 3},
+	}
+	for idx, w := range want {
+		got := deps[idx]
+		if !got.Departure.Equal(w.Departure) || got.Departure.Location() != timeloc {
+			t.Errorf("departure %d at %v, want %v", idx, got.Departure, w.Departure)
+		}
+		got.Departure = w.Departure
+		if got != w {
+			t.Errorf("departure %d = %+v, want %+v", idx, got, w)
+		}
+	}
+}
+
+func TestBuildDigestTransfers(t *testing.T) {
+	db, d := dbtest.Open(t)
+	d.Returns(`FROM transfer_reqs AS tr`, []string{"order_id", "name", "old_sku", "new_name"},
+		[]interface{}{"CHK1", "Ana", "sku1", "Sunset, Jul 6"})
+
+	dg := buildDigest(db, &types.MerchantConfig{ID: "m1", PassTitle: "Boat Co"}, time.Date(2024, 7, 4, 18, 0, 0, 0, timeloc))
+	if len(dg.Transfers) != 1 || dg.Transfers[0].OrderID != "CHK1" {
+		t.Errorf("transfers = %+v", dg.Transfers)
+	}
+	if !dg.Day.Equal(time.Date(2024, 7, 5, 0, 0, 0, 0, timeloc)) {
+		t.Errorf("day = %v", dg.Day)
+	}
+
+	q := d.Statements(`FROM transfer_reqs AS tr`)[0].Query
+	if !strings.Contains(q, `ol.id = tr.line_item_id || ':' || tr.old_sku`) {
+		t.Errorf("paypal transfers aren't joined to their lines: %q", q)
+	}
+}
+
+type failingMailer struct{}
+
+func (failingMailer) Send(context.Context, *internal.Message) (string, error) {
+	return "", errors.New("mailgun is down")
+}
+
+func TestRunDigestFailed(t *testing.T) {
+	prev := internal.DefaultMailer
+	internal.DefaultMailer = failingMailer{}
+	t.Cleanup(func() { internal.DefaultMailer = prev })
+
+	db, d := dbtest.Open(t)
+	runDigest(db, &types.MerchantConfig{ID: "m1", EmailFrom: "tickets@example.com"}, time.Now())
+	if n := len(d.Statements(`INSERT INTO "digest_runs"`)); n != 1 {
+		t.Fatalf("claimed %d times", n)
+	}
+	if n := len(d.Statements(`DELETE FROM "digest_runs"`)); n != 1 {
+		t.Error("a failed digest kept its claim")
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"html/template"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+	"github.com/zeroshade/tmsapi/types"
+)
+
+func addEmailTemplateRoutes(router *gin.RouterGroup, db *gorm.DB) {
+	router.GET("/email-templates", checkJWT(), ListEmailTemplates(db))
+	router.PUT("/email-templates/:kind", checkJWT(), logActionMiddle(db), SaveEmailTemplate(db))
+	router.DELETE("/email-templates/:kind", checkJWT(), logActionMiddle(db), ResetEmailTemplate(db))
+	router.POST("/email-templates/:kind/preview", checkJWT(), PreviewEmailTemplate(db))
+}
+
+func validEmailKind(c *gin.Context) (string, bool) {
+	kind := c.Param("kind")
+	if _, ok := types.DefaultEmailTemplates[kind]; !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "unknown email kind " + kind})
+		return "", false
+	}
+	return kind, true
+}
+
+// templateLocale is the ?locale= being edited, english when not given
+func templateLocale(c *gin.Context) (string, bool) {
+	q := c.Query("locale")
+	if q == "" {
+		return types.LocaleEnglish, true
+	}
+	l := types.ParseLocale(q)
+	if l == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "unsupported locale " + q})
+		return "", false
+	}
+	return l, true
+}
+
+func ListEmailTemplates(db *gorm.DB) gin.HandlerFunc {
+	type entry struct {
+		types.EmailTemplate
+		Custom bool                `json:"custom"`
+		Vars   []types.TemplateVar `json:"vars"`
+	}
+
+	return func(c *gin.Context) {
+		locale, ok := templateLocale(c)
+		if !ok {
+			return
+		}
+
+		var saved []types.EmailTemplate
+		db.Find(&saved, "merchant_id = ? AND locale = ?", c.Param("merchantid"), locale)
+		byKind := make(map[string]types.EmailTemplate)
+		for _, t := range saved {
+			byKind[t.Kind] = t
+		}
+
+		out := make([]entry, 0, len(types.EmailKinds))
+		for _, kind := range types.EmailKinds {
+			t, custom := byKind[kind]
+			if !custom {
+				t = types.DefaultEmailTemplate(kind, locale)
+			}
+			out = append(out, entry{EmailTemplate: t, Custom: custom, Vars: types.EmailTemplateVars[kind]})
+		}
+		c.JSON(http.StatusOK, out)
+	}
+}
+
+func SaveEmailTemplate(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		kind, ok := validEmailKind(c)
+		if !ok {
+			return
+		}
+		locale, ok := templateLocale(c)
+		if !ok {
+			return
+		}
+
+		var t types.EmailTemplate
+		if err := c.ShouldBindJSON(&t); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if t.Subject == "" || t.HTML == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "templates need a subject and html"})
+			return
+		}
+		t.Locale = locale
+		if err := t.Validate(); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		t.MerchantID = c.Param("merchantid")
+		t.Kind = kind
+		if err := db.Save(&t).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, t)
+	}
+}
+
+// ResetEmailTemplate drops the merchant's template so the default is used
+func ResetEmailTemplate(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		kind, ok := validEmailKind(c)
+		if !ok {
+			return
+		}
+		locale, ok := templateLocale(c)
+		if !ok {
+			return
+		}
+
+		if err := db.Where("merchant_id = ? AND kind = ? AND locale = ?", c.Param("merchantid"), kind, locale).
+			Delete(types.EmailTemplate{}).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, types.DefaultEmailTemplate(kind, locale))
+	}
+}
+
+func sampleEmailData(locale string) *types.EmailData {
+	trip := time.Date(2021, time.June, 1, 7, 0, 0, 0, timeloc)
+	return &types.EmailData{
+		Name:     "Jane Angler",
+		Email:    "jane@example.com",
+		Phone:    "555-555-1234",
+		OrderID:  "SAMPLE-ORDER",
+		Items:    []types.EmailItem{{Name: "Full Day Trip", Description: "Adult", Quantity: 2, Amount: "150.00"}},
+		Total:    "150.00",
+		PassLink: "https://example.com/passes",
+		PassType: types.T(locale, "passtype.boarding"),
+		Receipt:  "https://example.com/receipt",
+		GiftCards: []types.EmailGiftCard{
+			{Code: "GIFT-SAMPLE", Value: "50.00"},
+		},
+		Amount:        "75.00",
+		OldTrip:       "Full Day Trip, " + types.FormatDate(locale, trip, types.DateTime),
+		NewTrip:       "Full Day Trip, " + types.FormatDate(locale, trip.AddDate(0, 0, 7), types.DateTime),
+		Departure:     types.FormatDate(locale, trip.AddDate(0, 0, 7), types.DateTime),
+		DockLocation:  "Slip 12, Captree Boat Basin",
+		WeatherNotice: "Trips cancelled for weather are refunded in full.",
+		Locale:        locale,
+	}
+}
+
+// PreviewEmailTemplate renders a template against the merchant's most
+// recent order, or sample data if they don't have one yet. If no template
+// is posted the saved one (or the default) is previewed.
+func PreviewEmailTemplate(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		kind, ok := validEmailKind(c)
+		if !ok {
+			return
+		}
+		locale, ok := templateLocale(c)
+		if !ok {
+			return
+		}
+
+		var conf types.MerchantConfig
+		db.Find(&conf, "id = ?", c.Param("merchantid"))
+
+		var t types.EmailTemplate
+		if c.Request.ContentLength > 0 {
+			if err := c.ShouldBindJSON(&t); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+		}
+		if t.Subject == "" && t.HTML == "" && t.Text == "" {
+			t = types.LoadEmailTemplate(db, conf.ID, kind, locale)
+		}
+		t.Locale = locale
+
+		data := sampleEmailData(locale)
+		var o types.Order
+		db.Preload("Customer").Preload("Lines").Where("merchant_id = ?", conf.ID).
+			Order("created_at desc").First(&o)
+		if o.ID != "" {
+			data.OrderID = o.ID
+			data.Total = types.FormatMoney(types.ParseMoney(o.Total))
+			if o.Customer != nil {
+				data.Name, data.Email, data.Phone = o.Customer.Name, o.Customer.Email, o.Customer.Phone
+			}
+			data.Items = nil
+			var first *time.Time
+			for _, l := range o.Lines {
+				data.Items = append(data.Items, types.EmailItem{
+					Name: l.Name, Description: l.Description, Quantity: int(l.Quantity),
+					Amount: types.FormatMoney(types.ParseMoney(l.Amount))})
+				if l.Departure != nil && (first == nil || l.Departure.Before(*first)) {
+					first = l.Departure
+				}
+			}
+			if first != nil {
+				data.Departure = types.FormatDate(locale, first.In(timeloc), types.DateTime)
+			}
+		}
+		data.Merchant = conf.PassTitle
+		if conf.DockLocation != "" {
+			data.DockLocation = conf.DockLocation
+		}
+		if conf.WeatherNotice != "" {
+			data.WeatherNotice = conf.WeatherNotice
+		}
+		data.Content = template.HTML(conf.EmailContent)
+
+		out, err := t.Render(data)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, out)
+	}
+}
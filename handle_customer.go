@@ -1,8 +1,6 @@
 package main
 
 import (
-	"bytes"
-	"context"
 	"encoding/json"
 	"fmt"
 	"log"
@@ -10,137 +8,81 @@ import (
 	"os"
 	"regexp"
 	"strings"
-	"text/template"
 
 	"github.com/gin-gonic/gin"
 	"github.com/jinzhu/gorm"
-	"github.com/mailgun/mailgun-go/v4"
 	"github.com/zeroshade/tmsapi/internal"
+	"github.com/zeroshade/tmsapi/paypal"
 	"github.com/zeroshade/tmsapi/types"
 )
 
-var mailgunPublicKey = os.Getenv("MAILGUN_PUBLIC_KEY")
-var twilioAccountSid = os.Getenv("TWILIO_ACCOUNT_SID")
-var twilioAuthToken = os.Getenv("TWILIO_AUTH_TOKEN")
-var twilioMsgingService = os.Getenv("TWILIO_MSGING_SERVICE")
 var showSkuRe = regexp.MustCompile(`SHOW(\d+)([A-Z]+)`)
 
-func sendNotifyEmail(apiKey string, conf *types.MerchantConfig, order *types.CheckoutOrder) error {
-	log.Println("Send Notify Mail:", order.ID, conf.EmailFrom)
-	const tmpl = `
-	Tickets Purchased By: {{ .Payer.Name.GivenName }} {{ .Payer.Name.Surname }} <a href='mailto:{{ .Payer.Email }}'>{{ .Payer.Email }}</a>
-	<br /><br />
-	{{ range .PurchaseUnits -}}
-	<ul>
-	{{ range .Items -}}
-	<li>{{ .Quantity }} {{ .Name }}, {{ .Description }}</li>
-	{{- end }}
-	</ul>
-	{{- end }}`
-
-	t := template.Must(template.New("notify").Parse(tmpl))
-
-	// domain := strings.Split(conf.EmailFrom, "@")[1]
-	mg := mailgun.NewMailgun("mg.fishingreservationsystem.com", apiKey)
-	var tpl bytes.Buffer
-	if err := t.Execute(&tpl, order); err != nil {
-		return err
+// checkoutEmailData fills in the email template data for a paypal order
+func checkoutEmailData(order *types.CheckoutOrder) *types.EmailData {
+	data := &types.EmailData{
+		OrderID:  order.ID,
+		PassType: "boarding passes",
+	}
+	if order.Payer != nil {
+		data.Name = order.Payer.Name.GivenName + " " + order.Payer.Name.Surname
+		data.Email = order.Payer.Email
+		data.Phone = order.Payer.Phone.PhoneNumber.NationalNumber
 	}
-	subject := "Tickets Purchased"
-
-	m := mg.NewMessage("donotreply@fishingreservationsystem.com", subject, tpl.String(), fmt.Sprintf("%s <%s>", conf.EmailName, conf.EmailFrom))
-	m.SetHtml(tpl.String())
 
-	resp, id, err := mg.Send(context.Background(), m)
-	log.Println("Send Email: ", subject, conf.EmailName, conf.EmailFrom)
-	log.Println("Response: ", resp, id, err)
+	for _, pu := range order.PurchaseUnits {
+		data.Total = pu.Amount.Value
+		for _, item := range pu.Items {
+			if item.Sku == "SVCFEE" {
+				continue
+			}
+			if strings.HasPrefix(item.Sku, "SHOW") {
+				data.PassType = "tickets"
+			}
+			data.Items = append(data.Items, types.EmailItem{
+				Name:        item.Name,
+				Description: item.Description,
+				Quantity:    int(item.Quantity),
+				Amount:      item.Amount.Value,
+			})
+		}
+	}
+	return data
+}
 
-	// from := mail.NewEmail("Do Not Reply", "donotreply@websbyjoe.org")
-	// to := mail.NewEmail(conf.EmailName, conf.EmailFrom)
+func sendNotifyEmail(db *gorm.DB, conf *types.MerchantConfig, order *types.CheckoutOrder) error {
+	log.Println("Send Notify Mail:", order.ID, conf.EmailFrom)
 
-	// content := mail.NewContent("text/html", tpl.String())
+	msg, err := types.RenderEmail(db, conf, types.EmailNotify, checkoutEmailData(order))
+	if err != nil {
+		return err
+	}
 
-	// m := mail.NewV3MailInit(from, subject, to, content)
-	// request := sendgrid.GetRequest(apiKey, "/v3/mail/send", "https://api.sendgrid.com")
-	// request.Method = "POST"
-	// request.Body = mail.GetRequestBody(m)
-	// _, err := sendgrid.API(request)
-	// if err != nil {
-	// 	return err
-	// }
+	m := internal.NewMerchantMessage(conf, msg.Subject, msg.Text, msg.HTML, fmt.Sprintf("%s <%s>", conf.EmailName, conf.EmailFrom))
+	internal.SendEmail(db, conf, order.ID, types.EmailNotify, m)
 	return nil
 }
 
-func SendClientMail(apiKey, host, email string, order *types.CheckoutOrder, conf *types.MerchantConfig) (string, error) {
-	type TmplData struct {
-		Host          string
-		PurchaseUnits []types.PurchaseUnit
-		MerchantID    string
-		CheckoutID    string
-		DownloadType  string
-	}
+// SendClientMail emails the customer their passes link, a failed send is
+// only recorded in the notification log
+func SendClientMail(db *gorm.DB, host, email string, order *types.CheckoutOrder, conf *types.MerchantConfig) error {
+	data := checkoutEmailData(order)
+	data.Email = email
+	data.Locale = types.OrderLocale(db, conf, order.ID)
+	data.PassLink = fmt.Sprintf("https://%s/info/%s/passes/%s", host, order.PurchaseUnits[0].Payee.MerchantID, order.ID)
 
-	downloadType := "boarding passes"
-	if strings.HasPrefix(order.PurchaseUnits[0].Items[0].Sku, "SHOW") {
-		downloadType = "tickets"
+	msg, err := types.RenderEmail(db, conf, types.EmailPurchase, data)
+	if err != nil {
+		return err
 	}
 
-	const tmpl = `
-	<br /><br />
-	Tickets Ordered:<br/>
-	{{ range .PurchaseUnits -}}
-	<ul>
-	{{ range .Items -}}
-	{{- if ne .Sku "SVCFEE" }}
-	<li>{{ .Quantity }} {{ .Name }}, {{ .Description }}</li>
-	{{- end }}
-	{{- end }}
-	</ul>
-	{{- end }}
-	<br />
-	You can download your {{ .DownloadType }} here: <a href='https://{{.Host}}/info/{{.MerchantID}}/passes/{{.CheckoutID}}'>Click Here</a>
-	<br />`
-
 	log.Println("Send Client Mail:", conf.EmailFrom, email, order.ID)
-	domain := strings.Split(conf.EmailFrom, "@")[1]
-	if domain == "captreefishingticket.com" {
-		domain = "captree.com"
+	m := internal.NewMerchantMessage(conf, msg.Subject, msg.Text, msg.HTML, fmt.Sprintf("%s <%s>", data.Name, email))
+	if ics := types.OrderCalendar(db, conf, order.ID, data.PassLink); ics != nil {
+		m.Attach("trip.ics", ics)
 	}
-	mg := mailgun.NewMailgun("mg."+domain, apiKey)
-
-	t := template.Must(template.New("notify").Parse(tmpl))
-	var tpl bytes.Buffer
-	if err := t.Execute(&tpl, TmplData{
-		Host:          host,
-		PurchaseUnits: order.PurchaseUnits,
-		MerchantID:    order.PurchaseUnits[0].Payee.MerchantID,
-		DownloadType:  downloadType,
-		CheckoutID:    order.ID}); err != nil {
-		return "", err
-	}
-
-	subject := "Tickets Purchased"
-	m := mg.NewMessage(fmt.Sprintf("%s <%s>", conf.EmailName, conf.EmailFrom), subject, conf.EmailContent+tpl.String(), fmt.Sprintf("%s <%s>", order.Payer.Name.GivenName+" "+order.Payer.Name.Surname, email))
-	m.SetHtml(conf.EmailContent + tpl.String())
-
-	resp, id, err := mg.Send(context.Background(), m)
-	log.Println("Send Email: ", subject, order.Payer.Name.GivenName+" "+order.Payer.Name.Surname, email)
-	log.Println("Response: ", resp, id, err)
-	return resp, nil
-	// from := mail.NewEmail(conf.EmailName, conf.EmailFrom)
-	// to := mail.NewEmail(order.Payer.Name.GivenName+" "+order.Payer.Name.Surname, email)
-
-	// content := mail.NewContent("text/html", conf.EmailContent+tpl.String())
-
-	// m := mail.NewV3MailInit(from, subject, to, content)
-	// request := sendgrid.GetRequest(apiKey, "/v3/mail/send", "https://api.sendgrid.com")
-	// request.Method = "POST"
-	// request.Body = mail.GetRequestBody(m)
-	// response, err := sendgrid.API(request)
-	// if err != nil {
-	// 	return nil, err
-	// }
-	// return response, nil
+	internal.SendEmail(db, conf, order.ID, types.EmailPurchase, m)
+	return nil
 }
 
 func SendText(db *gorm.DB) gin.HandlerFunc {
@@ -183,9 +125,12 @@ func SendText(db *gorm.DB) gin.HandlerFunc {
 			db.Find(&conf)
 		}
 
-		// t := internal.NewTwilio(conf.TwilioAcctSID, conf.TwilioAcctToken, conf.TwilioFromNumber)
-		t := internal.NewDefaultTwilio()
-		t.Send(r.Phone, "Tickets Link: https://"+c.Request.Host+"/info/"+order.PurchaseUnits[0].Payee.MerchantID+"/passes/"+order.ID)
+		link := "https://" + c.Request.Host + "/info/" + order.PurchaseUnits[0].Payee.MerchantID + "/passes/" + order.ID
+		body := types.T(types.OrderLocale(db, &conf, order.ID), "sms.tickets_link", link)
+		if err := internal.SendSMS(db, &conf, order.ID, "tickets_link", r.Phone, body); err != nil {
+			c.JSON(http.StatusFailedDependency, gin.H{"error": err.Error()})
+			return
+		}
 	}
 }
 
@@ -195,8 +140,6 @@ func Resend(db *gorm.DB) gin.HandlerFunc {
 		Email      string `json:"email"`
 	}
 
-	// apiKey := os.Getenv("SENDGRID_API_KEY")
-	apiKey := os.Getenv("MAILGUN_API_KEY")
 	env := internal.SANDBOX
 	if strings.ToLower(os.Getenv("PAYPAL_ENV")) == "live" {
 		env = internal.LIVE
@@ -231,12 +174,10 @@ func Resend(db *gorm.DB) gin.HandlerFunc {
 			db.Find(&conf)
 		}
 
-		response, err := SendClientMail(apiKey, c.Request.Host, r.Email, &order, &conf)
-		if err != nil {
+		if err := SendClientMail(db, c.Request.Host, r.Email, &order, &conf); err != nil {
 			c.JSON(http.StatusFailedDependency, gin.H{"error": err.Error()})
 			return
 		}
-		log.Println("email response: ", response)
 
 		c.Status(http.StatusOK)
 	}
@@ -245,11 +186,9 @@ func Resend(db *gorm.DB) gin.HandlerFunc {
 func ConfirmAndSend(db *gorm.DB) gin.HandlerFunc {
 	type ConfReq struct {
 		CheckoutId string `json:"checkoutId"`
+		Locale     string `json:"locale"`
 	}
 
-	// apiKey := os.Getenv("SENDGRID_API_KEY")
-	apiKey := os.Getenv("MAILGUN_API_KEY")
-
 	env := internal.SANDBOX
 	if strings.ToLower(os.Getenv("PAYPAL_ENV")) == "live" {
 		env = internal.LIVE
@@ -316,19 +255,20 @@ func ConfirmAndSend(db *gorm.DB) gin.HandlerFunc {
 			db.Find(&conf)
 		}
 
-		response, err := SendClientMail(apiKey, c.Request.Host, order.Payer.Email, &order, &conf)
-		if err != nil {
+		if err := paypal.RecordOrder(db, conf.ID, &order); err != nil {
+			log.Println("Record Order Error:", err)
+		}
+		types.SetOrderLocale(db, order.ID, r.Locale)
+
+		if err := SendClientMail(db, c.Request.Host, order.Payer.Email, &order, &conf); err != nil {
 			c.JSON(http.StatusFailedDependency, gin.H{"error": err.Error()})
 			return
 		}
-		log.Println("email response: ", response)
 
-		sendNotifyEmail(apiKey, &conf, &order)
+		sendNotifyEmail(db, &conf, &order)
 
 		if conf.SendSMS {
-			// t := internal.NewTwilio(conf.TwilioAcctSID, conf.TwilioAcctToken, conf.TwilioFromNumber)
-			t := internal.NewDefaultTwilio()
-			t.Send(conf.NotifyNumber, "Tickets Purchased by "+order.Payer.Name.GivenName+" "+order.Payer.Name.Surname)
+			internal.SendSMS(db, &conf, order.ID, types.EmailNotify, conf.NotifyNumber, types.T(types.ResolveLocale(conf.Locale), "sms.purchased_by", order.Payer.Name.GivenName+" "+order.Payer.Name.Surname))
 		}
 
 		c.Status(http.StatusOK)
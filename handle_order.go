@@ -2,6 +2,7 @@ package main
 
 import (
 	"encoding/json"
+	"log"
 	"net/http"
 	"os"
 	"strings"
@@ -9,6 +10,7 @@ import (
 	"github.com/gin-gonic/gin"
 	"github.com/jinzhu/gorm"
 	"github.com/zeroshade/tmsapi/internal"
+	"github.com/zeroshade/tmsapi/paypal"
 	"github.com/zeroshade/tmsapi/types"
 )
 
@@ -31,8 +33,6 @@ type FailedCapture struct {
 	Links   []types.Link `json:"links"`
 }
 
-var apiKey = os.Getenv("MAILGUN_API_KEY")
-
 func AddOrderToDB(cr *CaptureResponse, tx *gorm.DB) *types.CheckoutOrder {
 	var order types.CheckoutOrder
 	order.ID = cr.ID
@@ -101,19 +101,20 @@ func CaptureOrder(db *gorm.DB) gin.HandlerFunc {
 				db.Find(&conf)
 			}
 
-			if err := sendNotifyEmail(apiKey, &conf, order); err != nil {
+			if err := paypal.RecordOrder(db, conf.ID, order); err != nil {
+				log.Println("Record Order Error:", err)
+			}
+
+			if err := sendNotifyEmail(db, &conf, order); err != nil {
 				c.JSON(http.StatusFailedDependency, gin.H{"error": err.Error()})
 				return
 			}
 
 			if conf.SendSMS {
-				// t := internal.NewTwilio(conf.TwilioAcctSID, conf.TwilioAcctToken, conf.TwilioFromNumber)
-				t := internal.NewDefaultTwilio()
-				t.Send(conf.NotifyNumber, "Tickets Purchased by "+order.Payer.Name.GivenName+" "+order.Payer.Name.Surname)
+				internal.SendSMS(db, &conf, order.ID, types.EmailNotify, conf.NotifyNumber, types.T(types.ResolveLocale(conf.Locale), "sms.purchased_by", order.Payer.Name.GivenName+" "+order.Payer.Name.Surname))
 			}
 
-			_, err := SendClientMail(apiKey, c.Request.Host, order.Payer.Email, order, &conf)
-			if err != nil {
+			if err := SendClientMail(db, c.Request.Host, order.Payer.Email, order, &conf); err != nil {
 				c.JSON(http.StatusFailedDependency, gin.H{"error": err.Error()})
 				return
 			}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"encoding/xml"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+	"github.com/zeroshade/tmsapi/internal"
+	"github.com/zeroshade/tmsapi/types"
+)
+
+func addInboxRoutes(router *gin.RouterGroup, db *gorm.DB) {
+	router.GET("/inbox", checkJWT(), ListConversations(db))
+	router.GET("/inbox/:phone", checkJWT(), GetConversation(db))
+	router.POST("/inbox/:phone", checkJWT(), logActionMiddle(db), ReplyConversation(db))
+}
+
+type conversation struct {
+	Phone         string    `json:"phone"`
+	LastBody      string    `json:"lastBody"`
+	LastDirection string    `json:"lastDirection"`
+	LastAt        time.Time `json:"lastAt"`
+	Unread        int       `json:"unread"`
+	OptedOut      bool      `json:"optedOut"`
+}
+
+// ListConversations is the merchant's inbox, newest conversation first
+func ListConversations(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var out []conversation
+		err := db.Raw(`SELECT m.phone, m.body AS last_body, m.direction AS last_direction, m.created_at AS last_at,
+			(SELECT count(*) FROM sms_messages u WHERE u.merchant_id = m.merchant_id AND u.phone = m.phone
+				AND u.direction = ? AND NOT u.read AND u.keyword = '') AS unread,
+			COALESCE(sc.opted_out, false) AS opted_out
+		FROM (SELECT DISTINCT ON (phone) * FROM sms_messages WHERE merchant_id = ? AND keyword = ''
+			ORDER BY phone, created_at DESC) m
+		LEFT JOIN sms_consents sc ON sc.phone = m.phone
+		ORDER BY m.created_at DESC`, types.SMSInbound, c.Param("merchantid")).Scan(&out).Error
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, out)
+	}
+}
+
+// GetConversation returns the messages with a number, marking the ones
+// they sent as read
+func GetConversation(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		phone, err := internal.NormalizePhone(c.Param("phone"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		scope := db.Model(&types.SMSMessage{}).Where("merchant_id = ? AND phone = ?", c.Param("merchantid"), phone)
+
+		var out []types.SMSMessage
+		if err := scope.Order("created_at").Find(&out).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		scope.Where("direction = ? AND NOT read", types.SMSInbound).Update("read", true)
+
+		c.JSON(http.StatusOK, gin.H{"phone": phone, "optedOut": types.SMSOptedOut(db, phone), "messages": out})
+	}
+}
+
+// ReplyConversation texts a number from the merchant on behalf of the
+// signed in staff member
+func ReplyConversation(db *gorm.DB) gin.HandlerFunc {
+	type replyReq struct {
+		Body string `json:"body"`
+	}
+
+	return func(c *gin.Context) {
+		var req replyReq
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if strings.TrimSpace(req.Body) == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "body is required"})
+			return
+		}
+
+		phone, err := internal.NormalizePhone(c.Param("phone"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		var conf types.MerchantConfig
+		db.Find(&conf, "id = ?", c.Param("merchantid"))
+
+		err = internal.SendSMS(db, &conf, "", "inbox_reply", phone, req.Body)
+		switch {
+		case err == types.ErrSMSOptedOut:
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		case err != nil:
+			c.JSON(http.StatusFailedDependency, gin.H{"error": err.Error()})
+			return
+		}
+
+		var sent types.Notification
+		db.Where("merchant_id = ? AND channel = ? AND recipient = ?", conf.ID, types.ChannelSMS, phone).
+			Order("id desc").First(&sent)
+
+		msg := types.SMSMessage{
+			MerchantID: conf.ID,
+			Phone:      phone,
+			Direction:  types.SMSOutbound,
+			Body:       req.Body,
+			ProviderID: sent.ProviderID,
+			StaffID:    c.GetString("user_id"),
+			Read:       true,
+		}
+		if err := db.Create(&msg).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, msg)
+	}
+}
+
+// ListUnassigned is the texts that couldn't be matched to a merchant, for
+// platform admins to sort out
+func ListUnassigned(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !c.GetBool("admin") {
+			c.JSON(http.StatusForbidden, gin.H{"error": "only admins can see unassigned messages"})
+			return
+		}
+
+		var out []types.SMSMessage
+		err := db.Where("merchant_id = '' AND direction = ? AND keyword = ''", types.SMSInbound).
+			Order("created_at DESC").Find(&out).Error
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, out)
+	}
+}
+
+// AssignMessage moves an unassigned text, and any others from the same
+// number, into a merchant's inbox
+func AssignMessage(db *gorm.DB) gin.HandlerFunc {
+	type assignReq struct {
+		MerchantID string `json:"merchantId"`
+	}
+
+	return func(c *gin.Context) {
+		if !c.GetBool("admin") {
+			c.JSON(http.StatusForbidden, gin.H{"error": "only admins can assign messages"})
+			return
+		}
+
+		var req assignReq
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		var conf types.MerchantConfig
+		if db.Find(&conf, "id = ?", req.MerchantID).RecordNotFound() {
+			c.JSON(http.StatusNotFound, gin.H{"error": "merchant not found"})
+			return
+		}
+
+		var msg types.SMSMessage
+		if db.Where("id = ? AND merchant_id = ''", c.Param("id")).First(&msg).RecordNotFound() {
+			c.JSON(http.StatusNotFound, gin.H{"error": "message not found"})
+			return
+		}
+
+		err := db.Model(&types.SMSMessage{}).Where("merchant_id = '' AND phone = ?", msg.Phone).
+			Update("merchant_id", conf.ID).Error
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.Status(http.StatusOK)
+	}
+}
+
+type twimlResponse struct {
+	XMLName xml.Name `xml:"Response"`
+	Message string   `xml:"Message,omitempty"`
+}
+
+// inboundMerchant works out who a text was meant for. A merchant's own
+// number is theirs, otherwise it's a reply on the shared platform number so
+// it goes to whoever last texted them.
+func inboundMerchant(db *gorm.DB, to, from string) (conf types.MerchantConfig, own bool) {
+	var owners []types.MerchantConfig
+	db.Where("twilio_from_number <> ''").Find(&owners)
+	for _, m := range owners {
+		if num, err := internal.NormalizePhone(m.TwilioFromNumber); err == nil && num == to {
+			return m, true
+		}
+	}
+
+	var last types.Notification
+	db.Where("channel = ? AND recipient = ?", types.ChannelSMS, from).Order("id desc").First(&last)
+	if last.MerchantID != "" {
+		db.Find(&conf, "id = ?", last.MerchantID)
+	}
+	return conf, false
+}
+
+// TwilioInboundWebhook takes texts sent to our numbers. STOP and START
+// replies change whether the number can be texted at all, anything else
+// lands in the merchant's inbox.
+func TwilioInboundWebhook(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if err := c.Request.ParseForm(); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		form := c.Request.PostForm
+
+		from, err := internal.NormalizePhone(form.Get("From"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		to, _ := internal.NormalizePhone(form.Get("To"))
+
+		conf, own := inboundMerchant(db, to, from)
+		token := internal.TwilioAuthToken(nil)
+		if own {
+			token = internal.TwilioAuthToken(&conf)
+		}
+		if !internal.ValidTwilioSignature(token, internal.TwilioInboundURL, form, c.GetHeader("X-Twilio-Signature")) {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid signature"})
+			return
+		}
+
+		body := form.Get("Body")
+		msg := types.SMSMessage{
+			MerchantID: conf.ID,
+			Phone:      from,
+			Direction:  types.SMSInbound,
+			Body:       body,
+			Keyword:    types.SMSKeyword(body),
+			ProviderID: form.Get("MessageSid"),
+		}
+		if err := db.Create(&msg).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if conf.ID == "" && msg.Keyword == "" {
+			// no merchant has texted them, it waits in the unassigned inbox
+			// for an admin to hand it to the right merchant
+			log.Println("Unassigned SMS:", msg.ID, from, to)
+		}
+
+		var resp twimlResponse
+		switch msg.Keyword {
+		case types.KeywordStop:
+			err = types.SetSMSConsent(db, from, true, strings.ToUpper(strings.TrimSpace(body)))
+		case types.KeywordStart:
+			err = types.SetSMSConsent(db, from, false, strings.ToUpper(strings.TrimSpace(body)))
+		case types.KeywordHelp:
+			if conf.ID != "" {
+				resp.Message = types.T(types.ResolveLocale(conf.Locale), "sms.help", conf.PassTitle, conf.EmailFrom)
+			}
+		}
+		if err != nil {
+			log.Println("SMS Consent Error:", from, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.XML(http.StatusOK, resp)
+	}
+}
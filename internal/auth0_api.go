@@ -129,16 +129,21 @@ func (a *Auth0Client) GetRole(role string) *Role {
 	return &roles[0]
 }
 
-func (a *Auth0Client) GetUserByID(userid string) *User {
-	res, _ := a.client.Get(Audience + "users/" + userid)
+func (a *Auth0Client) GetUserByID(userid string) (*User, error) {
+	res, err := a.client.Get(Audience + "users/" + url.PathEscape(userid))
+	if err != nil {
+		return nil, err
+	}
 	defer res.Body.Close()
-	dec := json.NewDecoder(res.Body)
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("auth0 user lookup: %s", res.Status)
+	}
 
 	u := &User{}
-	if err := dec.Decode(u); err != nil {
-		log.Println("Failed to decode user: ", err)
+	if err := json.NewDecoder(res.Body).Decode(u); err != nil {
+		return nil, err
 	}
-	return u
+	return u, nil
 }
 
 func (a *Auth0Client) GetUsersByRole(role string) []*User {
@@ -161,7 +166,11 @@ func (a *Auth0Client) GetUsersByRole(role string) []*User {
 
 	ret := make([]*User, 0, len(users))
 	for _, i := range users {
-		user := a.GetUserByID(i.UserID)
+		user, err := a.GetUserByID(i.UserID)
+		if err != nil {
+			log.Println("Failed to get user: ", i.UserID, err)
+			continue
+		}
 		if user.AppMetadata == nil {
 			user.AppMetadata = make(map[string]json.RawMessage)
 		}
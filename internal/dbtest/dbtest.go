@@ -0,0 +1,273 @@
+// Package dbtest is a scripted database/sql driver for testing code that
+// talks to postgres through gorm without a server. Queries get whatever rows
+// were set up for them and every statement is kept for checking afterwards.
+package dbtest
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/jinzhu/gorm"
+	_ "github.com/jinzhu/gorm/dialects/postgres"
+)
+
+// Stmt is a statement that was run along with its arguments
+type Stmt struct {
+	Query string
+	Args  []driver.Value
+}
+
+type response struct {
+	match    string
+	cols     []string
+	rows     [][]driver.Value
+	affected int64
+	err      error
+}
+
+// DB is the script and record of one test's database
+type DB struct {
+	mu        sync.Mutex
+	stmts     []Stmt
+	responses []*response
+}
+
+var (
+	registry = map[string]*DB{}
+	regMu    sync.Mutex
+	regOnce  sync.Once
+)
+
+// Open returns a gorm handle backed by a new script
+func Open(t testing.TB) (*gorm.DB, *DB) {
+	regOnce.Do(func() { sql.Register("dbtest", drv{}) })
+
+	d := &DB{}
+	regMu.Lock()
+	name := fmt.Sprintf("%s-%d", t.Name(), len(registry))
+	registry[name] = d
+	regMu.Unlock()
+
+	sqlDB, err := sql.Open("dbtest", name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := gorm.Open("postgres", sqlDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.LogMode(false)
+	t.Cleanup(func() { db.Close() })
+	return db, d
+}
+
+// Returns answers queries containing match with the rows given, the most
+// recently added match wins. Each row has a value for each column.
+func (d *DB) Returns(match string, cols []string, rows ...[]interface{}) {
+	r := &response{match: match, cols: cols}
+	for _, row := range rows {
+		vals := make([]driver.Value, len(row))
+		for idx, v := range row {
+			vals[idx] = v
+		}
+		r.rows = append(r.rows, vals)
+	}
+	d.add(r)
+}
+
+// Affects sets how many rows statements containing match report changing
+func (d *DB) Affects(match string, n int64) {
+	d.add(&response{match: match, affected: n})
+}
+
+// Fails makes statements containing match return err
+func (d *DB) Fails(match string, err error) {
+	d.add(&response{match: match, err: err})
+}
+
+func (d *DB) add(r *response) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.responses = append(d.responses, r)
+}
+
+// Statements returns every statement run so far containing match
+func (d *DB) Statements(match string) []Stmt {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var out []Stmt
+	for _, s := range d.stmts {
+		if strings.Contains(s.Query, match) {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+var setRe = regexp.MustCompile(`"(\w+)" = \$(\d+)`)
+
+// Value returns what an INSERT or UPDATE wrote to the column
+func (s Stmt) Value(col string) (driver.Value, bool) {
+	if m := insertRe.FindStringSubmatch(s.Query); m != nil {
+		for idx, c := range strings.Split(m[1], ",") {
+			if strings.Trim(c, `" `) == col && idx < len(s.Args) {
+				return s.Args[idx], true
+			}
+		}
+		return nil, false
+	}
+	for _, m := range setRe.FindAllStringSubmatch(s.Query, -1) {
+		if n, _ := strconv.Atoi(m[2]); m[1] == col && n > 0 && n <= len(s.Args) {
+			return s.Args[n-1], true
+		}
+	}
+	return nil, false
+}
+
+func (d *DB) run(query string, args []driver.Value) *response {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.stmts = append(d.stmts, Stmt{query, args})
+	for idx := len(d.responses) - 1; idx >= 0; idx-- {
+		if strings.Contains(query, d.responses[idx].match) {
+			return d.responses[idx]
+		}
+	}
+	return nil
+}
+
+var (
+	insertRe    = regexp.MustCompile(`^INSERT[^(]*\(([^)]*)\)`)
+	returningRe = regexp.MustCompile(`RETURNING "[^"]*"\."([^"]*)"`)
+)
+
+// defaultRows stands in for a query with nothing set up: counts are zero,
+// inserts hand back their key and anything else finds nothing
+func defaultRows(query string, args []driver.Value) *response {
+	switch {
+	case strings.HasPrefix(query, "SELECT count"):
+		return &response{cols: []string{"count"}, rows: [][]driver.Value{{int64(0)}}}
+	case strings.HasPrefix(query, "INSERT"):
+		m := returningRe.FindStringSubmatch(query)
+		if m == nil {
+			return &response{}
+		}
+		var key driver.Value = int64(1)
+		if cols := insertRe.FindStringSubmatch(query); cols != nil {
+			for idx, c := range strings.Split(cols[1], ",") {
+				if strings.Trim(c, `" `) == m[1] && idx < len(args) {
+					key = args[idx]
+				}
+			}
+		}
+		return &response{cols: []string{m[1]}, rows: [][]driver.Value{{key}}}
+	}
+	return &response{}
+}
+
+type drv struct{}
+
+func (drv) Open(name string) (driver.Conn, error) {
+	regMu.Lock()
+	defer regMu.Unlock()
+	d, ok := registry[name]
+	if !ok {
+		return nil, fmt.Errorf("dbtest: unknown database %q", name)
+	}
+	return &conn{d}, nil
+}
+
+type conn struct{ d *DB }
+
+func (c *conn) Prepare(query string) (driver.Stmt, error) { return &stmt{c, query}, nil }
+func (c *conn) Close() error                              { return nil }
+func (c *conn) Begin() (driver.Tx, error)                 { return tx{}, nil }
+
+func (c *conn) ExecContext(_ context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	r := c.d.run(query, values(args))
+	if r == nil {
+		return driver.RowsAffected(1), nil
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	if r.cols != nil {
+		return driver.RowsAffected(len(r.rows)), nil
+	}
+	return driver.RowsAffected(r.affected), nil
+}
+
+func (c *conn) QueryContext(_ context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	vals := values(args)
+	r := c.d.run(query, vals)
+	if r == nil {
+		r = defaultRows(query, vals)
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	return &rows{cols: r.cols, data: r.rows}, nil
+}
+
+func values(args []driver.NamedValue) []driver.Value {
+	out := make([]driver.Value, len(args))
+	for idx, a := range args {
+		out[idx] = a.Value
+	}
+	return out
+}
+
+type stmt struct {
+	c     *conn
+	query string
+}
+
+func (s *stmt) Close() error  { return nil }
+func (s *stmt) NumInput() int { return -1 }
+
+func (s *stmt) Exec(args []driver.Value) (driver.Result, error) {
+	return s.c.ExecContext(context.Background(), s.query, named(args))
+}
+
+func (s *stmt) Query(args []driver.Value) (driver.Rows, error) {
+	return s.c.QueryContext(context.Background(), s.query, named(args))
+}
+
+func named(args []driver.Value) []driver.NamedValue {
+	out := make([]driver.NamedValue, len(args))
+	for idx, a := range args {
+		out[idx] = driver.NamedValue{Ordinal: idx + 1, Value: a}
+	}
+	return out
+}
+
+type tx struct{}
+
+func (tx) Commit() error   { return nil }
+func (tx) Rollback() error { return nil }
+
+type rows struct {
+	cols []string
+	data [][]driver.Value
+	pos  int
+}
+
+func (r *rows) Columns() []string { return r.cols }
+func (r *rows) Close() error      { return nil }
+
+func (r *rows) Next(dest []driver.Value) error {
+	if r.pos >= len(r.data) {
+		return io.EOF
+	}
+	copy(dest, r.data[r.pos])
+	r.pos++
+	return nil
+}
@@ -24,7 +24,7 @@ const spaceBetween = 15
 var skuRe = regexp.MustCompile(`(\d+)([A-Z]+)(\d{10})\d*`)
 var showSkuRe = regexp.MustCompile(`SHOW(\d+)([A-Z]+)`)
 
-func drawShowTicket(f *gofpdf.Fpdf, logoInfo *gofpdf.ImageInfoType, show *types.Show, item types.PassItem, passTitle string, name, tkt, qrname string) {
+func drawShowTicket(f *gofpdf.Fpdf, tr func(string) string, locale string, logoInfo *gofpdf.ImageInfoType, show *types.Show, item types.PassItem, passTitle string, name, tkt, qrname string) {
 	// fmt.Println(item, passTitle, name, tkt, qrname)
 	var opt gofpdf.ImageOptions
 	opt.ImageType = "png"
@@ -49,7 +49,7 @@ func drawShowTicket(f *gofpdf.Fpdf, logoInfo *gofpdf.ImageInfoType, show *types.
 	f.SetX(left)
 	f.SetFont("Courier", "B", 18)
 	f.SetTextColor(255, 255, 255)
-	f.CellFormat(205, 7, passTitle, "B", 1, "C", true, 0, "")
+	f.CellFormat(205, 7, tr(passTitle), "B", 1, "C", true, 0, "")
 
 	const logoHeight = 25
 	newWidth := (logoHeight / logoInfo.Height()) * logoInfo.Width()
@@ -59,25 +59,25 @@ func drawShowTicket(f *gofpdf.Fpdf, logoInfo *gofpdf.ImageInfoType, show *types.
 	f.SetFont("Courier", "BU", 14)
 	f.SetXY(left, starty+logoHeight+2)
 
-	f.CellFormat(20, 7, "Name:", "", 0, "L", false, 0, "")
+	f.CellFormat(20, 7, tr(types.T(locale, "pass.name")), "", 0, "L", false, 0, "")
 	f.SetFontStyle("")
-	f.Cell(50, 7, name)
+	f.Cell(50, 7, tr(name))
 	f.Ln(15)
 
 	f.SetX(left)
 	f.SetFontStyle("BU")
-	f.CellFormat(20, 7, "Item:", "", 1, "L", false, 0, "")
+	f.CellFormat(20, 7, tr(types.T(locale, "pass.item")), "", 1, "L", false, 0, "")
 	f.SetFontStyle("")
-	f.Cell(50, 7, item.GetName())
+	f.Cell(50, 7, tr(item.GetName()))
 	f.Ln(7)
 	start, end, _ := show.GetDates()
-	f.Cell(50, 7, fmt.Sprintf("%s - %s", start.Format("Jan _2"), end.Format("Jan _2, '06")))
+	f.Cell(50, 7, tr(fmt.Sprintf("%s - %s", types.FormatDate(locale, start, types.DateShort), types.FormatDate(locale, end, types.DateShortYear))))
 
 	f.SetXY(left+125, starty+logoHeight+2)
 	f.SetFontStyle("BU")
-	f.CellFormat(20, 7, "Price:", "", 0, "L", false, 0, "")
+	f.CellFormat(20, 7, tr(types.T(locale, "pass.price")), "", 0, "L", false, 0, "")
 	f.SetFontStyle("")
-	f.Cell(20, 7, item.GetAmount())
+	f.Cell(20, 7, types.FormatCurrency(locale, types.ParseMoney(item.GetAmount())))
 
 	f.Ln(8)
 	f.Image(qrname, left+122, starty+logoHeight+8, 30, 0, false, "", 0, "")
@@ -90,7 +90,7 @@ func drawShowTicket(f *gofpdf.Fpdf, logoInfo *gofpdf.ImageInfoType, show *types.
 	f.SetXY(0, starty+passHeight+spaceBetween)
 }
 
-func drawPass(f *gofpdf.Fpdf, item types.PassItem, passTitle string, boat *types.Boat, name, tkt, qrname string) {
+func drawPass(f *gofpdf.Fpdf, tr func(string) string, locale string, item types.PassItem, passTitle string, boat *types.Boat, name, tkt, qrname string) {
 	// fmt.Println(item, passTitle, *boat, name, tkt, qrname)
 
 	var opt gofpdf.ImageOptions
@@ -116,14 +116,14 @@ func drawPass(f *gofpdf.Fpdf, item types.PassItem, passTitle string, boat *types
 	f.SetX(left)
 	f.SetFont("Courier", "B", 18)
 	f.SetTextColor(255, 255, 255)
-	f.CellFormat(205, 7, passTitle, "B", 1, "C", true, 0, "")
+	f.CellFormat(205, 7, tr(passTitle), "B", 1, "C", true, 0, "")
 
 	f.SetTextColor(0, 0, 0)
 	f.SetFont("Courier", "B", 16)
 	f.SetX(left)
-	f.Cell(40, 7, "Boarding Pass")
+	f.Cell(40, 7, tr(types.T(locale, "pass.boarding")))
 	f.SetX(-53)
-	f.Cell(40, 7, tkt+" Ticket")
+	f.Cell(40, 7, tr(types.T(locale, "pass.ticket", tkt)))
 
 	f.Ln(-1)
 	f.SetFont("Courier", "B", 16)
@@ -135,16 +135,16 @@ func drawPass(f *gofpdf.Fpdf, item types.PassItem, passTitle string, boat *types
 	f.Ln(-1)
 	f.SetFont("Courier", "B", 14)
 	f.SetX(left)
-	f.Cell(40, 7, "Trip:")
+	f.Cell(40, 7, tr(types.T(locale, "pass.trip")))
 	f.SetFont("Courier", "", 14)
-	f.Cell(100, 7, item.GetDesc())
+	f.Cell(100, 7, tr(item.GetDesc()))
 
 	f.Ln(15)
 	f.SetX(left)
 	f.SetFont("Courier", "B", 14)
-	f.Cell(40, 7, "Purchased By:")
+	f.Cell(40, 7, tr(types.T(locale, "pass.purchased_by")))
 	f.SetFont("Courier", "", 14)
-	f.Cell(50, 7, name)
+	f.Cell(50, 7, tr(name))
 
 	f.Ln(20)
 	f.SetFont("Courier", "I", 8)
@@ -155,12 +155,16 @@ func drawPass(f *gofpdf.Fpdf, item types.PassItem, passTitle string, boat *types
 	f.SetXY(0, starty+passHeight+spaceBetween)
 }
 
-func GeneratePdf(db *gorm.DB, items []types.PassItem, passTitle, name, email string, w io.Writer) {
+// GeneratePdf draws the passes for the items with their labels and dates in
+// the locale
+func GeneratePdf(db *gorm.DB, items []types.PassItem, passTitle, name, email, locale string, w io.Writer) {
 	var opt gofpdf.ImageOptions
 	opt.ImageType = "png"
 
 	pdf := gofpdf.New("P", "mm", "Letter", ".")
-	pdf.SetTitle("Passes", false)
+	pdf.SetTitle(types.T(locale, "pass.title"), true)
+	// the core fonts are cp1252, so accented labels need translating
+	tr := pdf.UnicodeTranslatorFromDescriptor("")
 
 	for _, i := range items {
 		if i.GetSku() == "SVCFEE" {
@@ -197,7 +201,7 @@ func GeneratePdf(db *gorm.DB, items []types.PassItem, passTitle, name, email str
 				qrname := fmt.Sprintf("%s-%s-%d", i.GetID(), i.GetSku(), n)
 				data, _ := qrcode.Encode(qrname, qrcode.High, 50)
 				pdf.RegisterImageOptionsReader(qrname, opt, bytes.NewReader(data))
-				drawShowTicket(pdf, logoInfo, &show, i, passTitle, name, strings.ToTitle(skuPieces[0][2]), qrname)
+				drawShowTicket(pdf, tr, locale, logoInfo, &show, i, passTitle, name, strings.ToTitle(skuPieces[0][2]), qrname)
 			}
 			continue
 		}
@@ -219,7 +223,7 @@ func GeneratePdf(db *gorm.DB, items []types.PassItem, passTitle, name, email str
 			qrname := fmt.Sprintf("%s-%s-%d", i.GetID(), i.GetSku(), n)
 			data, _ := qrcode.Encode(qrname, qrcode.High, 50)
 			pdf.RegisterImageOptionsReader(qrname, opt, bytes.NewReader(data))
-			drawPass(pdf, i, passTitle, prod.Boat, name, tkt, qrname)
+			drawPass(pdf, tr, locale, i, passTitle, prod.Boat, name, tkt, qrname)
 		}
 	}
 	pdf.Output(w)
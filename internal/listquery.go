@@ -0,0 +1,260 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+)
+
+const defaultMaxPerPage = 500
+
+// ListSpec describes what a list endpoint lets callers sort and filter by.
+// The keys of Sortable and Filterable are the names used by the API and the
+// values are the sql columns they map to, anything else is rejected so
+// request values never end up in the query text. DefaultSort is a list of
+// columns that has to end in a unique key for cursors to work.
+type ListSpec struct {
+	Sortable    map[string]string
+	Filterable  map[string]string
+	DefaultSort string
+	MaxPerPage  uint
+}
+
+// ListParams are the paging, sorting and filtering options from a request.
+// Callers can page with either Page or the opaque Cursor returned by a
+// previous request.
+type ListParams struct {
+	Page     uint              `json:"page" form:"page"`
+	PerPage  uint              `json:"perPage" form:"perPage"`
+	Cursor   string            `json:"cursor" form:"cursor"`
+	SortBy   []string          `json:"sortBy" form:"sortBy"`
+	SortDesc []bool            `json:"sortDesc" form:"sortDesc"`
+	Filters  map[string]string `json:"filters" form:"-"`
+}
+
+// ListResult holds the total number of matching rows and the cursor for the
+// page after this one, if there is one
+type ListResult struct {
+	Total      uint   `json:"total"`
+	NextCursor string `json:"nextCursor,omitempty"`
+}
+
+// SetHeaders adds the total and next cursor to the response headers, for
+// endpoints that return a bare array
+func (r ListResult) SetHeaders(c *gin.Context) {
+	c.Header("X-Total-Count", strconv.Itoa(int(r.Total)))
+	if r.NextCursor != "" {
+		c.Header("X-Next-Cursor", r.NextCursor)
+	}
+}
+
+// BindListQuery reads list options from the query string. Any other query
+// parameter matching a filterable name of the spec is used as a filter.
+func BindListQuery(c *gin.Context, spec *ListSpec) (ListParams, error) {
+	var p ListParams
+	if err := c.ShouldBindQuery(&p); err != nil {
+		return p, err
+	}
+
+	p.Filters = make(map[string]string)
+	for name := range spec.Filterable {
+		if v, ok := c.GetQuery(name); ok {
+			p.Filters[name] = v
+		}
+	}
+	return p, nil
+}
+
+// sortCol is one column of a list's ordering
+type sortCol struct {
+	col  string
+	desc bool
+}
+
+// ordering is the requested sort followed by the spec's default, which
+// should end in a unique key so every row has a fixed place in the list
+func (s *ListSpec) ordering(p ListParams) ([]sortCol, error) {
+	var out []sortCol
+	for idx, name := range p.SortBy {
+		col, ok := s.Sortable[name]
+		if !ok {
+			return nil, fmt.Errorf("cannot sort by %q", name)
+		}
+		out = append(out, sortCol{col, idx < len(p.SortDesc) && p.SortDesc[idx]})
+	}
+
+	for _, part := range strings.Split(s.DefaultSort, ",") {
+		fields := strings.Fields(part)
+		if len(fields) == 0 {
+			continue
+		}
+		out = append(out, sortCol{fields[0], len(fields) > 1 && strings.EqualFold(fields[1], "desc")})
+	}
+	return out, nil
+}
+
+// encodeCursor holds the sort values of the last row of a page, the next
+// page starts with whatever comes after it
+func encodeCursor(vals []interface{}) (string, error) {
+	for idx, v := range vals {
+		if b, ok := v.([]byte); ok {
+			vals[idx] = string(b)
+		}
+	}
+	data, err := json.Marshal(vals)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+func decodeCursor(cursor string, n int) ([]interface{}, error) {
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+
+	var vals []interface{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(&vals); err != nil || len(vals) != n {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+	return vals, nil
+}
+
+// after limits scope to the rows that sort after the cursor values. Postgres
+// puts nulls last going up and first going down.
+func after(scope *gorm.DB, order []sortCol, vals []interface{}) *gorm.DB {
+	var conds []string
+	var args []interface{}
+	var eq []string
+	var eqArgs []interface{}
+	for idx, s := range order {
+		var cond string
+		var condArgs []interface{}
+		switch {
+		case vals[idx] == nil && s.desc:
+			cond = s.col + " IS NOT NULL"
+		case vals[idx] == nil:
+			cond = "FALSE"
+		case s.desc:
+			cond, condArgs = s.col+" < ?", []interface{}{vals[idx]}
+		default:
+			cond, condArgs = "("+s.col+" > ? OR "+s.col+" IS NULL)", []interface{}{vals[idx]}
+		}
+
+		conds = append(conds, "("+strings.Join(append(append([]string{}, eq...), cond), " AND ")+")")
+		args = append(append(args, eqArgs...), condArgs...)
+
+		if vals[idx] == nil {
+			eq = append(eq, s.col+" IS NULL")
+		} else {
+			eq = append(eq, s.col+" = ?")
+			eqArgs = append(eqArgs, vals[idx])
+		}
+	}
+	return scope.Where(strings.Join(conds, " OR "), args...)
+}
+
+// Apply checks p against the spec, counts the matching rows of scope and
+// returns scope with the filters, ordering and paging added. A cursor pages
+// by the sort values of the last row seen, so rows added or removed earlier
+// in the list don't shift the page.
+func (s *ListSpec) Apply(scope *gorm.DB, p ListParams) (*gorm.DB, ListResult, error) {
+	var res ListResult
+
+	for name, val := range p.Filters {
+		col, ok := s.Filterable[name]
+		if !ok {
+			return nil, res, fmt.Errorf("cannot filter by %q", name)
+		}
+		scope = scope.Where(col+" = ?", val)
+	}
+
+	if err := scope.Count(&res.Total).Error; err != nil {
+		return nil, res, err
+	}
+
+	order, err := s.ordering(p)
+	if err != nil {
+		return nil, res, err
+	}
+	for _, o := range order {
+		if o.desc {
+			scope = scope.Order(o.col + " desc")
+		} else {
+			scope = scope.Order(o.col)
+		}
+	}
+
+	if p.PerPage == 0 {
+		return scope, res, nil
+	}
+
+	max := s.MaxPerPage
+	if max == 0 {
+		max = defaultMaxPerPage
+	}
+	if p.PerPage > max {
+		p.PerPage = max
+	}
+
+	var offset uint
+	switch {
+	case p.Cursor != "":
+		vals, err := decodeCursor(p.Cursor, len(order))
+		if err != nil {
+			return nil, res, err
+		}
+		scope = after(scope, order, vals)
+	case p.Page > 1:
+		offset = (p.Page - 1) * p.PerPage
+	}
+
+	if res.NextCursor, err = s.nextCursor(scope, order, offset+p.PerPage-1); err != nil {
+		return nil, res, err
+	}
+	return scope.Offset(offset).Limit(p.PerPage), res, nil
+}
+
+// nextCursor reads the sort values of the last row on the page, leaving it
+// empty when nothing comes after that row
+func (s *ListSpec) nextCursor(scope *gorm.DB, order []sortCol, last uint) (string, error) {
+	cols := make([]string, len(order))
+	for idx, o := range order {
+		cols[idx] = o.col
+	}
+
+	rows, err := scope.Select(strings.Join(cols, ", ")).Offset(last).Limit(2).Rows()
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+
+	var vals []interface{}
+	n := 0
+	for rows.Next() {
+		if n++; n > 1 {
+			break
+		}
+		vals = make([]interface{}, len(cols))
+		ptrs := make([]interface{}, len(cols))
+		for idx := range vals {
+			ptrs[idx] = &vals[idx]
+		}
+		if err := rows.Scan(ptrs...); err != nil {
+			return "", err
+		}
+	}
+	if n < 2 {
+		return "", rows.Err()
+	}
+	return encodeCursor(vals)
+}
@@ -0,0 +1,121 @@
+package internal
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/zeroshade/tmsapi/internal/dbtest"
+)
+
+type note struct {
+	ID        uint
+	CreatedAt time.Time
+	Status    string
+}
+
+var noteList = &ListSpec{
+	Sortable:    map[string]string{"created": "created_at", "status": "status"},
+	Filterable:  map[string]string{"status": "status"},
+	DefaultSort: "created_at DESC, id DESC",
+	MaxPerPage:  50,
+}
+
+// page runs the query Apply built, returning its statement
+func page(t *testing.T, d *dbtest.DB, scope *gorm.DB) dbtest.Stmt {
+	t.Helper()
+	var notes []note
+	if err := scope.Find(&notes).Error; err != nil {
+		t.Fatal(err)
+	}
+	stmts := d.Statements(`SELECT * FROM "notes"`)
+	if len(stmts) != 1 {
+		t.Fatalf("ran %d page queries", len(stmts))
+	}
+	return stmts[0]
+}
+
+func TestListApplyRejects(t *testing.T) {
+	db, _ := dbtest.Open(t)
+	tests := []ListParams{
+		{Filters: map[string]string{"recipient": "x"}},
+		{SortBy: []string{"created_at; DROP TABLE notes"}},
+		{PerPage: 10, Cursor: "not a cursor"},
+		{PerPage: 10, Cursor: "WyJhIl0"}, // ["a"], one value for two sort columns
+	}
+	for _, p := range tests {
+		if _, _, err := noteList.Apply(db.Model(&note{}), p); err == nil {
+			t.Errorf("Apply(%+v) accepted", p)
+		}
+	}
+}
+
+func TestListApplyOrderAndPage(t *testing.T) {
+	db, d := dbtest.Open(t)
+	d.Returns(`SELECT count(*) FROM "notes"`, []string{"count"}, []interface{}{int64(42)})
+
+	p := ListParams{Page: 3, PerPage: 500, SortBy: []string{"status"}, Filters: map[string]string{"status": "sent"}}
+	scope, res, err := noteList.Apply(db.Model(&note{}), p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Total != 42 {
+		t.Errorf("Total = %d", res.Total)
+	}
+
+	s := page(t, d, scope)
+	for _, want := range []string{"(status = $1)", `ORDER BY "status",created_at desc,id desc`, "LIMIT 50 OFFSET 100"} {
+		if !strings.Contains(s.Query, want) {
+			t.Errorf("query %q is missing %q", s.Query, want)
+		}
+	}
+	if res.NextCursor != "" {
+		t.Errorf("NextCursor = %q with nothing after the page", res.NextCursor)
+	}
+}
+
+func TestListApplyCursor(t *testing.T) {
+	db, d := dbtest.Open(t)
+	stamp := time.Date(2024, 6, 1, 12, 30, 0, 0, time.UTC)
+	d.Returns(`SELECT created_at, id FROM "notes"`, []string{"created_at", "id"},
+		[]interface{}{stamp, int64(17)}, []interface{}{stamp, int64(16)})
+
+	_, res, err := noteList.Apply(db.Model(&note{}), ListParams{PerPage: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.NextCursor == "" {
+		t.Fatal("no cursor with rows after the page")
+	}
+	if q := d.Statements(`SELECT created_at, id FROM "notes"`)[0].Query; !strings.Contains(q, "LIMIT 2 OFFSET 9") {
+		t.Errorf("cursor row query %q", q)
+	}
+
+	scope, _, err := noteList.Apply(db.Model(&note{}), ListParams{PerPage: 10, Cursor: res.NextCursor})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := page(t, d, scope)
+	if !strings.Contains(s.Query, "WHERE ((created_at < $1) OR (created_at = $2 AND id < $3))") ||
+		!strings.Contains(s.Query, "LIMIT 10 OFFSET 0") {
+		t.Errorf("query %q doesn't start after the cursor", s.Query)
+	}
+	if len(s.Args) != 3 || s.Args[0] != stamp.Format(time.RFC3339Nano) || s.Args[2] != "17" {
+		t.Errorf("args = %v", s.Args)
+	}
+}
+
+func TestListAfterNulls(t *testing.T) {
+	db, d := dbtest.Open(t)
+	order := []sortCol{{"status", false}, {"created_at", true}, {"id", false}}
+
+	var notes []note
+	after(db.Model(&note{}), order, []interface{}{nil, nil, "5"}).Find(&notes)
+	q := d.Statements(`SELECT * FROM "notes"`)[0].Query
+	want := "WHERE ((FALSE) OR (status IS NULL AND created_at IS NOT NULL) OR " +
+		"(status IS NULL AND created_at IS NULL AND (id > $1 OR id IS NULL)))"
+	if !strings.Contains(q, want) {
+		t.Errorf("query %q\nwant %q", q, want)
+	}
+}
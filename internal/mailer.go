@@ -0,0 +1,279 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/mailgun/mailgun-go/v4"
+	"github.com/zeroshade/tmsapi/types"
+)
+
+func init() {
+	// not every system's mime types know calendar invites
+	mime.AddExtensionType(".ics", "text/calendar; charset=utf-8")
+}
+
+type Attachment struct {
+	Name string
+	Data []byte
+}
+
+// Message is an email ready to send. Domain is the sending domain, which
+// only matters to transports like mailgun that send on behalf of one.
+type Message struct {
+	Domain      string
+	From        string
+	To          []string
+	Subject     string
+	Text        string
+	HTML        string
+	Attachments []Attachment
+}
+
+func (m *Message) Attach(name string, data []byte) {
+	m.Attachments = append(m.Attachments, Attachment{Name: name, Data: data})
+}
+
+// Mailer sends email, returning the transport's id for the message
+type Mailer interface {
+	Send(ctx context.Context, m *Message) (string, error)
+}
+
+// DefaultMailer is picked from $MAIL_TRANSPORT: "mailgun" (the default),
+// "smtp", "file" or "memory"
+var DefaultMailer = NewMailerFromEnv()
+
+func NewMailerFromEnv() Mailer {
+	switch strings.ToLower(os.Getenv("MAIL_TRANSPORT")) {
+	case "smtp":
+		return NewSMTPMailer(os.Getenv("SMTP_ADDR"), os.Getenv("SMTP_USER"), os.Getenv("SMTP_PASSWORD"))
+	case "file":
+		dir := os.Getenv("MAIL_DIR")
+		if dir == "" {
+			dir = filepath.Join(os.TempDir(), "tmsapi-mail")
+		}
+		return NewFileMailer(dir)
+	case "memory":
+		return &MemoryMailer{}
+	default:
+		return NewMailgunMailer(os.Getenv("MAILGUN_API_KEY"))
+	}
+}
+
+type mailgunMailer struct {
+	apiKey string
+}
+
+func NewMailgunMailer(apiKey string) Mailer {
+	return &mailgunMailer{apiKey: apiKey}
+}
+
+func (mm *mailgunMailer) Send(ctx context.Context, m *Message) (string, error) {
+	mg := mailgun.NewMailgun(m.Domain, mm.apiKey)
+	msg := mg.NewMessage(m.From, m.Subject, m.Text, m.To...)
+	if m.HTML != "" {
+		msg.SetHtml(m.HTML)
+	}
+	for _, a := range m.Attachments {
+		msg.AddBufferAttachment(a.Name, a.Data)
+	}
+
+	resp, id, err := mg.Send(ctx, msg)
+	log.Println("Send Email: ", m.Subject, m.To)
+	log.Println("Response: ", resp, id)
+	return id, err
+}
+
+type smtpMailer struct {
+	addr string
+	auth smtp.Auth
+}
+
+// NewSMTPMailer sends through an smtp server at host:port, authenticating
+// only if a user is given
+func NewSMTPMailer(addr, user, password string) Mailer {
+	s := &smtpMailer{addr: addr}
+	if user != "" {
+		host := addr
+		if idx := strings.LastIndex(addr, ":"); idx != -1 {
+			host = addr[:idx]
+		}
+		s.auth = smtp.PlainAuth("", user, password, host)
+	}
+	return s
+}
+
+func (s *smtpMailer) Send(ctx context.Context, m *Message) (string, error) {
+	id, body, err := buildMIME(m)
+	if err != nil {
+		return "", err
+	}
+
+	from, err := mail.ParseAddress(m.From)
+	if err != nil {
+		return "", err
+	}
+	to := make([]string, 0, len(m.To))
+	for _, t := range m.To {
+		addr, err := mail.ParseAddress(t)
+		if err != nil {
+			return "", err
+		}
+		to = append(to, addr.Address)
+	}
+
+	return id, smtp.SendMail(s.addr, s.auth, from.Address, to, body)
+}
+
+// FileMailer writes each message to its own .eml file instead of sending it,
+// for running the purchase flows locally
+type FileMailer struct {
+	Dir string
+}
+
+func NewFileMailer(dir string) *FileMailer {
+	return &FileMailer{Dir: dir}
+}
+
+func (f *FileMailer) Send(ctx context.Context, m *Message) (string, error) {
+	id, body, err := buildMIME(m)
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(f.Dir, 0755); err != nil {
+		return "", err
+	}
+
+	name := filepath.Join(f.Dir, time.Now().Format("20060102-150405")+"-"+strings.Trim(id, "<>")+".eml")
+	if err := ioutil.WriteFile(name, body, 0644); err != nil {
+		return "", err
+	}
+	log.Println("Wrote Email: ", m.Subject, m.To, name)
+	return id, nil
+}
+
+// MemoryMailer keeps every message it's given, for tests
+type MemoryMailer struct {
+	mu   sync.Mutex
+	sent []Message
+}
+
+func (mm *MemoryMailer) Send(ctx context.Context, m *Message) (string, error) {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	mm.sent = append(mm.sent, *m)
+	return fmt.Sprintf("<%d@memory>", len(mm.sent)), nil
+}
+
+// Sent returns a copy of the messages sent so far
+func (mm *MemoryMailer) Sent() []Message {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	return append([]Message(nil), mm.sent...)
+}
+
+func (mm *MemoryMailer) Reset() {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	mm.sent = nil
+}
+
+// buildMIME renders the message as multipart/mixed with a text and html
+// alternative followed by any attachments
+func buildMIME(m *Message) (string, []byte, error) {
+	domain := m.Domain
+	if domain == "" {
+		domain = "localhost"
+	}
+	id := "<" + uuid.New().String() + "@" + domain + ">"
+
+	var buf bytes.Buffer
+	mixed := multipart.NewWriter(&buf)
+
+	hdr := []string{
+		"From: " + m.From,
+		"To: " + strings.Join(m.To, ", "),
+		"Subject: " + mime.QEncoding.Encode("utf-8", m.Subject),
+		"Date: " + time.Now().Format(time.RFC1123Z),
+		"Message-ID: " + id,
+		"MIME-Version: 1.0",
+		"Content-Type: multipart/mixed; boundary=" + mixed.Boundary(),
+	}
+	out := bytes.NewBufferString(strings.Join(hdr, "\r\n") + "\r\n\r\n")
+
+	var alt bytes.Buffer
+	altw := multipart.NewWriter(&alt)
+	for _, part := range []struct{ typ, body string }{{"text/plain", m.Text}, {"text/html", m.HTML}} {
+		if part.body == "" {
+			continue
+		}
+		w, err := altw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.typ + "; charset=utf-8"},
+			"Content-Transfer-Encoding": {"base64"},
+		})
+		if err != nil {
+			return "", nil, err
+		}
+		writeBase64(w, []byte(part.body))
+	}
+	altw.Close()
+
+	w, err := mixed.CreatePart(textproto.MIMEHeader{"Content-Type": {"multipart/alternative; boundary=" + altw.Boundary()}})
+	if err != nil {
+		return "", nil, err
+	}
+	w.Write(alt.Bytes())
+
+	for _, a := range m.Attachments {
+		ctype := mime.TypeByExtension(filepath.Ext(a.Name))
+		if ctype == "" {
+			ctype = "application/octet-stream"
+		}
+		w, err := mixed.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {ctype},
+			"Content-Transfer-Encoding": {"base64"},
+			"Content-Disposition":       {fmt.Sprintf("attachment; filename=%q", a.Name)},
+		})
+		if err != nil {
+			return "", nil, err
+		}
+		writeBase64(w, a.Data)
+	}
+	mixed.Close()
+
+	out.Write(buf.Bytes())
+	return id, out.Bytes(), nil
+}
+
+// writeBase64 wraps the encoding at 76 columns as the mime rfc asks
+func writeBase64(w io.Writer, data []byte) {
+	enc := base64.StdEncoding.EncodeToString(data)
+	for len(enc) > 76 {
+		w.Write([]byte(enc[:76] + "\r\n"))
+		enc = enc[76:]
+	}
+	w.Write([]byte(enc + "\r\n"))
+}
+
+// NewMerchantMessage addresses a message from the merchant's sending domain
+// and from address
+func NewMerchantMessage(conf *types.MerchantConfig, subject, text, html string, to ...string) *Message {
+	domain, from := conf.MailSender()
+	return &Message{Domain: domain, From: from, To: to, Subject: subject, Text: text, HTML: html}
+}
@@ -0,0 +1,166 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func testMessage() *Message {
+	m := &Message{
+		Domain:  "mg.example.com",
+		From:    "Boat Co <tickets@example.com>",
+		To:      []string{"Ana Pérez <ana@example.com>"},
+		Subject: "Sus boletos ✓",
+		Text:    "plain body",
+		HTML:    "<p>html body</p>",
+	}
+	m.Attach("trip.ics", []byte("BEGIN:VCALENDAR\r\nEND:VCALENDAR\r\n"))
+	return m
+}
+
+// readParts returns each part of a multipart body keyed by content type,
+// with the base64 decoded
+func readParts(t *testing.T, ctype string, body []byte) map[string]string {
+	t.Helper()
+	media, params, err := mime.ParseMediaType(ctype)
+	if err != nil || !strings.HasPrefix(media, "multipart/") {
+		t.Fatalf("content type %q: %v", ctype, err)
+	}
+
+	out := make(map[string]string)
+	r := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+	for {
+		p, err := r.NextPart()
+		if err != nil {
+			break
+		}
+		data, _ := ioutil.ReadAll(p)
+		pt := p.Header.Get("Content-Type")
+		if strings.HasPrefix(pt, "multipart/") {
+			for k, v := range readParts(t, pt, data) {
+				out[k] = v
+			}
+			continue
+		}
+		if p.Header.Get("Content-Transfer-Encoding") == "base64" {
+			dec, err := base64.StdEncoding.DecodeString(strings.ReplaceAll(string(data), "\r\n", ""))
+			if err != nil {
+				t.Fatalf("part %s: %v", pt, err)
+			}
+			data = dec
+		}
+		if name := p.FileName(); name != "" {
+			pt += "; filename=" + name
+		}
+		out[pt] = string(data)
+	}
+	return out
+}
+
+func TestBuildMIME(t *testing.T) {
+	id, body, err := buildMIME(testMessage())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(id, "@mg.example.com>") {
+		t.Errorf("message id %q isn't on the sending domain", id)
+	}
+
+	msg, err := mail.ReadMessage(bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := msg.Header.Get("Message-ID"); got != id {
+		t.Errorf("Message-ID = %q, want %q", got, id)
+	}
+	subj, err := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject"))
+	if err != nil || subj != "Sus boletos ✓" {
+		t.Errorf("Subject = %q (%v)", subj, err)
+	}
+	if to, err := msg.Header.AddressList("To"); err != nil || len(to) != 1 || to[0].Address != "ana@example.com" {
+		t.Errorf("To = %v (%v)", to, err)
+	}
+
+	data, _ := ioutil.ReadAll(msg.Body)
+	parts := readParts(t, msg.Header.Get("Content-Type"), data)
+	want := map[string]string{
+		"text/plain; charset=utf-8":                       "plain body",
+		"text/html; charset=utf-8":                        "<p>html body</p>",
+		"text/calendar; charset=utf-8; filename=trip.ics": "BEGIN:VCALENDAR\r\nEND:VCALENDAR\r\n",
+	}
+	for k, v := range want {
+		if parts[k] != v {
+			t.Errorf("part %q = %q, want %q", k, parts[k], v)
+		}
+	}
+	if len(parts) != len(want) {
+		t.Errorf("got parts %v", parts)
+	}
+}
+
+func TestBuildMIMETextOnly(t *testing.T) {
+	_, body, err := buildMIME(&Message{From: "a@example.com", To: []string{"b@example.com"}, Subject: "hi", Text: "only text"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := mail.ReadMessage(bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id := msg.Header.Get("Message-ID"); !strings.HasSuffix(id, "@localhost>") {
+		t.Errorf("Message-ID without a domain = %q", id)
+	}
+
+	data, _ := ioutil.ReadAll(msg.Body)
+	parts := readParts(t, msg.Header.Get("Content-Type"), data)
+	if len(parts) != 1 || parts["text/plain; charset=utf-8"] != "only text" {
+		t.Errorf("got parts %v", parts)
+	}
+}
+
+func TestMemoryMailer(t *testing.T) {
+	mm := &MemoryMailer{}
+	id, err := mm.Send(context.Background(), testMessage())
+	if err != nil || id != "<1@memory>" {
+		t.Fatalf("Send = %q, %v", id, err)
+	}
+	mm.Send(context.Background(), &Message{Subject: "second"})
+
+	sent := mm.Sent()
+	if len(sent) != 2 || sent[0].Subject != "Sus boletos ✓" || sent[1].Subject != "second" {
+		t.Fatalf("Sent = %+v", sent)
+	}
+	mm.Reset()
+	if len(mm.Sent()) != 0 {
+		t.Error("Reset left messages behind")
+	}
+}
+
+func TestFileMailer(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "mail")
+	id, err := NewFileMailer(dir).Send(context.Background(), testMessage())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*.eml"))
+	if len(files) != 1 || !strings.Contains(files[0], strings.Trim(id, "<>")) {
+		t.Fatalf("files = %v, id %q", files, id)
+	}
+	data, _ := ioutil.ReadFile(files[0])
+	msg, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Header.Get("Message-ID") != id {
+		t.Errorf("Message-ID = %q, want %q", msg.Header.Get("Message-ID"), id)
+	}
+}
@@ -0,0 +1,78 @@
+package internal
+
+import (
+	"context"
+	"log"
+	"strings"
+
+	"github.com/jinzhu/gorm"
+	"github.com/zeroshade/tmsapi/types"
+)
+
+// SendEmail sends the message and records it in the merchant's notification
+// log against the order it's about
+func SendEmail(db *gorm.DB, conf *types.MerchantConfig, orderID, template string, m *Message) error {
+	return SendEmailFor(db, &types.Notification{MerchantID: conf.ID, OrderID: orderID, Template: template}, m)
+}
+
+// SendEmailFor sends the message and logs it with whatever n says it's
+// about, for messages that aren't about an order such as charter quotes
+func SendEmailFor(db *gorm.DB, n *types.Notification, m *Message) error {
+	n.Channel = types.ChannelEmail
+	n.Recipient = strings.Join(m.To, ", ")
+	n.Subject = m.Subject
+	n.Sender = m.From
+	n.Domain = m.Domain
+	n.Body = m.Text
+	n.HTML = m.HTML
+
+	names := make([]string, 0, len(m.Attachments))
+	for _, a := range m.Attachments {
+		names = append(names, a.Name)
+	}
+	n.Attachment = strings.Join(names, ", ")
+
+	id, err := DefaultMailer.Send(context.Background(), m)
+	recordNotification(db, n, id, err)
+	return err
+}
+
+// SendSMS texts the merchant's customer or staff and records it in the
+// notification log against the order it's about. Numbers that have opted
+// out are logged as suppressed and not sent to.
+func SendSMS(db *gorm.DB, conf *types.MerchantConfig, orderID, template, to, body string) error {
+	if num, err := NormalizePhone(to); err == nil {
+		to = num
+	}
+	n := &types.Notification{
+		MerchantID: conf.ID,
+		OrderID:    orderID,
+		Channel:    types.ChannelSMS,
+		Recipient:  to,
+		Subject:    template,
+		Template:   template,
+		Body:       body,
+	}
+
+	if types.SMSOptedOut(db, to) {
+		n.Status = types.NotifySuppressed
+		n.Detail = types.ErrSMSOptedOut.Error()
+		db.Create(n)
+		return types.ErrSMSOptedOut
+	}
+
+	id, err := NewSMSSender(conf).Send(to, body)
+	recordNotification(db, n, id, err)
+	return err
+}
+
+func recordNotification(db *gorm.DB, n *types.Notification, id string, err error) {
+	n.ProviderID = strings.Trim(id, "<>")
+	n.Status = types.NotifySent
+	if err != nil {
+		n.Status = types.NotifyFailed
+		n.Detail = err.Error()
+		log.Println("Send Error:", n.Channel, n.Recipient, n.Subject, err)
+	}
+	db.Create(n)
+}
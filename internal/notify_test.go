@@ -0,0 +1,128 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/zeroshade/tmsapi/internal/dbtest"
+	"github.com/zeroshade/tmsapi/types"
+)
+
+// useMailer swaps the default mailer for the length of a test
+func useMailer(t *testing.T, m Mailer) {
+	prev := DefaultMailer
+	DefaultMailer = m
+	t.Cleanup(func() { DefaultMailer = prev })
+}
+
+func notification(t *testing.T, d *dbtest.DB) dbtest.Stmt {
+	t.Helper()
+	ins := d.Statements(`INSERT INTO "notifications"`)
+	if len(ins) != 1 {
+		t.Fatalf("logged %d notifications, want 1", len(ins))
+	}
+	return ins[0]
+}
+
+func checkValues(t *testing.T, s dbtest.Stmt, want map[string]interface{}) {
+	t.Helper()
+	for col, v := range want {
+		if got, ok := s.Value(col); !ok || got != v {
+			t.Errorf("%s = %v, want %v", col, got, v)
+		}
+	}
+}
+
+func TestSendSMS(t *testing.T) {
+	t.Setenv("SMS_TRANSPORT", "stub")
+	StubSMS.Reset()
+	db, d := dbtest.Open(t)
+
+	conf := &types.MerchantConfig{ID: "m1"}
+	if err := SendSMS(db, conf, "o1", "reminder", "(732) 555-0142", "see you soon"); err != nil {
+		t.Fatal(err)
+	}
+
+	if sent := StubSMS.Sent(); len(sent) != 1 || sent[0].To != "+17325550142" || sent[0].Body != "see you soon" {
+		t.Fatalf("sent %+v", sent)
+	}
+	checkValues(t, notification(t, d), map[string]interface{}{
+		"merchant_id": "m1", "order_id": "o1", "channel": types.ChannelSMS, "recipient": "+17325550142",
+		"template": "reminder", "provider_id": "SM1", "status": types.NotifySent,
+	})
+}
+
+func TestSendSMSFailed(t *testing.T) {
+	t.Setenv("SMS_TRANSPORT", "stub")
+	StubSMS.Reset()
+	db, d := dbtest.Open(t)
+
+	if err := SendSMS(db, &types.MerchantConfig{ID: "m1"}, "o1", "reminder", "555-0142", "hi"); err == nil {
+		t.Fatal("sent to an invalid number")
+	}
+	n := notification(t, d)
+	checkValues(t, n, map[string]interface{}{"status": types.NotifyFailed})
+	if detail, _ := n.Value("detail"); detail == "" {
+		t.Error("failure has no detail")
+	}
+}
+
+func TestSendSMSOptedOut(t *testing.T) {
+	t.Setenv("SMS_TRANSPORT", "stub")
+	StubSMS.Reset()
+	db, d := dbtest.Open(t)
+	d.Returns(`FROM "sms_consents"`, []string{"phone", "opted_out"}, []interface{}{"+17325550142", true})
+
+	err := SendSMS(db, &types.MerchantConfig{ID: "m1"}, "o1", "reminder", "732-555-0142", "hi")
+	if err != types.ErrSMSOptedOut {
+		t.Fatalf("err = %v, want %v", err, types.ErrSMSOptedOut)
+	}
+	if len(StubSMS.Sent()) != 0 {
+		t.Error("texted a number that opted out")
+	}
+	checkValues(t, notification(t, d), map[string]interface{}{"status": types.NotifySuppressed})
+}
+
+func TestSendEmailFor(t *testing.T) {
+	mm := &MemoryMailer{}
+	useMailer(t, mm)
+	db, d := dbtest.Open(t)
+
+	m := &Message{Domain: "mg.example.com", From: "Boats <b@example.com>", To: []string{"Ana <ana@example.com>"},
+		Subject: "Your quote", Text: "text", HTML: "<p>html</p>"}
+	m.Attach("trip.ics", []byte("ics"))
+	n := &types.Notification{MerchantID: "m1", RelatedTo: "quote", RelatedID: "7", Template: types.EmailQuote}
+	if err := SendEmailFor(db, n, m); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(mm.Sent()) != 1 {
+		t.Fatalf("sent %d messages", len(mm.Sent()))
+	}
+	checkValues(t, notification(t, d), map[string]interface{}{
+		"merchant_id": "m1", "order_id": "", "related_to": "quote", "related_id": "7",
+		"channel": types.ChannelEmail, "recipient": "Ana <ana@example.com>", "subject": "Your quote",
+		"sender": "Boats <b@example.com>", "domain": "mg.example.com", "attachment": "trip.ics",
+		"provider_id": "1@memory", "status": types.NotifySent,
+	})
+}
+
+type failingMailer struct{}
+
+func (failingMailer) Send(_ context.Context, m *Message) (string, error) {
+	return "", errors.New("mailbox full")
+}
+
+func TestSendEmailFailed(t *testing.T) {
+	useMailer(t, failingMailer{})
+	db, d := dbtest.Open(t)
+
+	err := SendEmail(db, &types.MerchantConfig{ID: "m1"}, "o1", types.EmailRefund, &Message{To: []string{"a@example.com"}})
+	if err == nil {
+		t.Fatal("no error from a failed send")
+	}
+	checkValues(t, notification(t, d), map[string]interface{}{
+		"order_id": "o1", "template": types.EmailRefund, "status": types.NotifyFailed, "detail": "mailbox full",
+	})
+}
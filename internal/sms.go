@@ -0,0 +1,108 @@
+package internal
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/zeroshade/tmsapi/types"
+)
+
+// SMSSender sends a text message, returning the transport's id for it
+type SMSSender interface {
+	Send(to, body string) (string, error)
+}
+
+// StubSMS is used when $SMS_TRANSPORT is "stub", it logs and keeps every
+// message rather than sending it
+var StubSMS = &StubSender{}
+
+// NewSMSSender picks the merchant's own twilio account when they have one,
+// falling back to the platform account
+func NewSMSSender(conf *types.MerchantConfig) SMSSender {
+	if strings.ToLower(os.Getenv("SMS_TRANSPORT")) == "stub" {
+		return StubSMS
+	}
+	if ownTwilio(conf) {
+		return NewTwilio(conf.TwilioAcctSID, conf.TwilioAcctToken, conf.TwilioFromNumber)
+	}
+	return NewDefaultTwilio()
+}
+
+func ownTwilio(conf *types.MerchantConfig) bool {
+	return conf != nil && conf.TwilioAcctSID != "" && conf.TwilioAcctToken != "" && conf.TwilioFromNumber != ""
+}
+
+type SentSMS struct {
+	To   string
+	Body string
+}
+
+type StubSender struct {
+	mu   sync.Mutex
+	sent []SentSMS
+}
+
+func (s *StubSender) Send(to, body string) (string, error) {
+	num, err := NormalizePhone(to)
+	if err != nil {
+		return "", err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sent = append(s.sent, SentSMS{To: num, Body: body})
+	log.Println("Stub SMS to:", num, body)
+	return fmt.Sprintf("SM%d", len(s.sent)), nil
+}
+
+// Sent returns a copy of the messages sent so far
+func (s *StubSender) Sent() []SentSMS {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]SentSMS(nil), s.sent...)
+}
+
+func (s *StubSender) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sent = nil
+}
+
+// NormalizePhone puts a phone number in E.164 form. Numbers without a
+// country code are taken to be North American.
+func NormalizePhone(number string) (string, error) {
+	number = strings.TrimSpace(number)
+	intl := strings.HasPrefix(number, "+") || strings.HasPrefix(number, "00")
+
+	var digits strings.Builder
+	for _, r := range number {
+		if r >= '0' && r <= '9' {
+			digits.WriteRune(r)
+		}
+	}
+	d := digits.String()
+	if strings.HasPrefix(number, "00") {
+		d = d[2:]
+	}
+
+	switch {
+	case intl:
+	case len(d) == 10:
+		d = "1" + d
+	case len(d) == 11 && d[0] == '1':
+	default:
+		// numbers stored before they were normalised have the country code
+		// but no plus
+		if len(d) < 11 {
+			return "", fmt.Errorf("invalid phone number %q", number)
+		}
+	}
+
+	if len(d) < 8 || len(d) > 15 || d[0] == '0' {
+		return "", fmt.Errorf("invalid phone number %q", number)
+	}
+	return "+" + d, nil
+}
@@ -0,0 +1,54 @@
+package internal
+
+import (
+	"testing"
+)
+
+func TestNormalizePhone(t *testing.T) {
+	tests := []struct {
+		in, want string
+		ok       bool
+	}{
+		{"(732) 555-0142", "+17325550142", true},
+		{"732.555.0142", "+17325550142", true},
+		{"1 732 555 0142", "+17325550142", true},
+		{"+1 (732) 555-0142", "+17325550142", true},
+		{"17325550142", "+17325550142", true},
+		{"+44 20 7946 0958", "+442079460958", true},
+		{"0044 20 7946 0958", "+442079460958", true},
+		{"447946095812", "+447946095812", true},
+		{"  732-555-0142  ", "+17325550142", true},
+		{"555-0142", "", false},
+		{"", "", false},
+		{"+0 123 456 789", "", false},
+		{"+1234567890123456", "", false},
+		{"call me", "", false},
+	}
+
+	for _, tt := range tests {
+		got, err := NormalizePhone(tt.in)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("NormalizePhone(%q) = %q, %v; want %q, ok %v", tt.in, got, err, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestStubSender(t *testing.T) {
+	s := &StubSender{}
+	id, err := s.Send("732-555-0142", "hello")
+	if err != nil || id != "SM1" {
+		t.Fatalf("Send = %q, %v", id, err)
+	}
+	if _, err := s.Send("nope", "hello"); err == nil {
+		t.Error("sent to an invalid number")
+	}
+
+	sent := s.Sent()
+	if len(sent) != 1 || sent[0] != (SentSMS{To: "+17325550142", Body: "hello"}) {
+		t.Fatalf("Sent = %+v", sent)
+	}
+	s.Reset()
+	if len(s.Sent()) != 0 {
+		t.Error("Reset left messages behind")
+	}
+}
@@ -1,13 +1,19 @@
 package internal
 
 import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
 	"net/url"
 	"os"
+	"sort"
 	"strings"
+
+	"github.com/zeroshade/tmsapi/types"
 )
 
 var twilioMsgFrom = os.Getenv("TWILIO_MSG_FROM")
@@ -15,12 +21,22 @@ var twilioMsgSvcSID = os.Getenv("TWILIO_MSGING_SERVICE")
 var twilioSID = os.Getenv("TWILIO_ACCOUNT_SID")
 var twilioToken = os.Getenv("TWILIO_AUTH_TOKEN")
 
+// TwilioStatusCallback is where twilio reports delivery of the messages we
+// send, it has to match exactly to validate their signatures
+var TwilioStatusCallback = os.Getenv("TWILIO_STATUS_CALLBACK")
+
+// TwilioInboundURL is the messaging webhook set on our numbers, which incoming
+// texts are signed against
+var TwilioInboundURL = os.Getenv("TWILIO_INBOUND_URL")
+
 type twilio struct {
-	sid   string
-	token string
-	from  string
+	sid    string
+	token  string
+	from   string
+	svcSID string
 }
 
+// NewTwilio sends from a merchant's own twilio account and number
 func NewTwilio(sid, token, from string) *twilio {
 	return &twilio{
 		sid:   sid,
@@ -29,19 +45,37 @@ func NewTwilio(sid, token, from string) *twilio {
 	}
 }
 
+// NewDefaultTwilio sends through the platform's messaging service
 func NewDefaultTwilio() *twilio {
 	return &twilio{
-		sid:   twilioSID,
-		token: twilioToken,
-		from:  twilioMsgFrom,
+		sid:    twilioSID,
+		token:  twilioToken,
+		from:   twilioMsgFrom,
+		svcSID: twilioMsgSvcSID,
 	}
 }
 
-func (t *twilio) Send(to, body string) error {
+func (t *twilio) Send(to, body string) (string, error) {
+	num, err := NormalizePhone(to)
+	if err != nil {
+		return "", err
+	}
+
 	msgData := url.Values{}
-	msgData.Set("To", "+"+to)
-	msgData.Set("MessagingServiceSid", twilioMsgSvcSID)
+	msgData.Set("To", num)
+	if t.svcSID != "" {
+		msgData.Set("MessagingServiceSid", t.svcSID)
+	} else {
+		from, err := NormalizePhone(t.from)
+		if err != nil {
+			return "", fmt.Errorf("twilio from number: %w", err)
+		}
+		msgData.Set("From", from)
+	}
 	msgData.Set("Body", body)
+	if TwilioStatusCallback != "" {
+		msgData.Set("StatusCallback", TwilioStatusCallback)
+	}
 
 	twilioApiUrl := "https://api.twilio.com/2010-04-01/Accounts/" + t.sid + "/Messages.json"
 
@@ -53,19 +87,60 @@ func (t *twilio) Send(to, body string) error {
 
 	resp, err := client.Do(req)
 	if err != nil {
-		fmt.Println(err)
-		return err
+		return "", err
 	}
-	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
-		var data map[string]interface{}
-		defer resp.Body.Close()
-		decoder := json.NewDecoder(resp.Body)
-		if err := decoder.Decode(&data); err != nil {
-			return err
+	defer resp.Body.Close()
+
+	var data struct {
+		Sid     string `json:"sid"`
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	}
+	json.NewDecoder(resp.Body).Decode(&data)
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		if data.Message != "" {
+			return "", fmt.Errorf("twilio: %s (%d)", data.Message, data.Code)
 		}
-		log.Println("Twilio Notification set to: ", to, " sid: ", data["sid"])
-	} else {
-		log.Println("Twilio SMS: ", resp.Status)
+		return "", fmt.Errorf("twilio: %s", resp.Status)
 	}
-	return nil
+
+	log.Println("Twilio Notification set to: ", num, " sid: ", data.Sid)
+	return data.Sid, nil
+}
+
+// TwilioAuthToken is the token of whichever account NewSMSSender sends
+// from for the merchant
+func TwilioAuthToken(conf *types.MerchantConfig) string {
+	if ownTwilio(conf) {
+		return conf.TwilioAcctToken
+	}
+	return twilioToken
+}
+
+// ValidTwilioSignature checks the X-Twilio-Signature of a webhook request,
+// which signs the url followed by the sorted form parameters. Without a token
+// or url there's nothing to check against, so the request is rejected.
+func ValidTwilioSignature(token, url string, params url.Values, signature string) bool {
+	if token == "" || url == "" {
+		return false
+	}
+
+	keys := make([]string, 0, len(params))
+	for k := range params {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var buf strings.Builder
+	buf.WriteString(url)
+	for _, k := range keys {
+		for _, v := range params[k] {
+			buf.WriteString(k + v)
+		}
+	}
+
+	mac := hmac.New(sha1.New, []byte(token))
+	mac.Write([]byte(buf.String()))
+	expected := base64.StdEncoding.EncodeToString(mac.Sum(nil))
+	return hmac.Equal([]byte(expected), []byte(signature))
 }
@@ -0,0 +1,50 @@
+package internal
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestValidTwilioSignature(t *testing.T) {
+	// the example request from twilio's webhook security docs
+	const (
+		token = "12345"
+		hook  = "https://mycompany.com/myapp.php?foo=1&bar=2"
+		sig   = "0/KCTR6DLpKmkAf8muzZqo1nDgQ="
+	)
+	params := url.Values{
+		"CallSid": {"CA1234567890ABCDE"},
+		"Caller":  {"+12349013030"},
+		"Digits":  {"1234"},
+		"From":    {"+12349013030"},
+		"To":      {"+18005551212"},
+	}
+
+	if !ValidTwilioSignature(token, hook, params, sig) {
+		t.Error("rejected a valid signature")
+	}
+
+	tampered := url.Values{}
+	for k, v := range params {
+		tampered[k] = v
+	}
+	tampered.Set("Digits", "4321")
+
+	tests := []struct {
+		name             string
+		token, hook, sig string
+		params           url.Values
+	}{
+		{"changed param", token, hook, sig, tampered},
+		{"other url", token, "https://mycompany.com/other.php", sig, params},
+		{"other token", "54321", hook, sig, params},
+		{"no signature", token, hook, "", params},
+		{"no token", "", hook, sig, params},
+		{"no url", token, "", sig, params},
+	}
+	for _, tt := range tests {
+		if ValidTwilioSignature(tt.token, tt.hook, tt.params, tt.sig) {
+			t.Errorf("%s: accepted", tt.name)
+		}
+	}
+}
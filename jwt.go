@@ -4,9 +4,12 @@ import (
 	"log"
 	"net/http"
 	"sort"
+	"strings"
 
 	"github.com/auth0-community/go-auth0"
 	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+	"github.com/zeroshade/tmsapi/types"
 )
 
 const (
@@ -18,10 +21,31 @@ const (
 	USERAPI = "https://tmszero.auth0.com/api/v2/"
 	// AUTH0DOMAIN the url for the auth0 domain
 	AUTH0DOMAIN = "https://tmszero.auth0.com/"
+	// AdminMerchantHeader names the merchant a platform admin is acting on,
+	// admins only get into another merchant's routes by setting it
+	AdminMerchantHeader = "X-Admin-Merchant"
 )
 
 var validator *auth0.JWTValidator
 
+// authDB is where checkJWT audits the requests it denies
+var authDB *gorm.DB
+
+func auditDenial(c *gin.Context, d types.AuthDenial) {
+	log.Println("Auth Denied:", d.Reason, d.UserID, c.Request.Method, c.Request.URL.Path)
+	if authDB == nil {
+		return
+	}
+
+	d.MerchantID = c.Param("merchantid")
+	d.Method = c.Request.Method
+	d.Url = c.Request.URL.Path
+	d.RemoteIP = c.ClientIP()
+	if err := authDB.Create(&d).Error; err != nil {
+		log.Println("Auth Denial Audit Error:", err)
+	}
+}
+
 func init() {
 	client := auth0.NewJWKClient(auth0.JWKClientOptions{URI: JWKURI}, nil)
 	configuration := auth0.NewConfiguration(client, []string{USERAPI}, AUTH0DOMAIN, "RS256")
@@ -33,29 +57,43 @@ func checkJWT(perms ...string) gin.HandlerFunc {
 		tok, err := validator.ValidateRequest(c.Request)
 		if err != nil {
 			log.Println("Token isn't valid:", tok)
+			auditDenial(c, types.AuthDenial{Reason: "invalid token"})
 			c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid token"})
 			c.Abort()
 			return
 		}
 
+		// the auth0 rule copies app_metadata.merchant_id and the user's roles
+		// into the token alongside their permissions
 		claims := map[string]interface{}{}
 		custom := struct {
-			Subject string           `json:"sub"`
-			Perms   sort.StringSlice `json:"https://kithandkink.com/permissions"`
+			Subject    string           `json:"sub"`
+			Perms      sort.StringSlice `json:"https://kithandkink.com/permissions"`
+			MerchantID string           `json:"https://kithandkink.com/merchant_id"`
+			Roles      []string         `json:"https://kithandkink.com/roles"`
 		}{}
 
 		err = validator.Claims(c.Request, tok, &claims, &custom)
 		if err != nil {
 			log.Println("invalid Claims:", err)
+			auditDenial(c, types.AuthDenial{Reason: "invalid claims"})
 			c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid claims"})
 			c.Abort()
 			return
 		}
 
+		admin := false
+		for _, r := range custom.Roles {
+			admin = admin || r == "admin"
+		}
+		denial := types.AuthDenial{UserID: custom.Subject, TokenMerchant: custom.MerchantID, Roles: strings.Join(custom.Roles, ",")}
+
 		custom.Perms.Sort()
 		for _, p := range perms {
 			find := custom.Perms.Search(p)
 			if find == custom.Perms.Len() || custom.Perms[find] != p {
+				denial.Reason = "missing permission " + p
+				auditDenial(c, denial)
 				c.JSON(http.StatusUnauthorized, gin.H{"error": "missing permissions"})
 				c.Abort()
 				log.Println("MIssing permission: ", p)
@@ -63,7 +101,27 @@ func checkJWT(perms ...string) gin.HandlerFunc {
 			}
 		}
 
+		// callers only see their own merchant, admins can cross over to
+		// another one by naming it in the header
+		if mid := c.Param("merchantid"); mid != "" && mid != custom.MerchantID {
+			switch {
+			case !admin:
+				denial.Reason = "merchant mismatch"
+			case c.GetHeader(AdminMerchantHeader) != mid:
+				denial.Reason = "admin without " + AdminMerchantHeader
+			}
+			if denial.Reason != "" {
+				auditDenial(c, denial)
+				c.JSON(http.StatusForbidden, gin.H{"error": "not authorized for this merchant"})
+				c.Abort()
+				return
+			}
+			c.Set("cross_merchant", true)
+		}
+
 		c.Set("user_id", custom.Subject)
+		c.Set("admin", admin)
+		c.Set("merchant_id", custom.MerchantID)
 		c.Next()
 	}
-}
\ No newline at end of file
+}
@@ -13,9 +13,14 @@ import (
 
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
+	"github.com/zeroshade/tmsapi/cash"
+	"github.com/zeroshade/tmsapi/internal"
 	"github.com/zeroshade/tmsapi/stripe"
 	"github.com/zeroshade/tmsapi/types"
 
+	// payment providers register themselves
+	_ "github.com/zeroshade/tmsapi/paypal"
+
 	"github.com/jinzhu/gorm"
 	"github.com/jinzhu/gorm/dialects/postgres"
 	_ "github.com/jinzhu/gorm/dialects/postgres"
@@ -56,15 +61,62 @@ func logActionMiddle(db *gorm.DB) gin.HandlerFunc {
 	}
 }
 
+var logActionList = &internal.ListSpec{
+	Sortable:    map[string]string{"id": "id", "createdAt": "created_at", "userId": "user_id", "method": "method", "path": "url"},
+	Filterable:  map[string]string{"userId": "user_id", "method": "method"},
+	DefaultSort: "created_at DESC, id DESC",
+}
+
 func getLogActions(db *gorm.DB) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		var logs []types.LogAction
-		db.Order("created_at DESC").Find(&logs, "merchant_id = ?", c.Param("merchantid"))
+		params, err := internal.BindListQuery(c, logActionList)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		scope, res, err := logActionList.Apply(db.Model(&types.LogAction{}).Where("merchant_id = ?", c.Param("merchantid")), params)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
 
+		var logs []types.LogAction
+		scope.Find(&logs)
+		res.SetHeaders(c)
 		c.JSON(http.StatusOK, logs)
 	}
 }
 
+var authDenialList = &internal.ListSpec{
+	Sortable:    map[string]string{"id": "id", "createdAt": "created_at", "userId": "user_id", "reason": "reason"},
+	Filterable:  map[string]string{"userId": "user_id", "tokenMerchant": "token_merchant", "reason": "reason"},
+	DefaultSort: "created_at DESC, id DESC",
+}
+
+// getAuthDenials lists the requests for a merchant that were turned away,
+// including other merchants' staff trying to get in
+func getAuthDenials(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		params, err := internal.BindListQuery(c, authDenialList)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		scope, res, err := authDenialList.Apply(db.Model(&types.AuthDenial{}).Where("merchant_id = ?", c.Param("merchantid")), params)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		var out []types.AuthDenial
+		scope.Find(&out)
+		res.SetHeaders(c)
+		c.JSON(http.StatusOK, out)
+	}
+}
+
 func getStripeAcct(db *gorm.DB) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		var conf types.MerchantConfig
@@ -74,6 +126,7 @@ func getStripeAcct(db *gorm.DB) gin.HandlerFunc {
 		c.Set("fee_pct", conf.FeePercent)
 		c.Set("stripe_managed", conf.StripeManagedProds)
 		c.Set("fuel_surcharge", conf.FuelSurcharge)
+		c.Set("deposits_enabled", conf.DepositsEnabled)
 		c.Next()
 	}
 }
@@ -89,12 +142,19 @@ func main() {
 		log.Fatal(err)
 	}
 	defer db.Close()
+	authDB = db
+	hadDepositSettings := db.Dialect().HasColumn("merchant_configs", "deposits_enabled")
+	hadMailSettings := db.Dialect().HasColumn("merchant_configs", "mail_domain")
+	hadDepositNotify := db.Dialect().HasColumn("merchant_configs", "deposit_notify")
 	db.AutoMigrate(&types.Product{}, &types.Schedule{}, &types.ScheduleTime{}, &TicketCategory{}, &Report{},
 		&types.Transaction{}, &types.Payment{}, &types.Sale{}, &types.PayerInfo{}, &types.WebHookEvent{}, &types.Item{}, &types.SandboxInfo{},
 		&types.CheckoutOrder{}, &types.Payer{}, &types.PurchaseItem{}, &types.PurchaseUnit{}, &types.Capture{}, &types.MerchantConfig{},
 		&ManualOverride{}, &types.Refund{}, &types.Boat{}, &types.LogAction{}, &stripe.PaymentIntent{}, &stripe.LineItem{}, &types.TransferReq{},
 		&types.GiftCard{}, &stripe.ManualPayerInfo{}, &stripe.ManualDeposit{}, &stripe.DepositProduct{}, &stripe.DepositSchedule{},
-		&stripe.DepositPrice{}, &types.Show{}, &types.TicketUsage{})
+		&stripe.DepositPrice{}, &stripe.DepositBooking{}, &stripe.CharterBooking{}, &stripe.CharterPayment{}, &stripe.CharterQuote{}, &types.Show{}, &types.TicketUsage{}, &types.Customer{}, &types.Order{}, &types.OrderLine{},
+		&types.OrderPayment{}, &types.OrderRefund{}, &types.Notification{}, &types.SMSConsent{}, &types.SMSMessage{}, &cash.DrawerSession{},
+		&types.Reservation{}, &stripe.GroupOrder{}, &stripe.GroupMember{}, &types.EmailTemplate{}, &types.TripReminder{}, &types.DigestRun{},
+		&types.AuthDenial{})
 	db.Model(&types.Schedule{}).Association("TimeArray")
 	db.Model(&types.Schedule{}).Association("NotAvail")
 	db.Model(&types.Payment{}).Association("Payer.PayerInfo")
@@ -106,20 +166,48 @@ func main() {
 	db.Model(&types.PurchaseItem{}).AddForeignKey("checkout_id", "checkout_orders(id)", "CASCADE", "RESTRICT")
 	db.Model(&stripe.DepositProduct{}).Association("Prices")
 	db.Model(&stripe.DepositProduct{}).Association("Schedules")
+	db.Model(&types.OrderLine{}).AddForeignKey("order_id", "orders(id)", "CASCADE", "RESTRICT")
+	db.Model(&types.OrderPayment{}).AddForeignKey("order_id", "orders(id)", "CASCADE", "RESTRICT")
+	db.Model(&types.OrderRefund{}).AddForeignKey("order_id", "orders(id)", "CASCADE", "RESTRICT")
+
+	if !hadDepositSettings {
+		// merchants already taking deposits keep them when the setting arrives
+		db.Exec("UPDATE merchant_configs SET deposits_enabled = true WHERE id IN (SELECT merchant_id FROM deposit_products)")
+	}
+
+	if !hadDepositNotify {
+		// only these accounts were sent deposit emails before it was a setting
+		db.Exec("UPDATE merchant_configs SET deposit_notify = true WHERE stripe_key IN (?)",
+			[]string{"acct_1KajuuPBUMQYQx2b", "acct_1InCeDPOYCTX1AoD"})
+	}
+
+	if !hadMailSettings {
+		// paypal merchants already send their customer emails from their own domain
+		db.Exec(`UPDATE merchant_configs SET mail_domain = 'mg.' || split_part(email_from, '@', 2), mail_from = email_from
+			WHERE payment_type = 'paypal' AND email_from LIKE '%@%'`)
+		db.Exec("UPDATE merchant_configs SET mail_domain = 'mg.captree.com' WHERE mail_domain = 'mg.captreefishingticket.com'")
+	}
 
 	if err := db.Exec("CREATE EXTENSION IF NOT EXISTS hstore").Error; err != nil {
 		log.Fatal(err)
 	}
 
+	if err := createOrderSearchIndexes(db); err != nil {
+		log.Fatal(err)
+	}
+
 	// db.Exec("SET TIME ZONE 'America/New_York'")
 
 	port := os.Getenv("PORT")
 	if port == "" {
 		log.Fatal("must set $PORT")
 	}
+	if reminderHost == "" {
+		log.Fatal("must set $PUBLIC_HOST")
+	}
 
 	config := cors.DefaultConfig()
-	config.AllowHeaders = append(config.AllowHeaders, "Authorization", "x-calendar-origin")
+	config.AllowHeaders = append(config.AllowHeaders, "Authorization", "x-calendar-origin", AdminMerchantHeader)
 	config.AllowOrigins = []string{"*"}
 
 	router := gin.New()
@@ -135,12 +223,25 @@ func main() {
 	addUserRoutes(merchant, db)
 	addMerchantConfigRoutes(merchant, db)
 	addShowRoutes(merchant, db)
-	stripe.AddStripeRoutes(merchant, getStripeAcct(db), db)
+	addOrderRoutes(merchant, db)
+	addEmailTemplateRoutes(merchant, db)
+	addReminderRoutes(merchant, db)
+	addNotificationRoutes(merchant, db)
+	addInboxRoutes(merchant, db)
+	addDigestRoutes(merchant, db)
+	stripe.AddStripeRoutes(merchant, getStripeAcct(db), checkJWT(), logActionMiddle(db), db)
+	cash.AddPOSRoutes(merchant, checkJWT(), logActionMiddle(db), db)
 	merchant.GET("/passes/:checkoutid", GetBoardingPasses(db))
 	merchant.GET("/logactions", checkJWT(), getLogActions(db))
+	merchant.GET("/authdenials", checkJWT(), getAuthDenials(db))
 
 	router.POST("/stripehook", stripe.StripeWebhook(db))
 	router.POST("/paypal", HandlePaypalWebhook(db))
+	router.POST("/webhooks/mailgun", MailgunWebhook(db))
+	router.POST("/webhooks/twilio", TwilioStatusWebhook(db))
+	router.POST("/webhooks/twilio/inbound", TwilioInboundWebhook(db))
+	router.GET("/inbox/unassigned", checkJWT(), ListUnassigned(db))
+	router.PUT("/inbox/unassigned/:id", checkJWT(), AssignMessage(db))
 	router.POST("/confirmed", ConfirmAndSend(db))
 	router.POST("/sendmail", Resend(db))
 	router.POST("/sendtext", SendText(db))
@@ -148,6 +249,13 @@ func main() {
 	router.GET("/transaction/:transaction", GetItems(db))
 	// router.POST("/sendrefund", RefundReq(db))
 
+	go stripe.RefreshPaymentIntents(db, 10*time.Minute)
+	go stripe.SendCharterBalanceLinks(db, time.Hour)
+	go cash.ReleaseExpiredReservations(db, time.Minute)
+	go stripe.ReleaseUnpaidGroupSeats(db, time.Minute)
+	go SendTripReminders(db, 5*time.Minute)
+	go SendDigests(db, 5*time.Minute)
+
 	srv := &http.Server{
 		Addr:    ":" + port,
 		Handler: router,
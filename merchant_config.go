@@ -5,12 +5,15 @@ import (
 
 	"github.com/gin-gonic/gin"
 	"github.com/jinzhu/gorm"
+	"github.com/lib/pq"
 	"github.com/zeroshade/tmsapi/types"
 )
 
 func addMerchantConfigRoutes(router *gin.RouterGroup, db *gorm.DB) {
 	router.GET("/config", GetMerchantConfig(db))
 	router.PUT("/config", checkJWT(), logActionMiddle(db), UpdateMerchantConfig(db))
+	router.PUT("/config/deposits", checkJWT(), logActionMiddle(db), UpdateDepositSettings(db))
+	router.PUT("/config/mail", checkJWT(), logActionMiddle(db), UpdateMailSender(db))
 }
 
 func GetMerchantConfig(db *gorm.DB) gin.HandlerFunc {
@@ -29,8 +32,76 @@ func UpdateMerchantConfig(db *gorm.DB) gin.HandlerFunc {
 			return
 		}
 
+		if conf.Locale != "" && types.ParseLocale(conf.Locale) != conf.Locale {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "unsupported locale " + conf.Locale})
+			return
+		}
+
 		conf.ID = c.Param("merchantid")
 		db.Model(&conf).Update(&conf)
 		c.Status(http.StatusOK)
 	}
 }
+
+// UpdateMailSender sets the domain and address a merchant's email goes out
+// from. Only platform admins can, since the domain has to be set up in
+// mailgun first.
+func UpdateMailSender(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !c.GetBool("admin") {
+			c.JSON(http.StatusForbidden, gin.H{"error": "only admins can change the mail sender"})
+			return
+		}
+
+		var data struct {
+			MailDomain string `json:"mailDomain"`
+			MailFrom   string `json:"mailFrom"`
+		}
+		if err := c.ShouldBindJSON(&data); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		res := db.Model(&types.MerchantConfig{}).Where("id = ?", c.Param("merchantid")).
+			Updates(map[string]interface{}{"mail_domain": data.MailDomain, "mail_from": data.MailFrom})
+		if res.Error != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": res.Error.Error()})
+			return
+		}
+		c.Status(http.StatusOK)
+	}
+}
+
+// UpdateDepositSettings is separate from the merchant config so deposits and
+// their notifications can be switched off, which a struct update would skip
+func UpdateDepositSettings(db *gorm.DB) gin.HandlerFunc {
+	type settings struct {
+		Enabled      bool     `json:"depositsEnabled"`
+		Notify       bool     `json:"depositNotify"`
+		EmailContent string   `json:"depositEmailContent"`
+		NotifyEmails []string `json:"depositNotifyEmails"`
+		SendSMS      bool     `json:"depositSendSMS"`
+	}
+
+	return func(c *gin.Context) {
+		var req settings
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		err := db.Model(&types.MerchantConfig{}).Where("id = ?", c.Param("merchantid")).
+			Updates(map[string]interface{}{
+				"deposits_enabled":      req.Enabled,
+				"deposit_notify":        req.Notify,
+				"deposit_email_content": req.EmailContent,
+				"deposit_notify_emails": pq.StringArray(req.NotifyEmails),
+				"deposit_send_sms":      req.SendSMS,
+			}).Error
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, req)
+	}
+}
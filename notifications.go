@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+	"github.com/zeroshade/tmsapi/internal"
+	"github.com/zeroshade/tmsapi/types"
+)
+
+var mailgunSigningKey = os.Getenv("MAILGUN_WEBHOOK_SIGNING_KEY")
+
+// mailgunMaxAge is how old a signed webhook can be before it's treated as a
+// replay
+const mailgunMaxAge = 5 * time.Minute
+
+func addNotificationRoutes(router *gin.RouterGroup, db *gorm.DB) {
+	router.GET("/notifications", checkJWT(), ListNotifications(db))
+	router.POST("/notifications/:id/resend", checkJWT(), logActionMiddle(db), ResendNotification(db))
+}
+
+var notificationList = &internal.ListSpec{
+	Sortable: map[string]string{"id": "id", "created": "created_at", "status": "status", "channel": "channel"},
+	Filterable: map[string]string{
+		"orderId": "order_id", "status": "status", "channel": "channel", "template": "template", "recipient": "recipient",
+		"relatedTo": "related_to", "relatedId": "related_id",
+	},
+	DefaultSort: "created_at DESC, id DESC",
+}
+
+func ListNotifications(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		params, err := internal.BindListQuery(c, notificationList)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		scope, res, err := notificationList.Apply(db.Model(&types.Notification{}).Where("merchant_id = ?", c.Param("merchantid")), params)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		var out []types.Notification
+		scope.Find(&out)
+		res.SetHeaders(c)
+		c.JSON(http.StatusOK, out)
+	}
+}
+
+// ResendNotification sends a logged message again, optionally to a
+// different address. Passes are regenerated rather than kept, so a resent
+// purchase email has the passes as they are now.
+func ResendNotification(db *gorm.DB) gin.HandlerFunc {
+	type resendReq struct {
+		To string `json:"to"`
+	}
+
+	return func(c *gin.Context) {
+		var req resendReq
+		if c.Request.ContentLength > 0 {
+			if err := c.ShouldBindJSON(&req); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+		}
+
+		var n types.Notification
+		db.Find(&n, "id = ? AND merchant_id = ?", c.Param("id"), c.Param("merchantid"))
+		if n.ID == 0 {
+			c.JSON(http.StatusNotFound, gin.H{"error": "notification not found"})
+			return
+		}
+		if n.Body == "" && n.HTML == "" {
+			c.JSON(http.StatusConflict, gin.H{"error": "notification was logged before its content was kept"})
+			return
+		}
+
+		var conf types.MerchantConfig
+		db.Find(&conf, "id = ?", n.MerchantID)
+
+		to := n.Recipient
+		if req.To != "" {
+			to = req.To
+		}
+
+		var err error
+		switch n.Channel {
+		case types.ChannelEmail:
+			m := internal.NewMerchantMessage(&conf, n.Subject, n.Body, n.HTML, to)
+			if n.Domain != "" {
+				m.Domain, m.From = n.Domain, n.Sender
+			}
+			if strings.Contains(n.Attachment, "boardingpasses.pdf") {
+				handler, ok := paymentHandler(c, &conf)
+				if !ok {
+					return
+				}
+				var pdf bytes.Buffer
+				items, name, email := passItems(db, &conf, handler, n.OrderID)
+				internal.GeneratePdf(db, items, conf.PassTitle, name, email, types.OrderLocale(db, &conf, n.OrderID), &pdf)
+				m.Attach("boardingpasses.pdf", pdf.Bytes())
+			}
+			if strings.Contains(n.Attachment, "trip.ics") {
+				link := "https://" + c.Request.Host + "/info/" + conf.ID + "/passes/" + n.OrderID
+				if ics := types.OrderCalendar(db, &conf, n.OrderID, link); ics != nil {
+					m.Attach("trip.ics", ics)
+				}
+			}
+			err = internal.SendEmailFor(db, &types.Notification{
+				MerchantID: conf.ID, OrderID: n.OrderID, RelatedTo: n.RelatedTo, RelatedID: n.RelatedID, Template: n.Template,
+			}, m)
+		case types.ChannelSMS:
+			err = internal.SendSMS(db, &conf, n.OrderID, n.Template, to, n.Body)
+		default:
+			c.JSON(http.StatusBadRequest, gin.H{"error": "unknown channel " + n.Channel})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusFailedDependency, gin.H{"error": err.Error()})
+			return
+		}
+
+		var sent types.Notification
+		db.Where("merchant_id = ? AND order_id = ? AND related_to = ? AND related_id = ? AND channel = ?",
+			n.MerchantID, n.OrderID, n.RelatedTo, n.RelatedID, n.Channel).
+			Order("id desc").First(&sent)
+		c.JSON(http.StatusOK, sent)
+	}
+}
+
+// MailgunWebhook takes delivered, failed and complained events from mailgun
+func MailgunWebhook(db *gorm.DB) gin.HandlerFunc {
+	type event struct {
+		Signature struct {
+			Timestamp string `json:"timestamp"`
+			Token     string `json:"token"`
+			Signature string `json:"signature"`
+		} `json:"signature"`
+		Data struct {
+			Event    string `json:"event"`
+			Severity string `json:"severity"`
+			Reason   string `json:"reason"`
+			Message  struct {
+				Headers struct {
+					MessageID string `json:"message-id"`
+				} `json:"headers"`
+			} `json:"message"`
+			DeliveryStatus struct {
+				Message     string `json:"message"`
+				Description string `json:"description"`
+			} `json:"delivery-status"`
+		} `json:"event-data"`
+	}
+
+	return func(c *gin.Context) {
+		var ev event
+		if err := c.ShouldBindJSON(&ev); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		mac := hmac.New(sha256.New, []byte(mailgunSigningKey))
+		mac.Write([]byte(ev.Signature.Timestamp + ev.Signature.Token))
+		if mailgunSigningKey == "" || !hmac.Equal([]byte(hex.EncodeToString(mac.Sum(nil))), []byte(ev.Signature.Signature)) {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid signature"})
+			return
+		}
+
+		ts, err := strconv.ParseInt(ev.Signature.Timestamp, 10, 64)
+		if age := time.Since(time.Unix(ts, 0)); err != nil || age > mailgunMaxAge || age < -mailgunMaxAge {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "stale signature"})
+			return
+		}
+
+		var status string
+		switch ev.Data.Event {
+		case "delivered":
+			status = types.NotifyDelivered
+		case "failed":
+			// temporary failures are retried by mailgun
+			if ev.Data.Severity != "permanent" {
+				c.Status(http.StatusOK)
+				return
+			}
+			status = types.NotifyBounced
+		case "rejected":
+			status = types.NotifyFailed
+		case "complained":
+			status = types.NotifyComplained
+		default:
+			c.Status(http.StatusOK)
+			return
+		}
+
+		detail := ev.Data.DeliveryStatus.Description
+		if detail == "" {
+			detail = ev.Data.DeliveryStatus.Message
+		}
+		if detail == "" {
+			detail = ev.Data.Reason
+		}
+
+		id := strings.Trim(ev.Data.Message.Headers.MessageID, "<>")
+		if err := types.UpdateNotificationStatus(db, types.ChannelEmail, id, status, detail); err != nil && err != gorm.ErrRecordNotFound {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.Status(http.StatusOK)
+	}
+}
+
+// TwilioStatusWebhook takes message status callbacks from twilio
+func TwilioStatusWebhook(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if err := c.Request.ParseForm(); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		sid := c.Request.PostForm.Get("MessageSid")
+
+		var n types.Notification
+		db.Where("channel = ? AND provider_id = ?", types.ChannelSMS, sid).First(&n)
+		if n.ID == 0 {
+			c.Status(http.StatusOK)
+			return
+		}
+
+		var conf types.MerchantConfig
+		db.Find(&conf, "id = ?", n.MerchantID)
+		if !internal.ValidTwilioSignature(internal.TwilioAuthToken(&conf), internal.TwilioStatusCallback,
+			c.Request.PostForm, c.GetHeader("X-Twilio-Signature")) {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid signature"})
+			return
+		}
+
+		var status string
+		switch c.Request.PostForm.Get("MessageStatus") {
+		case "delivered":
+			status = types.NotifyDelivered
+		case "undelivered", "failed":
+			status = types.NotifyFailed
+		default:
+			c.Status(http.StatusOK)
+			return
+		}
+
+		detail := c.Request.PostForm.Get("ErrorCode")
+		if detail != "" {
+			detail = "twilio error " + detail
+		}
+		if err := types.UpdateNotificationStatus(db, types.ChannelSMS, sid, status, detail); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.Status(http.StatusOK)
+	}
+}
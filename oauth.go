@@ -9,6 +9,7 @@ import (
 	"github.com/gin-gonic/gin"
 	"github.com/jinzhu/gorm"
 	"github.com/zeroshade/tmsapi/internal"
+	"github.com/zeroshade/tmsapi/types"
 )
 
 var auth0Client *internal.Auth0Client
@@ -20,8 +21,34 @@ func init() {
 func addUserRoutes(router *gin.RouterGroup, db *gorm.DB) {
 	router.GET("/users", checkJWT(), getUsers())
 	router.POST("/user", checkJWT(), logActionMiddle(db), createUser())
-	router.DELETE("/user/:userid", checkJWT(), logActionMiddle(db), deleteUser())
-	router.POST("/user/:userid/passwd", checkJWT(), logActionMiddle(db), resetPass())
+	router.DELETE("/user/:userid", checkJWT(), merchantUser(), logActionMiddle(db), deleteUser())
+	router.POST("/user/:userid/passwd", checkJWT(), merchantUser(), logActionMiddle(db), resetPass())
+}
+
+// merchantUser stops staff managing users that belong to another merchant
+func merchantUser() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		u, err := auth0Client.GetUserByID(c.Param("userid"))
+		if err != nil {
+			c.JSON(http.StatusFailedDependency, gin.H{"error": err.Error()})
+			c.Abort()
+			return
+		}
+
+		var mid string
+		json.Unmarshal(u.AppMetadata["merchant_id"], &mid)
+		if mid != c.Param("merchantid") {
+			auditDenial(c, types.AuthDenial{
+				UserID:        c.GetString("user_id"),
+				TokenMerchant: c.GetString("merchant_id"),
+				Reason:        "user " + c.Param("userid") + " belongs to another merchant",
+			})
+			c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
 }
 
 func resetPass() gin.HandlerFunc {
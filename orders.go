@@ -0,0 +1,226 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+	"github.com/zeroshade/tmsapi/internal"
+	"github.com/zeroshade/tmsapi/types"
+)
+
+var nonDigitRe = regexp.MustCompile(`\D`)
+
+// likeEscaper quotes the LIKE wildcards so an id only matches itself
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+func addOrderRoutes(router *gin.RouterGroup, db *gorm.DB) {
+	router.GET("/orders/search", checkJWT(), SearchOrders(db))
+	router.GET("/order/:id", checkJWT(), GetOrderDetail(db))
+}
+
+// createOrderSearchIndexes sets up the trigram indexes that SearchOrders
+// relies on for partial name, email and phone matches
+func createOrderSearchIndexes(db *gorm.DB) error {
+	stmts := []string{
+		"CREATE EXTENSION IF NOT EXISTS pg_trgm",
+		`CREATE INDEX IF NOT EXISTS idx_customers_search ON customers USING gin ((name || ' ' || email) gin_trgm_ops)`,
+		`CREATE INDEX IF NOT EXISTS idx_customers_phone ON customers USING gin ((regexp_replace(phone, '\D', '', 'g')) gin_trgm_ops)`,
+		`CREATE INDEX IF NOT EXISTS idx_orders_id_trgm ON orders USING gin (id gin_trgm_ops)`,
+	}
+
+	for _, s := range stmts {
+		if err := db.Exec(s).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var orderSearchList = &internal.ListSpec{
+	Sortable: map[string]string{
+		"created":  "o.created_at",
+		"status":   "o.status",
+		"provider": "o.provider",
+		"total":    "o.total",
+	},
+	DefaultSort: "o.created_at desc, o.id desc",
+}
+
+// SearchOrders finds orders for a merchant across every payment provider.
+// The text query matches partial customer names, emails and phone numbers
+// as well as order ids, and can be combined with departure and purchase
+// date ranges, a product, a status and a provider.
+func SearchOrders(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		scope := db.Table("orders AS o").
+			Joins("LEFT JOIN customers AS cu ON cu.id = o.customer_id").
+			Where("o.merchant_id = ?", c.Param("merchantid"))
+
+		if q := strings.TrimSpace(c.Query("q")); q != "" {
+			like := "%" + q + "%"
+			cond := "(cu.name || ' ' || cu.email) ILIKE ? OR o.id ILIKE ?"
+			args := []interface{}{like, like}
+			if digits := nonDigitRe.ReplaceAllString(q, ""); len(digits) >= 3 {
+				cond += ` OR regexp_replace(cu.phone, '\D', '', 'g') LIKE ?`
+				args = append(args, "%"+digits+"%")
+			}
+			scope = scope.Where(cond, args...)
+		}
+
+		lines := db.Table("order_lines AS ol").Select("1").Where("ol.order_id = o.id")
+		filterLines := false
+		if from := c.Query("departFrom"); from != "" {
+			lines = lines.Where("ol.departure >= ?::date", from)
+			filterLines = true
+		}
+		if to := c.Query("departTo"); to != "" {
+			lines = lines.Where("ol.departure < ?::date + 1", to)
+			filterLines = true
+		}
+		if pid := c.Query("product"); pid != "" {
+			lines = lines.Where("ol.product_id = ?", pid)
+			filterLines = true
+		}
+		if filterLines {
+			scope = scope.Where("EXISTS ?", lines.SubQuery())
+		}
+
+		if from := c.Query("purchasedFrom"); from != "" {
+			scope = scope.Where("o.created_at >= ?::date", from)
+		}
+		if to := c.Query("purchasedTo"); to != "" {
+			scope = scope.Where("o.created_at < ?::date + 1", to)
+		}
+		if status := c.Query("status"); status != "" {
+			scope = scope.Where("o.status = ?", strings.ToLower(status))
+		}
+		if provider := c.Query("provider"); provider != "" {
+			scope = scope.Where("o.provider = ?", strings.ToLower(provider))
+		}
+
+		params, err := internal.BindListQuery(c, orderSearchList)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if params.PerPage == 0 {
+			params.PerPage = 50
+		}
+
+		scope, res, err := orderSearchList.Apply(scope, params)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		var ids []string
+		scope.Pluck("o.id", &ids)
+
+		byID := make(map[string]types.Order, len(ids))
+		var found []types.Order
+		db.Preload("Customer").Preload("Lines").Where("id IN (?)", ids).Find(&found)
+		for _, o := range found {
+			byID[o.ID] = o
+		}
+
+		orders := make([]types.Order, 0, len(ids))
+		for _, id := range ids {
+			orders = append(orders, byID[id])
+		}
+
+		c.JSON(http.StatusOK, gin.H{"total": res.Total, "nextCursor": res.NextCursor, "orders": orders})
+	}
+}
+
+// OrderEvent is a single entry in the timeline of an order
+type OrderEvent struct {
+	Time    time.Time   `json:"time"`
+	Type    string      `json:"type"`
+	Summary string      `json:"summary"`
+	Data    interface{} `json:"data"`
+}
+
+// GetOrderDetail returns everything that happened to a single order, along
+// with all of it merged into a chronological timeline
+func GetOrderDetail(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var order types.Order
+		db.Preload("Customer").Preload("Lines").Preload("Payments").Preload("Refunds").
+			Where("merchant_id = ? AND (id = ? OR provider_ref = ?)", c.Param("merchantid"), c.Param("id"), c.Param("id")).
+			First(&order)
+
+		if order.ID == "" {
+			c.JSON(http.StatusNotFound, gin.H{"error": "order not found"})
+			return
+		}
+
+		lineIDs := make([]string, 0, len(order.Lines))
+		for _, l := range order.Lines {
+			lineIDs = append(lineIDs, l.ID)
+		}
+
+		// paypal transfers are keyed by the checkout and the old sku
+		var transfers []types.TransferReq
+		db.Where("line_item_id IN (?) OR line_item_id || ':' || old_sku IN (?)", lineIDs, lineIDs).
+			Order("created_at").Find(&transfers)
+
+		var checkins []types.TicketUsage
+		db.Where("ticket_id ^@ ?", order.ProviderRef+"-").Find(&checkins)
+
+		var notifications []types.Notification
+		db.Where("order_id = ?", order.ID).Order("created_at").Find(&notifications)
+
+		var actions []types.LogAction
+		cond := make([]string, 0, len(lineIDs)+1)
+		args := []interface{}{c.Param("merchantid")}
+		for _, id := range append([]string{order.ID}, lineIDs...) {
+			like := "%" + likeEscaper.Replace(id) + "%"
+			cond = append(cond, `url LIKE ? ESCAPE '\' OR payload::text LIKE ? ESCAPE '\'`)
+			args = append(args, like, like)
+		}
+		db.Where("merchant_id = ? AND ("+strings.Join(cond, " OR ")+")", args...).Order("created_at").Find(&actions)
+
+		timeline := []OrderEvent{{Time: order.CreatedAt, Type: "created", Summary: "Order placed via " + order.Provider, Data: order.Lines}}
+		for _, p := range order.Payments {
+			timeline = append(timeline, OrderEvent{p.CreatedAt, "payment", fmt.Sprintf("Payment %s %s", p.Amount, p.Status), p})
+		}
+		for _, r := range order.Refunds {
+			timeline = append(timeline, OrderEvent{r.CreatedAt, "refund", fmt.Sprintf("Refund %s %s", r.Amount, r.Status), r})
+		}
+		for _, t := range transfers {
+			timeline = append(timeline, OrderEvent{t.CreatedAt, "transfer", "Transferred to " + t.NewName, t})
+		}
+		for _, u := range checkins {
+			summary := "Checked in " + u.TicketID
+			if !u.Used {
+				summary = "Check in cleared " + u.TicketID
+			}
+			timeline = append(timeline, OrderEvent{u.UpdatedAt, "checkin", summary, u})
+		}
+		for _, n := range notifications {
+			timeline = append(timeline, OrderEvent{n.CreatedAt, "notification", fmt.Sprintf("%s sent to %s: %s", n.Channel, n.Recipient, n.Subject), n})
+		}
+		for _, a := range actions {
+			timeline = append(timeline, OrderEvent{a.CreatedAt, "action", a.Method + " " + a.Url, a})
+		}
+
+		sort.SliceStable(timeline, func(i, j int) bool {
+			return timeline[i].Time.Before(timeline[j].Time)
+		})
+
+		c.JSON(http.StatusOK, gin.H{
+			"order":         order,
+			"transfers":     transfers,
+			"checkins":      checkins,
+			"notifications": notifications,
+			"actions":       actions,
+			"timeline":      timeline,
+		})
+	}
+}
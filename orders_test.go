@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/zeroshade/tmsapi/internal/dbtest"
+)
+
+func TestGetOrderDetailMatches(t *testing.T) {
+	db, d := dbtest.Open(t)
+	d.Returns(`FROM "orders"`, []string{"id", "merchant_id", "provider", "provider_ref"},
+		[]interface{}{"pi_1a", "m1", "stripe", "pi_1a"})
+	d.Returns(`FROM "order_lines"`, []string{"id", "order_id", "provider_ref", "sku"},
+		[]interface{}{"li_1", "pi_1a", "sku_trip", "sku_trip"})
+
+	gin.SetMode(gin.TestMode)
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Params = gin.Params{{Key: "merchantid", Value: "m1"}, {Key: "id", Value: "pi_1a"}}
+	GetOrderDetail(db)(c)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+
+	tr := d.Statements(`FROM "transfer_reqs"`)
+	if len(tr) != 1 {
+		t.Fatalf("looked up transfers %d times", len(tr))
+	}
+	for _, a := range tr[0].Args {
+		if a != "li_1" {
+			t.Errorf("transfers matched on %v, want only the line id", a)
+		}
+	}
+
+	acts := d.Statements(`FROM "log_actions"`)
+	if len(acts) != 1 {
+		t.Fatalf("looked up actions %d times", len(acts))
+	}
+	want := []interface{}{"m1", `%pi\_1a%`, `%pi\_1a%`, `%li\_1%`, `%li\_1%`}
+	if len(acts[0].Args) != len(want) {
+		t.Fatalf("action args = %v, want %v", acts[0].Args, want)
+	}
+	for idx, w := range want {
+		if acts[0].Args[idx] != w {
+			t.Errorf("action arg %d = %v, want %v", idx, acts[0].Args[idx], w)
+		}
+	}
+
+	if ck := d.Statements(`FROM "ticket_usages"`); len(ck) != 1 || ck[0].Args[0] != "pi_1a-" {
+		t.Errorf("check ins = %+v", ck)
+	}
+}
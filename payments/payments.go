@@ -0,0 +1,94 @@
+package payments
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/jinzhu/gorm"
+	"github.com/zeroshade/tmsapi/types"
+)
+
+// StaffKey is the gorm setting handlers put the signed in user under so that
+// providers can record who took a payment or made a refund
+const StaffKey = "payments:staff"
+
+// PaymentHandler is implemented by each payment provider a merchant can be
+// configured with
+type PaymentHandler interface {
+	OrdersTimestamp(config *types.MerchantConfig, db *gorm.DB, timestamp string) (interface{}, error)
+	GetSoldTickets(config *types.MerchantConfig, db *gorm.DB, from, to string) (interface{}, error)
+	GetPassItems(conf *types.MerchantConfig, db *gorm.DB, id string) ([]types.PassItem, string, string)
+	RefundTickets(config *types.MerchantConfig, db *gorm.DB, data json.RawMessage) (interface{}, error)
+	TransferTickets(config *types.MerchantConfig, db *gorm.DB, data []types.TransferReq) (interface{}, error)
+	ManualEntry(config *types.MerchantConfig, db *gorm.DB, entry types.Manual) (interface{}, error)
+	RedeemTickets(config *types.MerchantConfig, db *gorm.DB, data json.RawMessage) (interface{}, error)
+}
+
+var (
+	mu       sync.RWMutex
+	registry = make(map[string]PaymentHandler)
+)
+
+// Register makes a provider available under the payment type name merchants
+// are configured with. It panics if the name is registered twice.
+func Register(name string, h PaymentHandler) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if h == nil {
+		panic("payments: Register handler is nil")
+	}
+	if _, dup := registry[name]; dup {
+		panic("payments: Register called twice for " + name)
+	}
+	registry[name] = h
+}
+
+// Get returns the provider registered for a payment type
+func Get(paymentType string) (PaymentHandler, error) {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	h, ok := registry[paymentType]
+	if !ok {
+		if paymentType == "" {
+			return nil, fmt.Errorf("no payment type configured")
+		}
+		return nil, fmt.Errorf("unknown payment type %q", paymentType)
+	}
+	return h, nil
+}
+
+// For returns the provider the merchant is configured to use
+func For(config *types.MerchantConfig) (PaymentHandler, error) {
+	return Get(config.PaymentType)
+}
+
+// Providers lists the registered payment type names
+func Providers() []string {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	out := make([]string, 0, len(registry))
+	for name := range registry {
+		out = append(out, name)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// WithStaff returns a db handle carrying the staff member for providers
+func WithStaff(db *gorm.DB, staff string) *gorm.DB {
+	return db.Set(StaffKey, staff)
+}
+
+// Staff returns the staff member set on the db handle, if any
+func Staff(db *gorm.DB) string {
+	if v, ok := db.Get(StaffKey); ok {
+		s, _ := v.(string)
+		return s
+	}
+	return ""
+}
@@ -126,6 +126,19 @@ func HandlePaypalWebhook(db *gorm.DB) gin.HandlerFunc {
 					db.Find(&capture)
 					db.Model(&types.CheckoutOrder{}).Where("id = ?", capture.CheckoutID).Update("status", "REFUNDED")
 
+					err = types.RecordRefund(db, &types.OrderRefund{
+						ID:          val.ID,
+						OrderID:     capture.CheckoutID,
+						Provider:    types.ProviderPayPal,
+						ProviderRef: val.ID,
+						Status:      strings.ToLower(val.Status),
+						Amount:      val.Amount.Value,
+						CreatedAt:   val.CreateTime,
+					})
+					if err != nil {
+						log.Println("Record Refund Error:", capture.CheckoutID, val.ID, err)
+					}
+
 					var items []types.PurchaseItem
 					db.Find(&items, "checkout_id = ?", capture.CheckoutID)
 
@@ -0,0 +1,73 @@
+package paypal
+
+import (
+	"strings"
+
+	"github.com/jinzhu/gorm"
+	"github.com/zeroshade/tmsapi/types"
+)
+
+// LineID returns the unified order line id for the item with the given
+// original sku on a checkout order
+func LineID(checkoutID, sku string) string {
+	return checkoutID + ":" + sku
+}
+
+// ToOrder converts a checkout order, with its purchase units, items and
+// captures loaded, into the unified order schema
+func ToOrder(merchantID string, co *types.CheckoutOrder) *types.Order {
+	o := &types.Order{
+		ID:          co.ID,
+		MerchantID:  merchantID,
+		Provider:    types.ProviderPayPal,
+		ProviderRef: co.ID,
+		Status:      strings.ToLower(co.Status),
+		CreatedAt:   co.CreateTime,
+	}
+
+	if co.Payer != nil {
+		o.Customer = &types.Customer{
+			Name:  strings.TrimSpace(co.Payer.Name.GivenName + " " + co.Payer.Name.Surname),
+			Email: co.Payer.Email,
+			Phone: co.Payer.Phone.PhoneNumber.NationalNumber,
+		}
+	}
+
+	for _, pu := range co.PurchaseUnits {
+		if o.Total == "" {
+			o.Total = pu.Amount.Value
+		}
+
+		for _, item := range pu.Items {
+			o.Lines = append(o.Lines, types.OrderLine{
+				ID:          LineID(co.ID, item.Sku),
+				ProviderRef: item.Sku,
+				Sku:         item.Sku,
+				Name:        item.Name,
+				Description: item.Description,
+				Quantity:    item.Quantity,
+				UnitPrice:   item.Amount.Value,
+				Amount:      types.FormatMoney(types.ParseMoney(item.Amount.Value) * float64(item.Quantity)),
+				Status:      o.Status,
+			})
+		}
+
+		for _, cap := range pu.Payments.Captures {
+			o.Payments = append(o.Payments, types.OrderPayment{
+				ID:          cap.ID,
+				Provider:    types.ProviderPayPal,
+				ProviderRef: cap.ID,
+				Status:      strings.ToLower(cap.Status),
+				Amount:      cap.Amount.Value,
+				CreatedAt:   cap.CreateTime,
+			})
+		}
+	}
+
+	return o
+}
+
+// RecordOrder writes a checkout order into the unified order schema
+func RecordOrder(db *gorm.DB, merchantID string, co *types.CheckoutOrder) error {
+	return types.SaveOrder(db, ToOrder(merchantID, co))
+}
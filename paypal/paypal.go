@@ -12,6 +12,7 @@ import (
 	"github.com/google/uuid"
 	"github.com/jinzhu/gorm"
 	"github.com/lib/pq"
+	"github.com/zeroshade/tmsapi/payments"
 	"github.com/zeroshade/tmsapi/types"
 )
 
@@ -19,6 +20,7 @@ var timeloc *time.Location
 
 func init() {
 	timeloc, _ = time.LoadLocation("America/New_York")
+	payments.Register(types.ProviderPayPal, Handler{})
 }
 
 type Handler struct{}
@@ -58,6 +60,7 @@ func (h Handler) TransferTickets(conig *types.MerchantConfig, db *gorm.DB, data
 			UpdateColumn("avail", gorm.Expr("avail - ?", r[0].Quantity))
 
 		db.Save(&data[idx])
+		types.TransferOrderLine(db, LineID(data[idx].LineItemID, data[idx].OldSku), data[idx].NewSKU, data[idx].NewName)
 	}
 	return nil, nil
 }
@@ -188,5 +191,9 @@ func (h Handler) ManualEntry(config *types.MerchantConfig, db *gorm.DB, entry ty
 	co.PurchaseUnits[0].Payee.Email = config.EmailFrom
 
 	db.Save(&co)
+
+	o := ToOrder(config.ID, co)
+	o.Provider = types.ProviderManual
+	types.SaveOrder(db, o)
 	return nil, nil
 }
@@ -5,6 +5,7 @@ import (
 
 	"github.com/gin-gonic/gin"
 	"github.com/jinzhu/gorm"
+	"github.com/zeroshade/tmsapi/internal"
 	"github.com/zeroshade/tmsapi/stripe"
 	"github.com/zeroshade/tmsapi/types"
 )
@@ -20,10 +21,28 @@ func addProductRoutes(router *gin.RouterGroup, db *gorm.DB) {
 	router.DELETE("/boats", checkJWT(), logActionMiddle(db), deleteBoat(db))
 }
 
+var boatList = &internal.ListSpec{
+	Sortable:    map[string]string{"id": "id", "name": "name"},
+	DefaultSort: "id",
+}
+
 func getBoats(db *gorm.DB) gin.HandlerFunc {
 	return func(c *gin.Context) {
+		params, err := internal.BindListQuery(c, boatList)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		scope, res, err := boatList.Apply(db.Model(&types.Boat{}).Where("merchant_id = ?", c.Param("merchantid")), params)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
 		var boats []types.Boat
-		db.Find(&boats, "merchant_id = ?", c.Param("merchantid"))
+		scope.Find(&boats)
+		res.SetHeaders(c)
 		c.JSON(http.StatusOK, boats)
 	}
 }
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+	"github.com/zeroshade/tmsapi/internal"
+	"github.com/zeroshade/tmsapi/types"
+)
+
+// reminderHost is the host pass links in reminders point to, main won't
+// start without it
+var reminderHost = os.Getenv("PUBLIC_HOST")
+
+func addReminderRoutes(router *gin.RouterGroup, db *gorm.DB) {
+	router.GET("/reminders", checkJWT(), ListTripReminders(db))
+	router.PUT("/reminders/settings", checkJWT(), logActionMiddle(db), UpdateReminderSettings(db))
+}
+
+func ListTripReminders(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		scope := db.Where("merchant_id = ?", c.Param("merchantid"))
+		if oid := c.Query("orderId"); oid != "" {
+			scope = scope.Where("order_id = ?", oid)
+		}
+
+		var out []types.TripReminder
+		if err := scope.Order("created_at desc").Limit(500).Find(&out).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, out)
+	}
+}
+
+// UpdateReminderSettings is separate from the merchant config so reminders
+// can be switched off, which a struct update would skip
+func UpdateReminderSettings(db *gorm.DB) gin.HandlerFunc {
+	type settings struct {
+		Enabled       bool   `json:"remindersEnabled"`
+		Hours         int    `json:"reminderHours"`
+		SMS           bool   `json:"reminderSMS"`
+		DockLocation  string `json:"dockLocation"`
+		WeatherNotice string `json:"weatherNotice"`
+	}
+
+	return func(c *gin.Context) {
+		var req settings
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if req.Hours < 1 || req.Hours > 168 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "reminderHours must be between 1 and 168"})
+			return
+		}
+
+		err := db.Model(&types.MerchantConfig{}).Where("id = ?", c.Param("merchantid")).
+			Updates(map[string]interface{}{
+				"reminders_enabled": req.Enabled,
+				"reminder_hours":    req.Hours,
+				"reminder_sms":      req.SMS,
+				"dock_location":     req.DockLocation,
+				"weather_notice":    req.WeatherNotice,
+			}).Error
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, req)
+	}
+}
+
+type reminderLine struct {
+	OrderID    string
+	MerchantID string
+	Departure  time.Time
+	Name       string
+	Quantity   uint
+	CustName   string
+	Email      string
+	Phone      string
+	Locale     string
+}
+
+// dueReminders finds the passengers departing within their merchant's
+// reminder window that haven't been reminded yet
+func dueReminders(db *gorm.DB) ([]reminderLine, error) {
+	var lines []reminderLine
+	err := db.Table("order_lines AS ol").
+		Joins("JOIN orders AS o ON o.id = ol.order_id").
+		Joins("JOIN merchant_configs AS mc ON mc.id = o.merchant_id").
+		Joins("LEFT JOIN customers AS cu ON cu.id = o.customer_id").
+		Joins("LEFT JOIN trip_reminders AS tr ON tr.order_id = o.id AND tr.departure = ol.departure").
+		Where("mc.reminders_enabled AND tr.order_id IS NULL").
+		Where("ol.status NOT IN ('refunded', 'released') AND o.status <> 'refunded'").
+		Where("ol.departure > now() AND ol.departure <= now() + mc.reminder_hours * interval '1 hour'").
+		Select("o.id AS order_id, o.merchant_id, ol.departure, ol.name, ol.quantity, cu.name AS cust_name, cu.email, cu.phone, o.locale").
+		Order("o.id, ol.departure").
+		Scan(&lines).Error
+	return lines, err
+}
+
+// SendTripReminders periodically emails, and texts if the merchant wants,
+// every passenger a reminder ahead of their departure
+func SendTripReminders(db *gorm.DB, interval time.Duration) {
+	for {
+		lines, err := dueReminders(db)
+		if err != nil {
+			log.Println("Trip Reminder Error:", err)
+		}
+
+		confs := make(map[string]*types.MerchantConfig)
+		for start := 0; start < len(lines); {
+			end := start + 1
+			for end < len(lines) && lines[end].OrderID == lines[start].OrderID && lines[end].Departure.Equal(lines[start].Departure) {
+				end++
+			}
+
+			conf, ok := confs[lines[start].MerchantID]
+			if !ok {
+				conf = &types.MerchantConfig{}
+				db.Find(conf, "id = ?", lines[start].MerchantID)
+				confs[conf.ID] = conf
+			}
+			sendTripReminder(db, conf, lines[start:end])
+			start = end
+		}
+		time.Sleep(interval)
+	}
+}
+
+func sendTripReminder(db *gorm.DB, conf *types.MerchantConfig, lines []reminderLine) {
+	first := lines[0]
+	r := &types.TripReminder{
+		OrderID:    first.OrderID,
+		Departure:  first.Departure,
+		MerchantID: first.MerchantID,
+		Email:      first.Email,
+		Phone:      first.Phone,
+	}
+	if ok, err := types.ClaimReminder(db, r); !ok {
+		if err != nil {
+			log.Println("Trip Reminder Claim Error:", first.OrderID, err)
+		}
+		return
+	}
+
+	locale := types.ResolveLocale(first.Locale, conf.Locale)
+	data := &types.EmailData{
+		Locale:        locale,
+		Name:          first.CustName,
+		Email:         first.Email,
+		Phone:         first.Phone,
+		OrderID:       first.OrderID,
+		Departure:     types.FormatDate(locale, first.Departure.In(timeloc), types.DateTime),
+		DockLocation:  conf.DockLocation,
+		WeatherNotice: conf.WeatherNotice,
+	}
+	data.PassLink = passLink(reminderHost, conf.ID, first.OrderID)
+	for _, l := range lines {
+		data.Items = append(data.Items, types.EmailItem{Name: l.Name, Quantity: int(l.Quantity)})
+	}
+
+	var errs []string
+	if first.Email != "" {
+		msg, err := types.RenderEmail(db, conf, types.EmailReminder, data)
+		if err == nil {
+			m := internal.NewMerchantMessage(conf, msg.Subject, msg.Text, msg.HTML, fmt.Sprintf("%s <%s>", first.CustName, first.Email))
+			err = internal.SendEmail(db, conf, first.OrderID, types.EmailReminder, m)
+		}
+		if err != nil {
+			errs = append(errs, "email: "+err.Error())
+		} else {
+			r.EmailSent = true
+		}
+	}
+
+	if conf.ReminderSMS && first.Phone != "" {
+		body := types.T(locale, "sms.reminder", conf.PassTitle, data.Departure)
+		if conf.DockLocation != "" {
+			body += types.T(locale, "sms.reminder_dock", conf.DockLocation)
+		}
+		if conf.WeatherNotice != "" {
+			body += " " + conf.WeatherNotice
+		}
+		body += types.T(locale, "sms.reminder_link", data.PassLink)
+		if err := internal.SendSMS(db, conf, first.OrderID, types.EmailReminder, first.Phone, body); err != nil {
+			errs = append(errs, "sms: "+err.Error())
+		} else {
+			r.SMSSent = true
+		}
+	}
+
+	if len(errs) > 0 {
+		r.Error = strings.Join(errs, "; ")
+		log.Println("Trip Reminder Error:", first.OrderID, r.Error)
+		if !r.EmailSent && !r.SMSSent {
+			// nothing reached them, let the next pass try again
+			db.Delete(r)
+			return
+		}
+	}
+	db.Model(r).Updates(map[string]interface{}{"email_sent": r.EmailSent, "sms_sent": r.SMSSent, "error": r.Error})
+}
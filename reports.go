@@ -6,6 +6,7 @@ import (
 
 	"github.com/gin-gonic/gin"
 	"github.com/jinzhu/gorm"
+	"github.com/zeroshade/tmsapi/internal"
 )
 
 func addReportRoutes(router *gin.RouterGroup, db *gorm.DB) {
@@ -23,11 +24,28 @@ type Report struct {
 	Content    string     `json:"content"`
 }
 
+var reportList = &internal.ListSpec{
+	Sortable:    map[string]string{"id": "id", "createdAt": "created_at", "updatedAt": "updated_at"},
+	DefaultSort: "created_at desc, id desc",
+}
+
 func GetReports(db *gorm.DB) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		var rep []Report
-		db.Order("created_at desc").Find(&rep, "merchant_id = ?", c.Param("merchantid"))
+		params, err := internal.BindListQuery(c, reportList)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
 
+		scope, res, err := reportList.Apply(db.Model(&Report{}).Where("merchant_id = ?", c.Param("merchantid")), params)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		var rep []Report
+		scope.Find(&rep)
+		res.SetHeaders(c)
 		c.JSON(http.StatusOK, rep)
 	}
 }
@@ -1,13 +1,13 @@
 package main
 
 import (
+	"encoding/json"
 	"net/http"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/jinzhu/gorm"
-	"github.com/zeroshade/tmsapi/paypal"
-	"github.com/zeroshade/tmsapi/stripe"
+	"github.com/zeroshade/tmsapi/payments"
 	"github.com/zeroshade/tmsapi/types"
 )
 
@@ -62,24 +62,71 @@ func saveOverride(db *gorm.DB) gin.HandlerFunc {
 
 		over.Time = over.Time.In(timeloc)
 
+		var prev ManualOverride
+		db.Where("product_id = ? AND time = ?", over.ProductID, over.Time).First(&prev)
 		db.Save(&over)
+
+		if over.Cancelled && !prev.Cancelled {
+			go sendTripCancelled(db, c.Param("merchantid"), c.Request.Host, over.ProductID, over.Time)
+		}
 	}
 }
 
+// sumSold merges the online and box office counts for each departure so a
+// trip sold through both shows up once with its total
+func sumSold(ret interface{}) (interface{}, error) {
+	type sold struct {
+		Stamp time.Time `json:"stamp"`
+		Qty   uint      `json:"qty"`
+		Pid   uint      `json:"pid"`
+	}
+	type departure struct {
+		pid   uint
+		stamp int64
+	}
+
+	buf, err := json.Marshal(ret)
+	if err != nil {
+		return nil, err
+	}
+	var rows []sold
+	if err := json.Unmarshal(buf, &rows); err != nil {
+		return nil, err
+	}
+
+	out := make([]sold, 0, len(rows))
+	seen := make(map[departure]int)
+	for _, r := range rows {
+		key := departure{r.Pid, r.Stamp.Unix()}
+		if idx, ok := seen[key]; ok {
+			out[idx].Qty += r.Qty
+			continue
+		}
+		seen[key] = len(out)
+		out = append(out, r)
+	}
+	return out, nil
+}
+
 func GetSoldTickets(db *gorm.DB) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		var config types.MerchantConfig
 		db.Find(&config, "id = ?", c.Param("merchantid"))
 
-		var handler PaymentHandler
-		switch config.PaymentType {
-		case "paypal":
-			handler = &paypal.Handler{}
-		case "stripe":
-			handler = &stripe.Handler{}
+		handler, ok := paymentHandler(c, &config)
+		if !ok {
+			return
 		}
 
 		ret, err := handler.GetSoldTickets(&config, db, c.Param("from"), c.Param("to"))
+		if err == nil {
+			ret, err = withBoxOffice(&config, ret, func(box payments.PaymentHandler) (interface{}, error) {
+				return box.GetSoldTickets(&config, db, c.Param("from"), c.Param("to"))
+			})
+		}
+		if err == nil {
+			ret, err = sumSold(ret)
+		}
 		if err != nil {
 			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		} else {
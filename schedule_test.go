@@ -0,0 +1,45 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestSumSold(t *testing.T) {
+	type row struct {
+		Stamp time.Time `json:"stamp"`
+		Qty   uint      `json:"qty"`
+		Pid   uint      `json:"pid"`
+	}
+	morning := time.Date(2024, 7, 4, 8, 0, 0, 0, timeloc)
+	evening := time.Date(2024, 7, 4, 18, 0, 0, 0, timeloc)
+
+	// online sales followed by the box office's, which reports in utc
+	sold := []json.RawMessage{}
+	for _, r := range []row{
+		{morning, 4, 1}, {evening, 2, 1}, {morning, 3, 2},
+		{morning.UTC(), 5, 1}, {evening.UTC(), 1, 2},
+	} {
+		buf, _ := json.Marshal(r)
+		sold = append(sold, buf)
+	}
+
+	out, err := sumSold(sold)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf, _ := json.Marshal(out)
+	var got []row
+	json.Unmarshal(buf, &got)
+
+	want := []row{{morning, 9, 1}, {evening, 2, 1}, {morning, 3, 2}, {evening, 1, 2}}
+	if len(got) != len(want) {
+		t.Fatalf("got %+v", got)
+	}
+	for idx := range want {
+		if !got[idx].Stamp.Equal(want[idx].Stamp) || got[idx].Qty != want[idx].Qty || got[idx].Pid != want[idx].Pid {
+			t.Errorf("row %d = %+v, want %+v", idx, got[idx], want[idx])
+		}
+	}
+}
@@ -6,6 +6,7 @@ import (
 
 	"github.com/gin-gonic/gin"
 	"github.com/jinzhu/gorm"
+	"github.com/zeroshade/tmsapi/internal"
 	"github.com/zeroshade/tmsapi/types"
 )
 
@@ -71,83 +72,63 @@ func DeleteShow(db *gorm.DB) gin.HandlerFunc {
 	}
 }
 
-func GetShowOrders(db *gorm.DB) gin.HandlerFunc {
-	type OrdersReq struct {
-		From     string   `json:"from"`
-		To       string   `json:"to"`
-		Page     uint     `json:"page"`
-		PerPage  uint     `json:"perPage"`
-		SortBy   []string `json:"sortBy"`
-		SortDesc []bool   `json:"sortDesc"`
-	}
+var showOrderList = &internal.ListSpec{
+	Sortable: map[string]string{
+		"coid":        "pi.checkout_id",
+		"sku":         "pi.sku",
+		"name":        "pi.name",
+		"title":       "pi.name",
+		"description": "pi.description",
+		"quantity":    "pi.quantity",
+		"cost":        "pi.value",
+		"unit_amount": "pi.value",
+	},
+	Filterable: map[string]string{
+		"coid": "pi.checkout_id",
+		"sku":  "pi.sku",
+	},
+	DefaultSort: "pi.checkout_id, pi.sku",
+}
 
+func GetShowOrders(db *gorm.DB) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		var req OrdersReq
+		var req internal.ListParams
 		if err := c.ShouldBindJSON(&req); err != nil {
 			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 			return
 		}
 
-		var count uint
 		var ret []types.PurchaseItem
 
 		subQuery := db.Table("sandbox_infos").
 			Select("unnest(sandbox_ids)").
 			Where("id = ?", c.Param("merchantid"))
 
-		scope := db.Table("purchase_items as pi").
+		scope, res, err := showOrderList.Apply(db.Table("purchase_items as pi").
 			Select("pi.*").
 			Joins("LEFT JOIN purchase_units as pu USING(checkout_id)").
-			Where(`sku ^@ 'SHOW' AND (pu.payee_merchant_id = ? or pu.payee_merchant_id in ?)`, c.Param("merchantid"), subQuery.SubQuery())
-
-		scope.Count(&count)
-		for idx, sort := range req.SortBy {
-			col := sort
-			switch sort {
-			case "cost":
-				col = "value"
-			case "title":
-				col = "name"
-			}
-			if req.SortDesc[idx] {
-				scope = scope.Order(col + " desc")
-			} else {
-				scope = scope.Order(col)
-			}
-		}
-
-		if req.PerPage > 0 {
-			scope = scope.Offset((req.Page - 1) * req.PerPage).Limit(req.PerPage)
+			Where(`sku ^@ 'SHOW' AND (pu.payee_merchant_id = ? or pu.payee_merchant_id in ?)`, c.Param("merchantid"), subQuery.SubQuery()), req)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
 		}
 
 		scope.Scan(&ret)
 
-		checkouts := make(map[string]*types.CheckoutOrder)
-		for _, i := range ret {
-			checkouts[i.CheckoutID] = nil
-		}
-
-		ids := make([]string, len(checkouts))
-		for k := range checkouts {
-			ids = append(ids, k)
+		ids := itemCheckoutIDs(ret)
+		co, err := types.LoadCheckoutOrders(db, ids)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
 		}
 
-		var co []types.CheckoutOrder
-		db.Preload("Payer").Where("id in (?)", ids).Find(&co)
-
-		usage := make(map[string]bool)
-		for idx := range co {
-			var used []types.TicketUsage
-			db.Where("ticket_id ^@ ?", co[idx].ID).Find(&used)
-			for _, tu := range used {
-				usage[tu.TicketID] = tu.Used
-			}
-			db.Where("checkout_id = ?", co[idx].ID).Find(&co[idx].PurchaseUnits)
-			db.Where("checkout_id = ?", co[idx].ID).Find(&co[idx].PurchaseUnits[0].Payments.Captures)
-			db.Where("checkout_id = ?", co[idx].ID).Find(&co[idx].PurchaseUnits[0].Items)
+		usage, err := types.LoadTicketUsage(db, ids)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
 		}
 
-		c.JSON(http.StatusOK, gin.H{"total": count, "used": usage, "items": ret, "orders": co})
+		c.JSON(http.StatusOK, gin.H{"total": res.Total, "nextCursor": res.NextCursor, "used": usage, "items": ret, "orders": co})
 	}
 }
 
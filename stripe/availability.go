@@ -0,0 +1,192 @@
+package stripe
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+)
+
+const maxAvailabilityDays = 93
+
+// DepositSlot is a single bookable departure of a deposit product
+type DepositSlot struct {
+	Date      string `json:"date"`
+	Time      string `json:"time"`
+	Price     string `json:"price"`
+	Minimum   int    `json:"minimum"`
+	Available bool   `json:"available"`
+}
+
+type bookedTrip struct {
+	start, end time.Time
+}
+
+func parseSlot(date, tm string) (time.Time, error) {
+	return time.ParseInLocation("2006-01-02 15:04", date+" "+tm, timeloc)
+}
+
+// depositProduct finds the deposit product a price is for, by the local price
+// or failing that the stripe product the price is under
+func depositProduct(db *gorm.DB, merchantID, priceID, stripeProduct string) DepositProduct {
+	var prod DepositProduct
+	db.Table("deposit_products AS prod").Select("prod.*").
+		Joins("JOIN deposit_prices AS dp ON dp.deposit_product_id = prod.id").
+		Where("dp.stripe_id = ? AND prod.merchant_id = ?", priceID, merchantID).
+		Scan(&prod)
+	if prod.ID == 0 && stripeProduct != "" {
+		db.Find(&prod, "stripe_id = ? AND merchant_id = ?", stripeProduct, merchantID)
+	}
+	return prod
+}
+
+// bookedTrips returns when a boat is already out on a charter between from and
+// to. Deposits and manual entries with no boat recorded, like those made before
+// boats were tracked, block every boat of the merchant, and with no boat given
+// every trip of the merchant counts.
+func bookedTrips(db *gorm.DB, merchantID string, boatID uint, from, to time.Time) []bookedTrip {
+	type row struct {
+		Date   string
+		Time   string
+		Length uint
+	}
+
+	// pad the range so trips starting the day before that run past
+	// midnight still count
+	fromDate := from.AddDate(0, 0, -1).Format("2006-01-02")
+	toDate := to.Format("2006-01-02")
+
+	onBoat := func(scope *gorm.DB) *gorm.DB {
+		if boatID == 0 {
+			return scope
+		}
+		return scope.Where("boat_id IN (?, 0)", boatID)
+	}
+
+	var rows []row
+	db.Table("deposit_bookings").Scopes(onBoat).
+		Select("date, time, length").
+		Where("merchant_id = ? AND status = ?", merchantID, DepositSucceeded).
+		Where("date BETWEEN ? AND ?", fromDate, toDate).
+		Where("NOT EXISTS (SELECT 1 FROM charter_bookings AS cb WHERE cb.deposit_id = deposit_bookings.id AND cb.status = ?)", CharterCancelled).
+		Scan(&rows)
+
+	var manual []row
+	db.Table("manual_deposits").Scopes(onBoat).
+		Select("date, time, length").
+		Where("merchant_id = ?", merchantID).
+		Where("date BETWEEN ? AND ?", fromDate, toDate).
+		Scan(&manual)
+	rows = append(rows, manual...)
+
+	out := make([]bookedTrip, 0, len(rows))
+	for _, r := range rows {
+		start, err := parseSlot(r.Date, r.Time)
+		if err != nil {
+			continue
+		}
+		out = append(out, bookedTrip{start, start.Add(time.Duration(r.Length) * time.Hour)})
+	}
+	return out
+}
+
+// slotTaken reports whether a trip of the given length in hours starting at
+// start would overlap one that's already booked
+func slotTaken(booked []bookedTrip, start time.Time, length uint) bool {
+	end := start.Add(time.Duration(length) * time.Hour)
+	for _, b := range booked {
+		if start.Equal(b.start) || (start.Before(b.end) && end.After(b.start)) {
+			return true
+		}
+	}
+	return false
+}
+
+// expandSchedules lists every departure the schedules of a product offer
+// between from and to, inclusive
+func expandSchedules(scheds []DepositSchedule, from, to time.Time) []DepositSlot {
+	out := make([]DepositSlot, 0)
+	for d := from; !d.After(to); d = d.AddDate(0, 0, 1) {
+		date := d.Format("2006-01-02")
+		for _, s := range scheds {
+			if (s.Start != "" && date < s.Start) || (s.End != "" && date > s.End) {
+				continue
+			}
+
+			if len(s.Days) > 0 {
+				found := false
+				for _, day := range s.Days {
+					if time.Weekday(day) == d.Weekday() {
+						found = true
+					}
+				}
+				if !found {
+					continue
+				}
+			}
+
+			blocked := false
+			for _, na := range s.NotAvail {
+				if na == date {
+					blocked = true
+				}
+			}
+			if blocked {
+				continue
+			}
+
+			for _, t := range s.Times {
+				out = append(out, DepositSlot{Date: date, Time: t, Price: s.Price, Minimum: s.Minimum, Available: true})
+			}
+		}
+	}
+	return out
+}
+
+// DepositAvailability lists the departures of a deposit product between the
+// from and to dates, marking those that would overlap a trip already booked
+// on the same boat. The length query parameter is the trip length in hours
+// being asked about.
+func DepositAvailability(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var prod DepositProduct
+		db.Preload("Schedules").Find(&prod, "id = ? AND merchant_id = ?", c.Param("prodid"), c.Param("merchantid"))
+		if prod.ID == 0 {
+			c.JSON(http.StatusNotFound, gin.H{"error": "product not found"})
+			return
+		}
+
+		today := time.Now().In(timeloc)
+		from, err := time.ParseInLocation("2006-01-02", c.DefaultQuery("from", today.Format("2006-01-02")), timeloc)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		to := from.AddDate(0, 1, 0)
+		if q := c.Query("to"); q != "" {
+			if to, err = time.ParseInLocation("2006-01-02", q, timeloc); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+		}
+		if to.Before(from) || to.Sub(from) > maxAvailabilityDays*24*time.Hour {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid date range"})
+			return
+		}
+
+		length, _ := strconv.Atoi(c.Query("length"))
+
+		booked := bookedTrips(db, prod.MerchantID, prod.BoatID, from, to)
+		slots := expandSchedules(prod.Schedules, from, to)
+		for idx := range slots {
+			start, err := parseSlot(slots[idx].Date, slots[idx].Time)
+			if err != nil || start.Before(today) || slotTaken(booked, start, uint(length)) {
+				slots[idx].Available = false
+			}
+		}
+
+		c.JSON(http.StatusOK, slots)
+	}
+}
@@ -0,0 +1,120 @@
+package stripe
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/stripe/stripe-go/v72"
+	"github.com/stripe/stripe-go/v72/paymentintent"
+)
+
+// savePaymentDetails stores the customer and charge details of a payment
+// intent so that manifests don't need to go back to stripe for them
+func savePaymentDetails(db *gorm.DB, acct string, pi *stripe.PaymentIntent) {
+	now := time.Now()
+	rec := &PaymentIntent{
+		ID:        pi.ID,
+		Acct:      acct,
+		CreatedAt: time.Unix(pi.Created, 0),
+		Amount:    fmt.Sprintf("%0.2f", float64(pi.Amount)/100.0),
+		Status:    string(pi.Status),
+		GiftCard:  pi.Metadata["giftcard"],
+		Locale:    pi.Metadata["locale"],
+		SyncedAt:  &now,
+	}
+
+	if pi.Charges != nil && len(pi.Charges.Data) > 0 {
+		ch := pi.Charges.Data[0]
+		rec.ChargeID = ch.ID
+		rec.ReceiptURL = ch.ReceiptURL
+		if ch.BillingDetails != nil {
+			rec.Name = ch.BillingDetails.Name
+			rec.Email = ch.BillingDetails.Email
+			rec.Phone = ch.BillingDetails.Phone
+		}
+	}
+
+	// the customer record wins over the billing details, same as the
+	// manifest used to do when it fetched these live
+	if cus := pi.Customer; cus != nil {
+		rec.CustomerID = cus.ID
+		if cus.Name != "" {
+			rec.Name = cus.Name
+		}
+		if cus.Email != "" {
+			rec.Email = cus.Email
+		}
+		if cus.Phone != "" {
+			rec.Phone = cus.Phone
+		}
+	}
+
+	db.Save(rec)
+}
+
+// RefreshPaymentIntents periodically fills in the local details of any
+// purchased payment intents that were never synced from stripe, such as
+// ones whose webhook failed or that predate the cache
+func RefreshPaymentIntents(db *gorm.DB, interval time.Duration) {
+	for {
+		if n, err := refreshMissingIntents(db, 100); err != nil {
+			log.Println("Payment Intent Refresh Error:", err)
+		} else if n > 0 {
+			log.Println("Refreshed payment intents:", n)
+		}
+		time.Sleep(interval)
+	}
+}
+
+// maxSyncErrors is how many times fetching a payment intent can fail before
+// the refresh stops trying it
+const maxSyncErrors = 5
+
+// refreshMissingIntents syncs purchased payment intents that either have no
+// local record at all or one that was never filled in. A failed fetch is
+// counted against the intent and tried again on a later pass, up to
+// maxSyncErrors times. Manual and redeemed tickets have no intent, their
+// payment id is just a dash.
+func refreshMissingIntents(db *gorm.DB, limit int) (int, error) {
+	var missing []PaymentIntent
+	err := db.Raw(`SELECT id, acct FROM payment_intents
+		WHERE synced_at IS NULL AND sync_errors < ?
+		AND id IN (SELECT payment_id FROM line_items WHERE payment_id <> '-')
+		UNION
+		SELECT DISTINCT payment_id AS id, acct FROM line_items
+		WHERE payment_id <> '-' AND payment_id NOT IN (SELECT id FROM payment_intents)
+		ORDER BY id, acct
+		LIMIT ?`, maxSyncErrors, limit).Scan(&missing).Error
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, m := range missing {
+		key := stripe.Key
+		params := &stripe.PaymentIntentParams{}
+		params.AddExpand("customer")
+		params.AddExpand("charges")
+		if strings.HasPrefix(m.Acct, "acct_") {
+			params.SetStripeAccount(m.Acct)
+		} else {
+			key = m.Acct
+		}
+
+		piClient := paymentintent.Client{B: stripe.GetBackend(stripe.APIBackend), Key: key}
+		pi, err := piClient.Get(m.ID, params)
+		if err != nil {
+			log.Println("PI:", m.ID, err)
+			db.Exec(`INSERT INTO payment_intents (id, acct, created_at, sync_errors) VALUES (?, ?, now(), 1)
+				ON CONFLICT (id, acct) DO UPDATE SET sync_errors = payment_intents.sync_errors + 1`, m.ID, m.Acct)
+			continue
+		}
+
+		savePaymentDetails(db, m.Acct, pi)
+		count++
+	}
+	return count, nil
+}
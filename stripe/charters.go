@@ -0,0 +1,576 @@
+package stripe
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+	"github.com/lithammer/shortuuid/v3"
+	"github.com/stripe/stripe-go/v72"
+	"github.com/stripe/stripe-go/v72/checkout/session"
+	"github.com/zeroshade/tmsapi/internal"
+	"github.com/zeroshade/tmsapi/types"
+)
+
+const (
+	CharterBooked    = "booked"
+	CharterPaid      = "paid"
+	CharterCancelled = "cancelled"
+)
+
+// publicHost is the host customers are sent to for balance payment links
+// when there's no request to take it from, such as the reminder job
+var publicHost = os.Getenv("PUBLIC_HOST")
+
+// CharterBooking is a private charter from the deposit through to either the
+// final payment or a cancellation
+type CharterBooking struct {
+	ID               uint       `json:"id" gorm:"primary_key;auto_increment"`
+	MerchantID       string     `json:"-" gorm:"index"`
+	DepositProductID uint       `json:"productId"`
+	DepositPriceID   uint       `json:"priceId"`
+	DepositID        string     `json:"depositId" gorm:"unique_index"`
+	Date             string     `json:"date"`
+	Time             string     `json:"time"`
+	Length           uint       `json:"length"`
+	PartySize        int        `json:"estimated"`
+	TripType         string     `json:"tripType"`
+	Name             string     `json:"name"`
+	Email            string     `json:"email"`
+	Phone            string     `json:"phone"`
+	Total            string     `json:"total" gorm:"type:money"`
+	DepositPaid      string     `json:"depositPaid" gorm:"type:money"`
+	BalancePaid      string     `json:"balancePaid" gorm:"type:money"`
+	Forfeited        string     `json:"forfeited" gorm:"type:money"`
+	BalancePaymentID string     `json:"balancePaymentId"`
+	Status           string     `json:"status"`
+	Notes            string     `json:"notes"`
+	PayToken         string     `json:"-"`
+	BalanceSentAt    *time.Time `json:"balanceSentAt"`
+	PaidAt           *time.Time `json:"paidAt"`
+	CancelledAt      *time.Time `json:"cancelledAt"`
+	CreatedAt        time.Time  `json:"created"`
+	UpdatedAt        time.Time  `json:"updated"`
+
+	Paid string `json:"paid" gorm:"-"`
+	Owed string `json:"owed" gorm:"-"`
+}
+
+// CharterPayment is a payment made towards a charter's balance, kept so the
+// same payment isn't counted twice and can be refunded on cancellation
+type CharterPayment struct {
+	ID        string    `json:"id" gorm:"primary_key"`
+	CharterID uint      `json:"-" gorm:"index"`
+	Amount    string    `json:"amount" gorm:"type:money"`
+	Status    string    `json:"status"`
+	CreatedAt time.Time `json:"created"`
+}
+
+func (b *CharterBooking) paid() float64 {
+	return types.ParseMoney(b.DepositPaid) + types.ParseMoney(b.BalancePaid)
+}
+
+func (b *CharterBooking) owed() float64 {
+	if b.Status == CharterCancelled {
+		return 0
+	}
+	return math.Max(0, types.ParseMoney(b.Total)-b.paid())
+}
+
+func (b *CharterBooking) AfterFind() error {
+	b.Paid = types.FormatMoney(b.paid())
+	b.Owed = types.FormatMoney(b.owed())
+	return nil
+}
+
+func (b *CharterBooking) payLink(host string) string {
+	return fmt.Sprintf("https://%s/info/%s/charters/%d/pay?token=%s", host, b.MerchantID, b.ID, b.PayToken)
+}
+
+// charterPrice finds the full price of a charter on the given date from the
+// schedules of its product
+func charterPrice(scheds []DepositSchedule, date string) float64 {
+	d, err := time.Parse("2006-01-02", date)
+	if err != nil {
+		return 0
+	}
+
+	for _, s := range scheds {
+		start, err1 := time.Parse("2006-01-02", s.Start)
+		end, err2 := time.Parse("2006-01-02", s.End)
+		if err1 != nil || err2 != nil || d.Before(start) || d.After(end) {
+			continue
+		}
+
+		if len(s.Days) > 0 {
+			found := false
+			for _, day := range s.Days {
+				if time.Weekday(day) == d.Weekday() {
+					found = true
+				}
+			}
+			if !found {
+				continue
+			}
+		}
+		return types.ParseMoney(s.Price)
+	}
+	return 0
+}
+
+// createCharterFromDeposit opens a charter booking for a deposit that was just
+// paid, unless one already exists for it
+func createCharterFromDeposit(db *gorm.DB, dep *DepositBooking, price *DepositPrice) {
+	count := 0
+	db.Model(&CharterBooking{}).Where("deposit_id = ?", dep.ID).Count(&count)
+	if count > 0 {
+		return
+	}
+
+	b := &CharterBooking{
+		MerchantID:  dep.MerchantID,
+		DepositID:   dep.ID,
+		Date:        dep.Date,
+		Time:        dep.Time,
+		Length:      dep.Length,
+		PartySize:   dep.PartySize,
+		TripType:    dep.TripType,
+		Name:        dep.Name,
+		Email:       dep.Email,
+		Phone:       dep.Phone,
+		DepositPaid: dep.Amount,
+		BalancePaid: types.FormatMoney(0),
+		Forfeited:   types.FormatMoney(0),
+		Total:       types.FormatMoney(0),
+		Status:      CharterBooked,
+		PayToken:    shortuuid.New(),
+	}
+
+	if price.ID != 0 {
+		b.DepositPriceID = price.ID
+		b.DepositProductID = price.DepositProductID
+		// the intent amount includes fees, only the price goes to the charter
+		b.DepositPaid = types.FormatMoney(float64(price.UnitAmount) / 100.0)
+
+		var scheds []DepositSchedule
+		db.Find(&scheds, "deposit_product_id = ?", price.DepositProductID)
+		b.Total = types.FormatMoney(charterPrice(scheds, dep.Date))
+	}
+
+	if err := db.Create(b).Error; err != nil {
+		log.Println("Create Charter Error:", err)
+	}
+}
+
+// recordCharterPayment adds a balance payment made through the pay link to
+// its charter. Each payment is kept against the deposit's payment intent so
+// a retried webhook isn't counted twice and a cancellation can refund them all.
+func recordCharterPayment(db *gorm.DB, charterID string, pi *stripe.PaymentIntent) {
+	var b CharterBooking
+	db.Find(&b, "id = ?", charterID)
+	if b.ID == 0 {
+		log.Println("Charter Payment for unknown charter:", charterID, pi.ID)
+		return
+	}
+
+	amount := float64(pi.Amount) / 100.0
+	if fee, ok := pi.Metadata["fee"]; ok {
+		amount -= types.ParseMoney(fee)
+	}
+
+	added, err := types.CreateOnce(db, &CharterPayment{
+		ID:        pi.ID,
+		CharterID: b.ID,
+		Amount:    types.FormatMoney(amount),
+		Status:    string(pi.Status),
+		CreatedAt: time.Unix(pi.Created, 0),
+	})
+	if err != nil {
+		log.Println("Charter Payment Error:", charterID, pi.ID, err)
+		return
+	}
+	if !added {
+		return
+	}
+
+	b.applyPayment(amount)
+	b.BalancePaymentID = pi.ID
+	db.Save(&b)
+}
+
+func (b *CharterBooking) applyPayment(amount float64) {
+	b.BalancePaid = types.FormatMoney(types.ParseMoney(b.BalancePaid) + amount)
+	if b.owed() <= 0 && b.Status == CharterBooked {
+		now := time.Now()
+		b.Status = CharterPaid
+		b.PaidAt = &now
+	}
+	b.AfterFind()
+}
+
+func sendBalanceEmail(db *gorm.DB, conf *types.MerchantConfig, b *CharterBooking, link string) error {
+	data := &types.EmailData{
+		Name: b.Name, Email: b.Email, Phone: b.Phone, OrderID: b.DepositID,
+		Date: b.Date, Time: b.Time, Paid: b.Paid, Owed: b.Owed, PayLink: link,
+	}
+	msg, err := types.RenderEmail(db, conf, types.EmailBalance, data)
+	if err != nil {
+		return err
+	}
+
+	m := internal.NewMerchantMessage(conf, msg.Subject, msg.Text, msg.HTML, fmt.Sprintf("%s <%s>", b.Name, b.Email))
+	return internal.SendEmail(db, conf, b.DepositID, types.EmailBalance, m)
+}
+
+func sendBalanceLink(db *gorm.DB, host string, conf *types.MerchantConfig, b *CharterBooking) error {
+	link := b.payLink(host)
+	if err := sendBalanceEmail(db, conf, b, link); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	b.BalanceSentAt = &now
+	db.Model(b).UpdateColumn("balance_sent_at", now)
+	return nil
+}
+
+// SendCharterBalanceLinks periodically emails the balance payment link for
+// charters departing within their merchant's configured number of days
+func SendCharterBalanceLinks(db *gorm.DB, interval time.Duration) {
+	for {
+		if publicHost != "" {
+			var due []CharterBooking
+			db.Table("charter_bookings AS cb").
+				Joins("JOIN merchant_configs AS mc ON mc.id = cb.merchant_id").
+				Where("cb.status = ? AND cb.balance_sent_at IS NULL AND mc.charter_balance_days > 0", CharterBooked).
+				Where("to_date(cb.date, 'YYYY-MM-DD') <= current_date + mc.charter_balance_days").
+				Select("cb.*").Find(&due)
+
+			for idx := range due {
+				b := &due[idx]
+				if b.owed() <= 0 {
+					continue
+				}
+
+				var conf types.MerchantConfig
+				db.Find(&conf, "id = ?", b.MerchantID)
+				if err := sendBalanceLink(db, publicHost, &conf, b); err != nil {
+					log.Println("Charter Balance Email Error:", b.ID, err)
+				}
+			}
+		}
+		time.Sleep(interval)
+	}
+}
+
+func findCharter(db *gorm.DB, c *gin.Context) (*CharterBooking, bool) {
+	var b CharterBooking
+	db.Find(&b, "id = ? AND merchant_id = ?", c.Param("id"), c.Param("merchantid"))
+	if b.ID == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "charter not found"})
+		return nil, false
+	}
+	return &b, true
+}
+
+func ListCharters(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		scope := db.Where("merchant_id = ?", c.Param("merchantid"))
+		if ym := c.Query("yearmonth"); ym != "" {
+			scope = scope.Where("date LIKE ?", ym+"-%")
+		}
+		if status := c.Query("status"); status != "" {
+			scope = scope.Where("status = ?", status)
+		}
+
+		out := []CharterBooking{}
+		scope.Order("date, time").Find(&out)
+		c.JSON(http.StatusOK, out)
+	}
+}
+
+func UpdateCharter(db *gorm.DB) gin.HandlerFunc {
+	type updateReq struct {
+		Total     string `json:"total"`
+		PartySize int    `json:"estimated"`
+		Notes     string `json:"notes"`
+	}
+	return func(c *gin.Context) {
+		var req updateReq
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		b, ok := findCharter(db, c)
+		if !ok {
+			return
+		}
+
+		if req.Total != "" {
+			b.Total = types.FormatMoney(types.ParseMoney(req.Total))
+		}
+		if req.PartySize > 0 {
+			b.PartySize = req.PartySize
+		}
+		b.Notes = req.Notes
+		// lowering the total can leave it paid in full
+		b.applyPayment(0)
+		db.Save(b)
+		c.JSON(http.StatusOK, b)
+	}
+}
+
+// SendCharterBalance emails the customer the link to pay the rest of their
+// charter
+func SendCharterBalance(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		b, ok := findCharter(db, c)
+		if !ok {
+			return
+		}
+
+		if b.Status != CharterBooked || b.owed() <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "charter has no balance due"})
+			return
+		}
+
+		var conf types.MerchantConfig
+		db.Find(&conf, "id = ?", b.MerchantID)
+		if err := sendBalanceLink(db, c.Request.Host, &conf, b); err != nil {
+			c.JSON(http.StatusFailedDependency, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"link": b.payLink(c.Request.Host)})
+	}
+}
+
+// RecordCharterPayment records a balance payment taken outside of stripe,
+// such as cash or check on the day of the trip
+func RecordCharterPayment(db *gorm.DB) gin.HandlerFunc {
+	type paymentReq struct {
+		Amount string `json:"amount"`
+		Note   string `json:"note"`
+	}
+	return func(c *gin.Context) {
+		var req paymentReq
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		if types.ParseMoney(req.Amount) <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid amount"})
+			return
+		}
+
+		b, ok := findCharter(db, c)
+		if !ok {
+			return
+		}
+		if b.Status == CharterCancelled {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "charter is cancelled"})
+			return
+		}
+
+		b.applyPayment(types.ParseMoney(req.Amount))
+		if req.Note != "" {
+			b.Notes = strings.TrimSpace(b.Notes + "\n" + req.Note)
+		}
+		db.Save(b)
+		c.JSON(http.StatusOK, b)
+	}
+}
+
+// CancelCharter cancels a charter. The deposit is forfeited unless it is
+// explicitly refunded, and a balance paid through stripe can be refunded too.
+func CancelCharter(db *gorm.DB) gin.HandlerFunc {
+	type cancelReq struct {
+		RefundDeposit bool   `json:"refundDeposit"`
+		RefundBalance bool   `json:"refundBalance"`
+		Reason        string `json:"reason"`
+	}
+	return func(c *gin.Context) {
+		var req cancelReq
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		b, ok := findCharter(db, c)
+		if !ok {
+			return
+		}
+		if b.Status == CharterCancelled && !req.RefundDeposit && !req.RefundBalance {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "charter is already cancelled"})
+			return
+		}
+
+		// the charter is cancelled before anything is refunded and each
+		// refund is saved as it goes, so if one fails the charter still shows
+		// what's held and cancelling again only retries what's left
+		if b.Status != CharterCancelled {
+			now := time.Now()
+			b.Status = CharterCancelled
+			b.CancelledAt = &now
+			if !req.RefundDeposit {
+				b.Forfeited = b.DepositPaid
+			}
+			if req.Reason != "" {
+				b.Notes = strings.TrimSpace(b.Notes + "\nCancelled: " + req.Reason)
+			}
+			db.Model(b).Updates(map[string]interface{}{"status": b.Status, "cancelled_at": now, "forfeited": b.Forfeited, "notes": b.Notes})
+		}
+
+		acct := c.GetString("stripe_acct")
+		if deposit := types.ParseMoney(b.DepositPaid); req.RefundDeposit && deposit > 0 {
+			if _, err := refundIntent(acct, b.DepositID, deposit); err != nil {
+				b.AfterFind()
+				c.JSON(http.StatusFailedDependency, gin.H{"error": err.Error(), "charter": b})
+				return
+			}
+			b.DepositPaid = types.FormatMoney(0)
+			b.Forfeited = types.FormatMoney(0)
+			db.Model(b).Updates(map[string]interface{}{"deposit_paid": b.DepositPaid, "forfeited": b.Forfeited})
+		}
+
+		if req.RefundBalance {
+			var pays []CharterPayment
+			db.Where("charter_id = ? AND status <> ?", b.ID, "refunded").Find(&pays)
+			for idx := range pays {
+				if _, err := refundIntent(acct, pays[idx].ID, 0); err != nil {
+					b.AfterFind()
+					c.JSON(http.StatusFailedDependency, gin.H{"error": err.Error(), "charter": b})
+					return
+				}
+				db.Model(&pays[idx]).UpdateColumn("status", "refunded")
+				b.BalancePaid = types.FormatMoney(types.ParseMoney(b.BalancePaid) - types.ParseMoney(pays[idx].Amount))
+				db.Model(b).UpdateColumn("balance_paid", b.BalancePaid)
+			}
+		}
+
+		b.AfterFind()
+		c.JSON(http.StatusOK, b)
+	}
+}
+
+// PayCharterBalance is the link emailed to customers, it starts a new stripe
+// checkout for whatever is still owed so the link keeps working until the
+// charter is paid off
+func PayCharterBalance(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var b CharterBooking
+		db.Find(&b, "id = ? AND merchant_id = ?", c.Param("id"), c.Param("merchantid"))
+		if b.ID == 0 || b.PayToken == "" || c.Query("token") != b.PayToken {
+			c.JSON(http.StatusNotFound, gin.H{"error": "charter not found"})
+			return
+		}
+
+		switch {
+		case c.Query("status") == "success":
+			messagePage(c, "Thank you, your payment has been received.")
+			return
+		case c.Query("status") == "cancelled":
+			messagePage(c, "Your payment was cancelled, you can use the link in your email to try again.")
+			return
+		case b.Status == CharterCancelled:
+			messagePage(c, "This charter has been cancelled.")
+			return
+		case b.owed() <= 0:
+			messagePage(c, "This charter has been paid in full.")
+			return
+		}
+
+		sess, err := payLinkSession(db, c, b.owed(), b.Email,
+			fmt.Sprintf("Charter Balance, %s %s", b.Date, b.Time),
+			fmt.Sprintf("Balance for %d hour %s charter, %s %s", b.Length, b.TripType, b.Date, b.Time),
+			map[string]string{"type": "charter", "charter": fmt.Sprint(b.ID)},
+			b.payLink(c.Request.Host))
+		if err != nil {
+			c.JSON(http.StatusFailedDependency, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.Redirect(http.StatusSeeOther, sess.URL)
+	}
+}
+
+// payLinkSession starts a checkout for an amount owed through an emailed
+// payment link, adding the merchant's fee on top and recording it in the
+// metadata so the webhook can take it back off
+func payLinkSession(db *gorm.DB, c *gin.Context, amount float64, email, name, desc string, meta map[string]string, link string) (*stripe.CheckoutSession, error) {
+	key := stripe.Key
+	sk := c.GetString("stripe_acct")
+	if !strings.HasPrefix(sk, "acct_") {
+		key = sk
+		sk = ""
+	}
+
+	owed := int64(math.Round(amount * 100))
+	fee := int64(c.GetFloat64("fee_pct") * float64(owed))
+	meta["fee"] = types.FormatMoney(float64(fee) / 100.0)
+
+	params := &stripe.CheckoutSessionParams{
+		Mode: stripe.String(string(stripe.CheckoutSessionModePayment)),
+		LineItems: []*stripe.CheckoutSessionLineItemParams{
+			{
+				Quantity: stripe.Int64(1),
+				PriceData: &stripe.CheckoutSessionLineItemPriceDataParams{
+					Currency: stripe.String(string(stripe.CurrencyUSD)),
+					ProductData: &stripe.CheckoutSessionLineItemPriceDataProductDataParams{
+						Name: stripe.String(name),
+					},
+					UnitAmount: stripe.Int64(owed),
+				},
+			},
+		},
+		PaymentIntentData: &stripe.CheckoutSessionPaymentIntentDataParams{
+			Description: stripe.String(desc),
+			Metadata:    meta,
+		},
+		SuccessURL: stripe.String(link + "&status=success"),
+		CancelURL:  stripe.String(link + "&status=cancelled"),
+	}
+	if email != "" {
+		params.CustomerEmail = stripe.String(email)
+	}
+
+	if fee > 0 {
+		params.LineItems = append(params.LineItems, &stripe.CheckoutSessionLineItemParams{
+			Quantity: stripe.Int64(1),
+			PriceData: &stripe.CheckoutSessionLineItemPriceDataParams{
+				Currency: stripe.String(string(stripe.CurrencyUSD)),
+				ProductData: &stripe.CheckoutSessionLineItemPriceDataProductDataParams{
+					Name: stripe.String(feeItemName),
+				},
+				UnitAmount: stripe.Int64(fee),
+			},
+		})
+
+		stripeFee := int64(math.Ceil(float64(owed+fee)*0.029)) + 30
+		if fee > stripeFee {
+			params.PaymentIntentData.ApplicationFeeAmount = stripe.Int64(fee - stripeFee)
+		}
+	}
+	if sk != "" {
+		params.SetStripeAccount(sk)
+	}
+
+	sessClient := session.Client{B: stripe.GetBackend(stripe.APIBackend), Key: key}
+	sess, err := sessClient.New(params)
+	if err != nil {
+		return nil, err
+	}
+
+	db.Save(&PaymentIntent{
+		ID:   sess.PaymentIntent.ID,
+		Acct: c.GetString("stripe_acct"),
+	})
+	return sess, nil
+}
@@ -0,0 +1,219 @@
+package stripe
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+	"github.com/stripe/stripe-go/v72"
+	"github.com/zeroshade/tmsapi/internal"
+	"github.com/zeroshade/tmsapi/internal/dbtest"
+	"github.com/zeroshade/tmsapi/types"
+)
+
+// useMailer swaps the default mailer for the length of a test
+func useMailer(t *testing.T, m internal.Mailer) {
+	prev := internal.DefaultMailer
+	internal.DefaultMailer = m
+	t.Cleanup(func() { internal.DefaultMailer = prev })
+}
+
+func value(t *testing.T, s dbtest.Stmt, col string) interface{} {
+	t.Helper()
+	v, ok := s.Value(col)
+	if !ok {
+		t.Fatalf("%s isn't set by %q", col, s.Query)
+	}
+	return v
+}
+
+func charterRow(d *dbtest.DB) {
+	d.Returns(`FROM "charter_bookings"`,
+		[]string{"id", "merchant_id", "deposit_id", "status", "total", "deposit_paid", "balance_paid"},
+		[]interface{}{int64(7), "m1", "pi_dep", CharterBooked, "$500.00", "$100.00", "$0.00"})
+}
+
+func TestRecordCharterPayment(t *testing.T) {
+	db, d := dbtest.Open(t)
+	charterRow(d)
+
+	pi := &stripe.PaymentIntent{ID: "pi_bal", Amount: 41500, Status: stripe.PaymentIntentStatusSucceeded,
+		Metadata: map[string]string{"fee": "15.00"}}
+	recordCharterPayment(db, "7", pi)
+
+	ins := d.Statements(`INSERT INTO "charter_payments"`)
+	if len(ins) != 1 {
+		t.Fatalf("recorded %d payments", len(ins))
+	}
+	if v := value(t, ins[0], "amount"); v != "400.00" {
+		t.Errorf("payment amount = %v, want 400.00 less the fee", v)
+	}
+	if v := value(t, ins[0], "charter_id"); v != int64(7) {
+		t.Errorf("charter_id = %v", v)
+	}
+
+	upd := d.Statements(`UPDATE "charter_bookings"`)
+	if len(upd) != 1 {
+		t.Fatalf("updated the charter %d times", len(upd))
+	}
+	want := map[string]interface{}{"balance_paid": "400.00", "status": CharterPaid, "balance_payment_id": "pi_bal"}
+	for col, w := range want {
+		if v := value(t, upd[0], col); v != w {
+			t.Errorf("%s = %v, want %v", col, v, w)
+		}
+	}
+}
+
+func TestRecordCharterPaymentRepeated(t *testing.T) {
+	db, d := dbtest.Open(t)
+	charterRow(d)
+	// the payment is already there, so the insert is skipped
+	d.Returns(`INSERT INTO "charter_payments"`, []string{"id"})
+
+	recordCharterPayment(db, "7", &stripe.PaymentIntent{ID: "pi_bal", Amount: 40000})
+	if upd := d.Statements(`UPDATE "charter_bookings"`); len(upd) != 0 {
+		t.Errorf("a repeated webhook changed the charter: %q", upd[0].Query)
+	}
+}
+
+func TestRecordCharterPaymentUnknown(t *testing.T) {
+	db, d := dbtest.Open(t)
+	recordCharterPayment(db, "99", &stripe.PaymentIntent{ID: "pi_bal", Amount: 40000})
+	if ins := d.Statements(`INSERT INTO "charter_payments"`); len(ins) != 0 {
+		t.Error("recorded a payment for a charter that doesn't exist")
+	}
+}
+
+func TestSendBalanceEmail(t *testing.T) {
+	dir := t.TempDir()
+	useMailer(t, internal.NewFileMailer(dir))
+	db, d := dbtest.Open(t)
+
+	conf := &types.MerchantConfig{ID: "m1", PassTitle: "Boat Co", EmailFrom: "tickets@example.com"}
+	b := &CharterBooking{ID: 7, MerchantID: "m1", DepositID: "pi_dep", Name: "Ana", Email: "ana@example.com",
+		Date: "2024-07-04", Time: "18:00", Status: CharterBooked, Total: "500.00", DepositPaid: "100.00", PayToken: "tok"}
+	b.AfterFind()
+	link := b.payLink("tickets.example.com")
+	if err := sendBalanceEmail(db, conf, b, link); err != nil {
+		t.Fatal(err)
+	}
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*.eml"))
+	if len(files) != 1 {
+		t.Fatalf("wrote %d emails", len(files))
+	}
+	data, _ := ioutil.ReadFile(files[0])
+	if !strings.Contains(string(data), "To: Ana <ana@example.com>") {
+		t.Errorf("email isn't to the customer:\n%s", data)
+	}
+
+	ins := d.Statements(`INSERT INTO "notifications"`)
+	if len(ins) != 1 {
+		t.Fatalf("logged %d notifications", len(ins))
+	}
+	for col, w := range map[string]interface{}{"order_id": "pi_dep", "template": types.EmailBalance, "status": types.NotifySent} {
+		if v := value(t, ins[0], col); v != w {
+			t.Errorf("%s = %v, want %v", col, v, w)
+		}
+	}
+	if body := value(t, ins[0], "body").(string); !strings.Contains(body, link) || !strings.Contains(body, "$400.00") {
+		t.Errorf("body doesn't have the pay link and balance:\n%s", body)
+	}
+}
+
+// fakeRefunds points the stripe client at a server that refunds every
+// payment intent except the ones listed, returning the intents it was asked
+// to refund
+func fakeRefunds(t *testing.T, fail ...string) *[]string {
+	var refunded []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pi := r.FormValue("payment_intent")
+		for _, f := range fail {
+			if pi == f {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(`{"error": {"type": "invalid_request_error", "message": "refund failed"}}`))
+				return
+			}
+		}
+		refunded = append(refunded, pi)
+		w.Write([]byte(`{"id": "re_1", "object": "refund"}`))
+	}))
+	t.Cleanup(srv.Close)
+
+	stripe.SetBackend(stripe.APIBackend, stripe.GetBackendWithConfig(stripe.APIBackend,
+		&stripe.BackendConfig{URL: stripe.String(srv.URL), MaxNetworkRetries: stripe.Int64(0)}))
+	t.Cleanup(func() { stripe.SetBackend(stripe.APIBackend, nil) })
+	return &refunded
+}
+
+func cancelCharter(db *gorm.DB, body string) *httptest.ResponseRecorder {
+	gin.SetMode(gin.TestMode)
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodPost, "/m1/charters/7/cancel", strings.NewReader(body))
+	c.Params = gin.Params{{Key: "merchantid", Value: "m1"}, {Key: "id", Value: "7"}}
+	c.Set("stripe_acct", "sk_test_1")
+	CancelCharter(db)(c)
+	return w
+}
+
+func TestCancelCharterPartialRefund(t *testing.T) {
+	refunded := fakeRefunds(t, "pi_bal2")
+	db, d := dbtest.Open(t)
+	d.Returns(`FROM "charter_bookings"`,
+		[]string{"id", "merchant_id", "deposit_id", "status", "total", "deposit_paid", "balance_paid"},
+		[]interface{}{int64(7), "m1", "pi_dep", CharterBooked, "$500.00", "$100.00", "$400.00"})
+	d.Returns(`FROM "charter_payments"`, []string{"id", "charter_id", "amount", "status"},
+		[]interface{}{"pi_bal1", int64(7), "$150.00", "succeeded"},
+		[]interface{}{"pi_bal2", int64(7), "$250.00", "succeeded"})
+
+	w := cancelCharter(db, `{"refundDeposit": true, "refundBalance": true}`)
+	if w.Code != http.StatusFailedDependency {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	if got := strings.Join(*refunded, ","); got != "pi_dep,pi_bal1" {
+		t.Errorf("refunded %s", got)
+	}
+
+	// cancelled first, then each refund saved as it went
+	var saved []string
+	for _, s := range d.Statements(`UPDATE "charter`) {
+		for _, col := range []string{"status", "deposit_paid", "balance_paid"} {
+			if v, ok := s.Value(col); ok {
+				saved = append(saved, col+"="+v.(string))
+			}
+		}
+	}
+	want := "status=cancelled,deposit_paid=0.00,status=refunded,balance_paid=250.00"
+	if got := strings.Join(saved, ","); got != want {
+		t.Errorf("saved %s, want %s", got, want)
+	}
+}
+
+func TestCancelCharterRetry(t *testing.T) {
+	refunded := fakeRefunds(t)
+	db, d := dbtest.Open(t)
+	d.Returns(`FROM "charter_bookings"`,
+		[]string{"id", "merchant_id", "deposit_id", "status", "total", "deposit_paid", "balance_paid"},
+		[]interface{}{int64(7), "m1", "pi_dep", CharterCancelled, "$500.00", "$0.00", "$250.00"})
+	d.Returns(`FROM "charter_payments"`, []string{"id", "charter_id", "amount", "status"},
+		[]interface{}{"pi_bal2", int64(7), "$250.00", "succeeded"})
+
+	w := cancelCharter(db, `{"refundDeposit": true, "refundBalance": true}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	if got := strings.Join(*refunded, ","); got != "pi_bal2" {
+		t.Errorf("refunded %s, want only what was left", got)
+	}
+
+	w = cancelCharter(db, `{}`)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("cancelling again without refunds: %d", w.Code)
+	}
+}
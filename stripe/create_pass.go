@@ -14,7 +14,7 @@ func ExternalGeneratePDF(db *gorm.DB, config *types.MerchantConfig, payid, name,
 	items, _, _ := (Handler{}).GetPassItems(config, db, payid)
 	f, _ := os.Create("order_tmp.pdf")
 	defer f.Close()
-	internal.GeneratePdf(db, items, "Boarding Passes", name, email, f)
+	internal.GeneratePdf(db, items, "Boarding Passes", name, email, types.OrderLocale(db, config, payid), f)
 }
 
 func findDuration(prod *types.Product, trip time.Time) time.Duration {
@@ -0,0 +1,382 @@
+package stripe
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"log"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+	"github.com/stripe/stripe-go/v72"
+	"github.com/stripe/stripe-go/v72/charge"
+	"github.com/zeroshade/tmsapi/internal"
+	"github.com/zeroshade/tmsapi/types"
+)
+
+const (
+	DepositSucceeded = "succeeded"
+	DepositRefunded  = "refunded"
+	// DepositConflict is a deposit for a taken slot that couldn't be
+	// refunded automatically
+	DepositConflict = "conflict"
+)
+
+// DepositBooking is a charter deposit paid through stripe, keyed by its
+// payment intent
+type DepositBooking struct {
+	ID               string    `json:"id" gorm:"primary_key"`
+	MerchantID       string    `json:"-" gorm:"index"`
+	Acct             string    `json:"-"`
+	DepositProductID uint      `json:"productId"`
+	BoatID           uint      `json:"boatId"`
+	YearMonth        string    `json:"yearmonth" gorm:"index"`
+	Date             string    `json:"date"`
+	Time             string    `json:"time"`
+	Length           uint      `json:"length"`
+	PartySize        int       `json:"estimated"`
+	TripType         string    `json:"tripType"`
+	Name             string    `json:"name"`
+	Email            string    `json:"email"`
+	Phone            string    `json:"phone"`
+	Amount           string    `json:"amount" gorm:"type:money"`
+	Description      string    `json:"description"`
+	ChargeID         string    `json:"chargeId"`
+	Status           string    `json:"status"`
+	CreatedAt        time.Time `json:"created"`
+}
+
+// Metadata rebuilds the payment intent metadata the calendar has always been
+// given for a deposit
+func (d *DepositBooking) Metadata() map[string]string {
+	md := map[string]string{
+		"yearmonth": d.YearMonth,
+		"date":      d.Date,
+		"time":      d.Time,
+		"length":    strconv.Itoa(int(d.Length)),
+	}
+	if d.PartySize > 0 {
+		md["estimated"] = strconv.Itoa(d.PartySize)
+	}
+	if d.TripType != "" {
+		md["tripType"] = d.TripType
+	}
+	return md
+}
+
+var depositDescRe = regexp.MustCompile(`Deposit for \d+ hour (.*) trip, .*; Estimated: (\d+) people`)
+
+// isDeposit checks the metadata CheckoutDeposit puts on the payment intent,
+// deposits from before it set a type only have the date fields
+func isDeposit(pi *stripe.PaymentIntent) bool {
+	if typ, ok := pi.Metadata["type"]; ok {
+		return typ == "deposit"
+	}
+	return pi.Metadata["yearmonth"] != "" && pi.Metadata["date"] != ""
+}
+
+func depositFromIntent(merchantID, acct string, pi *stripe.PaymentIntent) *DepositBooking {
+	length, _ := strconv.Atoi(pi.Metadata["length"])
+	d := &DepositBooking{
+		ID:          pi.ID,
+		MerchantID:  merchantID,
+		Acct:        acct,
+		YearMonth:   pi.Metadata["yearmonth"],
+		Date:        pi.Metadata["date"],
+		Time:        pi.Metadata["time"],
+		Length:      uint(length),
+		TripType:    pi.Metadata["tripType"],
+		Amount:      fmt.Sprintf("%0.2f", float64(pi.Amount)/100.0),
+		Description: pi.Description,
+		Status:      DepositSucceeded,
+		CreatedAt:   time.Unix(pi.Created, 0),
+	}
+	d.PartySize, _ = strconv.Atoi(pi.Metadata["estimated"])
+
+	// deposits made before the metadata had these only have them in the
+	// description
+	if m := depositDescRe.FindStringSubmatch(pi.Description); m != nil {
+		if d.TripType == "" {
+			d.TripType = m[1]
+		}
+		if d.PartySize == 0 {
+			d.PartySize, _ = strconv.Atoi(m[2])
+		}
+	}
+
+	if pi.Charges != nil && len(pi.Charges.Data) > 0 {
+		ch := pi.Charges.Data[0]
+		d.ChargeID = ch.ID
+		if ch.Refunded {
+			d.Status = DepositRefunded
+		}
+		if ch.BillingDetails != nil {
+			d.Name = ch.BillingDetails.Name
+			d.Email = ch.BillingDetails.Email
+			d.Phone = ch.BillingDetails.Phone
+		}
+	}
+
+	if cus := pi.Customer; cus != nil {
+		if cus.Name != "" {
+			d.Name = cus.Name
+		}
+		if cus.Email != "" {
+			d.Email = cus.Email
+		}
+		if cus.Phone != "" {
+			d.Phone = cus.Phone
+		}
+	}
+
+	return d
+}
+
+// intentDepositProduct finds the product a deposit was paid for from the
+// ids checkout put in its metadata
+func intentDepositProduct(db *gorm.DB, merchantID string, pi *stripe.PaymentIntent) DepositProduct {
+	var prod DepositProduct
+	if id := pi.Metadata["productId"]; id != "" && id != "0" {
+		db.Find(&prod, "id = ? AND merchant_id = ?", id, merchantID)
+	} else if id := pi.Metadata["priceId"]; id != "" {
+		prod = depositProduct(db, merchantID, id, "")
+	}
+	return prod
+}
+
+// recordDeposit saves a deposit paid through checkout, along with the product
+// and boat it was for, and opens a charter booking for it. The slot is checked
+// again since someone else may have paid for it while this checkout was open,
+// in which case the deposit is refunded.
+func recordDeposit(db *gorm.DB, merchantID, acct string, pi *stripe.PaymentIntent) *DepositBooking {
+	dep := depositFromIntent(merchantID, acct, pi)
+
+	prod := intentDepositProduct(db, merchantID, pi)
+	dep.DepositProductID = prod.ID
+	dep.BoatID = prod.BoatID
+
+	var price DepositPrice
+	if id := pi.Metadata["priceId"]; id != "" && prod.ID != 0 {
+		db.Find(&price, "stripe_id = ? AND deposit_product_id = ?", id, prod.ID)
+	}
+
+	var existing int
+	db.Model(&DepositBooking{}).Where("id = ?", dep.ID).Count(&existing)
+	if existing == 0 && dep.Status == DepositSucceeded {
+		if start, err := parseSlot(dep.Date, dep.Time); err == nil {
+			booked := bookedTrips(db, merchantID, dep.BoatID, start, start.Add(time.Duration(dep.Length)*time.Hour))
+			if slotTaken(booked, start, dep.Length) {
+				refuseDeposit(db, acct, dep)
+				return dep
+			}
+		}
+	}
+
+	db.Save(dep)
+	createCharterFromDeposit(db, dep, &price)
+	if q := pi.Metadata["quote"]; q != "" {
+		markQuoteBooked(db, q, dep.ID)
+	}
+	return dep
+}
+
+// refuseDeposit refunds a deposit for a slot that was taken before it was
+// paid and lets the customer know
+func refuseDeposit(db *gorm.DB, acct string, dep *DepositBooking) {
+	log.Println("Deposit for a taken slot:", dep.ID, dep.Date, dep.Time)
+	if _, err := refundIntent(acct, dep.ID, 0); err != nil {
+		log.Println("Deposit Refund Error:", dep.ID, err)
+		dep.Status = DepositConflict
+		db.Save(dep)
+		return
+	}
+	dep.Status = DepositRefunded
+	db.Save(dep)
+
+	if dep.Email == "" {
+		return
+	}
+	var conf types.MerchantConfig
+	db.Find(&conf, "id = ?", dep.MerchantID)
+	data := &types.EmailData{
+		Name:    dep.Name,
+		Email:   dep.Email,
+		Phone:   dep.Phone,
+		OrderID: dep.ID,
+		Amount:  dep.Amount,
+		Items:   []types.EmailItem{{Name: fmt.Sprintf("%d hour %s charter, %s %s", dep.Length, dep.TripType, dep.Date, dep.Time), Quantity: 1}},
+	}
+	msg, err := types.RenderEmail(db, &conf, types.EmailRefund, data)
+	if err != nil {
+		log.Println("Deposit Refund Email Error:", dep.ID, err)
+		return
+	}
+	m := internal.NewMerchantMessage(&conf, msg.Subject, msg.Text, msg.HTML, fmt.Sprintf("%s <%s>", dep.Name, dep.Email))
+	if err := internal.SendEmail(db, &conf, dep.ID, types.EmailRefund, m); err != nil {
+		log.Println("Deposit Refund Email Error:", dep.ID, err)
+	}
+}
+
+const defaultDepositEmail = `{{ .Content }}`
+
+// sendDepositNotifications emails the customer using the merchant's deposit
+// template and lets the merchant know by email, and text if they want it.
+// Nothing is sent again when stripe repeats the webhook.
+func sendDepositNotifications(db *gorm.DB, conf *types.MerchantConfig, dep *DepositBooking, receipt string) {
+	var sent int
+	db.Model(&types.Notification{}).Where("order_id = ? AND template = ?", dep.ID, "deposit").Count(&sent)
+	if sent > 0 {
+		return
+	}
+
+	tmpl := conf.DepositEmailContent
+	if tmpl == "" {
+		tmpl = defaultDepositEmail
+	}
+
+	var content bytes.Buffer
+	t, err := template.New("deposit").Parse(tmpl)
+	if err == nil {
+		err = t.Execute(&content, gin.H{
+			"Content": template.HTML(conf.EmailContent),
+			"Name":    dep.Name, "Email": dep.Email, "Phone": dep.Phone,
+			"Date": dep.Date, "Time": dep.Time, "Length": dep.Length,
+			"TripType": dep.TripType, "Estimated": dep.PartySize,
+			"Amount": dep.Amount, "Receipt": receipt,
+		})
+	}
+	if err != nil {
+		log.Println("Deposit Template Error:", conf.ID, err)
+		content.Reset()
+		content.WriteString(conf.EmailContent)
+	}
+	content.WriteString(`<p>Receipt: <a href='` + receipt + `'>` + receipt + `</a>`)
+
+	m := internal.NewMerchantMessage(conf, conf.PassTitle, content.String(), content.String(), dep.Email)
+	internal.SendEmail(db, conf, dep.ID, "deposit", m)
+
+	notice := "Deposit made by: " + dep.Name + " " + dep.Email + "<br/>" + dep.Description
+	for _, to := range conf.DepositRecipients() {
+		m = internal.NewMerchantMessage(conf, conf.PassTitle, notice, "", to)
+		internal.SendEmail(db, conf, dep.ID, "deposit_notify", m)
+	}
+
+	if conf.DepositSendSMS && conf.NotifyNumber != "" {
+		internal.SendSMS(db, conf, dep.ID, "deposit_notify", conf.NotifyNumber, types.T(types.ResolveLocale(conf.Locale), "sms.deposit_notify", dep.Name, dep.Date, dep.Time))
+	}
+}
+
+// toPaymentIntent turns a stored deposit back into the shape GetDepositOrders
+// returned when it read straight from stripe
+func (d *DepositBooking) toPaymentIntent() *stripe.PaymentIntent {
+	amount := int64(math.Round(types.ParseMoney(d.Amount) * 100))
+	return &stripe.PaymentIntent{
+		ID:             d.ID,
+		Amount:         amount,
+		AmountReceived: amount,
+		Currency:       string(stripe.CurrencyUSD),
+		Created:        d.CreatedAt.Unix(),
+		Description:    d.Description,
+		Metadata:       d.Metadata(),
+		Status:         stripe.PaymentIntentStatusSucceeded,
+		Customer: &stripe.Customer{
+			Name:  d.Name,
+			Email: d.Email,
+			Phone: d.Phone,
+		},
+	}
+}
+
+func (m *ManualDeposit) toPaymentIntent() *stripe.PaymentIntent {
+	yearmonth := m.Date
+	if len(yearmonth) > 7 {
+		yearmonth = yearmonth[:7]
+	}
+	return &stripe.PaymentIntent{
+		ID:          "manual",
+		Description: "Manual Deposit",
+		Metadata: map[string]string{
+			"yearmonth": yearmonth,
+			"date":      m.Date,
+			"time":      m.Time,
+			"length":    strconv.Itoa(int(m.Length)),
+		},
+		Customer: &stripe.Customer{
+			Name:  m.Name,
+			Email: m.Email,
+			Phone: m.Phone,
+		},
+	}
+}
+
+func manualDepositsForMonth(db *gorm.DB, merchantID, yearmonth string) []ManualDeposit {
+	var deps []ManualDeposit
+	db.Find(&deps, `merchant_id = ? AND to_date(date, 'YYYY-MM-DD') BETWEEN ? AND (?::date + '1 month'::interval)`,
+		merchantID, yearmonth+"-01", yearmonth+"-01")
+	return deps
+}
+
+// SyncDeposits copies the deposit charges of a merchant's stripe account
+// created since the given time into the deposit bookings table
+func SyncDeposits(db *gorm.DB, conf *types.MerchantConfig, since time.Time) (int, error) {
+	key := stripe.Key
+	sk := conf.StripeKey
+	if !strings.HasPrefix(sk, "acct_") {
+		key = sk
+		sk = ""
+	}
+
+	cclient := charge.Client{B: stripe.GetBackend(stripe.APIBackend), Key: key}
+	params := &stripe.ChargeListParams{}
+	params.Filters.AddFilter("created", "gte", strconv.FormatInt(since.Unix(), 10))
+	params.AddExpand("data.payment_intent")
+	params.AddExpand("data.payment_intent.customer")
+	if sk != "" {
+		params.SetStripeAccount(sk)
+	}
+
+	count := 0
+	itr := cclient.List(params)
+	for itr.Next() {
+		ch := itr.Charge()
+		if ch.Status != stripe.ChargeStatusSucceeded || ch.PaymentIntent == nil || !isDeposit(ch.PaymentIntent) {
+			continue
+		}
+
+		// the expanded intent doesn't carry its charges back
+		ch.PaymentIntent.Charges = &stripe.ChargeList{Data: []*stripe.Charge{ch}}
+		if err := syncDeposit(db, conf, ch.PaymentIntent); err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, itr.Err()
+}
+
+// syncDeposit adds a deposit missing from the table, or refreshes what stripe
+// knows about one already there. The product, boat and any status set here
+// other than a refund are left alone.
+func syncDeposit(db *gorm.DB, conf *types.MerchantConfig, pi *stripe.PaymentIntent) error {
+	dep := depositFromIntent(conf.ID, conf.StripeKey, pi)
+	prod := intentDepositProduct(db, conf.ID, pi)
+	dep.DepositProductID = prod.ID
+	dep.BoatID = prod.BoatID
+
+	fields := map[string]interface{}{
+		"amount":      dep.Amount,
+		"description": dep.Description,
+		"charge_id":   dep.ChargeID,
+		"name":        dep.Name,
+		"email":       dep.Email,
+		"phone":       dep.Phone,
+	}
+	if dep.Status == DepositRefunded {
+		fields["status"] = DepositRefunded
+	}
+	return db.Where(DepositBooking{ID: dep.ID}).Assign(fields).FirstOrCreate(dep).Error
+}
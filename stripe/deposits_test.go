@@ -0,0 +1,144 @@
+package stripe
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stripe/stripe-go/v72"
+	"github.com/zeroshade/tmsapi/internal"
+	"github.com/zeroshade/tmsapi/internal/dbtest"
+	"github.com/zeroshade/tmsapi/types"
+)
+
+func TestDepositFromIntent(t *testing.T) {
+	pi := &stripe.PaymentIntent{
+		ID:          "pi_dep",
+		Amount:      25000,
+		Created:     1720000000,
+		Description: "Deposit for 4 hour Fishing trip, Thu, 04 Jul 2024 18:00 PM; Estimated: 6 people",
+		Metadata:    map[string]string{"yearmonth": "2024-07", "date": "2024-07-04", "time": "18:00", "length": "4"},
+		Charges: &stripe.ChargeList{Data: []*stripe.Charge{{
+			ID:             "ch_1",
+			BillingDetails: &stripe.BillingDetails{Name: "Card Name", Email: "card@example.com", Phone: "7325550142"},
+		}}},
+		Customer: &stripe.Customer{Name: "Ana", Email: "ana@example.com"},
+	}
+
+	d := depositFromIntent("m1", "acct_1", pi)
+	want := DepositBooking{
+		ID: "pi_dep", MerchantID: "m1", Acct: "acct_1", YearMonth: "2024-07", Date: "2024-07-04", Time: "18:00",
+		Length: 4, PartySize: 6, TripType: "Fishing", Name: "Ana", Email: "ana@example.com", Phone: "7325550142",
+		Amount: "250.00", Description: pi.Description, ChargeID: "ch_1", Status: DepositSucceeded, CreatedAt: d.CreatedAt,
+	}
+	if *d != want {
+		t.Errorf("got  %+v\nwant %+v", *d, want)
+	}
+	if d.CreatedAt.Unix() != pi.Created {
+		t.Errorf("CreatedAt = %v", d.CreatedAt)
+	}
+
+	pi.Metadata["tripType"] = "Sunset"
+	pi.Metadata["estimated"] = "12"
+	pi.Charges.Data[0].Refunded = true
+	d = depositFromIntent("m1", "acct_1", pi)
+	if d.TripType != "Sunset" || d.PartySize != 12 || d.Status != DepositRefunded {
+		t.Errorf("metadata should win over the description and a refunded charge is refunded: %+v", d)
+	}
+}
+
+func testDeposit() *DepositBooking {
+	return &DepositBooking{ID: "pi_dep", Name: "Ana", Email: "ana@example.com", Date: "2024-07-04", Time: "18:00",
+		Length: 4, TripType: "Fishing", Amount: "250.00", Description: "Deposit for 4 hour Fishing trip"}
+}
+
+func TestSendDepositNotifications(t *testing.T) {
+	t.Setenv("SMS_TRANSPORT", "stub")
+	internal.StubSMS.Reset()
+	mm := &internal.MemoryMailer{}
+	useMailer(t, mm)
+	db, d := dbtest.Open(t)
+
+	conf := &types.MerchantConfig{ID: "m1", PassTitle: "Boat Co", EmailFrom: "tickets@example.com",
+		DepositNotifyEmails: []string{"owner@example.com", "captain@example.com"},
+		DepositSendSMS:      true, NotifyNumber: "732-555-0142"}
+	sendDepositNotifications(db, conf, testDeposit(), "https://pay.stripe.com/receipts/1")
+
+	sent := mm.Sent()
+	if len(sent) != 3 {
+		t.Fatalf("sent %d emails, want the customer's and two notices", len(sent))
+	}
+	if sent[0].To[0] != "ana@example.com" || !strings.Contains(sent[0].HTML, "https://pay.stripe.com/receipts/1") {
+		t.Errorf("customer email = %+v", sent[0])
+	}
+	if sent[1].To[0] != "owner@example.com" || sent[2].To[0] != "captain@example.com" {
+		t.Errorf("notices went to %v and %v", sent[1].To, sent[2].To)
+	}
+
+	sms := internal.StubSMS.Sent()
+	if len(sms) != 1 || sms[0].To != "+17325550142" || !strings.Contains(sms[0].Body, "Ana") {
+		t.Errorf("texts = %+v", sms)
+	}
+	if n := len(d.Statements(`INSERT INTO "notifications"`)); n != 4 {
+		t.Errorf("logged %d notifications, want 4", n)
+	}
+}
+
+func TestSendDepositNotificationsRepeated(t *testing.T) {
+	t.Setenv("SMS_TRANSPORT", "stub")
+	internal.StubSMS.Reset()
+	mm := &internal.MemoryMailer{}
+	useMailer(t, mm)
+	db, d := dbtest.Open(t)
+	d.Returns(`SELECT count(*) FROM "notifications"`, []string{"count"}, []interface{}{int64(1)})
+
+	conf := &types.MerchantConfig{ID: "m1", EmailFrom: "tickets@example.com", DepositSendSMS: true, NotifyNumber: "732-555-0142"}
+	sendDepositNotifications(db, conf, testDeposit(), "")
+	if len(mm.Sent()) != 0 || len(internal.StubSMS.Sent()) != 0 {
+		t.Error("notified again for a repeated webhook")
+	}
+}
+
+func TestSyncDeposit(t *testing.T) {
+	conf := &types.MerchantConfig{ID: "m1", StripeKey: "acct_1"}
+	pi := &stripe.PaymentIntent{ID: "pi_dep", Amount: 25000,
+		Metadata: map[string]string{"type": "deposit", "productId": "3", "date": "2024-07-04", "time": "18:00"},
+		Customer: &stripe.Customer{Name: "Ana", Email: "ana@example.com"}}
+
+	db, d := dbtest.Open(t)
+	d.Returns(`FROM "deposit_products"`, []string{"id", "merchant_id", "boat_id"}, []interface{}{int64(3), "m1", int64(2)})
+	if err := syncDeposit(db, conf, pi); err != nil {
+		t.Fatal(err)
+	}
+	ins := d.Statements(`INSERT INTO "deposit_bookings"`)
+	if len(ins) != 1 {
+		t.Fatalf("inserted %d deposits", len(ins))
+	}
+	for col, w := range map[string]interface{}{"deposit_product_id": int64(3), "boat_id": int64(2), "status": DepositSucceeded} {
+		if v := value(t, ins[0], col); v != w {
+			t.Errorf("%s = %v, want %v", col, v, w)
+		}
+	}
+
+	// a deposit already there keeps what the webhook worked out for it
+	db, d = dbtest.Open(t)
+	d.Returns(`FROM "deposit_bookings"`, []string{"id", "merchant_id", "deposit_product_id", "boat_id", "status", "name"},
+		[]interface{}{"pi_dep", "m1", int64(3), int64(2), DepositConflict, "A"})
+	if err := syncDeposit(db, conf, pi); err != nil {
+		t.Fatal(err)
+	}
+	if ins := d.Statements(`INSERT INTO "deposit_bookings"`); len(ins) != 0 {
+		t.Fatalf("inserted over an existing deposit: %q", ins[0].Query)
+	}
+	upd := d.Statements(`UPDATE "deposit_bookings"`)
+	if len(upd) != 1 {
+		t.Fatalf("updated %d times", len(upd))
+	}
+	if v := value(t, upd[0], "name"); v != "Ana" {
+		t.Errorf("name = %v", v)
+	}
+	for _, col := range []string{"status", "deposit_product_id", "boat_id"} {
+		if _, ok := upd[0].Value(col); ok {
+			t.Errorf("sync overwrote %s: %q", col, upd[0].Query)
+		}
+	}
+}
@@ -0,0 +1,410 @@
+package stripe
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/jinzhu/gorm"
+	"github.com/lithammer/shortuuid/v3"
+	"github.com/stripe/stripe-go/v72"
+	"github.com/zeroshade/tmsapi/internal"
+	"github.com/zeroshade/tmsapi/types"
+)
+
+const (
+	GroupOpen     = "open"
+	GroupComplete = "complete"
+	GroupExpired  = "expired"
+
+	MemberPending  = "pending"
+	MemberPaid     = "paid"
+	MemberReleased = "released"
+	// paid after their seat was released and sold, MemberUnseated is when the
+	// automatic refund failed and staff need to sort it out
+	MemberRefunded = "refunded"
+	MemberUnseated = "unseated"
+)
+
+var groupTimestampRe = regexp.MustCompile(`^\d{10}$`)
+
+// GroupOrder is a booking where the organiser holds seats for a group and
+// each member pays for their own seat through their own link. Seats nobody
+// has paid for by the deadline go back into inventory.
+type GroupOrder struct {
+	ID             string        `json:"id" gorm:"primary_key"`
+	MerchantID     string        `json:"-" gorm:"index"`
+	ProductID      int           `json:"productId"`
+	Timestamp      string        `json:"timestamp"`
+	Sku            string        `json:"sku"`
+	Name           string        `json:"name"`
+	UnitPrice      string        `json:"unitPrice" gorm:"type:money"`
+	Seats          int           `json:"seats"`
+	OrganizerName  string        `json:"organizerName"`
+	OrganizerEmail string        `json:"organizerEmail"`
+	OrganizerPhone string        `json:"organizerPhone"`
+	Token          string        `json:"-"`
+	Deadline       time.Time     `json:"deadline" gorm:"index"`
+	Status         string        `json:"status" gorm:"index"`
+	CreatedAt      time.Time     `json:"created"`
+	Members        []GroupMember `json:"members"`
+}
+
+// GroupMember is one seat of a group order
+type GroupMember struct {
+	ID           string     `json:"id" gorm:"primary_key"`
+	GroupOrderID string     `json:"-" gorm:"index"`
+	Name         string     `json:"name"`
+	Email        string     `json:"email"`
+	Phone        string     `json:"phone"`
+	Token        string     `json:"-"`
+	Status       string     `json:"status"`
+	PaymentID    string     `json:"paymentId"`
+	LinkSentAt   *time.Time `json:"linkSentAt"`
+	PaidAt       *time.Time `json:"paidAt"`
+
+	Link string `json:"link,omitempty" gorm:"-"`
+}
+
+func (m *GroupMember) payLink(host, merchantID string) string {
+	return fmt.Sprintf("https://%s/info/%s/groups/%s/members/%s/pay?token=%s", host, merchantID, m.GroupOrderID, m.ID, m.Token)
+}
+
+// departure is when the group's trip leaves
+func (g *GroupOrder) departure() time.Time {
+	ts, _ := strconv.ParseInt(g.Timestamp, 10, 64)
+	return time.Unix(ts, 0)
+}
+
+func (g *GroupOrder) fillLinks(host string) {
+	for idx := range g.Members {
+		g.Members[idx].Link = g.Members[idx].payLink(host, g.MerchantID)
+	}
+}
+
+func (g *GroupOrder) adjustInventory(db *gorm.DB, seats int) {
+	db.Table("manual_overrides").Where("product_id = ? AND time = ?", g.ProductID, g.departure().In(timeloc)).
+		UpdateColumn("avail", gorm.Expr("avail + ?", seats))
+}
+
+// reserveSeats claims seats from the departure's remaining ones, failing if
+// there aren't enough left. Departures without an override aren't counted
+// here so always have room.
+func (g *GroupOrder) reserveSeats(db *gorm.DB, seats int) bool {
+	scope := db.Table("manual_overrides").Where("product_id = ? AND time = ?", g.ProductID, g.departure().In(timeloc))
+
+	var rows int
+	scope.Count(&rows)
+	if rows == 0 {
+		return true
+	}
+	return scope.Where("avail >= ?", seats).UpdateColumn("avail", gorm.Expr("avail - ?", seats)).RowsAffected > 0
+}
+
+type groupMemberRequest struct {
+	Name  string `json:"name"`
+	Email string `json:"email"`
+	Phone string `json:"phone"`
+}
+
+type createGroupRequest struct {
+	ProductID  int                  `json:"productId"`
+	Timestamp  string               `json:"timestamp"`
+	TicketType string               `json:"ticket"`
+	Desc       string               `json:"desc"`
+	UnitPrice  string               `json:"unitPrice"`
+	Seats      int                  `json:"seats"`
+	Name       string               `json:"name"`
+	Email      string               `json:"email"`
+	Phone      string               `json:"phone"`
+	Deadline   time.Time            `json:"deadline"`
+	Members    []groupMemberRequest `json:"members"`
+}
+
+func sendGroupMemberEmail(db *gorm.DB, conf *types.MerchantConfig, g *GroupOrder, m *GroupMember, link string) error {
+	data := &types.EmailData{
+		Name: m.Name, Email: m.Email, OrderID: g.ID,
+		Organizer: g.OrganizerName, Trip: g.Name, Amount: g.UnitPrice, PayLink: link,
+		Expires: types.FormatDate(types.ResolveLocale(conf.Locale), g.Deadline.In(timeloc), types.DateTime),
+	}
+	out, err := types.RenderEmail(db, conf, types.EmailGroup, data)
+	if err != nil {
+		return err
+	}
+
+	msg := internal.NewMerchantMessage(conf, out.Subject, out.Text, out.HTML, fmt.Sprintf("%s <%s>", m.Name, m.Email))
+	return internal.SendEmail(db, conf, g.ID, types.EmailGroup, msg)
+}
+
+// CreateGroupOrder holds seats for an organiser and their group, emailing a
+// payment link to each member that has an email address. The links for the
+// rest are returned for the organiser to pass on. Staff set up groups since
+// the price per seat is taken as given.
+func CreateGroupOrder(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req createGroupRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		switch {
+		case req.Name == "" || req.Email == "":
+			c.JSON(http.StatusBadRequest, gin.H{"error": "organiser name and email are required"})
+			return
+		case req.Seats < 2:
+			c.JSON(http.StatusBadRequest, gin.H{"error": "a group needs at least two seats"})
+			return
+		case len(req.Members) > req.Seats:
+			c.JSON(http.StatusBadRequest, gin.H{"error": "more members than seats"})
+			return
+		case types.ParseMoney(req.UnitPrice) <= 0:
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid price"})
+			return
+		}
+
+		g := &GroupOrder{
+			ID:             shortuuid.New(),
+			MerchantID:     c.Param("merchantid"),
+			ProductID:      req.ProductID,
+			Timestamp:      req.Timestamp,
+			Sku:            fmt.Sprintf("%d%s%s", req.ProductID, strings.ToUpper(req.TicketType), req.Timestamp),
+			Name:           req.Desc,
+			UnitPrice:      types.FormatMoney(types.ParseMoney(req.UnitPrice)),
+			Seats:          req.Seats,
+			OrganizerName:  req.Name,
+			OrganizerEmail: req.Email,
+			OrganizerPhone: req.Phone,
+			Token:          shortuuid.New(),
+			Deadline:       req.Deadline,
+			Status:         GroupOpen,
+		}
+
+		if !groupTimestampRe.MatchString(req.Timestamp) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid timestamp"})
+			return
+		}
+		if !g.Deadline.After(time.Now()) || g.Deadline.After(g.departure()) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "deadline must be between now and departure"})
+			return
+		}
+
+		for idx := 0; idx < req.Seats; idx++ {
+			m := GroupMember{ID: uuid.New().String(), Token: shortuuid.New(), Status: MemberPending}
+			if idx < len(req.Members) {
+				m.Name = req.Members[idx].Name
+				m.Email = req.Members[idx].Email
+				m.Phone = req.Members[idx].Phone
+			}
+			g.Members = append(g.Members, m)
+		}
+
+		if !g.reserveSeats(db, g.Seats) {
+			c.JSON(http.StatusConflict, gin.H{"error": "not enough seats left on this departure"})
+			return
+		}
+		if err := db.Create(g).Error; err != nil {
+			g.adjustInventory(db, g.Seats)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		var conf types.MerchantConfig
+		db.Find(&conf, "id = ?", g.MerchantID)
+
+		g.fillLinks(c.Request.Host)
+		for idx := range g.Members {
+			m := &g.Members[idx]
+			if m.Email == "" {
+				continue
+			}
+			if err := sendGroupMemberEmail(db, &conf, g, m, m.Link); err != nil {
+				log.Println("Group Member Email Error:", m.ID, err)
+				continue
+			}
+			now := time.Now()
+			m.LinkSentAt = &now
+			db.Model(m).UpdateColumn("link_sent_at", now)
+		}
+
+		c.JSON(http.StatusCreated, gin.H{"group": g, "token": g.Token})
+	}
+}
+
+// GetGroupOrder lets the organiser see who has paid, using the token they got
+// back when creating the group
+func GetGroupOrder(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var g GroupOrder
+		db.Preload("Members").Find(&g, "id = ? AND merchant_id = ?", c.Param("gid"), c.Param("merchantid"))
+		if g.ID == "" || c.Query("token") != g.Token {
+			c.JSON(http.StatusNotFound, gin.H{"error": "group not found"})
+			return
+		}
+
+		g.fillLinks(c.Request.Host)
+		c.JSON(http.StatusOK, g)
+	}
+}
+
+func ListGroupOrders(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		scope := db.Preload("Members").Where("merchant_id = ?", c.Param("merchantid"))
+		if status := c.Query("status"); status != "" {
+			scope = scope.Where("status = ?", status)
+		}
+
+		var out []GroupOrder
+		if err := scope.Order("created_at desc").Find(&out).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		for idx := range out {
+			out[idx].fillLinks(c.Request.Host)
+		}
+		c.JSON(http.StatusOK, out)
+	}
+}
+
+// PayGroupShare is the link each member gets for paying for their seat
+func PayGroupShare(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var g GroupOrder
+		db.Find(&g, "id = ? AND merchant_id = ?", c.Param("gid"), c.Param("merchantid"))
+		var m GroupMember
+		db.Find(&m, "id = ? AND group_order_id = ?", c.Param("mid"), g.ID)
+		if g.ID == "" || m.ID == "" || c.Query("token") != m.Token {
+			c.JSON(http.StatusNotFound, gin.H{"error": "group not found"})
+			return
+		}
+
+		switch {
+		case c.Query("status") == "success":
+			messagePage(c, "Thank you, your payment has been received. Your boarding pass will be emailed to you.")
+			return
+		case c.Query("status") == "cancelled":
+			messagePage(c, "Your payment was cancelled, you can use the same link to try again.")
+			return
+		case m.Status == MemberPaid:
+			messagePage(c, "Your seat has already been paid for.")
+			return
+		case m.Status == MemberReleased || g.Status == GroupExpired || time.Now().After(g.Deadline):
+			messagePage(c, "The deadline for this group has passed and the seat has been released.")
+			return
+		}
+
+		sess, err := payLinkSession(db, c, types.ParseMoney(g.UnitPrice), m.Email, g.Name,
+			fmt.Sprintf("Group booking %s, seat for %s", g.ID, m.Name),
+			map[string]string{"type": "group", "group": g.ID, "member": m.ID},
+			m.payLink(c.Request.Host, g.MerchantID))
+		if err != nil {
+			c.JSON(http.StatusFailedDependency, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.Redirect(http.StatusSeeOther, sess.URL)
+	}
+}
+
+// recordGroupPayment marks a member's seat as paid and records it as a regular
+// ticket purchase so it shows on manifests and the member gets their pass.
+// The seat already came out of inventory when the group was created.
+func recordGroupPayment(db *gorm.DB, host string, conf *types.MerchantConfig, pi *stripe.PaymentIntent) {
+	var m GroupMember
+	db.Find(&m, "id = ? AND group_order_id = ?", pi.Metadata["member"], pi.Metadata["group"])
+	var g GroupOrder
+	db.Find(&g, "id = ?", pi.Metadata["group"])
+	if m.ID == "" || g.ID == "" {
+		log.Println("Group Payment for unknown member:", pi.Metadata["group"], pi.Metadata["member"], pi.ID)
+		return
+	}
+
+	if m.PaymentID == pi.ID {
+		// stripe retrying the webhook
+		return
+	}
+
+	now := time.Now()
+	paid := map[string]interface{}{"status": MemberPaid, "payment_id": pi.ID, "paid_at": now}
+	res := db.Model(&GroupMember{}).Where("id = ? AND status = ?", m.ID, MemberPending).Updates(paid)
+	if res.RowsAffected == 0 {
+		// released before the payment landed. Claiming it from released means
+		// a retry can't take a second seat, and if the seat has since been
+		// sold the member gets their money back rather than overselling.
+		if db.Model(&GroupMember{}).Where("id = ? AND status = ?", m.ID, MemberReleased).Updates(paid).RowsAffected == 0 {
+			// the seat was already paid for with another payment
+			log.Println("Group Payment for a seat already paid:", g.ID, m.ID, pi.ID)
+			if _, err := refundIntent(conf.StripeKey, pi.ID, 0); err != nil {
+				log.Println("Group Refund Error:", pi.ID, err)
+			}
+			return
+		}
+		if !g.reserveSeats(db, 1) {
+			log.Println("Group Payment after release, no seats left:", g.ID, m.ID, pi.ID)
+			status := MemberRefunded
+			if _, err := refundIntent(conf.StripeKey, pi.ID, 0); err != nil {
+				log.Println("Group Refund Error:", pi.ID, err)
+				status = MemberUnseated
+			}
+			db.Model(&m).UpdateColumn("status", status)
+			return
+		}
+	}
+
+	db.Save(&LineItem{
+		ID:        uuid.New().String(),
+		PaymentID: pi.ID,
+		Acct:      conf.StripeKey,
+		Quantity:  1,
+		Name:      g.Name,
+		Sku:       g.Sku,
+		UnitPrice: g.UnitPrice,
+		Amount:    g.UnitPrice,
+		Status:    string(pi.Status),
+	})
+	if err := RecordOrder(db, conf.ID, pi.ID); err != nil {
+		log.Println("Record Order Error:", err)
+	}
+
+	var pending int
+	db.Model(&GroupMember{}).Where("group_order_id = ? AND status = ?", g.ID, MemberPending).Count(&pending)
+	if pending == 0 && g.Status == GroupOpen {
+		db.Model(&g).Update("status", GroupComplete)
+	}
+
+	if pi.Customer == nil || pi.Customer.Email == "" {
+		pi.Customer = &stripe.Customer{Name: m.Name, Email: m.Email}
+	}
+	if err := sendCustomerEmail(db, host, conf, pi); err != nil {
+		log.Println("Group Pass Email Error:", m.ID, err)
+	}
+}
+
+// ReleaseUnpaidGroupSeats periodically gives back the seats of group members
+// that haven't paid by their group's deadline
+func ReleaseUnpaidGroupSeats(db *gorm.DB, interval time.Duration) {
+	for {
+		var due []GroupOrder
+		db.Where("status = ? AND deadline <= ?", GroupOpen, time.Now()).Find(&due)
+		for idx := range due {
+			g := &due[idx]
+			res := db.Model(&GroupMember{}).Where("group_order_id = ? AND status = ?", g.ID, MemberPending).
+				UpdateColumn("status", MemberReleased)
+			if res.Error != nil {
+				log.Println("Release Group Seats Error:", g.ID, res.Error)
+				continue
+			}
+			if res.RowsAffected > 0 {
+				g.adjustInventory(db, int(res.RowsAffected))
+			}
+			db.Model(g).Update("status", GroupExpired)
+		}
+		time.Sleep(interval)
+	}
+}
@@ -0,0 +1,35 @@
+package stripe
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/zeroshade/tmsapi/internal/dbtest"
+)
+
+func TestReserveSeats(t *testing.T) {
+	g := &GroupOrder{ProductID: 3, Timestamp: "20240704180000", Seats: 6}
+
+	// no override for the departure
+	db, d := dbtest.Open(t)
+	if !g.reserveSeats(db, g.Seats) {
+		t.Error("departure without an override has no room")
+	}
+	if upd := d.Statements(`UPDATE "manual_overrides"`); len(upd) != 0 {
+		t.Errorf("changed inventory that isn't tracked: %q", upd[0].Query)
+	}
+
+	db, d = dbtest.Open(t)
+	d.Returns(`SELECT count(*) FROM "manual_overrides"`, []string{"count"}, []interface{}{int64(1)})
+	d.Affects(`UPDATE "manual_overrides"`, 0)
+	if g.reserveSeats(db, g.Seats) {
+		t.Error("reserved more seats than are left")
+	}
+	upd := d.Statements(`UPDATE "manual_overrides"`)
+	if len(upd) != 1 || !strings.Contains(upd[0].Query, "avail >= $") {
+		t.Fatalf("updates = %+v", upd)
+	}
+	if upd[0].Args[len(upd[0].Args)-1] != int64(6) {
+		t.Errorf("args = %v", upd[0].Args)
+	}
+}
@@ -6,7 +6,6 @@ import (
 	"fmt"
 	"log"
 	"math"
-	"os"
 	"regexp"
 	"strconv"
 	"strings"
@@ -20,6 +19,7 @@ import (
 	"github.com/stripe/stripe-go/v72/refund"
 
 	"github.com/zeroshade/tmsapi/internal"
+	"github.com/zeroshade/tmsapi/payments"
 	"github.com/zeroshade/tmsapi/types"
 )
 
@@ -27,6 +27,7 @@ var timeloc *time.Location
 
 func init() {
 	timeloc, _ = time.LoadLocation("America/New_York")
+	payments.Register(types.ProviderStripe, Handler{})
 }
 
 type Handler struct{}
@@ -54,69 +55,13 @@ func (h Handler) OrdersTimestamp(config *types.MerchantConfig, db *gorm.DB, time
 		Joins("LEFT JOIN transfer_reqs AS tr ON (li.id = tr.line_item_id)").
 		Joins("LEFT JOIN manual_payer_infos AS mpi ON (li.id = mpi.id)").
 		Where("li.acct = ? AND SUBSTRING(coalesce(new_sku, sku) FROM '\\d+[A-Z]+(\\d{10})\\d*') = ?", config.StripeKey, timestamp).
-		Select([]string{"li.id", "payment_id", "li.acct", "quantity",
+		Select([]string{"li.id", "CASE WHEN pi.gift_card <> '' THEN '-' ELSE payment_id END AS payment_id", "li.acct", "quantity",
 			"coalesce(new_sku, sku) as sku",
-			"coalesce(new_name, li.name) AS prod", "mpi.phone",
-			"coalesce(pi.name, mpi.name) AS name", "coalesce(pi.email, mpi.email) AS email", "created_at",
+			"coalesce(new_name, li.name) AS prod", "coalesce(nullif(pi.phone, ''), mpi.phone) AS phone",
+			"coalesce(nullif(pi.name, ''), mpi.name) AS name", "coalesce(nullif(pi.email, ''), mpi.email) AS email", "pi.created_at",
 			"coalesce(li.status, pi.status) AS status", "sku AS orig_sku", "li.name AS orig_prod"}).
 		Scan(&ret)
 
-	key := stripe.Key
-	sk := config.StripeKey
-	isSubAcct := strings.HasPrefix(sk, "acct_")
-	if !isSubAcct {
-		key = sk
-	}
-
-	piClient := paymentintent.Client{B: stripe.GetBackend(stripe.APIBackend), Key: key}
-
-	piMap := make(map[string]*stripe.PaymentIntent)
-	params := &stripe.PaymentIntentParams{}
-	params.AddExpand("customer")
-	if isSubAcct {
-		params.SetStripeAccount(sk)
-	}
-	for idx := range ret {
-		r := &ret[idx]
-		var (
-			cus *stripe.Customer
-			ok  bool
-		)
-
-		if strings.HasPrefix(r.Status, "manual entry") || r.PaymentID == "-" {
-			continue
-		}
-
-		pi, ok := piMap[r.PaymentID]
-		if !ok {
-			var err error
-			pi, err = piClient.Get(r.PaymentID, params)
-			if err != nil {
-				log.Println("PI:", err)
-				continue
-			}
-			piMap[r.PaymentID] = pi
-		}
-
-		if r.CreatedAt.IsZero() {
-			r.CreatedAt = time.Unix(pi.Created, 0)
-		}
-
-		cus = pi.Customer
-		if card, ok := pi.Metadata["giftcard"]; ok && card != "" {
-			r.PaymentID = "-"
-		}
-
-		if cus.Email != "" {
-			r.Email = cus.Email
-		}
-		if cus.Phone != "" {
-			r.Phone = cus.Phone
-		}
-		if cus.Name != "" {
-			r.Name = cus.Name
-		}
-	}
 	return ret, nil
 }
 
@@ -243,6 +188,20 @@ func (h Handler) RefundTickets(config *types.MerchantConfig, db *gorm.DB, data j
 		fmt.Printf("%+v\n", ref)
 		item.Status = "refunded"
 		db.Save(&item)
+
+		err = types.RecordRefund(db, &types.OrderRefund{
+			ID:          ref.ID,
+			OrderID:     item.PaymentID,
+			LineID:      item.ID,
+			Provider:    types.ProviderStripe,
+			ProviderRef: ref.ID,
+			Status:      string(ref.Status),
+			Amount:      fmt.Sprintf("%0.2f", float64(ref.Amount)/100.0),
+			CreatedAt:   time.Unix(ref.Created, 0),
+		})
+		if err != nil {
+			log.Println("Record Refund Error:", item.PaymentID, ref.ID, err)
+		}
 	}
 
 	return gin.H{"status": "success"}, nil
@@ -318,6 +277,7 @@ func (h Handler) TransferTickets(_ *types.MerchantConfig, db *gorm.DB, data []ty
 			UpdateColumn("avail", gorm.Expr("avail - ?", r[0].Quantity))
 
 		db.Save(&data[idx])
+		types.TransferOrderLine(db, data[idx].LineItemID, data[idx].NewSKU, data[idx].NewName)
 	}
 	return nil, nil
 }
@@ -340,13 +300,18 @@ func (h Handler) ManualEntry(config *types.MerchantConfig, db *gorm.DB, entry ty
 		Sku:       fmt.Sprintf("%d%s%s", entry.ProductID, strings.ToUpper(entry.TicketType), entry.Timestamp),
 	}
 
-	db.Create(li)
-	db.Create(&ManualPayerInfo{
+	payer := &ManualPayerInfo{
 		ID:    li.ID,
 		Name:  entry.Name,
 		Phone: entry.Phone,
 		Email: entry.Email,
-	})
+	}
+
+	db.Create(li)
+	db.Create(payer)
+	if err := RecordManualOrder(db, config.ID, li.ID, payer, []LineItem{*li}); err != nil {
+		log.Println("Record Order Error:", err)
+	}
 
 	pid := entry.ProductID
 	timestamp := entry.Timestamp
@@ -366,8 +331,6 @@ type TicketRedemption struct {
 }
 
 func (h Handler) RedeemTickets(config *types.MerchantConfig, db *gorm.DB, data json.RawMessage) (interface{}, error) {
-	apiKey := os.Getenv("SENDGRID_API_KEY")
-
 	var redeem TicketRedemption
 	json.Unmarshal(data, &redeem)
 
@@ -386,6 +349,8 @@ func (h Handler) RedeemTickets(config *types.MerchantConfig, db *gorm.DB, data j
 	}
 
 	var notifyList []notifyItem
+	var lines []LineItem
+	var payer *ManualPayerInfo
 
 	for _, item := range redeem.Items {
 		li := &LineItem{
@@ -402,17 +367,26 @@ func (h Handler) RedeemTickets(config *types.MerchantConfig, db *gorm.DB, data j
 
 		notifyList = append(notifyList, notifyItem{Name: li.Name, Quantity: li.Quantity})
 
-		db.Create(li)
-		db.Create(&ManualPayerInfo{
+		payer = &ManualPayerInfo{
 			ID:    li.ID,
 			Name:  redeem.Name,
 			Phone: redeem.Phone,
 			Email: redeem.Email,
-		})
+		}
+
+		db.Create(li)
+		db.Create(payer)
+		lines = append(lines, *li)
+	}
+
+	orderID := uuid.New().String()
+	if err := RecordManualOrder(db, config.ID, orderID, payer, lines); err != nil {
+		return nil, err
 	}
 
 	db.Model(&gc).Where("id = ?", gc.ID).Update("status", "used")
-	sendNotifyEmail(apiKey, config, &stripe.PaymentIntent{
+	sendNotifyEmail(db, config, &stripe.PaymentIntent{
+		ID: orderID,
 		Charges: &stripe.ChargeList{
 			Data: []*stripe.Charge{
 				{
@@ -426,9 +400,7 @@ func (h Handler) RedeemTickets(config *types.MerchantConfig, db *gorm.DB, data j
 	}, notifyList)
 
 	if config.SendSMS {
-		// t := internal.NewTwilio(config.TwilioAcctSID, config.TwilioAcctToken, config.TwilioFromNumber)
-		t := internal.NewDefaultTwilio()
-		t.Send(config.NotifyNumber, "Tickets Purchased by "+redeem.Name)
+		internal.SendSMS(db, config, orderID, types.EmailNotify, config.NotifyNumber, types.T(types.ResolveLocale(config.Locale), "sms.purchased_by", redeem.Name))
 	}
 
 	return nil, nil
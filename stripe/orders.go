@@ -0,0 +1,96 @@
+package stripe
+
+import (
+	"fmt"
+
+	"github.com/jinzhu/gorm"
+	"github.com/zeroshade/tmsapi/types"
+)
+
+func lineToOrderLine(li *LineItem) types.OrderLine {
+	return types.OrderLine{
+		ID:          li.ID,
+		ProviderRef: li.ID,
+		Sku:         li.Sku,
+		Name:        li.Name,
+		Quantity:    uint(li.Quantity),
+		UnitPrice:   li.UnitPrice,
+		Amount:      li.Amount,
+		Status:      li.Status,
+	}
+}
+
+// RecordOrder copies a payment intent and its line items from the stripe
+// tables into the unified order schema
+func RecordOrder(db *gorm.DB, merchantID, paymentID string) error {
+	var pi PaymentIntent
+	if err := db.Find(&pi, "id = ?", paymentID).Error; err != nil {
+		return fmt.Errorf("payment intent %s: %w", paymentID, err)
+	}
+
+	var items []LineItem
+	db.Find(&items, "payment_id = ?", paymentID)
+
+	o := &types.Order{
+		ID:          paymentID,
+		MerchantID:  merchantID,
+		Provider:    types.ProviderStripe,
+		ProviderRef: paymentID,
+		Status:      pi.Status,
+		Total:       pi.Amount,
+		CreatedAt:   pi.CreatedAt,
+		Locale:      pi.Locale,
+		Customer: &types.Customer{
+			Name:  pi.Name,
+			Email: pi.Email,
+			Phone: pi.Phone,
+		},
+	}
+
+	for idx := range items {
+		o.Lines = append(o.Lines, lineToOrderLine(&items[idx]))
+	}
+
+	if pi.Amount != "" {
+		o.Payments = []types.OrderPayment{{
+			ID:          paymentID,
+			Provider:    types.ProviderStripe,
+			ProviderRef: paymentID,
+			Status:      pi.Status,
+			Amount:      pi.Amount,
+			CreatedAt:   pi.CreatedAt,
+		}}
+	}
+
+	return types.SaveOrder(db, o)
+}
+
+// RecordManualOrder writes line items that were entered by staff or redeemed
+// with a gift card, and so have no payment intent, as a single unified order
+func RecordManualOrder(db *gorm.DB, merchantID, orderID string, payer *ManualPayerInfo, items []LineItem) error {
+	if len(items) == 0 || payer == nil {
+		return fmt.Errorf("manual order %s needs a payer and at least one item", orderID)
+	}
+
+	o := &types.Order{
+		ID:          orderID,
+		MerchantID:  merchantID,
+		Provider:    types.ProviderManual,
+		ProviderRef: items[0].ID,
+		Status:      items[0].Status,
+		Customer: &types.Customer{
+			Name:  payer.Name,
+			Email: payer.Email,
+			Phone: payer.Phone,
+		},
+	}
+
+	var total float64
+	for idx := range items {
+		o.Lines = append(o.Lines, lineToOrderLine(&items[idx]))
+		total += types.ParseMoney(items[idx].Amount)
+	}
+	o.Total = types.FormatMoney(total)
+
+	return types.SaveOrder(db, o)
+}
@@ -0,0 +1,24 @@
+package stripe
+
+import (
+	"testing"
+
+	"github.com/zeroshade/tmsapi/internal/dbtest"
+)
+
+func TestRecordOrderPhone(t *testing.T) {
+	db, d := dbtest.Open(t)
+	d.Returns(`FROM "payment_intents"`, []string{"id", "acct", "amount", "name", "email", "phone", "status"},
+		[]interface{}{"pi_1", "acct_1", "$40.00", "Ana", "ana@example.com", "7325550142", "succeeded"})
+	if err := RecordOrder(db, "m1", "pi_1"); err != nil {
+		t.Fatal(err)
+	}
+
+	cus := d.Statements(`"customers"`)
+	if len(cus) == 0 {
+		t.Fatal("customer wasn't saved")
+	}
+	if v := value(t, cus[len(cus)-1], "phone"); v != "7325550142" {
+		t.Errorf("phone = %v", v)
+	}
+}
@@ -1,6 +1,7 @@
 package stripe
 
 import (
+	"errors"
 	"fmt"
 	"math"
 	"net/http"
@@ -12,7 +13,6 @@ import (
 	"github.com/jinzhu/gorm"
 	"github.com/lib/pq"
 	"github.com/stripe/stripe-go/v72"
-	"github.com/stripe/stripe-go/v72/charge"
 	"github.com/stripe/stripe-go/v72/checkout/session"
 	"github.com/stripe/stripe-go/v72/price"
 	"github.com/zeroshade/tmsapi/types"
@@ -165,6 +165,7 @@ type CreateDepositCheckout struct {
 	TripLength   int    `json:"tripLength"`
 	TripType     string `json:"tripType"`
 	EstimatedPpl int    `json:"estimated"`
+	Email        string `json:"email"`
 }
 
 func CheckoutDeposit(db *gorm.DB) gin.HandlerFunc {
@@ -175,111 +176,160 @@ func CheckoutDeposit(db *gorm.DB) gin.HandlerFunc {
 			return
 		}
 
-		key := stripe.Key
-		sk := c.GetString("stripe_acct")
-		if !strings.HasPrefix(sk, "acct_") {
-			key = sk
-			sk = ""
+		if !c.GetBool("deposits_enabled") {
+			c.JSON(http.StatusForbidden, gin.H{"error": "deposits are not enabled"})
+			return
 		}
 
-		pcl := price.Client{B: stripe.GetBackend(stripe.APIBackend), Key: key}
-		priceParams := &stripe.PriceParams{}
-		priceParams.SetStripeAccount(sk)
-		p, err := pcl.Get(req.PriceID, priceParams)
+		sess, status, err := newDepositSession(db, c, &req, c.Request.Header.Get("x-calendar-origin"), nil)
 		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			c.JSON(status, gin.H{"error": err.Error()})
 			return
 		}
 
-		params := &stripe.CheckoutSessionParams{
-			PhoneNumberCollection: &stripe.CheckoutSessionPhoneNumberCollectionParams{
-				Enabled: stripe.Bool(true),
+		data := createCheckoutSessionResponse{SessionID: sess.ID}
+		c.JSON(http.StatusOK, data)
+	}
+}
+
+// newDepositSession starts a stripe checkout for a charter deposit, refusing
+// times that overlap a trip already booked on the boat. The customer is sent
+// back to returnURL with the status and session id added, and meta is added
+// to the payment intent metadata.
+func newDepositSession(db *gorm.DB, c *gin.Context, req *CreateDepositCheckout, returnURL string, meta map[string]string) (*stripe.CheckoutSession, int, error) {
+	key := stripe.Key
+	sk := c.GetString("stripe_acct")
+	if !strings.HasPrefix(sk, "acct_") {
+		key = sk
+		sk = ""
+	}
+
+	pcl := price.Client{B: stripe.GetBackend(stripe.APIBackend), Key: key}
+	priceParams := &stripe.PriceParams{}
+	priceParams.SetStripeAccount(sk)
+	p, err := pcl.Get(req.PriceID, priceParams)
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+
+	sep := "?"
+	if strings.Contains(returnURL, "?") {
+		sep = "&"
+	}
+
+	params := &stripe.CheckoutSessionParams{
+		PhoneNumberCollection: &stripe.CheckoutSessionPhoneNumberCollectionParams{
+			Enabled: stripe.Bool(true),
+		},
+		SubmitType: stripe.String("book"),
+		Mode:       stripe.String(string(stripe.CheckoutSessionModePayment)),
+		LineItems: []*stripe.CheckoutSessionLineItemParams{
+			{
+				Price:    &req.PriceID,
+				Quantity: stripe.Int64(1),
 			},
-			SubmitType: stripe.String("book"),
-			Mode:       stripe.String(string(stripe.CheckoutSessionModePayment)),
-			LineItems: []*stripe.CheckoutSessionLineItemParams{
-				{
-					Price:    &req.PriceID,
-					Quantity: stripe.Int64(1),
+		},
+		SuccessURL: stripe.String(returnURL + sep + "status=success&stripe_session_id={CHECKOUT_SESSION_ID}"),
+		CancelURL:  stripe.String(returnURL + sep + "status=cancelled&stripe_session_id={CHECKOUT_SESSION_ID}"),
+	}
+
+	// fuelSurcharge := c.GetFloat64("fuel_surcharge")
+	// surcharge := int64(p.UnitAmountDecimal * fuelSurcharge)
+	// if surcharge > 0 {
+	// 	params.LineItems = append(params.LineItems, &stripe.CheckoutSessionLineItemParams{
+	// 		Quantity: stripe.Int64(1),
+	// 		PriceData: &stripe.CheckoutSessionLineItemPriceDataParams{
+	// 			Currency: stripe.String(string(stripe.CurrencyUSD)),
+	// 			ProductData: &stripe.CheckoutSessionLineItemPriceDataProductDataParams{
+	// 				Name: stripe.String("Fuel Surcharge"),
+	// 			},
+	// 			UnitAmount: stripe.Int64(surcharge),
+	// 		},
+	// 	})
+	// }
+
+	feePct := c.GetFloat64("fee_pct")
+	fee := int64(p.UnitAmountDecimal * feePct)
+
+	if fee > 0 {
+		params.LineItems = append(params.LineItems, &stripe.CheckoutSessionLineItemParams{
+			Quantity: stripe.Int64(1),
+			PriceData: &stripe.CheckoutSessionLineItemPriceDataParams{
+				Currency: stripe.String(string(stripe.CurrencyUSD)),
+				ProductData: &stripe.CheckoutSessionLineItemPriceDataProductDataParams{
+					Name: stripe.String(feeItemName),
 				},
+				UnitAmount: stripe.Int64(fee),
 			},
-			SuccessURL: stripe.String(c.Request.Header.Get("x-calendar-origin") + "?status=success&stripe_session_id={CHECKOUT_SESSION_ID}"),
-			CancelURL:  stripe.String(c.Request.Header.Get("x-calendar-origin") + "?status=cancelled&stripe_session_id={CHECKOUT_SESSION_ID}"),
-		}
+		})
+	}
 
-		// fuelSurcharge := c.GetFloat64("fuel_surcharge")
-		// surcharge := int64(p.UnitAmountDecimal * fuelSurcharge)
-		// if surcharge > 0 {
-		// 	params.LineItems = append(params.LineItems, &stripe.CheckoutSessionLineItemParams{
-		// 		Quantity: stripe.Int64(1),
-		// 		PriceData: &stripe.CheckoutSessionLineItemPriceDataParams{
-		// 			Currency: stripe.String(string(stripe.CurrencyUSD)),
-		// 			ProductData: &stripe.CheckoutSessionLineItemPriceDataProductDataParams{
-		// 				Name: stripe.String("Fuel Surcharge"),
-		// 			},
-		// 			UnitAmount: stripe.Int64(surcharge),
-		// 		},
-		// 	})
-		// }
-
-		feePct := c.GetFloat64("fee_pct")
-		fee := int64(p.UnitAmountDecimal * feePct)
-
-		if fee > 0 {
-			params.LineItems = append(params.LineItems, &stripe.CheckoutSessionLineItemParams{
-				Quantity: stripe.Int64(1),
-				PriceData: &stripe.CheckoutSessionLineItemPriceDataParams{
-					Currency: stripe.String(string(stripe.CurrencyUSD)),
-					ProductData: &stripe.CheckoutSessionLineItemPriceDataProductDataParams{
-						Name: stripe.String(feeItemName),
-					},
-					UnitAmount: stripe.Int64(fee),
-				},
-			})
-		}
+	t, err := time.Parse("2006-01-02 15:04", req.Date+" "+req.Time)
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
 
-		t, err := time.Parse("2006-01-02 15:04", req.Date+" "+req.Time)
-		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-			return
-		}
+	var stripeProd string
+	if p.Product != nil {
+		stripeProd = p.Product.ID
+	}
+	prod := depositProduct(db, c.Param("merchantid"), req.PriceID, stripeProd)
 
-		params.PaymentIntentData = &stripe.CheckoutSessionPaymentIntentDataParams{
-			Description: stripe.String(fmt.Sprintf("Deposit for %d hour %s trip, %s; Estimated: %d people",
-				req.TripLength, req.TripType, t.Format("Mon, 02 Jan 2006 15:04 PM"), req.EstimatedPpl)),
-			Metadata: map[string]string{
-				"yearmonth": req.Date[:len(req.Date)-3],
-				"date":      req.Date, "time": req.Time,
-				"length": strconv.Itoa(req.TripLength),
-			},
-		}
+	start, err := parseSlot(req.Date, req.Time)
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	booked := bookedTrips(db, c.Param("merchantid"), prod.BoatID, start, start.Add(time.Duration(req.TripLength)*time.Hour))
+	if slotTaken(booked, start, uint(req.TripLength)) {
+		return nil, http.StatusConflict, errors.New("that trip time is no longer available")
+	}
 
-		stripeFee := int64(math.Ceil(float64(p.UnitAmount+fee)*0.029)) + 30
-		if fee > stripeFee {
-			params.PaymentIntentData.ApplicationFeeAmount = stripe.Int64(fee - stripeFee)
-		}
-		params.SetStripeAccount(sk)
+	params.PaymentIntentData = &stripe.CheckoutSessionPaymentIntentDataParams{
+		Description: stripe.String(fmt.Sprintf("Deposit for %d hour %s trip, %s; Estimated: %d people",
+			req.TripLength, req.TripType, t.Format("Mon, 02 Jan 2006 15:04 PM"), req.EstimatedPpl)),
+		Metadata: map[string]string{
+			"type":      "deposit",
+			"yearmonth": req.Date[:len(req.Date)-3],
+			"date":      req.Date, "time": req.Time,
+			"length":    strconv.Itoa(req.TripLength),
+			"tripType":  req.TripType,
+			"estimated": strconv.Itoa(req.EstimatedPpl),
+			"priceId":   req.PriceID,
+			"productId": strconv.Itoa(int(prod.ID)),
+		},
+	}
 
-		sessClient := session.Client{B: stripe.GetBackend(stripe.APIBackend), Key: key}
-		sess, err := sessClient.New(params)
-		if err != nil {
-			c.JSON(http.StatusFailedDependency, gin.H{"error": err.Error()})
-			return
-		}
+	for k, v := range meta {
+		params.PaymentIntentData.Metadata[k] = v
+	}
+	if req.Email != "" {
+		params.CustomerEmail = stripe.String(req.Email)
+	}
 
-		db.Save(&PaymentIntent{
-			ID:   sess.PaymentIntent.ID,
-			Acct: sk,
-		})
+	stripeFee := int64(math.Ceil(float64(p.UnitAmount+fee)*0.029)) + 30
+	if fee > stripeFee {
+		params.PaymentIntentData.ApplicationFeeAmount = stripe.Int64(fee - stripeFee)
+	}
+	params.SetStripeAccount(sk)
 
-		data := createCheckoutSessionResponse{SessionID: sess.ID}
-		c.JSON(http.StatusOK, data)
+	sessClient := session.Client{B: stripe.GetBackend(stripe.APIBackend), Key: key}
+	sess, err := sessClient.New(params)
+	if err != nil {
+		return nil, http.StatusFailedDependency, err
 	}
+
+	db.Save(&PaymentIntent{
+		ID:   sess.PaymentIntent.ID,
+		Acct: c.GetString("stripe_acct"),
+	})
+
+	return sess, http.StatusOK, nil
 }
 
 type ManualDeposit struct {
 	ID         int    `json:"id" gorm:"primary_key;auto_increment;"`
 	MerchantID string `json:"-"`
+	BoatID     uint   `json:"boatId"`
 	Date       string `json:"date"`
 	Time       string `json:"time"`
 	Length     uint   `json:"length"`
@@ -308,6 +358,11 @@ func SaveManualDeposit(db *gorm.DB) gin.HandlerFunc {
 			return
 		}
 
+		if _, err := time.Parse("2006-01-02", req.Date); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "date must be YYYY-MM-DD"})
+			return
+		}
+
 		req.MerchantID = c.Param("merchantid")
 		db.Save(&req)
 	}
@@ -330,37 +385,19 @@ type DepositSearchResult struct {
 
 func GetDeposits(db *gorm.DB) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		key := stripe.Key
-		sk := c.GetString("stripe_acct")
-		if !strings.HasPrefix(sk, "acct_") {
-			key = sk
-			sk = ""
-		}
-
-		cclient := charge.Client{B: stripe.GetBackend(stripe.APIBackend), Key: key}
-		params := &stripe.ChargeSearchParams{}
+		var bookings []DepositBooking
+		db.Order("created_at").Find(&bookings, "merchant_id = ? AND year_month = ? AND status = ?",
+			c.Param("merchantid"), c.Param("yearmonth"), DepositSucceeded)
 
-		// piclient := paymentintent.Client{B: stripe.GetBackend(stripe.APIBackend), Key: key}
-		// params := &stripe.PaymentIntentSearchParams{}
-		params.AddExpand("data.payment_intent")
-		params.SetStripeAccount(sk)
-		params.Context = c.Request.Context()
-		params.Query = `refunded:null AND status:"succeeded" AND metadata["yearmonth"]:"` + c.Param("yearmonth") + `"`
-		sitr := cclient.Search(params)
 		res := []DepositSearchResult{}
-
-		for sitr.Next() {
-			pi := sitr.Charge().PaymentIntent
+		for _, b := range bookings {
 			res = append(res, DepositSearchResult{
-				ID: pi.ID, Desc: pi.Description,
-				Metadata: pi.Metadata,
+				ID: b.ID, Desc: b.Description,
+				Metadata: b.Metadata(),
 			})
 		}
 
-		var deps []ManualDeposit
-		db.Find(&deps, `merchant_id = ? AND to_date(date, 'YYYY-MM-DD') BETWEEN ? AND (?::date + '1 month'::interval)`,
-			c.Param("merchantid"), c.Param("yearmonth")+"-01", c.Param("yearmonth")+"-01")
-
+		deps := manualDepositsForMonth(db, c.Param("merchantid"), c.Param("yearmonth"))
 		for _, d := range deps {
 			res = append(res, DepositSearchResult{
 				ID: "manual", Desc: "",
@@ -376,42 +413,23 @@ func GetDeposits(db *gorm.DB) gin.HandlerFunc {
 	}
 }
 
-func GetDepositOrders(c *gin.Context) {
-	key := stripe.Key
-	sk := c.GetString("stripe_acct")
-	if !strings.HasPrefix(sk, "acct_") {
-		key = sk
-		sk = ""
-	}
-
-	yr := c.Query("year")
-	mn := c.Query("month")
-
-	yearmonth := fmt.Sprintf("%s-%s", yr, mn)
+func GetDepositOrders(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		yearmonth := fmt.Sprintf("%s-%s", c.Query("year"), c.Query("month"))
 
-	cclient := charge.Client{B: stripe.GetBackend(stripe.APIBackend), Key: key}
-	params := &stripe.ChargeSearchParams{}
-	params.SetStripeAccount(sk)
-	// params.AddExpand("data.customer")
-	params.AddExpand("data.payment_intent")
-	params.AddExpand("data.payment_intent.customer")
-	params.Context = c.Request.Context()
-	params.Query = `status:"succeeded" AND refunded:null AND metadata['yearmonth']:"` + yearmonth + `"`
+		var bookings []DepositBooking
+		db.Order("created_at").Find(&bookings, "merchant_id = ? AND year_month = ? AND status = ?",
+			c.Param("merchantid"), yearmonth, DepositSucceeded)
 
-	sitr := cclient.Search(params)
+		res := []*stripe.PaymentIntent{}
+		for idx := range bookings {
+			res = append(res, bookings[idx].toPaymentIntent())
+		}
 
-	// piclient := paymentintent.Client{B: stripe.GetBackend(stripe.APIBackend), Key: key}
-	// params := &stripe.PaymentIntentSearchParams{}
-	// params.SetStripeAccount(sk)
-	// params.AddExpand("data.customer")
-	// params.Context = c.Request.Context()
-	// params.Query = `status:"succeeded"`
-	// sitr := piclient.Search(params)
-	res := []*stripe.PaymentIntent{}
-	for sitr.Next() {
-		if strings.HasPrefix(sitr.Charge().Description, "Deposit") {
-			res = append(res, sitr.Charge().PaymentIntent)
+		deps := manualDepositsForMonth(db, c.Param("merchantid"), yearmonth)
+		for idx := range deps {
+			res = append(res, deps[idx].toPaymentIntent())
 		}
+		c.JSON(http.StatusOK, res)
 	}
-	c.JSON(http.StatusOK, res)
 }
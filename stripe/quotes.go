@@ -0,0 +1,332 @@
+package stripe
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+	"github.com/lithammer/shortuuid/v3"
+	"github.com/zeroshade/tmsapi/internal"
+	"github.com/zeroshade/tmsapi/types"
+)
+
+const (
+	QuoteNew      = "new"
+	QuoteSent     = "quoted"
+	QuoteBooked   = "booked"
+	QuoteDeclined = "declined"
+	QuoteClosed   = "closed"
+
+	defaultQuoteDays = 7
+)
+
+// CharterQuote is a customer asking about a charter before paying anything
+type CharterQuote struct {
+	ID               uint       `json:"id" gorm:"primary_key;auto_increment"`
+	MerchantID       string     `json:"-" gorm:"index"`
+	DepositProductID uint       `json:"productId"`
+	Date             string     `json:"date"`
+	Time             string     `json:"time"`
+	TripLength       int        `json:"tripLength"`
+	TripType         string     `json:"tripType"`
+	EstimatedPpl     int        `json:"estimated"`
+	Name             string     `json:"name"`
+	Email            string     `json:"email"`
+	Phone            string     `json:"phone"`
+	Message          string     `json:"message"`
+	Status           string     `json:"status"`
+	PriceID          string     `json:"priceId"`
+	QuotedTotal      string     `json:"quotedTotal" gorm:"type:money"`
+	StaffNote        string     `json:"staffNote"`
+	Token            string     `json:"-"`
+	QuotedAt         *time.Time `json:"quotedAt"`
+	ExpiresAt        *time.Time `json:"expiresAt"`
+	DepositID        string     `json:"depositId"`
+	CreatedAt        time.Time  `json:"created"`
+	UpdatedAt        time.Time  `json:"updated"`
+}
+
+func (q *CharterQuote) link(host string) string {
+	return fmt.Sprintf("https://%s/info/%s/quotes/%d/checkout?token=%s", host, q.MerchantID, q.ID, q.Token)
+}
+
+// markQuoteBooked closes out the quote a deposit was paid from
+func markQuoteBooked(db *gorm.DB, quoteID, depositID string) {
+	db.Model(&CharterQuote{}).Where("id = ?", quoteID).
+		Updates(map[string]interface{}{"status": QuoteBooked, "deposit_id": depositID})
+}
+
+// RequestQuote is the public form for customers asking about a charter
+func RequestQuote(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var q CharterQuote
+		if err := c.ShouldBindJSON(&q); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		if _, err := parseSlot(q.Date, q.Time); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid date or time"})
+			return
+		}
+		if q.TripLength <= 0 || q.Name == "" || (q.Email == "" && q.Phone == "") {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "must include a trip length, name and email or phone"})
+			return
+		}
+
+		var conf types.MerchantConfig
+		if db.Find(&conf, "id = ?", c.Param("merchantid")).RecordNotFound() {
+			c.JSON(http.StatusNotFound, gin.H{"error": "merchant not found"})
+			return
+		}
+
+		q.ID = 0
+		q.MerchantID = conf.ID
+		q.Status = QuoteNew
+		q.PriceID, q.StaffNote, q.DepositID = "", "", ""
+		q.QuotedTotal = types.FormatMoney(0)
+		q.QuotedAt, q.ExpiresAt = nil, nil
+		if err := db.Create(&q).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"id": q.ID})
+	}
+}
+
+func ListQuotes(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		scope := db.Where("merchant_id = ?", c.Param("merchantid"))
+		if status := c.Query("status"); status != "" {
+			scope = scope.Where("status = ?", status)
+		}
+
+		out := []CharterQuote{}
+		scope.Order("created_at desc").Find(&out)
+		c.JSON(http.StatusOK, out)
+	}
+}
+
+func findQuote(db *gorm.DB, c *gin.Context) (*CharterQuote, bool) {
+	var q CharterQuote
+	db.Find(&q, "id = ? AND merchant_id = ?", c.Param("qid"), c.Param("merchantid"))
+	if q.ID == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "quote not found"})
+		return nil, false
+	}
+	return &q, true
+}
+
+// UpdateQuoteStatus lets staff decline or close a quote request
+func UpdateQuoteStatus(db *gorm.DB) gin.HandlerFunc {
+	type statusReq struct {
+		Status    string `json:"status"`
+		StaffNote string `json:"staffNote"`
+	}
+	return func(c *gin.Context) {
+		var req statusReq
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		switch req.Status {
+		case QuoteNew, QuoteDeclined, QuoteClosed:
+		default:
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid status " + req.Status})
+			return
+		}
+
+		q, ok := findQuote(db, c)
+		if !ok {
+			return
+		}
+
+		q.Status = req.Status
+		if req.StaffNote != "" {
+			q.StaffNote = req.StaffNote
+		}
+		// declining or closing stops the link from working
+		if req.Status != QuoteNew {
+			q.Token = ""
+		}
+		db.Save(q)
+		c.JSON(http.StatusOK, q)
+	}
+}
+
+func sendQuoteEmail(db *gorm.DB, conf *types.MerchantConfig, q *CharterQuote, link string) error {
+	data := &types.EmailData{
+		Name: q.Name, Email: q.Email, Phone: q.Phone,
+		TripLength: q.TripLength, TripType: q.TripType, Date: q.Date, Time: q.Time,
+		Note: q.StaffNote, PayLink: link,
+	}
+	if types.ParseMoney(q.QuotedTotal) > 0 {
+		data.Total = q.QuotedTotal
+	}
+	data.Expires = types.FormatDate(types.ResolveLocale(conf.Locale), q.ExpiresAt.In(timeloc), types.DateTime)
+
+	msg, err := types.RenderEmail(db, conf, types.EmailQuote, data)
+	if err != nil {
+		return err
+	}
+
+	m := internal.NewMerchantMessage(conf, msg.Subject, msg.Text, msg.HTML, fmt.Sprintf("%s <%s>", q.Name, q.Email))
+	return internal.SendEmailFor(db, &types.Notification{
+		MerchantID: conf.ID, RelatedTo: "quote", RelatedID: fmt.Sprint(q.ID), Template: types.EmailQuote,
+	}, m)
+}
+
+// SendQuote emails the customer a link that takes them to a deposit checkout
+// filled in from their request, using the price staff picked. The link stops
+// working once it expires.
+func SendQuote(db *gorm.DB) gin.HandlerFunc {
+	type sendReq struct {
+		PriceID     string `json:"priceId"`
+		Date        string `json:"date"`
+		Time        string `json:"time"`
+		TripLength  int    `json:"tripLength"`
+		QuotedTotal string `json:"quotedTotal"`
+		StaffNote   string `json:"staffNote"`
+		ExpiresIn   int    `json:"expiresInDays"`
+	}
+	return func(c *gin.Context) {
+		var req sendReq
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		if req.PriceID == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "must choose a price"})
+			return
+		}
+
+		q, ok := findQuote(db, c)
+		if !ok {
+			return
+		}
+		if q.Email == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "quote has no email to send to"})
+			return
+		}
+		if q.Status == QuoteBooked {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "quote has already been booked"})
+			return
+		}
+
+		var price DepositPrice
+		db.Table("deposit_prices AS dp").Select("dp.*").
+			Joins("JOIN deposit_products AS prod ON prod.id = dp.deposit_product_id").
+			Where("dp.stripe_id = ? AND prod.merchant_id = ?", req.PriceID, q.MerchantID).
+			Find(&price)
+		if price.ID == 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "unknown price " + req.PriceID})
+			return
+		}
+
+		// staff can adjust the trip when quoting
+		if req.Date != "" {
+			q.Date = req.Date
+		}
+		if req.Time != "" {
+			q.Time = req.Time
+		}
+		if req.TripLength > 0 {
+			q.TripLength = req.TripLength
+		}
+		if _, err := parseSlot(q.Date, q.Time); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid date or time"})
+			return
+		}
+
+		days := req.ExpiresIn
+		if days <= 0 {
+			days = defaultQuoteDays
+		}
+		now := time.Now()
+		expires := now.AddDate(0, 0, days)
+
+		q.PriceID = price.StripeID
+		q.DepositProductID = price.DepositProductID
+		q.QuotedTotal = types.FormatMoney(types.ParseMoney(req.QuotedTotal))
+		q.StaffNote = req.StaffNote
+		q.Status = QuoteSent
+		q.QuotedAt = &now
+		q.ExpiresAt = &expires
+		q.Token = shortuuid.New()
+		db.Save(q)
+
+		var conf types.MerchantConfig
+		db.Find(&conf, "id = ?", q.MerchantID)
+
+		link := q.link(c.Request.Host)
+		if err := sendQuoteEmail(db, &conf, q, link); err != nil {
+			c.JSON(http.StatusFailedDependency, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"quote": q, "link": link})
+	}
+}
+
+// messagePage answers a customer's payment link with a plain page, for the
+// times there's nothing to pay or they've come back from checkout
+func messagePage(c *gin.Context, msg string) {
+	c.Data(http.StatusOK, "text/html; charset=utf-8", []byte("<html><body><h3>"+template.HTMLEscapeString(msg)+"</h3></body></html>"))
+}
+
+// QuoteCheckout is the link a quote is sent with, it starts a deposit
+// checkout with everything from the quote already filled in
+func QuoteCheckout(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var q CharterQuote
+		db.Find(&q, "id = ? AND merchant_id = ?", c.Param("qid"), c.Param("merchantid"))
+		if q.ID == 0 || q.Token == "" || c.Query("token") != q.Token {
+			c.JSON(http.StatusNotFound, gin.H{"error": "quote not found"})
+			return
+		}
+
+		switch {
+		case c.Query("status") == "success" || q.Status == QuoteBooked:
+			messagePage(c, "Thank you, your charter deposit has been received.")
+			return
+		case c.Query("status") == "cancelled":
+			messagePage(c, "Your payment was cancelled, you can use the link in your email to try again.")
+			return
+		case q.Status != QuoteSent || q.ExpiresAt == nil || time.Now().After(*q.ExpiresAt):
+			messagePage(c, "This quote has expired, please contact us for a new one.")
+			return
+		}
+
+		if !c.GetBool("deposits_enabled") {
+			c.JSON(http.StatusForbidden, gin.H{"error": "deposits are not enabled"})
+			return
+		}
+
+		req := &CreateDepositCheckout{
+			Date:         q.Date,
+			Time:         q.Time,
+			PriceID:      q.PriceID,
+			TripLength:   q.TripLength,
+			TripType:     q.TripType,
+			EstimatedPpl: q.EstimatedPpl,
+			Email:        q.Email,
+		}
+
+		sess, status, err := newDepositSession(db, c, req, q.link(c.Request.Host), map[string]string{"quote": fmt.Sprint(q.ID)})
+		if err != nil {
+			if status == http.StatusConflict {
+				messagePage(c, "Sorry, that trip time has since been booked, please contact us for another time.")
+				return
+			}
+			c.JSON(status, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.Redirect(http.StatusSeeOther, sess.URL)
+	}
+}
@@ -0,0 +1,29 @@
+package stripe
+
+import (
+	"math"
+	"strings"
+
+	"github.com/stripe/stripe-go/v72"
+	"github.com/stripe/stripe-go/v72/refund"
+)
+
+// refundIntent refunds a payment intent on the merchant's stripe account,
+// all of it when amount is zero
+func refundIntent(acct, paymentID string, amount float64) (*stripe.Refund, error) {
+	key := stripe.Key
+	if !strings.HasPrefix(acct, "acct_") {
+		key, acct = acct, ""
+	}
+
+	params := &stripe.RefundParams{PaymentIntent: stripe.String(paymentID)}
+	if amount > 0 {
+		params.Amount = stripe.Int64(int64(math.Round(amount * 100)))
+	}
+	if acct != "" {
+		params.SetStripeAccount(acct)
+	}
+
+	refClient := refund.Client{B: stripe.GetBackend(stripe.APIBackend), Key: key}
+	return refClient.New(params)
+}
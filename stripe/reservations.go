@@ -0,0 +1,183 @@
+package stripe
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/jinzhu/gorm"
+	"github.com/lithammer/shortuuid/v3"
+	"github.com/stripe/stripe-go/v72"
+	"github.com/zeroshade/tmsapi/internal"
+	"github.com/zeroshade/tmsapi/types"
+)
+
+func reservationPayLink(host string, r *types.Reservation) string {
+	return fmt.Sprintf("https://%s/info/%s/reservations/%s/pay?token=%s", host, r.MerchantID, r.OrderID, r.PayToken)
+}
+
+func findReservation(db *gorm.DB, c *gin.Context) (*types.Reservation, bool) {
+	var r types.Reservation
+	db.Preload("Order").Preload("Order.Customer").Preload("Order.Lines").
+		Find(&r, "order_id = ? AND merchant_id = ?", c.Param("orderid"), c.Param("merchantid"))
+	if r.OrderID == "" || r.Order == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "reservation not found"})
+		return nil, false
+	}
+	return &r, true
+}
+
+// SendReservationLink emails the customer of an unpaid reservation a link to
+// pay for it online
+func SendReservationLink(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		r, ok := findReservation(db, c)
+		if !ok {
+			return
+		}
+		if r.Status != types.ReservationHeld {
+			c.JSON(http.StatusConflict, gin.H{"error": "reservation is " + r.Status})
+			return
+		}
+		cus := r.Order.Customer
+		if cus == nil || cus.Email == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "reservation has no email address"})
+			return
+		}
+
+		if r.PayToken == "" {
+			r.PayToken = shortuuid.New()
+			db.Model(r).UpdateColumn("pay_token", r.PayToken)
+		}
+
+		var conf types.MerchantConfig
+		db.Find(&conf, "id = ?", r.MerchantID)
+		locale := types.ResolveLocale(r.Order.Locale, conf.Locale)
+
+		data := &types.EmailData{
+			Locale:  r.Order.Locale,
+			Name:    cus.Name,
+			Email:   cus.Email,
+			Phone:   cus.Phone,
+			OrderID: r.OrderID,
+			Owed:    r.BalanceDue,
+			PayLink: reservationPayLink(c.Request.Host, r),
+		}
+		if r.ReleaseAt != nil {
+			data.Expires = types.FormatDate(locale, r.ReleaseAt.In(timeloc), types.DateTime)
+		}
+		for _, l := range r.Order.Lines {
+			data.Items = append(data.Items, types.EmailItem{Name: l.Name, Quantity: int(l.Quantity)})
+		}
+
+		msg, err := types.RenderEmail(db, &conf, types.EmailReserve, data)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		m := internal.NewMerchantMessage(&conf, msg.Subject, msg.Text, msg.HTML, fmt.Sprintf("%s <%s>", cus.Name, cus.Email))
+		if err := internal.SendEmail(db, &conf, r.OrderID, types.EmailReserve, m); err != nil {
+			c.JSON(http.StatusFailedDependency, gin.H{"error": err.Error()})
+			return
+		}
+
+		now := time.Now()
+		db.Model(r).UpdateColumn("link_sent_at", now)
+		c.Status(http.StatusOK)
+	}
+}
+
+// PayReservation is the link emailed for paying an unpaid reservation, it
+// sends the customer to checkout for the balance
+func PayReservation(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var r types.Reservation
+		db.Preload("Order").Preload("Order.Customer").
+			Find(&r, "order_id = ? AND merchant_id = ?", c.Param("orderid"), c.Param("merchantid"))
+		if r.OrderID == "" || r.PayToken == "" || c.Query("token") != r.PayToken {
+			c.JSON(http.StatusNotFound, gin.H{"error": "reservation not found"})
+			return
+		}
+
+		switch {
+		case c.Query("status") == "success":
+			messagePage(c, "Thank you, your payment has been received.")
+			return
+		case c.Query("status") == "cancelled":
+			messagePage(c, "Your payment was cancelled, you can use the link in your email to try again.")
+			return
+		case r.Status == types.ReservationPaid:
+			messagePage(c, "This reservation has already been paid for.")
+			return
+		case r.Status != types.ReservationHeld || (r.ReleaseAt != nil && time.Now().After(*r.ReleaseAt)):
+			messagePage(c, "This reservation has been released.")
+			return
+		}
+
+		var email string
+		if r.Order != nil && r.Order.Customer != nil {
+			email = r.Order.Customer.Email
+		}
+
+		sess, err := payLinkSession(db, c, types.ParseMoney(r.BalanceDue), email,
+			"Reservation", "Payment for reservation "+r.OrderID,
+			map[string]string{"type": "reservation", "order": r.OrderID},
+			reservationPayLink(c.Request.Host, &r))
+		if err != nil {
+			c.JSON(http.StatusFailedDependency, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.Redirect(http.StatusSeeOther, sess.URL)
+	}
+}
+
+// recordReservationPayment settles a reservation paid through its link. A
+// payment that lands after the seats were released is refunded, and kept on
+// the order either way so staff can see what happened.
+func recordReservationPayment(db *gorm.DB, acct, orderID string, pi *stripe.PaymentIntent) {
+	var seen int
+	db.Model(&types.OrderPayment{}).Where("order_id = ? AND provider_ref = ?", orderID, pi.ID).Count(&seen)
+	if seen > 0 {
+		return
+	}
+
+	amount := float64(pi.Amount) / 100.0
+	if fee, ok := pi.Metadata["fee"]; ok {
+		amount -= types.ParseMoney(fee)
+	}
+
+	pay := &types.OrderPayment{
+		ID:          uuid.New().String(),
+		Provider:    types.ProviderStripe,
+		ProviderRef: pi.ID,
+		Status:      "succeeded",
+		Amount:      types.FormatMoney(amount),
+		Tender:      types.TenderCard,
+	}
+	err := types.SettleReservation(db, orderID, pay)
+	if err != types.ErrReservationNotHeld {
+		if err != nil {
+			log.Println("Reservation Payment Error:", orderID, pi.ID, err)
+		}
+		return
+	}
+
+	log.Println("Reservation Payment after release:", orderID, pi.ID)
+	pay.OrderID = orderID
+	pay.CreatedAt = time.Now()
+	pay.Status = "refunded"
+	pay.Reference = "paid after the reservation was released"
+	if _, err := refundIntent(acct, pi.ID, 0); err != nil {
+		log.Println("Reservation Refund Error:", orderID, pi.ID, err)
+		pay.Status = "unapplied"
+		pay.Reference = "paid after the reservation was released, refund failed: " + err.Error()
+	}
+	if err := db.Create(pay).Error; err != nil {
+		log.Println("Reservation Payment Error:", orderID, pi.ID, err)
+	}
+}
@@ -0,0 +1,51 @@
+package stripe
+
+import (
+	"testing"
+
+	"github.com/stripe/stripe-go/v72"
+	"github.com/zeroshade/tmsapi/internal/dbtest"
+	"github.com/zeroshade/tmsapi/types"
+)
+
+func TestRecordReservationPayment(t *testing.T) {
+	db, d := dbtest.Open(t)
+
+	pi := &stripe.PaymentIntent{ID: "pi_res", Amount: 12500, Metadata: map[string]string{"fee": "5.00"}}
+	recordReservationPayment(db, "acct_1", "o1", pi)
+
+	held := d.Statements(`UPDATE "reservations"`)
+	if len(held) != 1 || value(t, held[0], "status") != types.ReservationPaid {
+		t.Fatalf("reservation updates = %+v", held)
+	}
+
+	ins := d.Statements(`INSERT INTO "order_payments"`)
+	if len(ins) != 1 {
+		t.Fatalf("recorded %d payments", len(ins))
+	}
+	want := map[string]interface{}{
+		"order_id": "o1", "provider": types.ProviderStripe, "provider_ref": "pi_res",
+		"status": "succeeded", "amount": "120.00", "tender": types.TenderCard,
+	}
+	for col, w := range want {
+		if v := value(t, ins[0], col); v != w {
+			t.Errorf("%s = %v, want %v", col, v, w)
+		}
+	}
+	if len(d.Statements(`UPDATE "orders"`)) != 1 {
+		t.Error("order wasn't marked paid")
+	}
+}
+
+func TestRecordReservationPaymentRepeated(t *testing.T) {
+	db, d := dbtest.Open(t)
+	d.Returns(`SELECT count(*) FROM "order_payments"`, []string{"count"}, []interface{}{int64(1)})
+
+	recordReservationPayment(db, "acct_1", "o1", &stripe.PaymentIntent{ID: "pi_res", Amount: 12500})
+	if upd := d.Statements(`UPDATE`); len(upd) != 0 {
+		t.Errorf("a repeated webhook settled again: %q", upd[0].Query)
+	}
+	if ins := d.Statements(`INSERT`); len(ins) != 0 {
+		t.Errorf("a repeated webhook recorded again: %q", ins[0].Query)
+	}
+}
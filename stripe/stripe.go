@@ -2,10 +2,8 @@ package stripe
 
 import (
 	"bytes"
-	"context"
 	"encoding/json"
 	"fmt"
-	"html/template"
 	"log"
 	"math"
 	"net/http"
@@ -19,7 +17,6 @@ import (
 	"github.com/gin-gonic/gin"
 	"github.com/jinzhu/gorm"
 	"github.com/lithammer/shortuuid/v3"
-	"github.com/mailgun/mailgun-go/v4"
 	"github.com/stripe/stripe-go/v72"
 	"github.com/stripe/stripe-go/v72/checkout/session"
 	"github.com/stripe/stripe-go/v72/coupon"
@@ -30,16 +27,34 @@ import (
 	"github.com/zeroshade/tmsapi/types"
 )
 
-func AddStripeRoutes(router *gin.RouterGroup, acctHandler gin.HandlerFunc, db *gorm.DB) {
+func AddStripeRoutes(router *gin.RouterGroup, acctHandler, authHandler, logHandler gin.HandlerFunc, db *gorm.DB) {
 	router.GET("/stripe/:stripe_session", acctHandler, GetSession(db))
 	router.POST("/stripe", acctHandler, CreateSession(db))
 	router.GET("/giftcard/:id", acctHandler, CheckGiftcard(db))
 	router.POST("/deposit/stripe", acctHandler, CheckoutDeposit(db))
+	router.GET("/deposit/availability/:prodid", DepositAvailability(db))
 	router.GET("/deposits/:yearmonth", acctHandler, GetDeposits(db))
-	router.GET("/deposits", acctHandler, GetDepositOrders)
+	router.GET("/deposits", acctHandler, GetDepositOrders(db))
 	router.PUT("/deposits/manual", acctHandler, SaveManualDeposit(db))
 	router.DELETE("/deposits/manual", acctHandler, DeleteManualDeposit(db))
 	router.GET("/deposits/manual", acctHandler, ListManualDeposits(db))
+	router.GET("/charters", authHandler, ListCharters(db))
+	router.PUT("/charters/:id", authHandler, logHandler, UpdateCharter(db))
+	router.POST("/charters/:id/balance", authHandler, logHandler, SendCharterBalance(db))
+	router.POST("/charters/:id/payment", authHandler, logHandler, RecordCharterPayment(db))
+	router.POST("/charters/:id/cancel", authHandler, logHandler, acctHandler, CancelCharter(db))
+	router.GET("/charters/:id/pay", acctHandler, PayCharterBalance(db))
+	router.POST("/quotes", RequestQuote(db))
+	router.GET("/quotes", authHandler, ListQuotes(db))
+	router.PUT("/quotes/:qid", authHandler, logHandler, UpdateQuoteStatus(db))
+	router.POST("/quotes/:qid/send", authHandler, logHandler, SendQuote(db))
+	router.GET("/quotes/:qid/checkout", acctHandler, QuoteCheckout(db))
+	router.POST("/reservations/:orderid/paylink", authHandler, logHandler, SendReservationLink(db))
+	router.GET("/reservations/:orderid/pay", acctHandler, PayReservation(db))
+	router.POST("/groups", authHandler, logHandler, acctHandler, CreateGroupOrder(db))
+	router.GET("/groups", authHandler, ListGroupOrders(db))
+	router.GET("/groups/:gid", GetGroupOrder(db))
+	router.GET("/groups/:gid/members/:mid/pay", acctHandler, PayGroupShare(db))
 }
 
 const feeItemName = "Fees"
@@ -60,6 +75,7 @@ type CreateSessionRequest struct {
 	Email       string `json:"email"`
 	Phone       string `json:"phone"`
 	UseGiftCard string `json:"useGift"`
+	Locale      string `json:"locale"`
 }
 
 type Item struct {
@@ -187,6 +203,10 @@ func CreateSession(db *gorm.DB) gin.HandlerFunc {
 		}
 
 		metadata := map[string]string{"type": cart.Type}
+		if l := types.ParseLocale(cart.Locale); l != "" {
+			metadata["locale"] = l
+			params.Locale = stripe.String(l)
+		}
 		var discount *stripe.Coupon
 
 		if cart.UseGiftCard != "" {
@@ -342,13 +362,21 @@ func CreateSession(db *gorm.DB) gin.HandlerFunc {
 }
 
 type PaymentIntent struct {
-	ID        string    `json:"id" gorm:"primary_key"`
-	Acct      string    `json:"-" gorm:"primary_key"`
-	CreatedAt time.Time `json:"createdAt"`
-	Amount    string    `json:"amount" gorm:"type:money"`
-	Email     string    `json:"email"`
-	Name      string    `json:"name"`
-	Status    string    `json:"status"`
+	ID         string     `json:"id" gorm:"primary_key"`
+	Acct       string     `json:"-" gorm:"primary_key"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	Amount     string     `json:"amount" gorm:"type:money"`
+	Email      string     `json:"email"`
+	Name       string     `json:"name"`
+	Phone      string     `json:"phone"`
+	Status     string     `json:"status"`
+	CustomerID string     `json:"customerId"`
+	ChargeID   string     `json:"chargeId"`
+	ReceiptURL string     `json:"receiptUrl"`
+	GiftCard   string     `json:"giftcard"`
+	Locale     string     `json:"locale"`
+	SyncedAt   *time.Time `json:"-"`
+	SyncErrors int        `json:"-" gorm:"default:0"`
 }
 
 type notifyItem struct {
@@ -357,193 +385,93 @@ type notifyItem struct {
 	Quantity    int
 }
 
-var (
-	// mailgunPublicKey = os.Getenv("MAILGUN_PUBLIC_KEY")
-	mailgunDomain = os.Getenv("MAILGUN_DOMAIN")
-)
-
-func sendNotifyEmail(apiKey string, conf *types.MerchantConfig, payment *stripe.PaymentIntent, itemList []notifyItem) error {
+func sendNotifyEmail(db *gorm.DB, conf *types.MerchantConfig, payment *stripe.PaymentIntent, itemList []notifyItem) error {
 	details := payment.Charges.Data[0].BillingDetails
 
 	log.Println("Send Notify Mail:", payment.ID, conf.EmailFrom)
-	const tmpl = `
-	Tickets Purchased By: {{ .Payer }} <a href='mailto:{{ .PayerEmail }}'>{{ .PayerEmail }}</a>
-	<br />
-	Phone: {{- if .Phone -}}{{.Phone}}{{- else -}}Not Provided{{- end -}}
-	<br />
-	<ul>
-	{{ range .Items -}}
-	<li>{{ .Quantity }} {{ .Name }} {{ .Description }}</li>
-	</ul>
-	{{- end }}`
-
-	t := template.Must(template.New("notify").Parse(tmpl))
-
-	mg := mailgun.NewMailgun(mailgunDomain, apiKey)
-
-	// from := mail.NewEmail("Fishing Reservation System", "donotreply@fishingreservationsystem.com")
-	// to := mail.NewEmail(conf.EmailName, conf.EmailFrom)
-	subject := "Tickets Purchased"
-	var tpl bytes.Buffer
-
-	if err := t.Execute(&tpl, gin.H{
-		"Payer":      details.Name,
-		"PayerEmail": details.Email,
-		"Phone":      details.Phone,
-		"Items":      itemList}); err != nil {
+	data := &types.EmailData{
+		Name:    details.Name,
+		Email:   details.Email,
+		Phone:   details.Phone,
+		OrderID: payment.ID,
+		Locale:  conf.Locale,
+	}
+	for _, i := range itemList {
+		data.Items = append(data.Items, types.EmailItem{Name: i.Name, Description: i.Description, Quantity: i.Quantity})
+	}
+
+	msg, err := types.RenderEmail(db, conf, types.EmailNotify, data)
+	if err != nil {
 		return err
 	}
 
-	to := fmt.Sprintf("%s <%s>", conf.EmailName, conf.EmailFrom)
-	m := mg.NewMessage("donotreply@fishingreservationsystem.com", subject, tpl.String(), to)
-	m.SetHtml(tpl.String())
-
-	resp, id, err := mg.Send(context.Background(), m)
-	log.Println("Send Email: ", subject, to)
-	log.Println("Response: ", resp, id)
-
-	// content := mail.NewContent("text/html", tpl.String())
-	// log.Println("Send Email:", from, subject, to, content)
-	// m := mail.NewV3MailInit(from, subject, to, content)
-	// request := sendgrid.GetRequest(apiKey, "/v3/mail/send", "https://api.sendgrid.com")
-	// request.Method = "POST"
-	// request.Body = mail.GetRequestBody(m)
-	// _, err := sendgrid.API(request)
-	// if err != nil {
-	// 	return err
-	// }
-	return err
+	m := internal.NewMerchantMessage(conf, msg.Subject, msg.Text, msg.HTML, fmt.Sprintf("%s <%s>", conf.EmailName, conf.EmailFrom))
+	return internal.SendEmail(db, conf, payment.ID, types.EmailNotify, m)
 }
 
-func sendCustomerEmail(db *gorm.DB, apiKey, host string, conf *types.MerchantConfig, payment *stripe.PaymentIntent) error {
+func sendCustomerEmail(db *gorm.DB, host string, conf *types.MerchantConfig, payment *stripe.PaymentIntent) error {
 	details := payment.Customer
 
-	const tickettmpl = `
-	<br /><br />
-	Your boarding passes and receipt are included as an attachment to this email as a PDF file
-	for easy printing. You can also access your receipt via Stripe by clicking <a href='{{.Receipt}}'>here</a>.
-	<br /><br />
-	If clicking on that doesn't work, you can copy and paste the following URL into
-	your browser to access your receipt: {{ .Receipt }}.	
-	<br/>`
-
-	const gifttmpl = `
-	<br /><br />
-	Your receipt can be accessed <a href='{{ .Receipt }}'>here</a>.
-	<br />
-	If clicking on that doesn't work, you can copy and pages the following URL into
-	your browser to access your receipt: {{ .Receipt}}.
-	<br /><br />
-	You should receive another e-mail shortly with the Gift Codes for your purchased Gift Cards.
-	<br />`
-
-	tmpl := tickettmpl
-	subject := "Tickets Purchased"
-
-	typ, ok := payment.Metadata["type"]
-	if ok && typ == "giftcards" {
-		tmpl = gifttmpl
-		subject = "Gift Cards Purchased"
+	data := &types.EmailData{
+		Name:          details.Name,
+		Email:         details.Email,
+		Phone:         details.Phone,
+		OrderID:       payment.ID,
+		Total:         fmt.Sprintf("%0.2f", float64(payment.Amount)/100.0),
+		PassType:      "boarding passes",
+		Receipt:       payment.Charges.Data[0].ReceiptURL,
+		GiftCardOrder: payment.Metadata["type"] == "giftcards",
+		Locale:        payment.Metadata["locale"],
 	}
+	data.Attached = !data.GiftCardOrder
 
-	mg := mailgun.NewMailgun(mailgunDomain, apiKey)
-
-	// from := mail.NewEmail(conf.EmailName, conf.EmailFrom)
-	// from := mail.NewEmail(conf.EmailName, "donotreply@fishingreservationsystem.com")
-
-	// to := mail.NewEmail(details.Name, details.Email)
+	var lines []LineItem
+	db.Find(&lines, "payment_id = ?", payment.ID)
+	for _, li := range lines {
+		if li.Name == feeItemName {
+			continue
+		}
+		data.Items = append(data.Items, types.EmailItem{Name: li.Name, Quantity: li.Quantity, Amount: li.Amount})
+	}
 
-	t := template.Must(template.New("notify").Parse(tmpl))
-	var tpl bytes.Buffer
-	if err := t.Execute(&tpl, gin.H{
-		"Receipt": payment.Charges.Data[0].ReceiptURL,
-		"Host":    host, "MerchantID": conf.ID, "PaymentID": payment.ID}); err != nil {
+	msg, err := types.RenderEmail(db, conf, types.EmailPurchase, data)
+	if err != nil {
 		return err
 	}
 
-	to := fmt.Sprintf("%s <%s>", details.Name, details.Email)
-	m := mg.NewMessage("donotreply@fishingreservationsystem.com", subject, tpl.String(), to)
-	m.SetHtml(tpl.String())
+	m := internal.NewMerchantMessage(conf, msg.Subject, msg.Text, msg.HTML, fmt.Sprintf("%s <%s>", details.Name, details.Email))
 
 	var pdf bytes.Buffer
-
 	items, _, _ := (Handler{}).GetPassItems(conf, db, payment.ID)
-	internal.GeneratePdf(db, items, conf.PassTitle, details.Name, details.Email, &pdf)
-	m.AddBufferAttachment("boardingpasses.pdf", pdf.Bytes())
-
-	resp, id, err := mg.Send(context.Background(), m)
-	log.Println("Send Email: ", subject, to)
-	log.Println("Response: ", resp, id)
-
-	// content := mail.NewContent("text/html", conf.EmailContent+tpl.String())
-	// log.Println("Send Email:", from, subject, to, content)
-	// m := mail.NewV3MailInit(from, subject, to, content)
-	// request := sendgrid.GetRequest(apiKey, "/v3/mail/send", "https://api.sendgrid.com")
-	// request.Method = "POST"
-	// request.Body = mail.GetRequestBody(m)
-	// _, err := sendgrid.API(request)
-	// if err != nil {
-	// 	return err
-	// }
-	return err
+	internal.GeneratePdf(db, items, conf.PassTitle, details.Name, details.Email, data.Locale, &pdf)
+	m.Attach("boardingpasses.pdf", pdf.Bytes())
+
+	link := fmt.Sprintf("https://%s/info/%s/passes/%s", host, conf.ID, payment.ID)
+	if ics := types.OrderCalendar(db, conf, payment.ID, link); ics != nil {
+		m.Attach("trip.ics", ics)
+	}
+
+	return internal.SendEmail(db, conf, payment.ID, types.EmailPurchase, m)
 }
 
-func sendGiftCardEmail(apiKey string, giftCards []types.GiftCard, conf *types.MerchantConfig, payment *stripe.PaymentIntent) error {
-	const tmpl = `
-	Thank you for your purchase of Gift Cards! Below you'll find the codes which can be entered
-	at checkout which can be given to your desired recipients.
-	<br />
-	<strong>Gift Card Codes are Case Sensitive at checkout!</strong>
-	<br /><br />
-	<table>
-		<thead>
-			<tr>
-				<th>Value</th>
-				<th>Code</th>
-			</tr>
-		</thead>
-		<tbody>
-	{{ range .GiftCards }}
-			<tr>
-				<td>{{ .Initial }}</td>
-				<td>{{ .ID }}</td>
-			</tr>
-	{{ end }}
-		</tbody>
-	</table>
-	`
-
-	mg := mailgun.NewMailgun("mg.fishingreservationsystem.com", apiKey)
-
-	// from := mail.NewEmail(conf.EmailName, conf.EmailFrom)
-	// from := mail.NewEmail(conf.EmailName, "donotreply@fishingreservationsystem.com")
-	// to := mail.NewEmail(payment.Customer.Name, payment.Customer.Email)
-	subject := "Gift Card Codes"
-	t := template.Must(template.New("codes").Parse(tmpl))
-	var tpl bytes.Buffer
-	if err := t.Execute(&tpl, gin.H{"GiftCards": giftCards}); err != nil {
-		return err
+func sendGiftCardEmail(db *gorm.DB, giftCards []types.GiftCard, conf *types.MerchantConfig, payment *stripe.PaymentIntent) error {
+	data := &types.EmailData{
+		Name:    payment.Customer.Name,
+		Email:   payment.Customer.Email,
+		OrderID: payment.ID,
+		Locale:  payment.Metadata["locale"],
+	}
+	for _, g := range giftCards {
+		data.GiftCards = append(data.GiftCards, types.EmailGiftCard{Code: g.ID, Value: g.Initial})
 	}
 
-	m := mg.NewMessage("donotreply@fishingreservationsystem.com", subject, tpl.String(), fmt.Sprintf("%s <%s>", payment.Customer.Name, payment.Customer.Email))
-	m.SetHtml(tpl.String())
-
-	resp, id, err := mg.Send(context.Background(), m)
-	log.Println("Send Email: ", subject, payment.Customer.Name, payment.Customer.Email)
-	log.Println("response: ", resp, id)
-
-	// content := mail.NewContent("text/html", tpl.String())
-	// log.Println("Send Email:", from, subject, to, content)
-	// m := mail.NewV3MailInit(from, subject, to, content)
-	// request := sendgrid.GetRequest(apiKey, "/v3/mail/send", "https://api.sendgrid.com")
-	// request.Method = "POST"
-	// request.Body = mail.GetRequestBody(m)
-	// _, err := sendgrid.API(request)
-	// if err != nil {
-	// 	return err
-	// }
+	msg, err := types.RenderEmail(db, conf, types.EmailGiftCodes, data)
+	if err != nil {
+		return err
+	}
 
-	return err
+	m := internal.NewMerchantMessage(conf, msg.Subject, msg.Text, msg.HTML, fmt.Sprintf("%s <%s>", payment.Customer.Name, payment.Customer.Email))
+	return internal.SendEmail(db, conf, payment.ID, types.EmailGiftCodes, m)
 }
 
 func getTransfer(acct string, transfers map[string]*stripe.TransferParams) *stripe.TransferParams {
@@ -572,7 +500,6 @@ type LineItem struct {
 }
 
 func StripeWebhook(db *gorm.DB) gin.HandlerFunc {
-	apiKey := os.Getenv("MAILGUN_API_KEY")
 
 	return func(c *gin.Context) {
 		event := stripe.Event{}
@@ -612,15 +539,11 @@ func StripeWebhook(db *gorm.DB) gin.HandlerFunc {
 				paymentIntent.Customer = cus
 			}
 
-			db.Save(&PaymentIntent{
-				ID:        paymentIntent.ID,
-				Acct:      conf.StripeKey,
-				CreatedAt: time.Unix(paymentIntent.Created, 0),
-				Amount:    fmt.Sprintf("%0.2f", float64(paymentIntent.Amount)/100.0),
-				Email:     paymentIntent.Customer.Email,
-				Name:      paymentIntent.Customer.Name,
-				Status:    string(paymentIntent.Status),
-			})
+			savePaymentDetails(db, conf.StripeKey, &paymentIntent)
+
+			if err := RecordOrder(db, conf.ID, paymentIntent.ID); err != nil {
+				log.Println("Record Order Error:", err)
+			}
 
 			if gift, ok := paymentIntent.Metadata["giftcard"]; ok {
 				amount, _ := strconv.Atoi(paymentIntent.Metadata["amount"])
@@ -629,7 +552,7 @@ func StripeWebhook(db *gorm.DB) gin.HandlerFunc {
 				db.Model(&types.GiftCard{}).Where("id = ?", gift).Update("status", "used")
 			}
 
-			// err := sendCustomerEmail(db, apiKey, c.Request.Host, &conf, &paymentIntent)
+			// err := sendCustomerEmail(db, c.Request.Host, &conf, &paymentIntent)
 			// if err != nil {
 			// 	c.JSON(http.StatusFailedDependency, gin.H{"err": err.Error()})
 			// 	return
@@ -640,7 +563,7 @@ func StripeWebhook(db *gorm.DB) gin.HandlerFunc {
 			if len(giftCards) > 0 {
 				db.Model(&types.GiftCard{}).Where("payment_id = ?", paymentIntent.ID).Update("status", "success")
 
-				sendGiftCardEmail(apiKey, giftCards, &conf, &paymentIntent)
+				sendGiftCardEmail(db, giftCards, &conf, &paymentIntent)
 			}
 
 			c.Status(http.StatusOK)
@@ -676,23 +599,36 @@ func StripeWebhook(db *gorm.DB) gin.HandlerFunc {
 			pm, err := piClient.Get(sess.PaymentIntent.ID, paymentParams)
 			if err != nil {
 				log.Println(err)
+				c.JSON(http.StatusFailedDependency, gin.H{"error": err.Error()})
+				return
 			}
+			savePaymentDetails(db, pi.Acct, pm)
 
-			if (pi.Acct == "acct_1KajuuPBUMQYQx2b" || pi.Acct == "acct_1InCeDPOYCTX1AoD") && strings.HasPrefix(pm.Description, "Deposit for") {
-				mg := mailgun.NewMailgun(mailgunDomain, apiKey)
-
-				content := conf.EmailContent
-				content += `<p>Receipt: <a href='` + pm.Charges.Data[0].ReceiptURL + `'>` + pm.Charges.Data[0].ReceiptURL + `</a>`
-
-				m := mg.NewMessage("donotreply@fishingreservationsystem.com", conf.PassTitle, content, sess.CustomerDetails.Email)
-				m.SetHtml(content)
-				mg.Send(context.Background(), m)
-
-				content = "Deposit made by: " + sess.CustomerDetails.Name + " " + sess.CustomerDetails.Email
-				content += "<br/>" + pm.Description
-				m = mg.NewMessage("donotreply@fishingreservationsystem.com", conf.PassTitle, content, conf.EmailFrom)
-				mg.Send(context.Background(), m)
+			switch pm.Metadata["type"] {
+			case "charter":
+				recordCharterPayment(db, pm.Metadata["charter"], pm)
+				c.Status(http.StatusOK)
+				return
+			case "reservation":
+				recordReservationPayment(db, pi.Acct, pm.Metadata["order"], pm)
+				c.Status(http.StatusOK)
+				return
+			case "group":
+				recordGroupPayment(db, c.Request.Host, &conf, pm)
+				c.Status(http.StatusOK)
+				return
+			}
 
+			if isDeposit(pm) {
+				dep := recordDeposit(db, conf.ID, pi.Acct, pm)
+				if conf.DepositNotify && dep.Status == DepositSucceeded {
+					var receipt string
+					if pm.Charges != nil && len(pm.Charges.Data) > 0 {
+						receipt = pm.Charges.Data[0].ReceiptURL
+					}
+					sendDepositNotifications(db, &conf, dep, receipt)
+				}
+				c.Status(http.StatusOK)
 				return
 			}
 
@@ -782,6 +718,10 @@ func StripeWebhook(db *gorm.DB) gin.HandlerFunc {
 				}
 			}
 
+			if err := RecordOrder(db, conf.ID, pm.ID); err != nil {
+				log.Println("Record Order Error:", err)
+			}
+
 			// stripeFee := int64(math.Ceil(float64(pm.Amount)*0.029)) + 30
 			amtTransferred := int64(0)
 			for _, v := range transfers {
@@ -813,19 +753,18 @@ func StripeWebhook(db *gorm.DB) gin.HandlerFunc {
 			// 	log.Println("fee transfer:", t.ID, t.Amount, err)
 			// }
 
-			err = sendCustomerEmail(db, apiKey, c.Request.Host, &conf, pm)
+			err = sendCustomerEmail(db, c.Request.Host, &conf, pm)
 			if err != nil {
 				log.Println("customer email error: ", err)
 			}
 
-			if err := sendNotifyEmail(apiKey, &conf, pm, itemList); err != nil {
+			if err := sendNotifyEmail(db, &conf, pm, itemList); err != nil {
 				c.JSON(http.StatusFailedDependency, gin.H{"error": err.Error()})
 				return
 			}
 
 			if conf.SendSMS {
-				t := internal.NewTwilio(conf.TwilioAcctSID, conf.TwilioAcctToken, conf.TwilioFromNumber)
-				t.Send(conf.NotifyNumber, "Tickets Purchased by "+pm.Charges.Data[0].BillingDetails.Name)
+				internal.SendSMS(db, &conf, pm.ID, types.EmailNotify, conf.NotifyNumber, types.T(types.ResolveLocale(conf.Locale), "sms.purchased_by", pm.Charges.Data[0].BillingDetails.Name))
 			}
 
 		case "charge.refunded":
@@ -843,6 +782,48 @@ func StripeWebhook(db *gorm.DB) gin.HandlerFunc {
 				Where("payment_id = ?", charge.PaymentIntent.ID).
 				UpdateColumn("status", "refunded")
 
+			if charge.Refunded {
+				db.Model(&DepositBooking{}).
+					Where("id = ?", charge.PaymentIntent.ID).
+					UpdateColumn("status", DepositRefunded)
+			}
+
+			// deposits and charter payments have no order to refund
+			var orders int
+			db.Model(&types.Order{}).Where("id = ?", charge.PaymentIntent.ID).Count(&orders)
+			if orders == 0 {
+				log.Println("Refund without an order, not recorded:", charge.PaymentIntent.ID)
+			} else if charge.Refunds != nil {
+				for _, r := range charge.Refunds.Data {
+					count := 0
+					db.Model(&types.OrderRefund{}).Where("id = ?", r.ID).Count(&count)
+					if count > 0 {
+						continue
+					}
+
+					ref := &types.OrderRefund{
+						ID:          r.ID,
+						OrderID:     charge.PaymentIntent.ID,
+						Provider:    types.ProviderStripe,
+						ProviderRef: r.ID,
+						Status:      string(r.Status),
+						Amount:      fmt.Sprintf("%0.2f", float64(r.Amount)/100.0),
+						CreatedAt:   time.Unix(r.Created, 0),
+					}
+					// partial refunds from RefundTickets are already recorded
+					// against their line, anything else left is the full charge
+					var err error
+					if charge.Refunded {
+						err = types.RecordRefund(db, ref)
+					} else {
+						err = db.Create(ref).Error
+					}
+					if err != nil {
+						log.Println("Record Refund Error:", ref.OrderID, r.ID, err)
+					}
+				}
+			}
+
 			type pidfind struct {
 				Quantity int `gorm:"quantity"`
 				Pid      int `gorm:"pid"`
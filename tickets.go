@@ -8,8 +8,9 @@ import (
 	"github.com/gin-gonic/gin"
 	"github.com/jinzhu/gorm"
 	"github.com/jinzhu/gorm/dialects/postgres"
-	"github.com/zeroshade/tmsapi/paypal"
-	"github.com/zeroshade/tmsapi/stripe"
+	"github.com/zeroshade/tmsapi/cash"
+	"github.com/zeroshade/tmsapi/internal"
+	"github.com/zeroshade/tmsapi/payments"
 	"github.com/zeroshade/tmsapi/types"
 )
 
@@ -21,7 +22,7 @@ func addTicketRoutes(router *gin.RouterGroup, db *gorm.DB) {
 	router.POST("/items", checkJWT(), logActionMiddle(db), GetOrders(db))
 	router.DELETE("/tickets/:id", checkJWT(), logActionMiddle(db), DeleteTicketsCat(db))
 	router.GET("/orders/:timestamp", checkJWT(), OrdersTimestamp(db))
-	router.GET("/orders", GetCheckouts(db))
+	router.GET("/orders", checkJWT(), GetCheckouts(db))
 	router.POST("/passes", GetPasses(db))
 	router.POST("/refund", checkJWT(), logActionMiddle(db), RefundTickets(db))
 	router.POST("/transfer", checkJWT(), logActionMiddle(db), TransferTickets(db))
@@ -41,11 +42,29 @@ type TicketCategory struct {
 	Categories postgres.Hstore `json:"categories"`
 }
 
+var ticketCatList = &internal.ListSpec{
+	Sortable:    map[string]string{"id": "id", "name": "name"},
+	DefaultSort: "id",
+}
+
 // GetTicketCats returns a function that fetchs all the Categories from the db
 func GetTicketCats(db *gorm.DB) gin.HandlerFunc {
 	return func(c *gin.Context) {
+		params, err := internal.BindListQuery(c, ticketCatList)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		scope, res, err := ticketCatList.Apply(db.Model(&TicketCategory{}).Where("merchant_id = ?", c.Param("merchantid")), params)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
 		var cats []TicketCategory
-		db.Find(&cats, "merchant_id = ?", c.Param("merchantid"))
+		scope.Find(&cats)
+		res.SetHeaders(c)
 		c.JSON(http.StatusOK, cats)
 	}
 }
@@ -85,18 +104,13 @@ func SaveTicketCats(db *gorm.DB) gin.HandlerFunc {
 
 func GetCheckouts(db *gorm.DB) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		var orders []*types.CheckoutOrder
 		var units []types.PurchaseUnit
 		db.Where("payee_merchant_id = ?", c.Param("merchantid")).Find(&units)
 
-		for idx := range units {
-			db.Where("checkout_id = ?", units[idx].CheckoutID).Find(&units[idx].Payments.Captures)
-			db.Where("checkout_id = ?", units[idx].CheckoutID).Find(&units[idx].Items)
-
-			o := &types.CheckoutOrder{}
-			db.Preload("Payer").Find(o, "id = ?", units[idx].CheckoutID)
-			o.PurchaseUnits = []types.PurchaseUnit{units[idx]}
-			orders = append(orders, o)
+		orders, err := types.LoadCheckoutsForUnits(db, units)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
 		}
 
 		c.JSON(http.StatusOK, orders)
@@ -115,14 +129,51 @@ func TripTime(d string) func(db *gorm.DB) *gorm.DB {
 	}
 }
 
-type PaymentHandler interface {
-	OrdersTimestamp(config *types.MerchantConfig, db *gorm.DB, timestamp string) (interface{}, error)
-	GetSoldTickets(config *types.MerchantConfig, db *gorm.DB, from, to string) (interface{}, error)
-	GetPassItems(conf *types.MerchantConfig, db *gorm.DB, id string) ([]types.PassItem, string, string)
-	RefundTickets(config *types.MerchantConfig, db *gorm.DB, data json.RawMessage) (interface{}, error)
-	TransferTickets(config *types.MerchantConfig, db *gorm.DB, data []types.TransferReq) (interface{}, error)
-	ManualEntry(config *types.MerchantConfig, db *gorm.DB, entry types.Manual) (interface{}, error)
-	RedeemTickets(config *types.MerchantConfig, db *gorm.DB, data json.RawMessage) (interface{}, error)
+// paymentHandler looks up the payment provider the merchant is configured
+// with, responding with an error if there isn't one
+func paymentHandler(c *gin.Context, config *types.MerchantConfig) (payments.PaymentHandler, bool) {
+	handler, err := payments.For(config)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return nil, false
+	}
+	return handler, true
+}
+
+// withBoxOffice adds the merchant's box office sales to the results from
+// their online provider so manifests and inventory count both
+func withBoxOffice(config *types.MerchantConfig, ret interface{}, fetch func(payments.PaymentHandler) (interface{}, error)) (interface{}, error) {
+	if config.PaymentType == types.ProviderCash {
+		return ret, nil
+	}
+
+	box, err := payments.Get(types.ProviderCash)
+	if err != nil {
+		return ret, nil
+	}
+	extra, err := fetch(box)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]json.RawMessage, 0)
+	for _, r := range []interface{}{ret, extra} {
+		buf, err := json.Marshal(r)
+		if err != nil {
+			return nil, err
+		}
+		var rows []json.RawMessage
+		if err := json.Unmarshal(buf, &rows); err != nil {
+			return nil, err
+		}
+		out = append(out, rows...)
+	}
+	return out, nil
+}
+
+// staffDB passes the signed in user through to the payment provider
+func staffDB(c *gin.Context, db *gorm.DB) *gorm.DB {
+	return payments.WithStaff(db, c.GetString("user_id"))
 }
 
 func OrdersTimestamp(db *gorm.DB) gin.HandlerFunc {
@@ -130,15 +181,17 @@ func OrdersTimestamp(db *gorm.DB) gin.HandlerFunc {
 		var config types.MerchantConfig
 		db.Find(&config, "id = ?", c.Param("merchantid"))
 
-		var handler PaymentHandler
-		switch config.PaymentType {
-		case "paypal":
-			handler = &paypal.Handler{}
-		case "stripe":
-			handler = &stripe.Handler{}
+		handler, ok := paymentHandler(c, &config)
+		if !ok {
+			return
 		}
 
 		ret, err := handler.OrdersTimestamp(&config, db, c.Param("timestamp"))
+		if err == nil {
+			ret, err = withBoxOffice(&config, ret, func(box payments.PaymentHandler) (interface{}, error) {
+				return box.OrdersTimestamp(&config, db, c.Param("timestamp"))
+			})
+		}
 		if err != nil {
 			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		} else {
@@ -147,6 +200,20 @@ func OrdersTimestamp(db *gorm.DB) gin.HandlerFunc {
 	}
 }
 
+// itemCheckoutIDs returns the distinct checkout ids of a list of items in the
+// order they first appear
+func itemCheckoutIDs(items []types.PurchaseItem) []string {
+	seen := make(map[string]bool)
+	ids := make([]string, 0)
+	for _, i := range items {
+		if !seen[i.CheckoutID] {
+			seen[i.CheckoutID] = true
+			ids = append(ids, i.CheckoutID)
+		}
+	}
+	return ids
+}
+
 func GetPurchases(db *gorm.DB) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		var ret []types.PurchaseItem
@@ -156,97 +223,61 @@ func GetPurchases(db *gorm.DB) gin.HandlerFunc {
 			Where("pu.payee_merchant_id = ?", c.Param("merchantid")).
 			Scan(&ret)
 
-		checkouts := make(map[string]*types.CheckoutOrder)
-		for _, i := range ret {
-			checkouts[i.CheckoutID] = nil
-		}
-
-		ids := make([]string, len(checkouts))
-		for k := range checkouts {
-			ids = append(ids, k)
-		}
-
-		var co []types.CheckoutOrder
-		db.Preload("Payer").Where("id in (?)", ids).Find(&co)
-
-		for idx := range co {
-			db.Where("checkout_id = ?", co[idx].ID).Find(&co[idx].PurchaseUnits)
-			db.Where("checkout_id = ?", co[idx].ID).Find(&co[idx].PurchaseUnits[0].Payments.Captures)
-			db.Where("checkout_id = ?", co[idx].ID).Find(&co[idx].PurchaseUnits[0].Items)
+		co, err := types.LoadCheckoutOrders(db, itemCheckoutIDs(ret))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
 		}
 
 		c.JSON(http.StatusOK, gin.H{"items": ret, "orders": co})
 	}
 }
 
-func GetOrders(db *gorm.DB) gin.HandlerFunc {
-	type OrdersReq struct {
-		From     string   `json:"from"`
-		To       string   `json:"to"`
-		Page     uint     `json:"page"`
-		PerPage  uint     `json:"perPage"`
-		SortBy   []string `json:"sortBy"`
-		SortDesc []bool   `json:"sortDesc"`
-	}
+var purchaseItemList = &internal.ListSpec{
+	Sortable: map[string]string{
+		"coid":        "pi.checkout_id",
+		"sku":         "pi.sku",
+		"name":        "pi.name",
+		"description": "pi.description",
+		"title":       "pi.description",
+		"quantity":    "pi.quantity",
+		"cost":        "pi.value",
+		"unit_amount": "pi.value",
+	},
+	Filterable: map[string]string{
+		"coid": "pi.checkout_id",
+		"sku":  "pi.sku",
+	},
+	DefaultSort: "pi.checkout_id, pi.sku",
+}
 
+func GetOrders(db *gorm.DB) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		var req OrdersReq
+		var req internal.ListParams
 		if err := c.ShouldBindJSON(&req); err != nil {
 			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 			return
 		}
 
-		var count uint
-
 		var ret []types.PurchaseItem
-		scope := db.Table("purchase_items as pi").
+		scope, res, err := purchaseItemList.Apply(db.Table("purchase_items as pi").
 			Select("pi.*").
 			Joins("LEFT JOIN purchase_units as pu ON pi.checkout_id = pu.checkout_id").
-			Where("pu.payee_merchant_id = ?", c.Param("merchantid"))
-
-		scope.Count(&count)
-
-		for idx, sort := range req.SortBy {
-			col := sort
-			switch sort {
-			case "cost":
-				col = "value"
-			case "title":
-				col = "description"
-			}
-			if req.SortDesc[idx] {
-				scope = scope.Order(col + " desc")
-			} else {
-				scope = scope.Order(col)
-			}
-		}
-
-		if req.PerPage > 0 {
-			scope = scope.Offset((req.Page - 1) * req.PerPage).Limit(req.PerPage)
+			Where("pu.payee_merchant_id = ?", c.Param("merchantid")), req)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
 		}
 
 		scope.Scan(&ret)
 
-		checkouts := make(map[string]*types.CheckoutOrder)
-		for _, i := range ret {
-			checkouts[i.CheckoutID] = nil
-		}
-
-		ids := make([]string, len(checkouts))
-		for k := range checkouts {
-			ids = append(ids, k)
-		}
-
-		var co []types.CheckoutOrder
-		db.Preload("Payer").Where("id in (?)", ids).Find(&co)
-
-		for idx := range co {
-			db.Where("checkout_id = ?", co[idx].ID).Find(&co[idx].PurchaseUnits)
-			db.Where("checkout_id = ?", co[idx].ID).Find(&co[idx].PurchaseUnits[0].Payments.Captures)
-			db.Where("checkout_id = ?", co[idx].ID).Find(&co[idx].PurchaseUnits[0].Items)
+		co, err := types.LoadCheckoutOrders(db, itemCheckoutIDs(ret))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
 		}
 
-		c.JSON(http.StatusOK, gin.H{"total": count, "items": ret, "orders": co})
+		c.JSON(http.StatusOK, gin.H{"total": res.Total, "nextCursor": res.NextCursor, "items": ret, "orders": co})
 	}
 }
 
@@ -294,19 +325,19 @@ func RefundTickets(db *gorm.DB) gin.HandlerFunc {
 		var config types.MerchantConfig
 		db.Find(&config, "id = ?", c.Param("merchantid"))
 
-		var handler PaymentHandler
-		switch config.PaymentType {
-		case "paypal":
-			handler = &paypal.Handler{}
-		case "stripe":
-			handler = &stripe.Handler{}
+		handler, ok := paymentHandler(c, &config)
+		if !ok {
+			return
 		}
 
-		ret, err := handler.RefundTickets(&config, db, data)
+		// stripe stamps refunds to the second
+		since := time.Now().Truncate(time.Second)
+		ret, err := handler.RefundTickets(&config, staffDB(c, db), data)
 		if err != nil {
 			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 			return
 		}
+		sendRefundNotices(db, &config, since, data)
 
 		c.JSON(http.StatusOK, ret)
 	}
@@ -323,19 +354,18 @@ func TransferTickets(db *gorm.DB) gin.HandlerFunc {
 		var config types.MerchantConfig
 		db.Find(&config, "id = ?", c.Param("merchantid"))
 
-		var handler PaymentHandler
-		switch config.PaymentType {
-		case "paypal":
-			handler = &paypal.Handler{}
-		case "stripe":
-			handler = &stripe.Handler{}
+		handler, ok := paymentHandler(c, &config)
+		if !ok {
+			return
 		}
 
-		ret, err := handler.TransferTickets(&config, db, data)
+		before := transferredLines(db, data)
+		ret, err := handler.TransferTickets(&config, staffDB(c, db), data)
 		if err != nil {
 			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 			return
 		}
+		sendTransferUpdates(db, &config, c.Request.Host, before)
 
 		c.JSON(http.StatusOK, ret)
 	}
@@ -352,17 +382,18 @@ func ManualEntry(db *gorm.DB) gin.HandlerFunc {
 		var config types.MerchantConfig
 		db.Find(&config, "id = ?", c.Param("merchantid"))
 
-		var handler PaymentHandler
-		switch config.PaymentType {
-		case "paypal":
-			handler = &paypal.Handler{}
-		case "stripe":
-			handler = &stripe.Handler{}
+		handler, ok := paymentHandler(c, &config)
+		if !ok {
+			return
 		}
 
-		ret, err := handler.ManualEntry(&config, db, entry)
+		ret, err := handler.ManualEntry(&config, staffDB(c, db), entry)
 		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			status := http.StatusBadRequest
+			if err == cash.ErrNoDrawer {
+				status = http.StatusConflict
+			}
+			c.JSON(status, gin.H{"error": err.Error()})
 			return
 		}
 
@@ -381,12 +412,9 @@ func RedeemTickets(db *gorm.DB) gin.HandlerFunc {
 		var config types.MerchantConfig
 		db.Find(&config, "id = ?", c.Param("merchantid"))
 
-		var handler PaymentHandler
-		switch config.PaymentType {
-		case "paypal":
-			handler = &paypal.Handler{}
-		case "stripe":
-			handler = &stripe.Handler{}
+		handler, ok := paymentHandler(c, &config)
+		if !ok {
+			return
 		}
 
 		ret, err := handler.RedeemTickets(&config, db, data)
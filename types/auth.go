@@ -0,0 +1,19 @@
+package types
+
+import "time"
+
+// AuthDenial records a request checkJWT turned away. MerchantID is the
+// merchant the request was for and TokenMerchant the one the caller
+// belongs to, if the token got that far.
+type AuthDenial struct {
+	ID            uint      `json:"id" gorm:"primary_key"`
+	CreatedAt     time.Time `json:"createdAt" gorm:"index"`
+	MerchantID    string    `json:"merchantId" gorm:"index"`
+	TokenMerchant string    `json:"tokenMerchant"`
+	UserID        string    `json:"userId" gorm:"index"`
+	Roles         string    `json:"roles"`
+	Method        string    `json:"method"`
+	Url           string    `json:"path"`
+	RemoteIP      string    `json:"remoteIp"`
+	Reason        string    `json:"reason"`
+}
@@ -0,0 +1,232 @@
+package types
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/jinzhu/gorm"
+)
+
+// Calendar methods, PUBLISH adds or updates the events and CANCEL removes
+// them from the customer's calendar
+const (
+	CalendarPublish = "PUBLISH"
+	CalendarCancel  = "CANCEL"
+)
+
+// CalendarEvent is one departure on an order
+type CalendarEvent struct {
+	UID         string
+	LineID      string
+	Sequence    int
+	Attendee    string
+	ProductID   uint
+	Start       time.Time
+	End         time.Time
+	Summary     string
+	Location    string
+	Description string
+	URL         string
+	Cancelled   bool
+}
+
+// TripLength is how long a departure of the product lasts going by the
+// schedule it's on, or zero if no schedule has that start time. The
+// schedules and their times need to be loaded.
+func (p *Product) TripLength(trip time.Time) time.Duration {
+	trip = trip.In(loc)
+	start := trip.Format("15:04")
+	yy, mm, dd := trip.Date()
+	day := time.Date(yy, mm, dd, 0, 0, 0, 0, loc)
+
+	for _, s := range p.Schedules {
+		if !s.runsOn(day) {
+			continue
+		}
+
+		for _, t := range s.TimeArray {
+			if t.StartTime != start {
+				continue
+			}
+			end, err := time.Parse("15:04", t.EndTime)
+			if err != nil {
+				return 0
+			}
+			return time.Date(yy, mm, dd, end.Hour(), end.Minute(), 0, 0, loc).Sub(trip)
+		}
+	}
+	return 0
+}
+
+// OrderEvents returns an event for each departure on an order that hasn't
+// been refunded. The uid is the departure's first line so that moving the
+// tickets to another trip updates the event rather than adding one, and the
+// line keeps the event's sequence.
+func OrderEvents(db *gorm.DB, conf *MerchantConfig, orderID, passLink string) []CalendarEvent {
+	var lines []OrderLine
+	owned := db.Model(&Order{}).Select("id").Where("id = ? AND merchant_id = ?", orderID, conf.ID).SubQuery()
+	db.Where("order_id IN ? AND departure IS NOT NULL AND COALESCE(status, '') <> ?", owned, "refunded").
+		Order("id").Find(&lines)
+	if len(lines) == 0 {
+		return nil
+	}
+
+	locale := OrderLocale(db, conf, orderID)
+	domain, _ := conf.MailSender()
+	var o Order
+	db.Preload("Customer").Where("id = ?", orderID).First(&o)
+
+	type departure struct {
+		pid uint
+		at  int64
+	}
+	var order []departure
+	groups := make(map[departure][]OrderLine)
+	for _, l := range lines {
+		key := departure{l.ProductID, l.Departure.Unix()}
+		if _, ok := groups[key]; !ok {
+			order = append(order, key)
+		}
+		groups[key] = append(groups[key], l)
+	}
+	sort.SliceStable(order, func(i, j int) bool { return order[i].at < order[j].at })
+
+	out := make([]CalendarEvent, 0, len(order))
+	for _, key := range order {
+		group := groups[key]
+		start := group[0].Departure.In(loc)
+
+		var prod Product
+		db.Unscoped().Preload("Schedules").Preload("Schedules.TimeArray").
+			Where("id = ? AND merchant_id = ?", key.pid, conf.ID).First(&prod)
+		var boat Boat
+		db.Where("id = ? AND merchant_id = ?", prod.BoatID, conf.ID).First(&boat)
+		var cancelled int
+		db.Table("manual_overrides").Where("product_id = ? AND time = ? AND cancelled", key.pid, start).
+			Count(&cancelled)
+
+		var desc []string
+		if boat.Name != "" {
+			desc = append(desc, T(locale, "ics.boat", boat.Name))
+		}
+		for _, l := range group {
+			desc = append(desc, fmt.Sprintf("%d %s", l.Quantity, l.Name))
+		}
+		if passLink != "" {
+			desc = append(desc, T(locale, "ics.passes", passLink))
+		}
+
+		ev := CalendarEvent{
+			UID:         group[0].ID + "@" + domain,
+			LineID:      group[0].ID,
+			Sequence:    group[0].CalendarSeq,
+			ProductID:   key.pid,
+			Start:       start,
+			Summary:     prod.Name,
+			Location:    conf.DockLocation,
+			Description: strings.Join(desc, "\n"),
+			URL:         passLink,
+			Cancelled:   cancelled > 0,
+		}
+		if o.Customer != nil {
+			ev.Attendee = o.Customer.Email
+		}
+		if conf.PassTitle != "" {
+			ev.Summary = conf.PassTitle + ": " + prod.Name
+		}
+		if d := prod.TripLength(start); d > 0 {
+			ev.End = start.Add(d)
+		}
+		out = append(out, ev)
+	}
+	return out
+}
+
+// OrderCalendar is an order's departures as an ics file, or nil when the
+// order has none
+func OrderCalendar(db *gorm.DB, conf *MerchantConfig, orderID, passLink string) []byte {
+	events := OrderEvents(db, conf, orderID, passLink)
+	if len(events) == 0 {
+		return nil
+	}
+	return BuildCalendar(conf, CalendarPublish, events)
+}
+
+// BumpSequence moves each event on to its next sequence, for sending an
+// update that has to replace the version the customer already has
+func BumpSequence(db *gorm.DB, events []CalendarEvent) {
+	for idx := range events {
+		events[idx].Sequence++
+		db.Model(&OrderLine{}).Where("id = ?", events[idx].LineID).
+			UpdateColumn("calendar_seq", events[idx].Sequence)
+	}
+}
+
+var icsEscaper = strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r", "", "\n", `\n`)
+
+const icsTime = "20060102T150405Z"
+
+// BuildCalendar writes events out as an ics file. Cancellations name the
+// customer as the attendee being taken off the event.
+func BuildCalendar(conf *MerchantConfig, method string, events []CalendarEvent) []byte {
+	now := time.Now().UTC()
+
+	var b strings.Builder
+	prop := func(name, value string) {
+		line := name + ":" + value
+		n := 0
+		for _, r := range line {
+			// lines are folded at 75 octets without splitting a character
+			if l := utf8.RuneLen(r); n+l > 75 {
+				b.WriteString("\r\n ")
+				n = 1
+			}
+			b.WriteRune(r)
+			n += utf8.RuneLen(r)
+		}
+		b.WriteString("\r\n")
+	}
+
+	prop("BEGIN", "VCALENDAR")
+	prop("VERSION", "2.0")
+	prop("PRODID", "-//tmsapi//"+icsEscaper.Replace(conf.PassTitle)+"//EN")
+	prop("CALSCALE", "GREGORIAN")
+	prop("METHOD", method)
+	for _, ev := range events {
+		prop("BEGIN", "VEVENT")
+		prop("UID", ev.UID)
+		prop("DTSTAMP", now.Format(icsTime))
+		prop("SEQUENCE", fmt.Sprint(ev.Sequence))
+		prop("DTSTART", ev.Start.UTC().Format(icsTime))
+		if !ev.End.IsZero() {
+			prop("DTEND", ev.End.UTC().Format(icsTime))
+		}
+		prop("SUMMARY", icsEscaper.Replace(ev.Summary))
+		if ev.Location != "" {
+			prop("LOCATION", icsEscaper.Replace(ev.Location))
+		}
+		if ev.Description != "" {
+			prop("DESCRIPTION", icsEscaper.Replace(ev.Description))
+		}
+		if ev.URL != "" {
+			prop("URL", ev.URL)
+		}
+		if conf.EmailFrom != "" {
+			prop(`ORGANIZER;CN="`+strings.ReplaceAll(conf.PassTitle, `"`, "")+`"`, "mailto:"+conf.EmailFrom)
+		}
+		if method == CalendarCancel && ev.Attendee != "" {
+			prop("ATTENDEE", "mailto:"+ev.Attendee)
+		}
+		if method == CalendarCancel || ev.Cancelled {
+			prop("STATUS", "CANCELLED")
+		} else {
+			prop("STATUS", "CONFIRMED")
+		}
+		prop("END", "VEVENT")
+	}
+	prop("END", "VCALENDAR")
+	return []byte(b.String())
+}
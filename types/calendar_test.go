@@ -0,0 +1,104 @@
+package types
+
+import (
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+// unfold joins folded ics lines back together
+func unfold(ics string) []string {
+	return strings.Split(strings.TrimSuffix(strings.ReplaceAll(ics, "\r\n ", ""), "\r\n"), "\r\n")
+}
+
+func hasLine(lines []string, want string) bool {
+	for _, l := range lines {
+		if l == want {
+			return true
+		}
+	}
+	return false
+}
+
+func testEvent() CalendarEvent {
+	start := time.Date(2024, time.July, 4, 18, 0, 0, 0, time.UTC)
+	return CalendarEvent{
+		UID:         "line-1@mg.example.com",
+		Sequence:    3,
+		Attendee:    "ana@example.com",
+		Start:       start,
+		End:         start.Add(4 * time.Hour),
+		Summary:     "Fireworks Cruise; Deck, Bar",
+		Location:    "Pier 9",
+		Description: "Barco: Ñandú\n" + strings.Repeat("2 Adultos ✓ ", 12),
+		URL:         "https://tickets.example.com/info/m1/passes/o1",
+	}
+}
+
+func TestBuildCalendarFolding(t *testing.T) {
+	conf := &MerchantConfig{PassTitle: "Boat Co", EmailFrom: "tickets@example.com"}
+	ics := string(BuildCalendar(conf, CalendarPublish, []CalendarEvent{testEvent()}))
+
+	if !strings.HasSuffix(ics, "END:VCALENDAR\r\n") {
+		t.Error("calendar isn't ended with a CRLF line")
+	}
+	for _, l := range strings.Split(strings.TrimSuffix(ics, "\r\n"), "\r\n") {
+		if len(l) > 75 {
+			t.Errorf("line longer than 75 octets: %q", l)
+		}
+		if !utf8.ValidString(l) {
+			t.Errorf("fold split a character: %q", l)
+		}
+	}
+
+	lines := unfold(ics)
+	want := []string{
+		"METHOD:PUBLISH",
+		"UID:line-1@mg.example.com",
+		"SEQUENCE:3",
+		"DTSTART:20240704T180000Z",
+		"DTEND:20240704T220000Z",
+		`SUMMARY:Fireworks Cruise\; Deck\, Bar`,
+		`DESCRIPTION:Barco: Ñandú\n` + strings.Repeat("2 Adultos ✓ ", 12),
+		`ORGANIZER;CN="Boat Co":mailto:tickets@example.com`,
+		"STATUS:CONFIRMED",
+	}
+	for _, w := range want {
+		if !hasLine(lines, w) {
+			t.Errorf("missing %q in\n%s", w, ics)
+		}
+	}
+	for _, l := range lines {
+		if strings.HasPrefix(l, "ATTENDEE") {
+			t.Errorf("published invite names an attendee: %q", l)
+		}
+	}
+}
+
+func TestBuildCalendarCancel(t *testing.T) {
+	ev := testEvent()
+	ev.End = time.Time{}
+	ics := string(BuildCalendar(&MerchantConfig{}, CalendarCancel, []CalendarEvent{ev}))
+
+	lines := unfold(ics)
+	for _, w := range []string{"METHOD:CANCEL", "SEQUENCE:3", "ATTENDEE:mailto:ana@example.com", "STATUS:CANCELLED"} {
+		if !hasLine(lines, w) {
+			t.Errorf("missing %q in\n%s", w, ics)
+		}
+	}
+	for _, l := range lines {
+		if strings.HasPrefix(l, "DTEND") || strings.HasPrefix(l, "ORGANIZER") {
+			t.Errorf("unexpected %q", l)
+		}
+	}
+}
+
+func TestBuildCalendarCancelledDeparture(t *testing.T) {
+	ev := testEvent()
+	ev.Cancelled = true
+	lines := unfold(string(BuildCalendar(&MerchantConfig{}, CalendarPublish, []CalendarEvent{ev})))
+	if !hasLine(lines, "STATUS:CANCELLED") {
+		t.Error("cancelled departure isn't marked cancelled")
+	}
+}
@@ -0,0 +1,23 @@
+package types
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// DigestRun records a merchant's daily digest so each day's is only sent
+// once, Date is the local day it was sent in YYYY-MM-DD form
+type DigestRun struct {
+	MerchantID string    `json:"-" gorm:"primary_key"`
+	Date       string    `json:"date" gorm:"primary_key"`
+	Recipients string    `json:"recipients"`
+	Error      string    `json:"error,omitempty"`
+	CreatedAt  time.Time `json:"created"`
+}
+
+// ClaimDigest records the digest before it's sent, returning false if it
+// has already been claimed
+func ClaimDigest(db *gorm.DB, r *DigestRun) (bool, error) {
+	return CreateOnce(db, r)
+}
@@ -0,0 +1,15 @@
+package types
+
+import (
+	"testing"
+
+	"github.com/zeroshade/tmsapi/internal/dbtest"
+)
+
+func TestClaimDigest(t *testing.T) {
+	db, d := dbtest.Open(t)
+	d.Returns(`INSERT INTO "digest_runs"`, []string{"merchant_id"})
+	if ok, err := ClaimDigest(db, &DigestRun{MerchantID: "m1", Date: "2024-07-04"}); ok || err != nil {
+		t.Errorf("claimed digest: %v, %v", ok, err)
+	}
+}
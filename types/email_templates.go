@@ -0,0 +1,642 @@
+package types
+
+import (
+	"bytes"
+	htmltemplate "html/template"
+	"text/template"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// Kinds of email a merchant can customise
+const (
+	EmailPurchase  = "purchase"
+	EmailNotify    = "notify"
+	EmailGiftCodes = "giftcodes"
+	EmailRefund    = "refund"
+	EmailTransfer  = "transfer"
+	EmailReminder  = "reminder"
+	EmailCancelled = "cancelled"
+	EmailQuote     = "charter_quote"
+	EmailBalance   = "charter_balance"
+	EmailGroup     = "group_invite"
+	EmailReserve   = "reservation_link"
+)
+
+// EmailKinds lists every kind of email in the order the dashboard shows them
+var EmailKinds = []string{EmailPurchase, EmailNotify, EmailGiftCodes, EmailRefund, EmailTransfer, EmailReminder, EmailCancelled,
+	EmailQuote, EmailBalance, EmailGroup, EmailReserve}
+
+// EmailTemplate is a merchant's own version of one kind of email in one
+// locale. The subject and text are text/templates and the html an
+// html/template, all rendered with EmailData.
+type EmailTemplate struct {
+	MerchantID string    `json:"-" gorm:"primary_key"`
+	Kind       string    `json:"kind" gorm:"primary_key"`
+	Locale     string    `json:"locale" gorm:"primary_key;default:'en'"`
+	Subject    string    `json:"subject"`
+	HTML       string    `json:"html" gorm:"type:text"`
+	Text       string    `json:"text" gorm:"type:text"`
+	UpdatedAt  time.Time `json:"updated"`
+}
+
+type EmailItem struct {
+	Name        string
+	Description string
+	Quantity    int
+	Amount      string
+}
+
+type EmailGiftCard struct {
+	Code  string
+	Value string
+}
+
+// EmailData is what every email template is rendered with, not every field
+// is filled in for every kind
+type EmailData struct {
+	Merchant      string
+	Content       htmltemplate.HTML
+	Name          string
+	Email         string
+	Phone         string
+	OrderID       string
+	Items         []EmailItem
+	Total         string
+	PassLink      string
+	PassType      string
+	Attached      bool
+	Receipt       string
+	GiftCardOrder bool
+	GiftCards     []EmailGiftCard
+	Amount        string
+	OldTrip       string
+	NewTrip       string
+	Departure     string
+	DockLocation  string
+	WeatherNotice string
+	Locale        string
+	PayLink       string
+	Expires       string
+	Paid          string
+	Owed          string
+	Note          string
+	Organizer     string
+	Trip          string
+	TripType      string
+	TripLength    int
+	Date          string
+	Time          string
+}
+
+// TemplateVar documents a field of EmailData for the template editor
+type TemplateVar struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+var commonVars = []TemplateVar{
+	{".Merchant", "the merchant's pass title"},
+	{".Content", "the merchant's email content setting, as raw html"},
+	{".Name", "the customer's name"},
+	{".Email", "the customer's email address"},
+	{".Phone", "the customer's phone number"},
+	{".OrderID", "the order or payment id"},
+	{".Locale", `the language the email is in, "en" or "es"`},
+	{"money", "formats an amount for the locale, ie: {{ money .Total }}"},
+}
+
+var itemVars = []TemplateVar{
+	{".Items", "the tickets ordered, each with .Name .Description .Quantity and .Amount"},
+	{".Total", "the order total"},
+}
+
+// EmailTemplateVars documents the variables available to each kind of email
+var EmailTemplateVars = map[string][]TemplateVar{
+	EmailPurchase: append(append(append([]TemplateVar{}, commonVars...), itemVars...),
+		TemplateVar{".PassLink", "link to download the passes, empty when they're attached"},
+		TemplateVar{".PassType", `"boarding passes" or "tickets" for shows`},
+		TemplateVar{".Attached", "whether the passes are attached as a pdf"},
+		TemplateVar{".Receipt", "link to the payment receipt, if there is one"},
+		TemplateVar{".GiftCardOrder", "whether the order was for gift cards"}),
+	EmailNotify: append(append([]TemplateVar{}, commonVars...), itemVars...),
+	EmailGiftCodes: append(append([]TemplateVar{}, commonVars...),
+		TemplateVar{".GiftCards", "the gift cards bought, each with .Code and .Value"}),
+	EmailRefund: append(append(append([]TemplateVar{}, commonVars...), itemVars...),
+		TemplateVar{".Amount", "the amount refunded"}),
+	EmailTransfer: append(append([]TemplateVar{}, commonVars...),
+		TemplateVar{".OldTrip", "the trip the tickets were moved from"},
+		TemplateVar{".NewTrip", "the trip the tickets were moved to"},
+		TemplateVar{".PassLink", "link to download the updated passes"}),
+	EmailReminder: append(append(append([]TemplateVar{}, commonVars...), itemVars...),
+		TemplateVar{".Departure", "when the trip leaves"},
+		TemplateVar{".PassLink", "link to download the passes"},
+		TemplateVar{".DockLocation", "where the boat leaves from"},
+		TemplateVar{".WeatherNotice", "the merchant's weather policy"}),
+	EmailCancelled: append(append(append([]TemplateVar{}, commonVars...), itemVars...),
+		TemplateVar{".Departure", "when the cancelled trip was to leave"},
+		TemplateVar{".WeatherNotice", "the merchant's weather policy"}),
+	EmailQuote: append(append([]TemplateVar{}, commonVars...),
+		TemplateVar{".TripType", "the kind of charter asked about"},
+		TemplateVar{".TripLength", "how many hours the charter is"},
+		TemplateVar{".Date", "the date asked for"},
+		TemplateVar{".Time", "the time asked for"},
+		TemplateVar{".Total", "the quoted total, empty when staff didn't give one"},
+		TemplateVar{".Note", "the staff member's note to the customer"},
+		TemplateVar{".PayLink", "link to pay the deposit"},
+		TemplateVar{".Expires", "when the quote runs out"}),
+	EmailBalance: append(append([]TemplateVar{}, commonVars...),
+		TemplateVar{".Date", "the charter's date"},
+		TemplateVar{".Time", "the charter's time"},
+		TemplateVar{".Paid", "how much has been paid so far"},
+		TemplateVar{".Owed", "the balance still due"},
+		TemplateVar{".PayLink", "link to pay the balance"}),
+	EmailGroup: append(append([]TemplateVar{}, commonVars...),
+		TemplateVar{".Organizer", "who booked the group"},
+		TemplateVar{".Trip", "the trip the group is on"},
+		TemplateVar{".Amount", "the member's share"},
+		TemplateVar{".PayLink", "link to pay for the seat"},
+		TemplateVar{".Expires", "when the seat is released if unpaid"}),
+	EmailReserve: append(append([]TemplateVar{}, commonVars...),
+		TemplateVar{".Items", "the tickets reserved, each with .Name and .Quantity"},
+		TemplateVar{".Owed", "the balance due"},
+		TemplateVar{".PayLink", "link to pay the balance"},
+		TemplateVar{".Expires", "when the reservation is released, empty if it's held indefinitely"}),
+}
+
+// DefaultEmailTemplates are used for any kind a merchant hasn't customised
+var DefaultEmailTemplates = map[string]EmailTemplate{
+	EmailPurchase: {
+		Kind:    EmailPurchase,
+		Subject: `{{ if .GiftCardOrder }}Gift Cards Purchased{{ else }}Tickets Purchased{{ end }}`,
+		HTML: `{{ .Content }}
+<br /><br />
+Ordered:<br/>
+<ul>
+{{ range .Items -}}
+<li>{{ .Quantity }} {{ .Name }}{{ if .Description }}, {{ .Description }}{{ end }}</li>
+{{ end -}}
+</ul>
+{{ if .Attached -}}
+Your {{ .PassType }} are included as an attachment to this email as a PDF file for easy printing.<br />
+{{- else if .PassLink -}}
+You can download your {{ .PassType }} here: <a href='{{ .PassLink }}'>Click Here</a><br />
+{{- end }}
+{{ if .Receipt -}}
+<br />You can access your receipt <a href='{{ .Receipt }}'>here</a>. If clicking on that doesn't work,
+you can copy and paste the following URL into your browser: {{ .Receipt }}<br />
+{{- end }}
+{{ if .GiftCardOrder -}}
+<br />You should receive another e-mail shortly with the Gift Codes for your purchased Gift Cards.<br />
+{{- end }}`,
+		Text: `Ordered:
+{{ range .Items }}  {{ .Quantity }} {{ .Name }}{{ if .Description }}, {{ .Description }}{{ end }}
+{{ end }}
+{{ if .Attached }}Your {{ .PassType }} are attached as a PDF.{{ else if .PassLink }}Download your {{ .PassType }}: {{ .PassLink }}{{ end }}
+{{ if .Receipt }}Receipt: {{ .Receipt }}{{ end }}`,
+	},
+	EmailNotify: {
+		Kind:    EmailNotify,
+		Subject: `Tickets Purchased`,
+		HTML: `Tickets Purchased By: {{ .Name }} <a href='mailto:{{ .Email }}'>{{ .Email }}</a>
+<br />
+Phone: {{ if .Phone }}{{ .Phone }}{{ else }}Not Provided{{ end }}
+<br />
+<ul>
+{{ range .Items -}}
+<li>{{ .Quantity }} {{ .Name }}{{ if .Description }}, {{ .Description }}{{ end }}</li>
+{{ end -}}
+</ul>`,
+		Text: `Tickets Purchased By: {{ .Name }} {{ .Email }}
+Phone: {{ if .Phone }}{{ .Phone }}{{ else }}Not Provided{{ end }}
+{{ range .Items }}  {{ .Quantity }} {{ .Name }}{{ if .Description }}, {{ .Description }}{{ end }}
+{{ end }}`,
+	},
+	EmailGiftCodes: {
+		Kind:    EmailGiftCodes,
+		Subject: `Gift Card Codes`,
+		HTML: `Thank you for your purchase of Gift Cards! Below you'll find the codes which can be entered
+at checkout which can be given to your desired recipients.
+<br />
+<strong>Gift Card Codes are Case Sensitive at checkout!</strong>
+<br /><br />
+<table>
+	<thead><tr><th>Value</th><th>Code</th></tr></thead>
+	<tbody>
+{{ range .GiftCards }}		<tr><td>{{ money .Value }}</td><td>{{ .Code }}</td></tr>
+{{ end }}	</tbody>
+</table>`,
+		Text: `Thank you for your purchase of Gift Cards! Gift Card Codes are case sensitive at checkout.
+{{ range .GiftCards }}  {{ money .Value }}: {{ .Code }}
+{{ end }}`,
+	},
+	EmailRefund: {
+		Kind:    EmailRefund,
+		Subject: `Refund Issued`,
+		HTML: `A refund of {{ money .Amount }} has been issued for your order {{ .OrderID }}.
+<ul>
+{{ range .Items -}}
+<li>{{ .Quantity }} {{ .Name }}{{ if .Description }}, {{ .Description }}{{ end }}</li>
+{{ end -}}
+</ul>`,
+		Text: `A refund of {{ money .Amount }} has been issued for your order {{ .OrderID }}.
+{{ range .Items }}  {{ .Quantity }} {{ .Name }}
+{{ end }}`,
+	},
+	EmailTransfer: {
+		Kind:    EmailTransfer,
+		Subject: `Tickets Transferred`,
+		HTML: `Your tickets have been moved from {{ .OldTrip }} to <b>{{ .NewTrip }}</b>.
+{{ if .PassLink }}<br />You can download your updated passes here: <a href='{{ .PassLink }}'>Click Here</a>{{ end }}`,
+		Text: `Your tickets have been moved from {{ .OldTrip }} to {{ .NewTrip }}.
+{{ if .PassLink }}Download your updated passes: {{ .PassLink }}{{ end }}`,
+	},
+	EmailReminder: {
+		Kind:    EmailReminder,
+		Subject: `Reminder: your trip on {{ .Departure }}`,
+		HTML: `This is a reminder that your trip with {{ .Merchant }} leaves {{ .Departure }}.
+<ul>
+{{ range .Items -}}
+<li>{{ .Quantity }} {{ .Name }}</li>
+{{ end -}}
+</ul>
+{{ if .DockLocation }}We leave from {{ .DockLocation }}.<br />{{ end }}
+{{ if .WeatherNotice }}{{ .WeatherNotice }}<br />{{ end }}
+{{ if .PassLink }}You can download your passes here: <a href='{{ .PassLink }}'>Click Here</a>{{ end }}`,
+		Text: `This is a reminder that your trip with {{ .Merchant }} leaves {{ .Departure }}.
+{{ range .Items }}  {{ .Quantity }} {{ .Name }}
+{{ end }}{{ if .DockLocation }}We leave from {{ .DockLocation }}.
+{{ end }}{{ if .WeatherNotice }}{{ .WeatherNotice }}
+{{ end }}{{ if .PassLink }}Passes: {{ .PassLink }}{{ end }}`,
+	},
+	EmailCancelled: {
+		Kind:    EmailCancelled,
+		Subject: `Trip Cancelled: {{ .Departure }}`,
+		HTML: `We're sorry, your trip with {{ .Merchant }} on {{ .Departure }} has been cancelled.
+<ul>
+{{ range .Items -}}
+<li>{{ .Quantity }} {{ .Name }}</li>
+{{ end -}}
+</ul>
+{{ if .WeatherNotice }}{{ .WeatherNotice }}<br />{{ end }}
+We'll be in touch about your tickets, or reply to this email with any questions.`,
+		Text: `We're sorry, your trip with {{ .Merchant }} on {{ .Departure }} has been cancelled.
+{{ range .Items }}  {{ .Quantity }} {{ .Name }}
+{{ end }}{{ if .WeatherNotice }}{{ .WeatherNotice }}
+{{ end }}We'll be in touch about your tickets, or reply to this email with any questions.`,
+	},
+	EmailQuote: {
+		Kind:    EmailQuote,
+		Subject: `{{ .Merchant }} Charter Quote`,
+		HTML: `<p>Hi {{ .Name }},</p>
+<p>Thank you for asking about a {{ .TripLength }} hour {{ .TripType }} charter on {{ .Date }} at {{ .Time }}.</p>
+{{ if .Total }}<p>The total for your charter is <b>{{ money .Total }}</b>.</p>{{ end }}
+{{ if .Note }}<p>{{ .Note }}</p>{{ end }}
+<p>You can reserve it by paying the deposit <a href='{{ .PayLink }}'>here</a>.
+This offer is held until {{ .Expires }}.</p>
+<p>If clicking on that doesn't work, you can copy and paste the following URL into
+your browser: {{ .PayLink }}</p>`,
+		Text: `Hi {{ .Name }},
+Thank you for asking about a {{ .TripLength }} hour {{ .TripType }} charter on {{ .Date }} at {{ .Time }}.
+{{ if .Total }}The total for your charter is {{ money .Total }}.
+{{ end }}{{ if .Note }}{{ .Note }}
+{{ end }}Reserve it by paying the deposit, this offer is held until {{ .Expires }}: {{ .PayLink }}`,
+	},
+	EmailBalance: {
+		Kind:    EmailBalance,
+		Subject: `{{ .Merchant }} Charter Balance Due`,
+		HTML: `<p>Thank you for booking your charter on {{ .Date }} at {{ .Time }}.</p>
+<p>Your deposit of {{ money .Paid }} has been received and the remaining balance of <b>{{ money .Owed }}</b>
+is now due. You can pay it online <a href='{{ .PayLink }}'>here</a>.</p>
+<p>If clicking on that doesn't work, you can copy and paste the following URL into
+your browser: {{ .PayLink }}</p>`,
+		Text: `Thank you for booking your charter on {{ .Date }} at {{ .Time }}.
+Your deposit of {{ money .Paid }} has been received and the remaining balance of {{ money .Owed }} is now due.
+Pay it online: {{ .PayLink }}`,
+	},
+	EmailGroup: {
+		Kind:    EmailGroup,
+		Subject: `{{ .Merchant }} Group Booking`,
+		HTML: `<p>{{ .Organizer }} has booked a seat for you on {{ .Trip }}.</p>
+<p>Your share is <b>{{ money .Amount }}</b>, please pay it by {{ .Expires }} to keep your seat.
+You can pay online <a href='{{ .PayLink }}'>here</a>.</p>
+<p>If clicking on that doesn't work, you can copy and paste the following URL into
+your browser: {{ .PayLink }}</p>`,
+		Text: `{{ .Organizer }} has booked a seat for you on {{ .Trip }}.
+Your share is {{ money .Amount }}, please pay it by {{ .Expires }} to keep your seat.
+Pay online: {{ .PayLink }}`,
+	},
+	EmailReserve: {
+		Kind:    EmailReserve,
+		Subject: `{{ .Merchant }} Reservation Payment`,
+		HTML: `<p>Your reservation is being held{{ if .Expires }} until {{ .Expires }}{{ end }}.</p>
+<ul>{{ range .Items }}<li>{{ .Quantity }} x {{ .Name }}</li>{{ end }}</ul>
+<p>The balance of <b>{{ money .Owed }}</b> can be paid online <a href='{{ .PayLink }}'>here</a>.</p>
+<p>If clicking on that doesn't work, you can copy and paste the following URL into
+your browser: {{ .PayLink }}</p>`,
+		Text: `Your reservation is being held{{ if .Expires }} until {{ .Expires }}{{ end }}.
+{{ range .Items }}  {{ .Quantity }} x {{ .Name }}
+{{ end }}The balance of {{ money .Owed }} can be paid online: {{ .PayLink }}`,
+	},
+}
+
+// localizedEmailTemplates are the defaults in the other locales, any kind
+// missing here falls back to the english default
+var localizedEmailTemplates = map[string]map[string]EmailTemplate{
+	LocaleSpanish: {
+		EmailPurchase: {
+			Kind:    EmailPurchase,
+			Subject: `{{ if .GiftCardOrder }}Tarjetas de Regalo Compradas{{ else }}Boletos Comprados{{ end }}`,
+			HTML: `{{ .Content }}
+<br /><br />
+Pedido:<br/>
+<ul>
+{{ range .Items -}}
+<li>{{ .Quantity }} {{ .Name }}{{ if .Description }}, {{ .Description }}{{ end }}</li>
+{{ end -}}
+</ul>
+{{ if .Attached -}}
+Sus {{ .PassType }} están adjuntos a este correo como un archivo PDF para imprimirlos fácilmente.<br />
+{{- else if .PassLink -}}
+Puede descargar sus {{ .PassType }} aquí: <a href='{{ .PassLink }}'>Haga Clic Aquí</a><br />
+{{- end }}
+{{ if .Receipt -}}
+<br />Puede ver su recibo <a href='{{ .Receipt }}'>aquí</a>. Si el enlace no funciona,
+copie y pegue la siguiente dirección en su navegador: {{ .Receipt }}<br />
+{{- end }}
+{{ if .GiftCardOrder -}}
+<br />En breve recibirá otro correo con los códigos de sus Tarjetas de Regalo.<br />
+{{- end }}`,
+			Text: `Pedido:
+{{ range .Items }}  {{ .Quantity }} {{ .Name }}{{ if .Description }}, {{ .Description }}{{ end }}
+{{ end }}
+{{ if .Attached }}Sus {{ .PassType }} están adjuntos como PDF.{{ else if .PassLink }}Descargue sus {{ .PassType }}: {{ .PassLink }}{{ end }}
+{{ if .Receipt }}Recibo: {{ .Receipt }}{{ end }}`,
+		},
+		EmailNotify: {
+			Kind:    EmailNotify,
+			Subject: `Boletos Comprados`,
+			HTML: `Boletos Comprados Por: {{ .Name }} <a href='mailto:{{ .Email }}'>{{ .Email }}</a>
+<br />
+Teléfono: {{ if .Phone }}{{ .Phone }}{{ else }}No Proporcionado{{ end }}
+<br />
+<ul>
+{{ range .Items -}}
+<li>{{ .Quantity }} {{ .Name }}{{ if .Description }}, {{ .Description }}{{ end }}</li>
+{{ end -}}
+</ul>`,
+			Text: `Boletos Comprados Por: {{ .Name }} {{ .Email }}
+Teléfono: {{ if .Phone }}{{ .Phone }}{{ else }}No Proporcionado{{ end }}
+{{ range .Items }}  {{ .Quantity }} {{ .Name }}{{ if .Description }}, {{ .Description }}{{ end }}
+{{ end }}`,
+		},
+		EmailGiftCodes: {
+			Kind:    EmailGiftCodes,
+			Subject: `Códigos de Tarjetas de Regalo`,
+			HTML: `¡Gracias por comprar Tarjetas de Regalo! A continuación encontrará los códigos que se pueden
+ingresar al pagar y que puede entregar a quien desee.
+<br />
+<strong>¡Los códigos distinguen entre mayúsculas y minúsculas al pagar!</strong>
+<br /><br />
+<table>
+	<thead><tr><th>Valor</th><th>Código</th></tr></thead>
+	<tbody>
+{{ range .GiftCards }}		<tr><td>{{ money .Value }}</td><td>{{ .Code }}</td></tr>
+{{ end }}	</tbody>
+</table>`,
+			Text: `¡Gracias por comprar Tarjetas de Regalo! Los códigos distinguen entre mayúsculas y minúsculas al pagar.
+{{ range .GiftCards }}  {{ money .Value }}: {{ .Code }}
+{{ end }}`,
+		},
+		EmailRefund: {
+			Kind:    EmailRefund,
+			Subject: `Reembolso Emitido`,
+			HTML: `Se ha emitido un reembolso de {{ money .Amount }} para su pedido {{ .OrderID }}.
+<ul>
+{{ range .Items -}}
+<li>{{ .Quantity }} {{ .Name }}{{ if .Description }}, {{ .Description }}{{ end }}</li>
+{{ end -}}
+</ul>`,
+			Text: `Se ha emitido un reembolso de {{ money .Amount }} para su pedido {{ .OrderID }}.
+{{ range .Items }}  {{ .Quantity }} {{ .Name }}
+{{ end }}`,
+		},
+		EmailTransfer: {
+			Kind:    EmailTransfer,
+			Subject: `Boletos Transferidos`,
+			HTML: `Sus boletos se han cambiado de {{ .OldTrip }} a <b>{{ .NewTrip }}</b>.
+{{ if .PassLink }}<br />Puede descargar sus pases actualizados aquí: <a href='{{ .PassLink }}'>Haga Clic Aquí</a>{{ end }}`,
+			Text: `Sus boletos se han cambiado de {{ .OldTrip }} a {{ .NewTrip }}.
+{{ if .PassLink }}Descargue sus pases actualizados: {{ .PassLink }}{{ end }}`,
+		},
+		EmailReminder: {
+			Kind:    EmailReminder,
+			Subject: `Recordatorio: su viaje el {{ .Departure }}`,
+			HTML: `Le recordamos que su viaje con {{ .Merchant }} sale el {{ .Departure }}.
+<ul>
+{{ range .Items -}}
+<li>{{ .Quantity }} {{ .Name }}</li>
+{{ end -}}
+</ul>
+{{ if .DockLocation }}Salimos desde {{ .DockLocation }}.<br />{{ end }}
+{{ if .WeatherNotice }}{{ .WeatherNotice }}<br />{{ end }}
+{{ if .PassLink }}Puede descargar sus pases aquí: <a href='{{ .PassLink }}'>Haga Clic Aquí</a>{{ end }}`,
+			Text: `Le recordamos que su viaje con {{ .Merchant }} sale el {{ .Departure }}.
+{{ range .Items }}  {{ .Quantity }} {{ .Name }}
+{{ end }}{{ if .DockLocation }}Salimos desde {{ .DockLocation }}.
+{{ end }}{{ if .WeatherNotice }}{{ .WeatherNotice }}
+{{ end }}{{ if .PassLink }}Pases: {{ .PassLink }}{{ end }}`,
+		},
+		EmailCancelled: {
+			Kind:    EmailCancelled,
+			Subject: `Viaje Cancelado: {{ .Departure }}`,
+			HTML: `Lo sentimos, su viaje con {{ .Merchant }} el {{ .Departure }} ha sido cancelado.
+<ul>
+{{ range .Items -}}
+<li>{{ .Quantity }} {{ .Name }}</li>
+{{ end -}}
+</ul>
+{{ if .WeatherNotice }}{{ .WeatherNotice }}<br />{{ end }}
+Nos pondremos en contacto sobre sus boletos, o responda a este correo con cualquier pregunta.`,
+			Text: `Lo sentimos, su viaje con {{ .Merchant }} el {{ .Departure }} ha sido cancelado.
+{{ range .Items }}  {{ .Quantity }} {{ .Name }}
+{{ end }}{{ if .WeatherNotice }}{{ .WeatherNotice }}
+{{ end }}Nos pondremos en contacto sobre sus boletos, o responda a este correo con cualquier pregunta.`,
+		},
+		EmailQuote: {
+			Kind:    EmailQuote,
+			Subject: `{{ .Merchant }} Cotización de Charter`,
+			HTML: `<p>Hola {{ .Name }},</p>
+<p>Gracias por consultar sobre un charter de {{ .TripType }} de {{ .TripLength }} horas el {{ .Date }} a las {{ .Time }}.</p>
+{{ if .Total }}<p>El total de su charter es <b>{{ money .Total }}</b>.</p>{{ end }}
+{{ if .Note }}<p>{{ .Note }}</p>{{ end }}
+<p>Puede reservarlo pagando el depósito <a href='{{ .PayLink }}'>aquí</a>.
+Esta oferta se mantiene hasta el {{ .Expires }}.</p>
+<p>Si el enlace no funciona, copie y pegue la siguiente dirección en su
+navegador: {{ .PayLink }}</p>`,
+			Text: `Hola {{ .Name }},
+Gracias por consultar sobre un charter de {{ .TripType }} de {{ .TripLength }} horas el {{ .Date }} a las {{ .Time }}.
+{{ if .Total }}El total de su charter es {{ money .Total }}.
+{{ end }}{{ if .Note }}{{ .Note }}
+{{ end }}Resérvelo pagando el depósito, esta oferta se mantiene hasta el {{ .Expires }}: {{ .PayLink }}`,
+		},
+		EmailBalance: {
+			Kind:    EmailBalance,
+			Subject: `{{ .Merchant }} Saldo de Charter Pendiente`,
+			HTML: `<p>Gracias por reservar su charter el {{ .Date }} a las {{ .Time }}.</p>
+<p>Hemos recibido su depósito de {{ money .Paid }} y el saldo restante de <b>{{ money .Owed }}</b>
+ya debe pagarse. Puede pagarlo en línea <a href='{{ .PayLink }}'>aquí</a>.</p>
+<p>Si el enlace no funciona, copie y pegue la siguiente dirección en su
+navegador: {{ .PayLink }}</p>`,
+			Text: `Gracias por reservar su charter el {{ .Date }} a las {{ .Time }}.
+Hemos recibido su depósito de {{ money .Paid }} y el saldo restante de {{ money .Owed }} ya debe pagarse.
+Páguelo en línea: {{ .PayLink }}`,
+		},
+		EmailGroup: {
+			Kind:    EmailGroup,
+			Subject: `{{ .Merchant }} Reserva de Grupo`,
+			HTML: `<p>{{ .Organizer }} le ha reservado un asiento en {{ .Trip }}.</p>
+<p>Su parte es <b>{{ money .Amount }}</b>, por favor páguela antes del {{ .Expires }} para conservar su asiento.
+Puede pagar en línea <a href='{{ .PayLink }}'>aquí</a>.</p>
+<p>Si el enlace no funciona, copie y pegue la siguiente dirección en su
+navegador: {{ .PayLink }}</p>`,
+			Text: `{{ .Organizer }} le ha reservado un asiento en {{ .Trip }}.
+Su parte es {{ money .Amount }}, por favor páguela antes del {{ .Expires }} para conservar su asiento.
+Pague en línea: {{ .PayLink }}`,
+		},
+		EmailReserve: {
+			Kind:    EmailReserve,
+			Subject: `{{ .Merchant }} Pago de Reserva`,
+			HTML: `<p>Su reserva está retenida{{ if .Expires }} hasta el {{ .Expires }}{{ end }}.</p>
+<ul>{{ range .Items }}<li>{{ .Quantity }} x {{ .Name }}</li>{{ end }}</ul>
+<p>El saldo de <b>{{ money .Owed }}</b> se puede pagar en línea <a href='{{ .PayLink }}'>aquí</a>.</p>
+<p>Si el enlace no funciona, copie y pegue la siguiente dirección en su
+navegador: {{ .PayLink }}</p>`,
+			Text: `Su reserva está retenida{{ if .Expires }} hasta el {{ .Expires }}{{ end }}.
+{{ range .Items }}  {{ .Quantity }} x {{ .Name }}
+{{ end }}El saldo de {{ money .Owed }} se puede pagar en línea: {{ .PayLink }}`,
+		},
+	},
+}
+
+// DefaultEmailTemplate is the default for a kind of email in a locale
+func DefaultEmailTemplate(kind, locale string) EmailTemplate {
+	t, ok := localizedEmailTemplates[locale][kind]
+	if !ok {
+		t = DefaultEmailTemplates[kind]
+	}
+	t.Locale = ResolveLocale(locale)
+	return t
+}
+
+// templateFuncs are available to every template, formatting for the
+// locale being rendered
+func templateFuncs(locale string) map[string]interface{} {
+	return map[string]interface{}{
+		"money": func(s string) string { return FormatCurrency(locale, ParseMoney(s)) },
+	}
+}
+
+// RenderedEmail is a template filled in for a particular message
+type RenderedEmail struct {
+	Subject string `json:"subject"`
+	HTML    string `json:"html"`
+	Text    string `json:"text"`
+}
+
+// Validate checks that every part of the template parses
+func (t *EmailTemplate) Validate() error {
+	funcs := templateFuncs(t.Locale)
+	if _, err := template.New("subject").Funcs(funcs).Parse(t.Subject); err != nil {
+		return err
+	}
+	if _, err := htmltemplate.New("html").Funcs(funcs).Parse(t.HTML); err != nil {
+		return err
+	}
+	_, err := template.New("text").Funcs(funcs).Parse(t.Text)
+	return err
+}
+
+// Render fills in the template with the data for a message
+func (t *EmailTemplate) Render(data *EmailData) (*RenderedEmail, error) {
+	var out RenderedEmail
+	var buf bytes.Buffer
+	funcs := templateFuncs(ResolveLocale(data.Locale, t.Locale))
+
+	st, err := template.New("subject").Funcs(funcs).Parse(t.Subject)
+	if err != nil {
+		return nil, err
+	}
+	if err := st.Execute(&buf, data); err != nil {
+		return nil, err
+	}
+	out.Subject = buf.String()
+
+	buf.Reset()
+	ht, err := htmltemplate.New("html").Funcs(funcs).Parse(t.HTML)
+	if err != nil {
+		return nil, err
+	}
+	if err := ht.Execute(&buf, data); err != nil {
+		return nil, err
+	}
+	out.HTML = buf.String()
+
+	if t.Text != "" {
+		buf.Reset()
+		tt, err := template.New("text").Funcs(funcs).Parse(t.Text)
+		if err != nil {
+			return nil, err
+		}
+		if err := tt.Execute(&buf, data); err != nil {
+			return nil, err
+		}
+		out.Text = buf.String()
+	}
+	return &out, nil
+}
+
+// LoadEmailTemplate returns the merchant's template for a kind of email in
+// a locale, or the default in that locale when they haven't set one
+func LoadEmailTemplate(db *gorm.DB, merchantID, kind, locale string) EmailTemplate {
+	var t EmailTemplate
+	db.Where("merchant_id = ? AND kind = ? AND locale = ?", merchantID, kind, locale).First(&t)
+	if t.Kind == "" {
+		t = DefaultEmailTemplate(kind, locale)
+		t.MerchantID = merchantID
+	}
+	return t
+}
+
+// RenderEmail renders the merchant's template for a kind of email in the
+// data's locale, or the merchant's when it has none. It falls back to the
+// default if theirs fails so the customer still hears from us.
+func RenderEmail(db *gorm.DB, conf *MerchantConfig, kind string, data *EmailData) (*RenderedEmail, error) {
+	data.Locale = ResolveLocale(data.Locale, conf.Locale)
+	// callers fill in the pass type in english
+	switch data.PassType {
+	case T(LocaleEnglish, "passtype.boarding"):
+		data.PassType = T(data.Locale, "passtype.boarding")
+	case T(LocaleEnglish, "passtype.tickets"):
+		data.PassType = T(data.Locale, "passtype.tickets")
+	}
+	if data.Merchant == "" {
+		data.Merchant = conf.PassTitle
+	}
+	if data.Content == "" {
+		data.Content = htmltemplate.HTML(conf.EmailContent)
+	}
+
+	t := LoadEmailTemplate(db, conf.ID, kind, data.Locale)
+	out, err := t.Render(data)
+	if err == nil {
+		return out, nil
+	}
+
+	def := DefaultEmailTemplate(kind, data.Locale)
+	if def.Kind == "" || t.Subject == def.Subject && t.HTML == def.HTML && t.Text == def.Text {
+		return nil, err
+	}
+	return def.Render(data)
+}
@@ -0,0 +1,154 @@
+package types
+
+import (
+	"github.com/jinzhu/gorm"
+	"github.com/lib/pq"
+)
+
+type checkoutParts struct {
+	orders   map[string]*CheckoutOrder
+	units    map[string][]PurchaseUnit
+	captures map[string][]*Capture
+	items    map[string][]PurchaseItem
+}
+
+// loadCheckoutParts fetches the orders, payers, purchase units, captures and
+// items for a set of checkout ids with one query per table rather than one
+// set of queries per order
+func loadCheckoutParts(db *gorm.DB, ids []string, withUnits bool) (*checkoutParts, error) {
+	parts := &checkoutParts{
+		orders:   make(map[string]*CheckoutOrder, len(ids)),
+		units:    make(map[string][]PurchaseUnit),
+		captures: make(map[string][]*Capture),
+		items:    make(map[string][]PurchaseItem),
+	}
+
+	if len(ids) == 0 {
+		return parts, nil
+	}
+
+	var orders []CheckoutOrder
+	if err := db.Preload("Payer").Where("id IN (?)", ids).Find(&orders).Error; err != nil {
+		return nil, err
+	}
+	for idx := range orders {
+		parts.orders[orders[idx].ID] = &orders[idx]
+	}
+
+	// a checkout with no captures or items still gets empty lists rather
+	// than nulls in the json
+	for _, id := range ids {
+		parts.captures[id] = []*Capture{}
+		parts.items[id] = []PurchaseItem{}
+	}
+
+	if withUnits {
+		var units []PurchaseUnit
+		if err := db.Where("checkout_id IN (?)", ids).Find(&units).Error; err != nil {
+			return nil, err
+		}
+		for _, u := range units {
+			parts.units[u.CheckoutID] = append(parts.units[u.CheckoutID], u)
+		}
+	}
+
+	var captures []*Capture
+	if err := db.Where("checkout_id IN (?)", ids).Find(&captures).Error; err != nil {
+		return nil, err
+	}
+	for _, c := range captures {
+		parts.captures[c.CheckoutID] = append(parts.captures[c.CheckoutID], c)
+	}
+
+	var items []PurchaseItem
+	if err := db.Where("checkout_id IN (?)", ids).Find(&items).Error; err != nil {
+		return nil, err
+	}
+	for _, i := range items {
+		parts.items[i.CheckoutID] = append(parts.items[i.CheckoutID], i)
+	}
+
+	return parts, nil
+}
+
+// LoadCheckoutOrders returns the checkout orders with the given ids along with
+// their payer and purchase units. As with the rest of the api, the captures
+// and items of an order are attached to its first purchase unit.
+func LoadCheckoutOrders(db *gorm.DB, ids []string) ([]CheckoutOrder, error) {
+	parts, err := loadCheckoutParts(db, ids, true)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make([]CheckoutOrder, 0, len(parts.orders))
+	for _, id := range ids {
+		o, ok := parts.orders[id]
+		if !ok {
+			continue
+		}
+
+		o.PurchaseUnits = parts.units[id]
+		if len(o.PurchaseUnits) > 0 {
+			o.PurchaseUnits[0].Payments.Captures = parts.captures[id]
+			o.PurchaseUnits[0].Items = parts.items[id]
+		}
+		ret = append(ret, *o)
+		// ids may repeat, only return each order once
+		delete(parts.orders, id)
+	}
+	return ret, nil
+}
+
+// LoadCheckoutsForUnits returns one checkout order per purchase unit, each
+// holding just that unit filled in with its captures and items
+func LoadCheckoutsForUnits(db *gorm.DB, units []PurchaseUnit) ([]*CheckoutOrder, error) {
+	if len(units) == 0 {
+		return nil, nil
+	}
+
+	ids := make([]string, 0, len(units))
+	seen := make(map[string]bool, len(units))
+	for _, u := range units {
+		if !seen[u.CheckoutID] {
+			seen[u.CheckoutID] = true
+			ids = append(ids, u.CheckoutID)
+		}
+	}
+
+	parts, err := loadCheckoutParts(db, ids, false)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make([]*CheckoutOrder, 0, len(units))
+	for _, u := range units {
+		u.Payments.Captures = parts.captures[u.CheckoutID]
+		u.Items = parts.items[u.CheckoutID]
+
+		o := &CheckoutOrder{}
+		if found, ok := parts.orders[u.CheckoutID]; ok {
+			*o = *found
+		}
+		o.PurchaseUnits = []PurchaseUnit{u}
+		ret = append(ret, o)
+	}
+	return ret, nil
+}
+
+// LoadTicketUsage returns whether each ticket of the given checkouts has been
+// used, keyed by ticket id
+func LoadTicketUsage(db *gorm.DB, checkoutIDs []string) (map[string]bool, error) {
+	usage := make(map[string]bool)
+	if len(checkoutIDs) == 0 {
+		return usage, nil
+	}
+
+	var used []TicketUsage
+	if err := db.Where("ticket_id ^@ ANY (?::text[])", pq.Array(checkoutIDs)).Find(&used).Error; err != nil {
+		return nil, err
+	}
+	for _, tu := range used {
+		usage[tu.TicketID] = tu.Used
+	}
+	return usage, nil
+}
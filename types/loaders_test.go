@@ -0,0 +1,21 @@
+package types
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/zeroshade/tmsapi/internal/dbtest"
+)
+
+func TestLoadCheckoutsForUnitsEmpty(t *testing.T) {
+	db, _ := dbtest.Open(t)
+	out, err := LoadCheckoutsForUnits(db, []PurchaseUnit{{CheckoutID: "CHK1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf, _ := json.Marshal(out)
+	if !strings.Contains(string(buf), `"items":[]`) || !strings.Contains(string(buf), `"captures":[]`) {
+		t.Errorf("checkout with no captures or items has nulls: %s", buf)
+	}
+}
@@ -0,0 +1,197 @@
+package types
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// Locales customer communications can be sent in
+const (
+	LocaleEnglish = "en"
+	LocaleSpanish = "es"
+)
+
+var Locales = []string{LocaleEnglish, LocaleSpanish}
+
+// ParseLocale reduces a language tag such as "es-MX" to one of our locales,
+// returning "" when we don't support it
+func ParseLocale(tag string) string {
+	tag = strings.ToLower(strings.TrimSpace(tag))
+	if idx := strings.IndexAny(tag, "-_"); idx >= 0 {
+		tag = tag[:idx]
+	}
+	for _, l := range Locales {
+		if l == tag {
+			return l
+		}
+	}
+	return ""
+}
+
+// ResolveLocale picks the first supported locale given, so an order's
+// choice can fall back to the merchant's and then to English
+func ResolveLocale(tags ...string) string {
+	for _, t := range tags {
+		if l := ParseLocale(t); l != "" {
+			return l
+		}
+	}
+	return LocaleEnglish
+}
+
+// OrderLocale is the language an order's customer communications use
+func OrderLocale(db *gorm.DB, conf *MerchantConfig, orderID string) string {
+	var o Order
+	db.Select("locale").Where("id = ?", orderID).First(&o)
+	return ResolveLocale(o.Locale, conf.Locale)
+}
+
+// SetOrderLocale records the language chosen at checkout, unsupported or
+// empty choices leave the order on the merchant's locale
+func SetOrderLocale(db *gorm.DB, orderID, tag string) error {
+	l := ParseLocale(tag)
+	if l == "" {
+		return nil
+	}
+	return db.Model(&Order{}).Where("id = ?", orderID).UpdateColumn("locale", l).Error
+}
+
+var messages = map[string]map[string]string{
+	LocaleEnglish: {
+		"pass.title":         "Passes",
+		"pass.boarding":      "Boarding Pass",
+		"pass.ticket":        "%s Ticket",
+		"pass.trip":          "Trip:",
+		"pass.purchased_by":  "Purchased By:",
+		"pass.name":          "Name:",
+		"pass.item":          "Item:",
+		"pass.price":         "Price:",
+		"passtype.boarding":  "boarding passes",
+		"passtype.tickets":   "tickets",
+		"sms.tickets_link":   "Tickets Link: %s",
+		"sms.reminder":       "Reminder: your %s trip leaves %s.",
+		"sms.reminder_dock":  " We leave from %s.",
+		"sms.reminder_link":  " Passes: %s",
+		"sms.help":           "%s: for help with your booking email %s. Reply STOP to opt out.",
+		"sms.purchased_by":   "Tickets Purchased by %s",
+		"sms.deposit_notify": "Deposit made by %s for %s %s",
+		"ics.boat":           "Boat: %s",
+		"ics.passes":         "Passes: %s",
+	},
+	LocaleSpanish: {
+		"pass.title":         "Pases",
+		"pass.boarding":      "Pase de Abordar",
+		"pass.ticket":        "Boleto %s",
+		"pass.trip":          "Viaje:",
+		"pass.purchased_by":  "Comprado Por:",
+		"pass.name":          "Nombre:",
+		"pass.item":          "Artículo:",
+		"pass.price":         "Precio:",
+		"passtype.boarding":  "pases de abordar",
+		"passtype.tickets":   "boletos",
+		"sms.tickets_link":   "Enlace de boletos: %s",
+		"sms.reminder":       "Recordatorio: su viaje con %s sale el %s.",
+		"sms.reminder_dock":  " Salimos desde %s.",
+		"sms.reminder_link":  " Pases: %s",
+		"sms.help":           "%s: para ayuda con su reserva escriba a %s. Responda STOP para no recibir más mensajes.",
+		"sms.purchased_by":   "Boletos comprados por %s",
+		"sms.deposit_notify": "Depósito hecho por %s para %s %s",
+		"ics.boat":           "Barco: %s",
+		"ics.passes":         "Pases: %s",
+	},
+}
+
+// T translates a message, falling back to English for anything missing
+func T(locale, key string, args ...interface{}) string {
+	msg, ok := messages[locale][key]
+	if !ok {
+		msg, ok = messages[LocaleEnglish][key]
+	}
+	if !ok {
+		return key
+	}
+	if len(args) > 0 {
+		return fmt.Sprintf(msg, args...)
+	}
+	return msg
+}
+
+// Date styles for FormatDate
+const (
+	DateTime      = "datetime"
+	DateShort     = "short"
+	DateShortYear = "shortyear"
+)
+
+var dateLayouts = map[string]map[string]string{
+	LocaleEnglish: {
+		DateTime:      "Mon, Jan 2 at 3:04 PM",
+		DateShort:     "Jan _2",
+		DateShortYear: "Jan _2, '06",
+	},
+	LocaleSpanish: {
+		DateTime:      "Mon, 2 Jan, 15:04",
+		DateShort:     "2 Jan",
+		DateShortYear: "2 Jan 2006",
+	},
+}
+
+// go only formats english names, so other locales swap them afterwards
+var dateNames = map[string]*strings.Replacer{
+	LocaleSpanish: strings.NewReplacer(
+		"Mon", "lun", "Tue", "mar", "Wed", "mié", "Thu", "jue", "Fri", "vie", "Sat", "sáb", "Sun", "dom",
+		"Jan", "ene", "Feb", "feb", "Mar", "mar", "Apr", "abr", "May", "may", "Jun", "jun",
+		"Jul", "jul", "Aug", "ago", "Sep", "sept", "Oct", "oct", "Nov", "nov", "Dec", "dic"),
+}
+
+// FormatDate formats a time in one of the date styles for the locale
+func FormatDate(locale string, t time.Time, style string) string {
+	layouts, ok := dateLayouts[locale]
+	if !ok {
+		layouts = dateLayouts[LocaleEnglish]
+	}
+	out := t.Format(layouts[style])
+	if r, ok := dateNames[locale]; ok {
+		out = r.Replace(out)
+	}
+	return out
+}
+
+// FormatCurrency formats a dollar amount for showing to a customer, ie:
+// "$1,234.50" in english and "1.234,50 US$" in spanish
+func FormatCurrency(locale string, v float64) string {
+	neg := v < 0
+	if neg {
+		v = -v
+	}
+	s := strconv.FormatFloat(v, 'f', 2, 64)
+	whole, frac := s[:len(s)-3], s[len(s)-2:]
+
+	group, decimal := ",", "."
+	if locale == LocaleSpanish {
+		group, decimal = ".", ","
+	}
+
+	var b strings.Builder
+	for i, r := range whole {
+		if i > 0 && (len(whole)-i)%3 == 0 {
+			b.WriteString(group)
+		}
+		b.WriteRune(r)
+	}
+	num := b.String() + decimal + frac
+
+	if locale == LocaleSpanish {
+		num += " US$"
+	} else {
+		num = "$" + num
+	}
+	if neg {
+		num = "-" + num
+	}
+	return num
+}
@@ -0,0 +1,58 @@
+package types
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFormatCurrency(t *testing.T) {
+	tests := []struct {
+		locale string
+		v      float64
+		want   string
+	}{
+		{LocaleEnglish, 0, "$0.00"},
+		{LocaleEnglish, 5.5, "$5.50"},
+		{LocaleEnglish, 999.999, "$1,000.00"},
+		{LocaleEnglish, 1234567.891, "$1,234,567.89"},
+		{LocaleEnglish, -42.1, "-$42.10"},
+		{LocaleSpanish, 1234.5, "1.234,50 US$"},
+		{LocaleSpanish, 100, "100,00 US$"},
+		{LocaleSpanish, -1000000, "-1.000.000,00 US$"},
+		{"fr", 12, "$12.00"},
+	}
+	for _, tt := range tests {
+		if got := FormatCurrency(tt.locale, tt.v); got != tt.want {
+			t.Errorf("FormatCurrency(%q, %v) = %q, want %q", tt.locale, tt.v, got, tt.want)
+		}
+	}
+}
+
+func TestFormatDate(t *testing.T) {
+	ny, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip(err)
+	}
+	tue := time.Date(2024, time.March, 5, 14, 7, 0, 0, ny)
+	sat := time.Date(2025, time.August, 30, 9, 0, 0, 0, ny)
+
+	tests := []struct {
+		locale string
+		t      time.Time
+		style  string
+		want   string
+	}{
+		{LocaleEnglish, tue, DateTime, "Tue, Mar 5 at 2:07 PM"},
+		{LocaleEnglish, tue, DateShort, "Mar  5"},
+		{LocaleEnglish, tue, DateShortYear, "Mar  5, '24"},
+		{LocaleSpanish, tue, DateTime, "mar, 5 mar, 14:07"},
+		{LocaleSpanish, sat, DateTime, "sáb, 30 ago, 09:00"},
+		{LocaleSpanish, sat, DateShortYear, "30 ago 2025"},
+		{"de", sat, DateShort, "Aug 30"},
+	}
+	for _, tt := range tests {
+		if got := FormatDate(tt.locale, tt.t, tt.style); got != tt.want {
+			t.Errorf("FormatDate(%q, %v, %q) = %q, want %q", tt.locale, tt.t, tt.style, got, tt.want)
+		}
+	}
+}
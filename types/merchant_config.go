@@ -1,6 +1,8 @@
 package types
 
 import (
+	"os"
+
 	"github.com/lib/pq"
 	"github.com/lib/pq/hstore"
 )
@@ -11,24 +13,88 @@ type SandboxInfo struct {
 }
 
 type MerchantConfig struct {
-	ID                 string        `json:"-" gorm:"primary_key"`
-	PassTitle          string        `json:"passTitle"`
-	NotifyNumber       string        `json:"notifyNumber"`
-	EmailFrom          string        `json:"emailFrom"`
-	EmailName          string        `json:"emailName"`
-	EmailContent       string        `json:"emailContent"`
-	SendSMS            bool          `json:"sendSMS" gorm:"default:false"`
-	TermsConds         string        `json:"terms"`
-	SandboxID          string        `json:"-"`
-	TwilioAcctSID      string        `json:"-"`
-	TwilioAcctToken    string        `json:"-"`
-	TwilioFromNumber   string        `json:"-"`
-	StripeKey          string        `json:"-"`
-	StripeSecondary    string        `json:"-"`
-	StripeAcctMap      hstore.Hstore `json:"-"`
-	PaymentType        string        `json:"-"`
-	FeePercent         float64       `json:"-"`
-	FuelSurcharge      float64       `json:"-"`
-	LogoBytes          []byte        `json:"-"`
-	StripeManagedProds bool          `json:"-"`
+	ID                 string         `json:"-" gorm:"primary_key"`
+	PassTitle          string         `json:"passTitle"`
+	NotifyNumber       string         `json:"notifyNumber"`
+	EmailFrom          string         `json:"emailFrom"`
+	EmailName          string         `json:"emailName"`
+	EmailContent       string         `json:"emailContent"`
+	SendSMS            bool           `json:"sendSMS" gorm:"default:false"`
+	TermsConds         string         `json:"terms"`
+	SandboxID          string         `json:"-"`
+	TwilioAcctSID      string         `json:"-"`
+	TwilioAcctToken    string         `json:"-"`
+	TwilioFromNumber   string         `json:"-"`
+	StripeKey          string         `json:"-"`
+	StripeSecondary    string         `json:"-"`
+	StripeAcctMap      hstore.Hstore  `json:"-"`
+	PaymentType        string         `json:"-"`
+	FeePercent         float64        `json:"-"`
+	FuelSurcharge      float64        `json:"-"`
+	LogoBytes          []byte         `json:"-"`
+	StripeManagedProds bool           `json:"-"`
+	CharterBalanceDays int            `json:"charterBalanceDays"`
+	MailDomain         string         `json:"-"`
+	MailFrom           string         `json:"-"`
+	RemindersEnabled   bool           `json:"remindersEnabled" gorm:"default:true"`
+	ReminderHours      int            `json:"reminderHours" gorm:"default:24"`
+	ReminderSMS        bool           `json:"reminderSMS" gorm:"default:false"`
+	DockLocation       string         `json:"dockLocation"`
+	WeatherNotice      string         `json:"weatherNotice"`
+	Locale             string         `json:"locale" gorm:"default:'en'"`
+	DigestEnabled      bool           `json:"digestEnabled" gorm:"default:false"`
+	DigestTime         string         `json:"digestTime" gorm:"default:'18:00'"`
+	DigestRecipients   pq.StringArray `json:"digestRecipients" gorm:"type:text[]"`
+
+	DepositsEnabled     bool           `json:"depositsEnabled" gorm:"default:false"`
+	DepositNotify       bool           `json:"depositNotify" gorm:"default:false"`
+	DepositEmailContent string         `json:"depositEmailContent"`
+	DepositNotifyEmails pq.StringArray `json:"depositNotifyEmails" gorm:"type:text[]"`
+	DepositSendSMS      bool           `json:"depositSendSMS" gorm:"default:false"`
+}
+
+// DigestTo is who gets the daily digest, falling back to the merchant's
+// from address when no one is configured
+func (m *MerchantConfig) DigestTo() []string {
+	if len(m.DigestRecipients) > 0 {
+		return m.DigestRecipients
+	}
+	return []string{m.EmailFrom}
+}
+
+// DepositRecipients is who gets told about new deposits, falling back to the
+// merchant's from address when no one is configured
+func (m *MerchantConfig) DepositRecipients() []string {
+	if len(m.DepositNotifyEmails) > 0 {
+		return m.DepositNotifyEmails
+	}
+	return []string{m.EmailFrom}
+}
+
+var (
+	defaultMailDomain = envOr("MAILGUN_DOMAIN", "mg.fishingreservationsystem.com")
+	defaultMailFrom   = envOr("MAIL_FROM", "donotreply@fishingreservationsystem.com")
+)
+
+func envOr(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+// MailSender is the domain and from address to send the merchant's email
+// with, the shared ones are used unless the merchant has their own
+func (m *MerchantConfig) MailSender() (domain, from string) {
+	domain, from = defaultMailDomain, defaultMailFrom
+	if m.MailDomain != "" {
+		domain = m.MailDomain
+	}
+	if m.MailFrom != "" {
+		from = m.MailFrom
+		if m.EmailName != "" {
+			from = m.EmailName + " <" + m.MailFrom + ">"
+		}
+	}
+	return
 }
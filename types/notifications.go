@@ -0,0 +1,72 @@
+package types
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// Notification channels
+const (
+	ChannelEmail = "email"
+	ChannelSMS   = "sms"
+)
+
+// Notification delivery statuses, providers report back through webhooks
+const (
+	NotifySent       = "sent"
+	NotifyDelivered  = "delivered"
+	NotifyFailed     = "failed"
+	NotifyBounced    = "bounced"
+	NotifyComplained = "complained"
+	NotifySuppressed = "suppressed"
+)
+
+// notifyRank orders the statuses so a late webhook can't undo a later one
+var notifyRank = map[string]int{
+	NotifySent:       1,
+	NotifyDelivered:  2,
+	NotifyFailed:     3,
+	NotifyBounced:    3,
+	NotifyComplained: 3,
+	NotifySuppressed: 3,
+}
+
+// Notification records a message that was sent about an order, along with
+// what's needed to send it again
+type Notification struct {
+	ID         uint      `json:"id" gorm:"primary_key"`
+	CreatedAt  time.Time `json:"created"`
+	UpdatedAt  time.Time `json:"updated"`
+	MerchantID string    `json:"-" gorm:"index"`
+	OrderID    string    `json:"orderId" gorm:"index"`
+	RelatedTo  string    `json:"relatedTo,omitempty" gorm:"index:idx_notifications_related"`
+	RelatedID  string    `json:"relatedId,omitempty" gorm:"index:idx_notifications_related"`
+	Channel    string    `json:"channel"`
+	Recipient  string    `json:"recipient"`
+	Subject    string    `json:"subject"`
+	Template   string    `json:"template"`
+	ProviderID string    `json:"providerId" gorm:"index"`
+	Status     string    `json:"status"`
+	Detail     string    `json:"detail,omitempty"`
+	Attachment string    `json:"attachment,omitempty"`
+	Sender     string    `json:"-"`
+	Domain     string    `json:"-"`
+	Body       string    `json:"-" gorm:"type:text"`
+	HTML       string    `json:"-" gorm:"type:text"`
+}
+
+// UpdateNotificationStatus applies a delivery report from the provider to
+// the notification it sent with that id
+func UpdateNotificationStatus(db *gorm.DB, channel, providerID, status, detail string) error {
+	var n Notification
+	db.Where("channel = ? AND provider_id = ?", channel, providerID).First(&n)
+	if n.ID == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	if notifyRank[status] < notifyRank[n.Status] {
+		return nil
+	}
+
+	return db.Model(&n).Updates(map[string]interface{}{"status": status, "detail": detail}).Error
+}
@@ -0,0 +1,259 @@
+package types
+
+import (
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jinzhu/gorm"
+)
+
+// Provider names recorded on unified orders
+const (
+	ProviderPayPal = "paypal"
+	ProviderStripe = "stripe"
+	ProviderManual = "manual"
+	ProviderCash   = "cash"
+)
+
+var orderSkuRe = regexp.MustCompile(`^(\d+)([A-Z]+)(\d{10})`)
+
+// ErrOrderNotRecorded is returned for a refund of a payment that has no
+// order, such as a charter deposit
+var ErrOrderNotRecorded = errors.New("no order recorded for this payment")
+
+// Customer is the provider-neutral purchaser of an order, shared across
+// every order a merchant has for the same email address
+type Customer struct {
+	ID         string    `json:"id" gorm:"primary_key"`
+	MerchantID string    `json:"-" gorm:"index"`
+	Name       string    `json:"name"`
+	Email      string    `json:"email" gorm:"index"`
+	Phone      string    `json:"phone"`
+	CreatedAt  time.Time `json:"-"`
+	UpdatedAt  time.Time `json:"-"`
+}
+
+// Order is the provider-neutral record of a purchase. Both PayPal and Stripe
+// write here so reporting and manifests only need to look in one place,
+// ProviderRef holds the id the provider knows the order by.
+type Order struct {
+	ID          string         `json:"id" gorm:"primary_key"`
+	MerchantID  string         `json:"-" gorm:"index"`
+	Provider    string         `json:"provider" gorm:"index"`
+	ProviderRef string         `json:"providerRef" gorm:"index"`
+	Status      string         `json:"status"`
+	Total       string         `json:"total" gorm:"type:money"`
+	CustomerID  string         `json:"-" gorm:"index"`
+	Customer    *Customer      `json:"customer"`
+	Lines       []OrderLine    `json:"lines"`
+	Payments    []OrderPayment `json:"payments"`
+	Refunds     []OrderRefund  `json:"refunds"`
+	Locale      string         `json:"locale"`
+	CreatedAt   time.Time      `json:"created"`
+	UpdatedAt   time.Time      `json:"updated"`
+}
+
+// OrderLine is a single ticket type on an order. Sku and Name reflect any
+// transfers, the original values are kept in OrigSku and OrigName.
+type OrderLine struct {
+	ID          string     `json:"id" gorm:"primary_key"`
+	OrderID     string     `json:"-" gorm:"index"`
+	ProviderRef string     `json:"providerRef"`
+	Sku         string     `json:"sku"`
+	Name        string     `json:"name"`
+	Description string     `json:"desc"`
+	OrigSku     string     `json:"origSku"`
+	OrigName    string     `json:"origName"`
+	Quantity    uint       `json:"qty"`
+	UnitPrice   string     `json:"unitPrice" gorm:"type:money"`
+	Amount      string     `json:"total" gorm:"type:money"`
+	Status      string     `json:"status"`
+	ProductID   uint       `json:"pid" gorm:"index"`
+	Departure   *time.Time `json:"departure" gorm:"index"`
+	CalendarSeq int        `json:"-" gorm:"default:0"`
+}
+
+// BeforeSave fills in the product and departure time encoded in the sku
+func (l *OrderLine) BeforeSave() error {
+	if l.OrigSku == "" {
+		l.OrigSku = l.Sku
+	}
+	if l.OrigName == "" {
+		l.OrigName = l.Name
+	}
+
+	res := orderSkuRe.FindStringSubmatch(l.Sku)
+	if len(res) < 4 {
+		return nil
+	}
+
+	pid, _ := strconv.Atoi(res[1])
+	timestamp, _ := strconv.ParseInt(res[3], 10, 64)
+	dep := time.Unix(timestamp, 0).In(loc)
+
+	l.ProductID = uint(pid)
+	l.Departure = &dep
+	return nil
+}
+
+// Tender types recorded for payments taken in person
+const (
+	TenderCash  = "cash"
+	TenderCheck = "check"
+	TenderCard  = "card"
+)
+
+func (l *OrderLine) GetName() string   { return l.Name }
+func (l *OrderLine) GetSku() string    { return l.Sku }
+func (l *OrderLine) GetDesc() string   { return l.Description }
+func (l *OrderLine) GetQuantity() uint { return l.Quantity }
+func (l *OrderLine) GetID() string     { return l.OrderID }
+func (l *OrderLine) GetAmount() string { return l.Amount }
+
+// OrderPayment is a capture or charge taken against an order. Payments taken
+// in person also record the tender and the staff member that took them.
+type OrderPayment struct {
+	ID          string    `json:"id" gorm:"primary_key"`
+	OrderID     string    `json:"-" gorm:"index"`
+	Provider    string    `json:"provider"`
+	ProviderRef string    `json:"providerRef"`
+	Status      string    `json:"status"`
+	Amount      string    `json:"amount" gorm:"type:money"`
+	Tender      string    `json:"tender,omitempty"`
+	Reference   string    `json:"reference,omitempty"`
+	StaffID     string    `json:"staffId,omitempty" gorm:"index"`
+	DrawerID    string    `json:"drawerId,omitempty" gorm:"index"`
+	CreatedAt   time.Time `json:"created"`
+}
+
+// OrderRefund is money returned against an order, LineID is set when the
+// refund only covered a single line
+type OrderRefund struct {
+	ID          string    `json:"id" gorm:"primary_key"`
+	OrderID     string    `json:"-" gorm:"index"`
+	LineID      string    `json:"lineId"`
+	Provider    string    `json:"provider"`
+	ProviderRef string    `json:"providerRef"`
+	Status      string    `json:"status"`
+	Amount      string    `json:"amount" gorm:"type:money"`
+	Tender      string    `json:"tender,omitempty"`
+	StaffID     string    `json:"staffId,omitempty"`
+	DrawerID    string    `json:"drawerId,omitempty" gorm:"index"`
+	CreatedAt   time.Time `json:"created"`
+}
+
+// ParseMoney reads a money value as returned by postgres, ie: "$1,234.50"
+func ParseMoney(s string) float64 {
+	s = strings.NewReplacer("$", "", ",", "").Replace(strings.TrimSpace(s))
+	v, _ := strconv.ParseFloat(s, 64)
+	return v
+}
+
+// FormatMoney formats a dollar amount for storing in a money column
+func FormatMoney(v float64) string {
+	return strconv.FormatFloat(v, 'f', 2, 64)
+}
+
+// SaveOrder upserts an order along with its lines, payments and refunds. The
+// customer is matched against existing customers of the merchant by email
+// (or phone when there is no email) so repeat purchasers share one record.
+func SaveOrder(db *gorm.DB, o *Order) error {
+	if o.Customer != nil {
+		c := o.Customer
+		c.MerchantID = o.MerchantID
+		if c.ID == "" {
+			var existing Customer
+			switch {
+			case c.Email != "":
+				db.Where("merchant_id = ? AND lower(email) = ?", o.MerchantID, strings.ToLower(c.Email)).First(&existing)
+			case c.Phone != "":
+				db.Where("merchant_id = ? AND email = '' AND phone = ?", o.MerchantID, c.Phone).First(&existing)
+			}
+
+			c.ID = existing.ID
+			if c.ID == "" {
+				c.ID = uuid.New().String()
+			}
+			if c.Name == "" {
+				c.Name = existing.Name
+			}
+			if c.Phone == "" {
+				c.Phone = existing.Phone
+			}
+		}
+		o.CustomerID = c.ID
+	}
+
+	// Save writes every column, so keep the original creation time and
+	// language when re-recording an order that the provider didn't give us
+	// them for
+	if o.CreatedAt.IsZero() || o.Locale == "" {
+		var existing Order
+		db.Select("created_at, locale").Where("id = ?", o.ID).First(&existing)
+		if o.CreatedAt.IsZero() {
+			o.CreatedAt = existing.CreatedAt
+		}
+		if o.Locale == "" {
+			o.Locale = existing.Locale
+		}
+		if o.CreatedAt.IsZero() {
+			o.CreatedAt = time.Now()
+		}
+	}
+
+	for idx := range o.Lines {
+		o.Lines[idx].OrderID = o.ID
+	}
+	for idx := range o.Payments {
+		o.Payments[idx].OrderID = o.ID
+		if o.Payments[idx].CreatedAt.IsZero() {
+			o.Payments[idx].CreatedAt = o.CreatedAt
+		}
+	}
+	for idx := range o.Refunds {
+		o.Refunds[idx].OrderID = o.ID
+	}
+
+	return db.Save(o).Error
+}
+
+// RecordRefund stores a refund against an order. A refund covering a single
+// line only marks that line as refunded, otherwise the whole order is.
+func RecordRefund(db *gorm.DB, r *OrderRefund) error {
+	var orders int
+	if err := db.Model(&Order{}).Where("id = ?", r.OrderID).Count(&orders).Error; err != nil {
+		return err
+	}
+	if orders == 0 {
+		return ErrOrderNotRecorded
+	}
+
+	if err := db.Save(r).Error; err != nil {
+		return err
+	}
+
+	if r.LineID != "" {
+		return db.Model(&OrderLine{}).Where("id = ?", r.LineID).UpdateColumn("status", "refunded").Error
+	}
+
+	db.Model(&OrderLine{}).Where("order_id = ?", r.OrderID).UpdateColumn("status", "refunded")
+	return db.Model(&Order{}).Where("id = ?", r.OrderID).Update("status", "refunded").Error
+}
+
+// TransferOrderLine moves a line onto a new trip, keeping the original sku
+func TransferOrderLine(db *gorm.DB, lineID, newSku, newName string) error {
+	var line OrderLine
+	if err := db.Find(&line, "id = ?", lineID).Error; err != nil {
+		return err
+	}
+
+	line.Sku = newSku
+	if newName != "" {
+		line.Name = newName
+	}
+	return db.Save(&line).Error
+}
@@ -0,0 +1,26 @@
+package types
+
+import (
+	"testing"
+
+	"github.com/zeroshade/tmsapi/internal/dbtest"
+)
+
+func TestRecordRefundWithoutOrder(t *testing.T) {
+	db, d := dbtest.Open(t)
+	if err := RecordRefund(db, &OrderRefund{ID: "re_1", OrderID: "pi_dep"}); err != ErrOrderNotRecorded {
+		t.Errorf("err = %v", err)
+	}
+	if n := len(d.Statements(`"order_refunds"`)); n != 0 {
+		t.Error("recorded a refund for a payment with no order")
+	}
+
+	db, d = dbtest.Open(t)
+	d.Returns(`SELECT count(*) FROM "orders"`, []string{"count"}, []interface{}{int64(1)})
+	if err := RecordRefund(db, &OrderRefund{ID: "re_1", OrderID: "pi_1"}); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(d.Statements(`"order_refunds"`)); n != 1 {
+		t.Errorf("saved the refund %d times", n)
+	}
+}
@@ -0,0 +1,44 @@
+package types
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// TripReminder records the reminder for one order's departure so it's only
+// sent once. One that reached the customer on no channel is removed so that
+// it's tried again.
+type TripReminder struct {
+	OrderID    string    `json:"orderId" gorm:"primary_key"`
+	Departure  time.Time `json:"departure" gorm:"primary_key"`
+	MerchantID string    `json:"-" gorm:"index"`
+	Email      string    `json:"email"`
+	Phone      string    `json:"phone"`
+	EmailSent  bool      `json:"emailSent"`
+	SMSSent    bool      `json:"smsSent"`
+	Error      string    `json:"error,omitempty"`
+	CreatedAt  time.Time `json:"created"`
+}
+
+// CreateOnce inserts value unless a row with its key is already there,
+// returning whether it was added. On postgres gorm reads the key back with
+// RETURNING, so a skipped insert comes back as no rows rather than zero rows
+// affected.
+func CreateOnce(db *gorm.DB, value interface{}) (bool, error) {
+	res := db.Set("gorm:insert_option", "ON CONFLICT DO NOTHING").Create(value)
+	switch {
+	case res.Error == sql.ErrNoRows:
+		return false, nil
+	case res.Error != nil:
+		return false, res.Error
+	}
+	return res.RowsAffected == 1, nil
+}
+
+// ClaimReminder records the reminder before it's sent, returning false if
+// it has already been claimed
+func ClaimReminder(db *gorm.DB, r *TripReminder) (bool, error) {
+	return CreateOnce(db, r)
+}
@@ -0,0 +1,35 @@
+package types
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zeroshade/tmsapi/internal/dbtest"
+)
+
+func TestClaimReminder(t *testing.T) {
+	r := &TripReminder{OrderID: "o1", Departure: time.Now(), MerchantID: "m1"}
+
+	db, _ := dbtest.Open(t)
+	if ok, err := ClaimReminder(db, r); !ok || err != nil {
+		t.Errorf("new reminder: %v, %v", ok, err)
+	}
+
+	// postgres returns no row from a skipped insert
+	db, d := dbtest.Open(t)
+	d.Returns(`INSERT INTO "trip_reminders"`, []string{"order_id"})
+	if ok, err := ClaimReminder(db, r); ok || err != nil {
+		t.Errorf("claimed reminder: %v, %v", ok, err)
+	}
+	if q := d.Statements(`INSERT INTO "trip_reminders"`)[0].Query; !strings.Contains(q, "ON CONFLICT DO NOTHING") {
+		t.Errorf("insert %q", q)
+	}
+
+	db, d = dbtest.Open(t)
+	d.Fails(`INSERT INTO "trip_reminders"`, errors.New("connection reset"))
+	if ok, err := ClaimReminder(db, r); ok || err == nil {
+		t.Errorf("failed insert: %v, %v", ok, err)
+	}
+}
@@ -0,0 +1,108 @@
+package types
+
+import (
+	"errors"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// Reservation statuses, the order and its lines are "reserved" while held
+const (
+	ReservationHeld     = "held"
+	ReservationPaid     = "paid"
+	ReservationReleased = "released"
+)
+
+// ErrReservationNotHeld is returned when a reservation has already been paid
+// or released
+var ErrReservationNotHeld = errors.New("reservation is no longer held")
+
+// Reservation holds seats on an order that hasn't been paid for yet, such as
+// regulars that call in and pay at the dock. ReleaseAt is the earlier of the
+// explicit hold expiry and the cutoff before the first departure, a held
+// reservation without one keeps its seats until someone releases it.
+type Reservation struct {
+	OrderID       string     `json:"orderId" gorm:"primary_key"`
+	MerchantID    string     `json:"-" gorm:"index"`
+	Status        string     `json:"status" gorm:"index"`
+	BalanceDue    string     `json:"balanceDue" gorm:"type:money"`
+	HoldUntil     *time.Time `json:"holdUntil"`
+	CutoffMinutes int        `json:"cutoffMinutes"`
+	ReleaseAt     *time.Time `json:"releaseAt" gorm:"index"`
+	PayToken      string     `json:"-"`
+	LinkSentAt    *time.Time `json:"linkSentAt"`
+	CreatedBy     string     `json:"createdBy"`
+	SettledAt     *time.Time `json:"settledAt"`
+	ReleasedAt    *time.Time `json:"releasedAt"`
+	CreatedAt     time.Time  `json:"created"`
+	Order         *Order     `json:"order,omitempty"`
+}
+
+// SetReleaseAt works out when the hold runs out from the expiry, the cutoff
+// and the earliest departure on the order
+func (r *Reservation) SetReleaseAt(firstDeparture *time.Time) {
+	r.ReleaseAt = r.HoldUntil
+	if r.CutoffMinutes <= 0 || firstDeparture == nil {
+		return
+	}
+
+	cutoff := firstDeparture.Add(-time.Duration(r.CutoffMinutes) * time.Minute)
+	if r.ReleaseAt == nil || cutoff.Before(*r.ReleaseAt) {
+		r.ReleaseAt = &cutoff
+	}
+}
+
+// SettleReservation records the payment for a held reservation and turns it
+// into a regular paid order
+func SettleReservation(db *gorm.DB, orderID string, pay *OrderPayment) error {
+	now := time.Now()
+	// claim it first so a release running at the same time can't also
+	// hand the seats back
+	res := db.Model(&Reservation{}).Where("order_id = ? AND status = ?", orderID, ReservationHeld).
+		Updates(map[string]interface{}{"status": ReservationPaid, "balance_due": "0.00", "settled_at": now})
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return ErrReservationNotHeld
+	}
+
+	pay.OrderID = orderID
+	if pay.CreatedAt.IsZero() {
+		pay.CreatedAt = now
+	}
+	if err := db.Create(pay).Error; err != nil {
+		return err
+	}
+
+	db.Model(&OrderLine{}).Where("order_id = ? AND status = 'reserved'", orderID).UpdateColumn("status", "succeeded")
+	return db.Model(&Order{}).Where("id = ?", orderID).Update("status", "succeeded").Error
+}
+
+// ReleaseReservation gives the seats of a held reservation back to inventory
+func ReleaseReservation(db *gorm.DB, r *Reservation) error {
+	now := time.Now()
+	res := db.Model(&Reservation{}).Where("order_id = ? AND status = ?", r.OrderID, ReservationHeld).
+		Updates(map[string]interface{}{"status": ReservationReleased, "released_at": now})
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return ErrReservationNotHeld
+	}
+	r.Status = ReservationReleased
+	r.ReleasedAt = &now
+
+	var lines []OrderLine
+	db.Find(&lines, "order_id = ? AND status = 'reserved'", r.OrderID)
+	for _, l := range lines {
+		if l.Departure != nil {
+			db.Table("manual_overrides").Where("product_id = ? AND time = ?", l.ProductID, *l.Departure).
+				UpdateColumn("avail", gorm.Expr("avail + ?", l.Quantity))
+		}
+	}
+
+	db.Model(&OrderLine{}).Where("order_id = ? AND status = 'reserved'", r.OrderID).UpdateColumn("status", ReservationReleased)
+	return db.Model(&Order{}).Where("id = ?", r.OrderID).Update("status", ReservationReleased).Error
+}
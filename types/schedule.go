@@ -87,3 +87,61 @@ func (s *Schedule) MarshalJSON() ([]byte, error) {
 		EndDay:   s.End.Format("2006-01-02"),
 	})
 }
+
+// runsOn reports whether the schedule covers a day, going by its dates and
+// days of the week
+func (s *Schedule) runsOn(day time.Time) bool {
+	if day.Before(s.Start.In(loc)) || day.After(s.End.In(loc)) {
+		return false
+	}
+	for _, d := range s.Days {
+		if time.Weekday(d) == day.Weekday() {
+			return true
+		}
+	}
+	return false
+}
+
+// ScheduledDeparture is a departure a schedule offers and how many tickets
+// it has
+type ScheduledDeparture struct {
+	Time  time.Time
+	Avail uint
+}
+
+// Departures lists the departures the product's schedules offer on a day,
+// skipping days marked not available. The schedules and their times need to
+// be loaded.
+func (p *Product) Departures(day time.Time) []ScheduledDeparture {
+	day = day.In(loc)
+	yy, mm, dd := day.Date()
+	day = time.Date(yy, mm, dd, 0, 0, 0, 0, loc)
+	date := day.Format("2006-01-02")
+
+	var out []ScheduledDeparture
+	for _, s := range p.Schedules {
+		if !s.runsOn(day) {
+			continue
+		}
+
+		blocked := false
+		for _, na := range s.NotAvail {
+			blocked = blocked || na == date
+		}
+		if blocked {
+			continue
+		}
+
+		for _, t := range s.TimeArray {
+			start, err := time.Parse("15:04", t.StartTime)
+			if err != nil {
+				continue
+			}
+			out = append(out, ScheduledDeparture{
+				Time:  time.Date(yy, mm, dd, start.Hour(), start.Minute(), 0, 0, loc),
+				Avail: s.TicketsAvail,
+			})
+		}
+	}
+	return out
+}
@@ -49,6 +49,7 @@ func (s *Show) GetDates() (start, end time.Time, err error) {
 }
 
 type TicketUsage struct {
-	TicketID string `json:"ticket_id" gorm:"primary_key;type:varchar"`
-	Used     bool   `json:"used"`
+	TicketID  string    `json:"ticket_id" gorm:"primary_key;type:varchar"`
+	Used      bool      `json:"used"`
+	UpdatedAt time.Time `json:"updated"`
 }
@@ -0,0 +1,72 @@
+package types
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// ErrSMSOptedOut is returned when texting a number that replied STOP
+var ErrSMSOptedOut = errors.New("number has opted out of text messages")
+
+// Keywords carriers require us to honour, as returned by SMSKeyword
+const (
+	KeywordStop  = "stop"
+	KeywordStart = "start"
+	KeywordHelp  = "help"
+)
+
+var smsKeywords = map[string]string{
+	"STOP": KeywordStop, "STOPALL": KeywordStop, "UNSUBSCRIBE": KeywordStop,
+	"CANCEL": KeywordStop, "END": KeywordStop, "QUIT": KeywordStop,
+	"START": KeywordStart, "YES": KeywordStart, "UNSTOP": KeywordStart,
+	"HELP": KeywordHelp, "INFO": KeywordHelp,
+}
+
+// SMSKeyword returns which opt in or out keyword a reply is, if any. Like
+// the carriers, only a message that is just the keyword counts.
+func SMSKeyword(body string) string {
+	word := strings.ToUpper(strings.Trim(strings.TrimSpace(body), ".!"))
+	return smsKeywords[word]
+}
+
+// SMSConsent is whether a phone number, in E.164 form, will accept texts
+type SMSConsent struct {
+	Phone     string    `json:"phone" gorm:"primary_key"`
+	OptedOut  bool      `json:"optedOut"`
+	Keyword   string    `json:"keyword"`
+	UpdatedAt time.Time `json:"updated"`
+}
+
+func SetSMSConsent(db *gorm.DB, phone string, optedOut bool, keyword string) error {
+	return db.Save(&SMSConsent{Phone: phone, OptedOut: optedOut, Keyword: keyword}).Error
+}
+
+func SMSOptedOut(db *gorm.DB, phone string) bool {
+	var c SMSConsent
+	db.Where("phone = ?", phone).First(&c)
+	return c.OptedOut
+}
+
+// SMS directions in a merchant's inbox
+const (
+	SMSInbound  = "in"
+	SMSOutbound = "out"
+)
+
+// SMSMessage is a text in a conversation between a merchant and a phone
+// number. Keyword replies are kept but don't show in the inbox.
+type SMSMessage struct {
+	ID         uint      `json:"id" gorm:"primary_key"`
+	CreatedAt  time.Time `json:"created"`
+	MerchantID string    `json:"-" gorm:"index"`
+	Phone      string    `json:"phone" gorm:"index"`
+	Direction  string    `json:"direction"`
+	Body       string    `json:"body" gorm:"type:text"`
+	Keyword    string    `json:"keyword,omitempty"`
+	ProviderID string    `json:"providerId"`
+	StaffID    string    `json:"staffId,omitempty"`
+	Read       bool      `json:"read"`
+}
@@ -1,5 +1,7 @@
 package types
 
+import "time"
+
 type PassItem interface {
 	GetName() string
 	GetSku() string
@@ -10,10 +12,11 @@ type PassItem interface {
 }
 
 type TransferReq struct {
-	LineItemID string `json:"id" gorm:"primary_key"`
-	NewSKU     string `json:"newsku" gorm:"primary_key"`
-	NewName    string `json:"newname"`
-	OldSku     string `json:"oldsku"`
+	LineItemID string    `json:"id" gorm:"primary_key"`
+	NewSKU     string    `json:"newsku" gorm:"primary_key"`
+	NewName    string    `json:"newname"`
+	OldSku     string    `json:"oldsku"`
+	CreatedAt  time.Time `json:"-"`
 }
 
 type GiftCard struct {
@@ -34,4 +37,6 @@ type Manual struct {
 	Name       string `json:"name"`
 	Email      string `json:"email"`
 	Phone      string `json:"phone"`
+	Tender     string `json:"tender"`
+	Amount     string `json:"amount"`
 }